@@ -7,7 +7,11 @@
 // ACL policies are provided by tailscale peer capabilities.
 package acl
 
-import "github.com/creachadair/mds/mstr"
+import (
+	"strings"
+
+	"github.com/creachadair/mds/mstr"
+)
 
 // Action is an action on secrets that is subject to access control.
 type Action string
@@ -56,6 +60,18 @@ func (rr Rules) Allow(action Action, secret string) bool {
 	return false
 }
 
+// AllowExplicit reports whether the ACLs allow action on secret through a
+// pattern that begins with prefix. Broader patterns that also match secret,
+// such as "*", do not count.
+func (rr Rules) AllowExplicit(action Action, secret, prefix string) bool {
+	for _, r := range rr {
+		if r.allow(action, secret, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 // Rule is an access control rule that permits some actions on some
 // secrets. Secrets can contain '*' wildcards, which match zero or
 // more characters.
@@ -65,7 +81,11 @@ type Rule struct {
 }
 
 // Allow reports whether the rule allows action on secret.
-func (r *Rule) Allow(action Action, secret string) bool {
+func (r *Rule) Allow(action Action, secret string) bool { return r.allow(action, secret, "") }
+
+// allow reports whether the rule allows action on secret through a pattern
+// that begins with prefix.
+func (r *Rule) allow(action Action, secret, prefix string) bool {
 	actionMatches := func(acts []Action) bool {
 		for _, a := range acts {
 			if a == action {
@@ -76,7 +96,7 @@ func (r *Rule) Allow(action Action, secret string) bool {
 	}
 	secretMatches := func(secs []Secret) bool {
 		for _, s := range secs {
-			if s.Match(secret) {
+			if strings.HasPrefix(string(s), prefix) && s.Match(secret) {
 				return true
 			}
 		}
@@ -75,3 +75,26 @@ func TestACL(t *testing.T) {
 		}
 	}
 }
+
+func TestAllowExplicit(t *testing.T) {
+	rules := acl.Rules{
+		{Action: []acl.Action{acl.ActionGet}, Secret: []acl.Secret{"*"}},
+		{Action: []acl.Action{acl.ActionGet}, Secret: []acl.Secret{"_internal/webhook/*"}},
+	}
+	tests := []struct {
+		secret string
+		want   bool
+	}{
+		{"_internal/webhook/hosts", true},
+		{"_internal/ca/root", false},
+		{"app/key", false},
+	}
+	for _, test := range tests {
+		if got := rules.AllowExplicit(acl.ActionGet, test.secret, "_internal/"); got != test.want {
+			t.Errorf("AllowExplicit(get, %q) = %v, want %v", test.secret, got, test.want)
+		}
+		if !rules.Allow(acl.ActionGet, test.secret) {
+			t.Errorf("Allow(get, %q) = false, want true", test.secret)
+		}
+	}
+}
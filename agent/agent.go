@@ -0,0 +1,508 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package agent implements a caching, read-only proxy for the setec API, to
+// run on each host alongside the programs that use secrets.
+//
+// The agent forwards reads (get, info, and list) to an upstream server, and
+// remembers the results. If the upstream server is unavailable, it serves
+// reads of secrets this host has already fetched from its cache, marking the
+// responses as stale. The agent never serves writes.
+//
+// The cache only holds what the upstream server allowed this host to read.
+// When the upstream server reports that a secret no longer exists, or that the
+// host may no longer access it, the secret is removed from the cache. Values
+// of dynamic secrets are never cached, since each is a credential issued for
+// a single fetch under its own lease.
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/client/setec"
+	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/metrics"
+	"tailscale.com/types/logger"
+)
+
+// Headers set on responses served from the cache while the upstream server
+// is unavailable. Such responses also carry a standard Age header giving the
+// number of seconds since the upstream server last confirmed the value.
+const (
+	// HeaderCache is set to "stale" on responses served from the cache.
+	HeaderCache = "X-Leger-Cache"
+
+	// HeaderCacheUpdated is the time, in RFC 3339 format, when the upstream
+	// server last confirmed a stale response.
+	HeaderCacheUpdated = "X-Leger-Cache-Updated"
+)
+
+// Config is the configuration for an Agent.
+type Config struct {
+	// Client is the client for the upstream server. Its retry policy, if
+	// any, determines how hard the agent tries before serving from the
+	// cache. Required.
+	Client setec.Client
+
+	// Cache, if non-nil, is where the agent persists its cache, so that it
+	// can serve secrets while the upstream server is unavailable even after a
+	// restart. Since the cache holds secret values, it should be an
+	// [setec.EncryptedFileCache]. If nil, the cache is kept only in memory.
+	Cache setec.Cache
+
+	// Allow, if non-empty, restricts the secrets the agent serves and caches
+	// to those matching one of these patterns. Requests for other secrets
+	// are denied without contacting the upstream server.
+	Allow []acl.Secret
+
+	// MaxStale is the longest the agent serves a cached value after the
+	// upstream server last confirmed it. If zero, the default is 24 hours.
+	// If negative, cached values are served regardless of age.
+	MaxStale time.Duration
+
+	// UpstreamTimeout, if positive, bounds the time spent on each call to the
+	// upstream server. If zero, the default is 5 seconds.
+	UpstreamTimeout time.Duration
+
+	// Mux is the serving mux on which the agent registers its handlers.
+	// Required.
+	Mux *http.ServeMux
+
+	// Logf is where logs are sent. If nil, logs go to log.Printf.
+	Logf logger.Logf
+}
+
+// Agent is a caching proxy for the setec API.
+type Agent struct {
+	client   setec.Client
+	cache    setec.Cache
+	allow    []acl.Secret
+	maxStale time.Duration
+	timeout  time.Duration
+	logf     logger.Logf
+	timeNow  func() time.Time
+
+	countCalls         *metrics.LabelMap // :: method name → count
+	countUpstreamError *metrics.LabelMap // :: method name → count
+	countStale         *metrics.LabelMap // :: method name → count
+	countCacheMiss     *metrics.LabelMap // :: method name → count
+	countWriteRejected *metrics.LabelMap // :: method name → count
+	gaugeCached        expvar.Func
+
+	mu    sync.Mutex
+	state *cacheState
+}
+
+// cacheState is the persistent state of the cache.
+type cacheState struct {
+	Secrets     map[string]*cacheEntry // :: secret name → entry
+	List        []*api.SecretInfo      `json:",omitempty"`
+	ListUpdated time.Time              `json:",omitempty"`
+}
+
+// cacheEntry is the cached state of a single secret.
+type cacheEntry struct {
+	Active   *api.SecretValue             `json:",omitempty"` // the latest active value
+	Versions map[api.SecretVersion][]byte `json:",omitempty"` // specific versions fetched
+	Info     *api.SecretInfo              `json:",omitempty"`
+	Updated  time.Time                    // when the upstream last confirmed the entry
+}
+
+// New constructs an Agent from cfg, loading its cache if one is configured,
+// and registers its handlers on cfg.Mux.
+func New(cfg Config) (*Agent, error) {
+	if cfg.Client.Server == "" {
+		return nil, errors.New("no upstream server")
+	} else if cfg.Mux == nil {
+		return nil, errors.New("no serving mux")
+	}
+	a := &Agent{
+		client:             cfg.Client,
+		cache:              cfg.Cache,
+		allow:              cfg.Allow,
+		maxStale:           cfg.MaxStale,
+		timeout:            cfg.UpstreamTimeout,
+		logf:               cfg.Logf,
+		timeNow:            time.Now,
+		countCalls:         &metrics.LabelMap{Label: "method"},
+		countUpstreamError: &metrics.LabelMap{Label: "method"},
+		countStale:         &metrics.LabelMap{Label: "method"},
+		countCacheMiss:     &metrics.LabelMap{Label: "method"},
+		countWriteRejected: &metrics.LabelMap{Label: "method"},
+		state:              &cacheState{Secrets: make(map[string]*cacheEntry)},
+	}
+	if a.timeout <= 0 {
+		a.timeout = 5 * time.Second
+	}
+	if a.maxStale == 0 {
+		a.maxStale = 24 * time.Hour
+	}
+	if a.logf == nil {
+		a.logf = log.Printf
+	}
+	a.gaugeCached = func() any {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.state.Secrets)
+	}
+	if err := a.loadCache(); err != nil {
+		return nil, err
+	}
+
+	cfg.Mux.HandleFunc("/api/get", a.get)
+	cfg.Mux.HandleFunc("/api/info", a.info)
+	cfg.Mux.HandleFunc("/api/list", a.list)
+	cfg.Mux.HandleFunc("/api/", a.rejectWrite)
+	return a, nil
+}
+
+// Metrics returns a collection of metrics for a. The caller is responsible
+// for publishing the result to the metrics exporter.
+func (a *Agent) Metrics() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("counter_api_calls", a.countCalls)
+	m.Set("counter_upstream_errors", a.countUpstreamError)
+	m.Set("counter_stale_served", a.countStale)
+	m.Set("counter_cache_misses", a.countCacheMiss)
+	m.Set("counter_writes_rejected", a.countWriteRejected)
+	m.Set("gauge_cached_secrets", a.gaugeCached)
+	return m
+}
+
+// loadCache loads the persisted state of the cache, if any. A cache that
+// cannot be authenticated or decoded is discarded, since its contents will be
+// fetched again from the upstream server.
+func (a *Agent) loadCache() error {
+	if a.cache == nil {
+		return nil
+	}
+	data, err := a.cache.Read()
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && len(data) == 0) {
+		return nil
+	} else if errors.Is(err, setec.ErrCacheTampered) {
+		a.logf("[agent] WARNING: discarding cache: %v", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading cache: %w", err)
+	}
+	var st cacheState
+	if err := json.Unmarshal(data, &st); err != nil {
+		a.logf("[agent] WARNING: discarding invalid cache: %v", err)
+		return nil
+	}
+	if st.Secrets == nil {
+		st.Secrets = make(map[string]*cacheEntry)
+	}
+	a.state = &st
+	a.logf("[agent] loaded %d cached secrets", len(st.Secrets))
+	return nil
+}
+
+// saveLocked persists the state of the cache, if a cache is configured. The
+// caller must hold a.mu. Failure to persist the cache is logged, but does not
+// prevent serving.
+func (a *Agent) saveLocked() {
+	if a.cache == nil {
+		return
+	}
+	data, err := json.Marshal(a.state)
+	if err == nil {
+		err = a.cache.Write(data)
+	}
+	if err != nil {
+		a.logf("[agent] WARNING: error writing cache: %v", err)
+	}
+}
+
+// allowed reports whether the agent serves the named secret.
+func (a *Agent) allowed(name string) bool {
+	return len(a.allow) == 0 || slices.ContainsFunc(a.allow, func(pat acl.Secret) bool {
+		return pat.Match(name)
+	})
+}
+
+// entryLocked returns the cache entry for name, creating it if necessary.
+// The caller must hold a.mu.
+func (a *Agent) entryLocked(name string) *cacheEntry {
+	e, ok := a.state.Secrets[name]
+	if !ok {
+		e = new(cacheEntry)
+		a.state.Secrets[name] = e
+	}
+	return e
+}
+
+// forget removes the named secret from the cache, because the upstream
+// server reported it does not exist or is not accessible.
+func (a *Agent) forget(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.state.Secrets[name]; ok {
+		delete(a.state.Secrets, name)
+		a.state.List = slices.DeleteFunc(a.state.List, func(si *api.SecretInfo) bool {
+			return si.Name == name
+		})
+		a.saveLocked()
+	}
+}
+
+// fresh reports whether a cached value last confirmed at updated may still
+// be served.
+func (a *Agent) fresh(updated time.Time) bool {
+	return a.maxStale <= 0 || a.timeNow().Sub(updated) <= a.maxStale
+}
+
+func (a *Agent) get(w http.ResponseWriter, r *http.Request) {
+	serveJSON(a, w, r, func(ctx context.Context, req api.GetRequest) (*api.SecretValue, time.Time, error) {
+		if !a.allowed(req.Name) {
+			return nil, time.Time{}, api.ErrAccessDenied
+		}
+		var sv *api.SecretValue
+		var err error
+		switch {
+		case req.Version == api.SecretVersionDefault:
+			sv, err = a.client.Get(ctx, req.Name)
+		case req.UpdateIfChanged:
+			sv, err = a.client.GetIfChanged(ctx, req.Name, req.Version)
+		default:
+			sv, err = a.client.GetVersion(ctx, req.Name, req.Version)
+		}
+		if err == nil && isDynamic(sv) {
+			return sv, time.Time{}, nil
+		} else if err == nil {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			e := a.entryLocked(req.Name)
+			e.Updated = a.timeNow()
+			if req.Version == api.SecretVersionDefault || req.UpdateIfChanged {
+				if e.Active == nil || e.Active.Version != sv.Version {
+					e.Active = sv
+					a.saveLocked()
+				}
+			} else if _, ok := e.Versions[sv.Version]; !ok {
+				if e.Versions == nil {
+					e.Versions = make(map[api.SecretVersion][]byte)
+				}
+				e.Versions[sv.Version] = sv.Value
+				a.saveLocked()
+			}
+			return sv, time.Time{}, nil
+		} else if errors.Is(err, api.ErrValueNotChanged) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if e, ok := a.state.Secrets[req.Name]; ok && e.Active != nil && e.Active.Version == req.Version {
+				e.Updated = a.timeNow()
+			}
+			return nil, time.Time{}, err
+		} else if errors.Is(err, api.ErrNotFound) || errors.Is(err, api.ErrAccessDenied) {
+			a.forget(req.Name)
+			return nil, time.Time{}, err
+		} else if !setec.IsUnavailable(err) {
+			return nil, time.Time{}, err
+		}
+
+		// The upstream is unavailable; try the cache.
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		e, ok := a.state.Secrets[req.Name]
+		if !ok || !a.fresh(e.Updated) {
+			return nil, time.Time{}, notCachedError{err}
+		}
+		switch {
+		case req.Version == api.SecretVersionDefault && e.Active != nil:
+			return e.Active, e.Updated, nil
+		case req.UpdateIfChanged && e.Active != nil:
+			if e.Active.Version == req.Version {
+				return nil, e.Updated, api.ErrValueNotChanged
+			}
+			return e.Active, e.Updated, nil
+		case e.Active != nil && e.Active.Version == req.Version:
+			return e.Active, e.Updated, nil
+		}
+		if v, ok := e.Versions[req.Version]; ok {
+			return &api.SecretValue{Value: v, Version: req.Version}, e.Updated, nil
+		}
+		return nil, time.Time{}, notCachedError{err}
+	})
+}
+
+func (a *Agent) info(w http.ResponseWriter, r *http.Request) {
+	serveJSON(a, w, r, func(ctx context.Context, req api.InfoRequest) (*api.SecretInfo, time.Time, error) {
+		if !a.allowed(req.Name) {
+			return nil, time.Time{}, api.ErrAccessDenied
+		}
+		si, err := a.client.Info(ctx, req.Name)
+		if err == nil {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			e := a.entryLocked(req.Name)
+			e.Updated = a.timeNow()
+			if e.Info == nil || !infoEqual(e.Info, si) {
+				e.Info = si
+				a.saveLocked()
+			}
+			return si, time.Time{}, nil
+		} else if errors.Is(err, api.ErrNotFound) || errors.Is(err, api.ErrAccessDenied) {
+			a.forget(req.Name)
+			return nil, time.Time{}, err
+		} else if !setec.IsUnavailable(err) {
+			return nil, time.Time{}, err
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if e, ok := a.state.Secrets[req.Name]; ok && e.Info != nil && a.fresh(e.Updated) {
+			return e.Info, e.Updated, nil
+		}
+		return nil, time.Time{}, notCachedError{err}
+	})
+}
+
+func (a *Agent) list(w http.ResponseWriter, r *http.Request) {
+	serveJSON(a, w, r, func(ctx context.Context, req api.ListRequest) ([]*api.SecretInfo, time.Time, error) {
+		infos, err := a.client.List(ctx)
+		if err == nil {
+			infos = slices.DeleteFunc(infos, func(si *api.SecretInfo) bool { return !a.allowed(si.Name) })
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.state.ListUpdated = a.timeNow()
+			if !slices.EqualFunc(a.state.List, infos, infoEqual) {
+				a.state.List = infos
+				a.saveLocked()
+			}
+			return infos, time.Time{}, nil
+		} else if errors.Is(err, api.ErrAccessDenied) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.state.List, a.state.ListUpdated = nil, time.Time{}
+			a.saveLocked()
+			return nil, time.Time{}, err
+		} else if !setec.IsUnavailable(err) {
+			return nil, time.Time{}, err
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.state.ListUpdated.IsZero() || !a.fresh(a.state.ListUpdated) {
+			return nil, time.Time{}, notCachedError{err}
+		}
+		return a.state.List, a.state.ListUpdated, nil
+	})
+}
+
+// rejectWrite handles all other API methods, which the agent does not serve.
+func (a *Agent) rejectWrite(w http.ResponseWriter, r *http.Request) {
+	a.countWriteRejected.Add(r.URL.Path, 1)
+	http.Error(w, "the legerd agent is read-only; send writes to the server", http.StatusMethodNotAllowed)
+}
+
+// isDynamic reports whether sv is the value of a dynamic secret, which is a
+// credential issued for this fetch alone (see [api.DynamicValue]).
+func isDynamic(sv *api.SecretValue) bool {
+	var dv api.DynamicValue
+	return json.Unmarshal(sv.Value, &dv) == nil && dv.LeaseID != "" && !dv.Expires.IsZero()
+}
+
+// infoEqual reports whether a and b describe the same state of a secret.
+func infoEqual(a, b *api.SecretInfo) bool {
+	return a.Name == b.Name && a.ActiveVersion == b.ActiveVersion && slices.Equal(a.Versions, b.Versions)
+}
+
+// notCachedError reports that the upstream server was unavailable, and the
+// requested value was not available from the cache.
+type notCachedError struct{ err error }
+
+func (e notCachedError) Error() string {
+	return fmt.Sprintf("upstream unavailable and not cached: %v", e.err)
+}
+
+func (e notCachedError) Unwrap() error { return e.err }
+
+// serveJSON calls fn to handle a JSON API request, with the request body
+// decoded into r, and serializes its response back to the client, following
+// the conventions of the setec server. If fn reports a non-zero time, the
+// response was served from the cache, and that is when it was last confirmed
+// by the upstream server.
+func serveJSON[REQ any, RESP any](a *Agent, w http.ResponseWriter, r *http.Request, fn func(context.Context, REQ) (RESP, time.Time, error)) {
+	apiMethod := r.URL.Path
+	a.countCalls.Add(apiMethod, 1)
+
+	if r.Method != "POST" {
+		http.Error(w, "only POST requests allowed", http.StatusBadRequest)
+		return
+	}
+	if c := r.Header.Get("Content-Type"); c != "application/json" {
+		http.Error(w, "request body must be json", http.StatusBadRequest)
+		return
+	}
+	// As with the server, refuse requests from browsers, which may be able
+	// to reach an agent listening on localhost. See server/server.go.
+	if h := r.Header.Get("Sec-X-Tailscale-No-Browsers"); h != "setec" {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+
+	var req REQ
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.timeout)
+	defer cancel()
+	resp, updated, err := fn(ctx, req)
+	if !updated.IsZero() {
+		a.countStale.Add(apiMethod, 1)
+		w.Header().Set(HeaderCache, "stale")
+		w.Header().Set(HeaderCacheUpdated, updated.UTC().Format(time.RFC3339))
+		w.Header().Set("Age", strconv.Itoa(int(max(a.timeNow().Sub(updated), 0).Seconds())))
+	}
+
+	var nc notCachedError
+	switch {
+	case err == nil:
+	case errors.As(err, &nc):
+		a.countUpstreamError.Add(apiMethod, 1)
+		a.countCacheMiss.Add(apiMethod, 1)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, api.ErrValueNotChanged):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case errors.Is(err, api.ErrNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	case errors.Is(err, api.ErrAccessDenied):
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	case errors.Is(err, api.ErrRateLimited):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	default:
+		a.countUpstreamError.Add(apiMethod, 1)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	bs, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bs)
+}
@@ -0,0 +1,267 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/agent"
+	"github.com/leger-labs/leger/client/setec"
+	"github.com/leger-labs/leger/setectest"
+	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/types/logger"
+)
+
+// newAgent starts an agent with the given configuration, and returns a client
+// for it along with the URL at which it is served.
+func newAgent(t *testing.T, cfg agent.Config) (setec.Client, string) {
+	t.Helper()
+	cfg.Mux = http.NewServeMux()
+	cfg.Logf = logger.Discard
+	if _, err := agent.New(cfg); err != nil {
+		t.Fatalf("agent.New: %v", err)
+	}
+	hs := httptest.NewServer(cfg.Mux)
+	t.Cleanup(hs.Close)
+	return setec.Client{Server: hs.URL}, hs.URL
+}
+
+// upstream returns a client for the fake with retries and circuit breakers
+// disabled, so that failures are reported immediately.
+func upstream(url string) setec.Client {
+	return setec.Client{Server: url, Retry: &setec.RetryPolicy{MaxAttempts: 1, BreakerThreshold: -1}}
+}
+
+// rawGet fetches name from the agent at url, and returns the response.
+func rawGet(t *testing.T, url, name string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("POST", url+"/api/get", strings.NewReader(`{"Name":"`+name+`"}`))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Sec-X-Tailscale-No-Browsers", "setec")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Get %q: %v", name, err)
+	}
+	rsp.Body.Close()
+	return rsp
+}
+
+func TestAgent(t *testing.T) {
+	fake := setectest.NewFake(t, nil)
+	fake.Rotate("app/token", "alpha")
+	fake.Rotate("app/other", "uncached")
+
+	cache := setec.NewMemCache("")
+	cli, url := newAgent(t, agent.Config{Client: upstream(fake.URL), Cache: cache})
+	ctx := context.Background()
+
+	checkGet := func(name, want string) {
+		t.Helper()
+		sv, err := cli.Get(ctx, name)
+		if err != nil {
+			t.Fatalf("Get %q: unexpected error: %v", name, err)
+		}
+		if got := string(sv.Value); got != want {
+			t.Errorf("Get %q: got %q, want %q", name, got, want)
+		}
+	}
+
+	// While the upstream is available, reads are forwarded.
+	checkGet("app/token", "alpha")
+	if _, err := cli.Info(ctx, "app/token"); err != nil {
+		t.Fatalf("Info: unexpected error: %v", err)
+	}
+	if _, err := cli.List(ctx); err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if rsp := rawGet(t, url, "app/token"); rsp.Header.Get(agent.HeaderCache) != "" {
+		t.Errorf("Fresh response has cache header %q", rsp.Header.Get(agent.HeaderCache))
+	}
+
+	t.Run("Writes", func(t *testing.T) {
+		n := len(fake.CallsTo("put"))
+		if _, err := cli.Put(ctx, "app/token", []byte("nope")); err == nil {
+			t.Error("Put through agent: got nil, want error")
+		}
+		if err := cli.Activate(ctx, "app/token", 1); err == nil {
+			t.Error("Activate through agent: got nil, want error")
+		}
+		if got := len(fake.CallsTo("put")); got != n {
+			t.Errorf("Upstream put calls: got %d, want %d", got, n)
+		}
+	})
+
+	t.Run("Offline", func(t *testing.T) {
+		fake.FailMethod("*", -1, 0)
+		defer fake.ClearFaults()
+
+		checkGet("app/token", "alpha")
+		rsp := rawGet(t, url, "app/token")
+		if got := rsp.Header.Get(agent.HeaderCache); got != "stale" {
+			t.Errorf("Header %s: got %q, want stale", agent.HeaderCache, got)
+		}
+		if rsp.Header.Get("Age") == "" || rsp.Header.Get(agent.HeaderCacheUpdated) == "" {
+			t.Errorf("Stale response is missing Age or update time: %v", rsp.Header)
+		}
+		if _, err := cli.GetIfChanged(ctx, "app/token", 1); !errors.Is(err, api.ErrValueNotChanged) {
+			t.Errorf("GetIfChanged: got %v, want %v", err, api.ErrValueNotChanged)
+		}
+		if si, err := cli.Info(ctx, "app/token"); err != nil || si.ActiveVersion != 1 {
+			t.Errorf("Info: got (%v, %v), want version 1", si, err)
+		}
+		if infos, err := cli.List(ctx); err != nil || len(infos) != 2 {
+			t.Errorf("List: got (%v, %v), want 2 secrets", infos, err)
+		}
+
+		// A secret that was never fetched is not available.
+		if _, err := cli.Get(ctx, "app/other"); err == nil || !strings.Contains(err.Error(), "not cached") {
+			t.Errorf("Get uncached: got %v, want not cached", err)
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		fake.Rotate("app/token", "bravo")
+		if _, err := cli.GetIfChanged(ctx, "app/token", 1); err != nil {
+			t.Fatalf("GetIfChanged: unexpected error: %v", err)
+		}
+		fake.FailMethod("*", -1, 0)
+		defer fake.ClearFaults()
+		checkGet("app/token", "bravo")
+	})
+
+	t.Run("Restart", func(t *testing.T) {
+		fake.FailMethod("*", -1, http.StatusServiceUnavailable)
+		defer fake.ClearFaults()
+
+		cli2, _ := newAgent(t, agent.Config{Client: upstream(fake.URL), Cache: cache})
+		sv, err := cli2.Get(ctx, "app/token")
+		if err != nil || string(sv.Value) != "bravo" {
+			t.Errorf("Get after restart: got (%v, %v), want bravo", sv, err)
+		}
+
+		// Values older than MaxStale are not served.
+		cli3, _ := newAgent(t, agent.Config{Client: upstream(fake.URL), Cache: cache, MaxStale: time.Nanosecond})
+		if _, err := cli3.Get(ctx, "app/token"); err == nil {
+			t.Error("Get too stale: got nil, want error")
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		fake.SetRules(setectest.DefaultPrincipal)
+		if _, err := cli.Get(ctx, "app/token"); !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("Get revoked: got %v, want %v", err, api.ErrAccessDenied)
+		}
+
+		// The revoked secret was removed from the cache.
+		fake.FailMethod("*", -1, 0)
+		defer fake.ClearFaults()
+		if _, err := cli.Get(ctx, "app/token"); err == nil {
+			t.Error("Get revoked while offline: got nil, want error")
+		}
+	})
+}
+
+func TestAgentAllow(t *testing.T) {
+	fake := setectest.NewFake(t, nil)
+	fake.Rotate("app/token", "alpha")
+	fake.Rotate("ops/key", "hidden")
+
+	cli, _ := newAgent(t, agent.Config{
+		Client: upstream(fake.URL),
+		Allow:  []acl.Secret{"app/*"},
+	})
+	ctx := context.Background()
+
+	if _, err := cli.Get(ctx, "app/token"); err != nil {
+		t.Errorf("Get allowed: unexpected error: %v", err)
+	}
+	fake.ResetCalls()
+	if _, err := cli.Get(ctx, "ops/key"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Get disallowed: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("Disallowed get reached upstream: %+v", calls)
+	}
+	infos, err := cli.List(ctx)
+	if err != nil {
+		t.Fatalf("List: unexpected error: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Name != "app/token" {
+		t.Errorf("List: got %d secrets, want only app/token", len(infos))
+	}
+}
+
+func TestAgentDynamic(t *testing.T) {
+	fake := setectest.NewFake(t, nil)
+	value, err := json.Marshal(api.DynamicValue{
+		LeaseID: "lease-1",
+		Expires: time.Now().Add(time.Hour),
+		Data:    map[string]string{"username": "u", "password": "p"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Rotate("db/creds", string(value))
+
+	cache := setec.NewMemCache("")
+	cli, _ := newAgent(t, agent.Config{Client: upstream(fake.URL), Cache: cache})
+	ctx := context.Background()
+	if _, err := cli.Get(ctx, "db/creds"); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	if data, _ := cache.Read(); bytes.Contains(data, []byte("lease-1")) {
+		t.Errorf("Cache contains the dynamic credential: %s", data)
+	}
+
+	// The credential is not served while the upstream is unavailable.
+	fake.FailMethod("*", -1, 0)
+	defer fake.ClearFaults()
+	if _, err := cli.Get(ctx, "db/creds"); err == nil || !strings.Contains(err.Error(), "not cached") {
+		t.Errorf("Get dynamic while offline: got %v, want not cached", err)
+	}
+}
+
+func TestAgentEncryptedCache(t *testing.T) {
+	fake := setectest.NewFake(t, nil)
+	fake.Rotate("app/token", "correct horse battery staple")
+
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyPath, bytes.Repeat([]byte("k"), 32), 0600); err != nil {
+		t.Fatalf("Write key: %v", err)
+	}
+	cachePath := filepath.Join(dir, "cache")
+	cache, err := setec.NewEncryptedFileCache(cachePath, setec.KeyFile(keyPath))
+	if err != nil {
+		t.Fatalf("NewEncryptedFileCache: %v", err)
+	}
+
+	cli, _ := newAgent(t, agent.Config{Client: upstream(fake.URL), Cache: cache})
+	if _, err := cli.Get(context.Background(), "app/token"); err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatalf("Read cache: %v", err)
+	}
+	for _, plain := range []string{"app/token", "correct horse"} {
+		if bytes.Contains(data, []byte(plain)) {
+			t.Errorf("Cache file contains %q", plain)
+		}
+	}
+}
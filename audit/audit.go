@@ -60,6 +60,10 @@ type Entry struct {
 	// upon. Set for acl.ActionGet, acl.ActionPut,
 	// acl.ActionSetActive.
 	SecretVersion api.SecretVersion `json:"secretVersion,omitempty"`
+	// Reason, if non-empty, explains why an unauthorized action was refused
+	// for a reason other than the principal's ACLs, for example because the
+	// principal was locked out after repeated access denials.
+	Reason string `json:"reason,omitempty"`
 }
 
 // Writer is an audit log writer.
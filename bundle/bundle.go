@@ -0,0 +1,341 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package bundle implements encrypted export bundles of secrets.
+//
+// A bundle holds a selection of secrets from a setec server, with their
+// values and version metadata. Bundles are encrypted with [age] to one or more
+// recipients, and can be imported into another server. This is useful to move
+// secrets to a new server that does not share the same key-encryption key, or
+// as an escape hatch for disaster recovery.
+//
+// Bundles are read from and written to a server through its API, so exports
+// and imports are subject to the ACLs of the caller and are recorded in the
+// audit logs of the servers involved.
+//
+// [age]: https://age-encryption.org
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/types/api"
+)
+
+// formatVersion is the (currently) only supported version of the bundle
+// format.
+const formatVersion = 1
+
+// Bundle is a collection of exported secrets.
+//
+// Encoded as JSON, prior to encryption, a bundle has this structure:
+//
+//	{
+//	  "version": 1,
+//	  "created": "2024-05-01T12:00:00Z",
+//	  "secrets": [
+//	    {
+//	      "name": "secret1",
+//	      "activeVersion": 2,
+//	      "versions": [
+//	        {"version": 1, "value": "<secret-1-value-base64>"},
+//	        {"version": 2, "value": "<secret-2-value-base64>"}
+//	      ]
+//	    },
+//	    ...
+//	  ]
+//	}
+type Bundle struct {
+	// Version is the version of the bundle format.
+	Version int `json:"version"`
+
+	// Created is when the bundle was created.
+	Created time.Time `json:"created"`
+
+	// Secrets are the exported secrets, in order by name.
+	Secrets []*Secret `json:"secrets"`
+}
+
+// Secret is a single secret in a bundle.
+type Secret struct {
+	// Name is the name of the secret.
+	Name string `json:"name"`
+
+	// ActiveVersion is the version that was active when the secret was
+	// exported. It is always one of the versions present in Versions.
+	ActiveVersion api.SecretVersion `json:"activeVersion"`
+
+	// Versions are the exported versions of the secret, in increasing order.
+	Versions []Version `json:"versions"`
+}
+
+// Version is a single version of a secret in a bundle.
+type Version struct {
+	Version api.SecretVersion `json:"version"`
+	Value   []byte            `json:"value"`
+}
+
+// Client is the subset of the setec API used to export and import bundles.
+// It is implemented by [setec.Client].
+//
+// [setec.Client]: https://godoc.org/github.com/leger-labs/leger/client/setec#Client
+type Client interface {
+	List(ctx context.Context) ([]*api.SecretInfo, error)
+	Info(ctx context.Context, name string) (*api.SecretInfo, error)
+	GetVersion(ctx context.Context, name string, version api.SecretVersion) (*api.SecretValue, error)
+	Put(ctx context.Context, name string, value []byte) (api.SecretVersion, error)
+	Activate(ctx context.Context, name string, version api.SecretVersion) error
+	DeleteVersion(ctx context.Context, name string, version api.SecretVersion) error
+}
+
+// ExportOptions are options for exporting secrets.
+// A nil *ExportOptions is ready for use and provides defaults as described.
+type ExportOptions struct {
+	// Filter, if non-empty, selects which secrets to export. A secret is
+	// exported if its name matches any of the patterns. If empty, all the
+	// secrets visible to the caller are exported.
+	//
+	// Reserved secrets, whose names begin with "_internal/", are exported
+	// only if a pattern beginning with "_internal/" selects them, as reading
+	// them requires an ACL rule naming them so.
+	Filter []acl.Secret
+
+	// AllVersions, if true, exports all versions of each secret. Otherwise,
+	// only the active version of each secret is exported.
+	AllVersions bool
+}
+
+// reservedPrefix is the name prefix of secrets reserved for the server's
+// own configuration.
+const reservedPrefix = "_internal/"
+
+func (o *ExportOptions) match(name string) bool {
+	reserved := strings.HasPrefix(name, reservedPrefix)
+	if o == nil || len(o.Filter) == 0 {
+		return !reserved
+	}
+	return slices.ContainsFunc(o.Filter, func(pat acl.Secret) bool {
+		return pat.Match(name) && (!reserved || strings.HasPrefix(string(pat), reservedPrefix))
+	})
+}
+
+func (o *ExportOptions) allVersions() bool { return o != nil && o.AllVersions }
+
+// Export reads the secrets selected by opts from c and returns them as a
+// bundle. The caller must have "info" access to list the secrets, and "get"
+// access to read their values. If opts == nil, default options are used (see
+// ExportOptions).
+func Export(ctx context.Context, c Client, opts *ExportOptions) (*Bundle, error) {
+	infos, err := c.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing secrets: %w", err)
+	}
+	b := &Bundle{Version: formatVersion, Created: time.Now().UTC()}
+	for _, info := range infos {
+		if !opts.match(info.Name) {
+			continue
+		}
+		vers := []api.SecretVersion{info.ActiveVersion}
+		if opts.allVersions() {
+			vers = info.Versions
+		}
+		sec := &Secret{Name: info.Name, ActiveVersion: info.ActiveVersion}
+		for _, v := range vers {
+			sv, err := c.GetVersion(ctx, info.Name, v)
+			if err != nil {
+				return nil, fmt.Errorf("get %q version %v: %w", info.Name, v, err)
+			}
+			sec.Versions = append(sec.Versions, Version{Version: sv.Version, Value: sv.Value})
+		}
+		b.Secrets = append(b.Secrets, sec)
+	}
+	return b, nil
+}
+
+// Encrypt writes b to w, encrypted to the specified recipients.
+func (b *Bundle) Encrypt(w io.Writer, recipients ...age.Recipient) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipients specified")
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("encoding bundle: %w", err)
+	}
+	ew, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return fmt.Errorf("encrypting bundle: %w", err)
+	}
+	if _, err := ew.Write(data); err != nil {
+		return fmt.Errorf("encrypting bundle: %w", err)
+	}
+	return ew.Close()
+}
+
+// Decrypt reads an encrypted bundle from r, using the specified identities to
+// decrypt it.
+func Decrypt(r io.Reader, identities ...age.Identity) (*Bundle, error) {
+	dr, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting bundle: %w", err)
+	}
+	data, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting bundle: %w", err)
+	}
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("decoding bundle: %w", err)
+	}
+	if b.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Version)
+	}
+	for _, s := range b.Secrets {
+		if err := s.check(); err != nil {
+			return nil, err
+		}
+	}
+	return &b, nil
+}
+
+// check reports whether s is a well-formed bundle secret.
+func (s *Secret) check() error {
+	if s.Name == "" {
+		return errors.New("bundle contains a secret with an empty name")
+	} else if len(s.Versions) == 0 {
+		return fmt.Errorf("secret %q has no versions", s.Name)
+	}
+	for _, v := range s.Versions {
+		if v.Version == s.ActiveVersion {
+			return nil
+		}
+	}
+	return fmt.Errorf("secret %q: active version %v is missing", s.Name, s.ActiveVersion)
+}
+
+// Strategy is a way to resolve a conflict when importing a secret that
+// already exists on the target server.
+type Strategy string
+
+const (
+	// Skip leaves an existing secret unchanged.
+	Skip Strategy = "skip"
+
+	// NewVersion adds the imported values as new versions of an existing
+	// secret, and activates the version corresponding to the active version in
+	// the bundle. Existing versions are kept.
+	NewVersion Strategy = "new-version"
+
+	// Overwrite adds the imported values as new versions of an existing
+	// secret, activates the version corresponding to the active version in the
+	// bundle, then deletes all the versions that were not imported.
+	Overwrite Strategy = "overwrite"
+)
+
+// ParseStrategy parses a Strategy from its string representation.
+func ParseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case Skip, NewVersion, Overwrite:
+		return st, nil
+	}
+	return "", fmt.Errorf("unknown conflict strategy %q", s)
+}
+
+// Result describes the outcome of importing a single secret.
+type Result struct {
+	// Name is the name of the secret.
+	Name string
+
+	// Action is what was done with the secret: "created", "skipped",
+	// "updated", or "overwritten".
+	Action string
+
+	// Versions maps the version numbers in the bundle to the corresponding
+	// version numbers on the target server. It is empty if the secret was
+	// skipped.
+	Versions map[api.SecretVersion]api.SecretVersion
+
+	// Err, if non-nil, is the error that occurred importing the secret.
+	Err error
+}
+
+// Import writes the secrets in b to c. Secrets that do not already exist are
+// created; secrets that do exist are handled according to strategy.
+//
+// Import attempts to import every secret in the bundle, and reports a Result
+// for each of them. If any secret could not be imported, Import also reports
+// an error describing all the failures.
+func Import(ctx context.Context, c Client, b *Bundle, strategy Strategy) ([]Result, error) {
+	if _, err := ParseStrategy(string(strategy)); err != nil {
+		return nil, err
+	}
+	var out []Result
+	var errs []error
+	for _, s := range b.Secrets {
+		res := importSecret(ctx, c, s, strategy)
+		if res.Err != nil {
+			errs = append(errs, fmt.Errorf("import %q: %w", s.Name, res.Err))
+		}
+		out = append(out, res)
+	}
+	return out, errors.Join(errs...)
+}
+
+func importSecret(ctx context.Context, c Client, s *Secret, strategy Strategy) Result {
+	res := Result{Name: s.Name, Action: "created"}
+	info, err := c.Info(ctx, s.Name)
+	if err == nil {
+		switch strategy {
+		case Skip:
+			res.Action = "skipped"
+			return res
+		case NewVersion:
+			res.Action = "updated"
+		case Overwrite:
+			res.Action = "overwritten"
+		}
+	} else if !errors.Is(err, api.ErrNotFound) {
+		res.Err = err
+		return res
+	}
+
+	res.Versions = make(map[api.SecretVersion]api.SecretVersion)
+	for _, v := range s.Versions {
+		nv, err := c.Put(ctx, s.Name, v.Value)
+		if err != nil {
+			res.Err = fmt.Errorf("put version %v: %w", v.Version, err)
+			return res
+		}
+		res.Versions[v.Version] = nv
+	}
+	active := res.Versions[s.ActiveVersion]
+	if err := c.Activate(ctx, s.Name, active); err != nil {
+		res.Err = fmt.Errorf("activate version %v: %w", active, err)
+		return res
+	}
+
+	if info != nil && strategy == Overwrite {
+		keep := make(map[api.SecretVersion]bool)
+		for _, nv := range res.Versions {
+			keep[nv] = true
+		}
+		for _, v := range info.Versions {
+			if keep[v] {
+				continue
+			}
+			if err := c.DeleteVersion(ctx, s.Name, v); err != nil {
+				res.Err = fmt.Errorf("delete version %v: %w", v, err)
+				return res
+			}
+		}
+	}
+	return res
+}
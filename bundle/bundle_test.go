@@ -0,0 +1,206 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package bundle_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/bundle"
+	"github.com/leger-labs/leger/client/setec"
+	"github.com/leger-labs/leger/server"
+	"github.com/leger-labs/leger/setectest"
+	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func newClient(t *testing.T, d *setectest.DB) setec.Client {
+	t.Helper()
+	ss := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ss.Mux)
+	t.Cleanup(hs.Close)
+	return setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	src := setectest.NewDB(t, nil)
+	src.MustPut(src.Superuser, "app/key", "k1")
+	src.MustPut(src.Superuser, "app/key", "k2")
+	src.MustActivate(src.Superuser, "app/key", 2)
+	src.MustPut(src.Superuser, "app/key", "k3")
+	src.MustPut(src.Superuser, "app/token", "t1")
+	src.MustPut(src.Superuser, "other/thing", "x")
+	// Reserved secrets are not exported unless selected explicitly.
+	src.MustPut(src.Superuser, "_internal/dynamic/token", `{"backend":"hmac","hmac":{"key":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}}`)
+	srcClient := newClient(t, src)
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Generate identity: %v", err)
+	}
+
+	t.Run("ActiveOnly", func(t *testing.T) {
+		b, err := bundle.Export(ctx, srcClient, &bundle.ExportOptions{
+			Filter: []acl.Secret{"app/*"},
+		})
+		if err != nil {
+			t.Fatalf("Export: unexpected error: %v", err)
+		}
+		want := []*bundle.Secret{
+			{Name: "app/key", ActiveVersion: 2, Versions: []bundle.Version{{2, []byte("k2")}}},
+			{Name: "app/token", ActiveVersion: 1, Versions: []bundle.Version{{1, []byte("t1")}}},
+		}
+		if diff := cmp.Diff(b.Secrets, want); diff != "" {
+			t.Errorf("Export (-got, +want):\n%s", diff)
+		}
+	})
+
+	b, err := bundle.Export(ctx, srcClient, &bundle.ExportOptions{AllVersions: true})
+	if err != nil {
+		t.Fatalf("Export: unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := b.Encrypt(&buf, id.Recipient()); err != nil {
+		t.Fatalf("Encrypt: unexpected error: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("app/key")) {
+		t.Error("Encrypted bundle contains plaintext secret names")
+	}
+
+	t.Run("WrongIdentity", func(t *testing.T) {
+		other, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatalf("Generate identity: %v", err)
+		}
+		if got, err := bundle.Decrypt(bytes.NewReader(buf.Bytes()), other); err == nil {
+			t.Errorf("Decrypt: got %+v, want error", got)
+		}
+	})
+
+	got, err := bundle.Decrypt(bytes.NewReader(buf.Bytes()), id)
+	if err != nil {
+		t.Fatalf("Decrypt: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, b); diff != "" {
+		t.Fatalf("Decrypted bundle (-got, +want):\n%s", diff)
+	}
+
+	t.Run("Import", func(t *testing.T) {
+		dst := setectest.NewDB(t, nil)
+		dst.MustPut(dst.Superuser, "app/token", "old")
+		dstClient := newClient(t, dst)
+
+		res, err := bundle.Import(ctx, dstClient, got, bundle.Skip)
+		if err != nil {
+			t.Fatalf("Import: unexpected error: %v", err)
+		}
+		actions := make(map[string]string)
+		for _, r := range res {
+			actions[r.Name] = r.Action
+		}
+		if diff := cmp.Diff(actions, map[string]string{
+			"app/key": "created", "app/token": "skipped", "other/thing": "created",
+		}); diff != "" {
+			t.Errorf("Import actions (-got, +want):\n%s", diff)
+		}
+
+		// The imported secret has all its versions, and the correct one active.
+		if sv := dst.MustGet(dst.Superuser, "app/key"); string(sv.Value) != "k2" {
+			t.Errorf("Get app/key: got %q, want k2", sv.Value)
+		}
+		if sv := dst.MustGetVersion(dst.Superuser, "app/key", 3); string(sv.Value) != "k3" {
+			t.Errorf("Get app/key version 3: got %q, want k3", sv.Value)
+		}
+		// The skipped secret is unchanged.
+		if sv := dst.MustGet(dst.Superuser, "app/token"); string(sv.Value) != "old" {
+			t.Errorf("Get app/token: got %q, want old", sv.Value)
+		}
+	})
+
+	t.Run("NewVersion", func(t *testing.T) {
+		dst := setectest.NewDB(t, nil)
+		dst.MustPut(dst.Superuser, "app/token", "old")
+		dstClient := newClient(t, dst)
+
+		if _, err := bundle.Import(ctx, dstClient, got, bundle.NewVersion); err != nil {
+			t.Fatalf("Import: unexpected error: %v", err)
+		}
+		if sv := dst.MustGet(dst.Superuser, "app/token"); string(sv.Value) != "t1" || sv.Version != 2 {
+			t.Errorf("Get app/token: got %q (version %v), want t1 (version 2)", sv.Value, sv.Version)
+		}
+		if sv := dst.MustGetVersion(dst.Superuser, "app/token", 1); string(sv.Value) != "old" {
+			t.Errorf("Get app/token version 1: got %q, want old", sv.Value)
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		dst := setectest.NewDB(t, nil)
+		dst.MustPut(dst.Superuser, "app/token", "old")
+		dstClient := newClient(t, dst)
+
+		if _, err := bundle.Import(ctx, dstClient, got, bundle.Overwrite); err != nil {
+			t.Fatalf("Import: unexpected error: %v", err)
+		}
+		info, err := dst.Actual.Info(dst.Superuser, "app/token")
+		if err != nil {
+			t.Fatalf("Info app/token: %v", err)
+		}
+		if diff := cmp.Diff(info, &api.SecretInfo{
+			Name: "app/token", Versions: []api.SecretVersion{2}, ActiveVersion: 2,
+		}, cmpopts.IgnoreFields(api.SecretInfo{}, "AccessSince")); diff != "" {
+			t.Errorf("Info app/token (-got, +want):\n%s", diff)
+		}
+	})
+
+	t.Run("AccessDenied", func(t *testing.T) {
+		dst := setectest.NewDB(t, nil)
+		ss := setectest.NewServer(t, dst, &setectest.ServerOptions{
+			WhoIs: readOnly,
+		})
+		hs := httptest.NewServer(ss.Mux)
+		defer hs.Close()
+		dstClient := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+		res, err := bundle.Import(ctx, dstClient, got, bundle.Skip)
+		if !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("Import: got %v, want %v", err, api.ErrAccessDenied)
+		}
+		for _, r := range res {
+			if !errors.Is(r.Err, api.ErrAccessDenied) {
+				t.Errorf("Import %q: got %v, want %v", r.Name, r.Err, api.ErrAccessDenied)
+			}
+		}
+		if got := dst.MustList(dst.Superuser); len(got) != 0 {
+			t.Errorf("List after failed import: got %d secrets, want 0", len(got))
+		}
+	})
+}
+
+// readOnly is a WhoIs function that grants a caller permission to read, but
+// not write, all secrets.
+func readOnly(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+	rule, err := json.Marshal(acl.Rule{
+		Action: []acl.Action{acl.ActionGet, acl.ActionInfo},
+		Secret: []acl.Secret{"*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "example.com"},
+		UserProfile: &tailcfg.UserProfile{ID: 1, LoginName: "reader@example.com"},
+		CapMap:      tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
+	}, nil
+}
@@ -0,0 +1,275 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package ca implements an internal certificate authority for issuing TLS
+// certificates to services on a tailnet.
+//
+// An [Authority] is a CA certificate and private key, stored as a secret. A
+// certificate secret is defined by a [CertConfig], which names the authority
+// and describes the certificate to issue. The server issues a certificate for
+// each certificate secret as a new version of that secret, and reissues it
+// before it expires. Each issued certificate is recorded in a [Registry] for
+// its authority, from which revocation status and CRLs are derived.
+//
+// The value of a certificate secret is a PEM encoded certificate chain
+// followed by the private key, so it can be passed as both arguments to
+// [tls.X509KeyPair].
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// KeyType is the type of a private key.
+type KeyType string
+
+// Supported key types.
+const (
+	ECDSAP256 KeyType = "ecdsa-p256"
+	ECDSAP384 KeyType = "ecdsa-p384"
+	Ed25519   KeyType = "ed25519"
+	RSA2048   KeyType = "rsa-2048"
+	RSA4096   KeyType = "rsa-4096"
+)
+
+// generateKey generates a new private key of type kt. If kt is empty,
+// ECDSAP256 is used.
+func generateKey(kt KeyType) (crypto.Signer, error) {
+	switch kt {
+	case ECDSAP256, "":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("unknown key type %q", kt)
+}
+
+func (kt KeyType) check() error {
+	switch kt {
+	case ECDSAP256, ECDSAP384, Ed25519, RSA2048, RSA4096, "":
+		return nil
+	}
+	return fmt.Errorf("unknown key type %q", kt)
+}
+
+// Authority is a certificate authority.
+type Authority struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewAuthority generates a new self-signed certificate authority with the
+// given common name, valid for ttl, and returns it PEM encoded in the format
+// accepted by ParseAuthority.
+func NewAuthority(commonName string, ttl time.Duration, kt KeyType) ([]byte, error) {
+	if commonName == "" {
+		return nil, errors.New("empty common name")
+	}
+	key, err := generateKey(kt)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(ttl),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("creating CA certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...), nil
+}
+
+// ParseAuthority parses a PEM encoded CA certificate and PKCS #8 private key.
+func ParseAuthority(data []byte) (*Authority, error) {
+	var a Authority
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			break
+		}
+		switch b.Type {
+		case "CERTIFICATE":
+			if a.Cert != nil {
+				return nil, errors.New("multiple CA certificates")
+			}
+			cert, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing CA certificate: %w", err)
+			}
+			a.Cert = cert
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing CA key: %w", err)
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("unsupported CA key type %T", key)
+			}
+			a.Key = signer
+		}
+	}
+	if a.Cert == nil || a.Key == nil {
+		return nil, errors.New("CA must contain a certificate and a private key")
+	} else if !a.Cert.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	} else if !publicKeysEqual(a.Cert.PublicKey, a.Key.Public()) {
+		return nil, errors.New("CA key does not match certificate")
+	}
+	return &a, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	ak, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && ak.Equal(b)
+}
+
+// CertPEM returns the PEM encoding of the CA certificate.
+func (a *Authority) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.Cert.Raw})
+}
+
+// clockSkew is how far before the time of issue certificates become valid,
+// to tolerate clients whose clocks are slightly behind.
+const clockSkew = 5 * time.Minute
+
+// Issue issues a certificate described by cfg, valid from now. It returns the
+// value to store in the certificate secret, and the certificate itself.
+func (a *Authority) Issue(cfg *CertConfig, now time.Time) ([]byte, *x509.Certificate, error) {
+	key, err := generateKey(cfg.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	notAfter := now.Add(cfg.ttl())
+	if notAfter.After(a.Cert.NotAfter) {
+		notAfter = a.Cert.NotAfter
+	}
+	var ips []net.IP
+	for _, ip := range cfg.ips {
+		ips = append(ips, ip.AsSlice())
+	}
+	usage := x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cfg.commonName()},
+		DNSNames:              cfg.DNSNames,
+		IPAddresses:           ips,
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              notAfter,
+		KeyUsage:              usage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.Cert, key.Public(), a.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	out = append(out, a.CertPEM()...)
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	return out, cert, nil
+}
+
+// crlValidity is how long a CRL produced by an Authority remains valid.
+const crlValidity = 24 * time.Hour
+
+// CRL returns a DER encoded certificate revocation list signed by a, listing
+// the unexpired certificates that are revoked in r.
+func (a *Authority) CRL(r *Registry, now time.Time) ([]byte, error) {
+	var revoked []x509.RevocationListEntry
+	for _, c := range r.Certs {
+		if c.RevokedAt == nil || now.After(c.NotAfter) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(c.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q in registry", c.Serial)
+		}
+		revoked = append(revoked, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: *c.RevokedAt,
+		})
+	}
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: revoked,
+	}, a.Cert, a.Key)
+}
+
+// Leaf returns the first certificate in the PEM encoded value of a
+// certificate secret.
+func Leaf(value []byte) (*x509.Certificate, error) {
+	for {
+		var b *pem.Block
+		b, value = pem.Decode(value)
+		if b == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if b.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(b.Bytes)
+		}
+	}
+}
+
+// SerialString returns the canonical string form of a certificate serial
+// number, as used in a Registry.
+func SerialString(serial *big.Int) string { return serial.Text(16) }
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
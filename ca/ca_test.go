@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ca_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/ca"
+)
+
+func TestIssue(t *testing.T) {
+	caPEM, err := ca.NewAuthority("Test CA", 365*24*time.Hour, ca.Ed25519)
+	if err != nil {
+		t.Fatalf("NewAuthority: %v", err)
+	}
+	auth, err := ca.ParseAuthority(caPEM)
+	if err != nil {
+		t.Fatalf("ParseAuthority: %v", err)
+	}
+
+	cfg, err := ca.ParseCertConfig([]byte(`{"ca":"test","dnsNames":["web.example.com"],"ipAddresses":["100.64.0.1"],"ttl":"24h"}`))
+	if err != nil {
+		t.Fatalf("ParseCertConfig: %v", err)
+	}
+	now := time.Now()
+	value, cert, err := auth.Issue(cfg, now)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	// The value is usable directly as a TLS key pair.
+	if _, err := tls.X509KeyPair(value, value); err != nil {
+		t.Errorf("X509KeyPair: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(auth.Cert)
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "web.example.com", Roots: roots}); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if cert.Subject.CommonName != "web.example.com" {
+		t.Errorf("Common name: got %q, want web.example.com", cert.Subject.CommonName)
+	}
+
+	// A fresh certificate does not need renewal until the last third of its
+	// lifetime, or until its configuration changes.
+	if ca.NeedsRenewal(value, cfg, now) {
+		t.Error("NeedsRenewal: fresh certificate needs renewal")
+	}
+	if !ca.NeedsRenewal(value, cfg, now.Add(17*time.Hour)) {
+		t.Error("NeedsRenewal: aging certificate does not need renewal")
+	}
+	cfg2, err := ca.ParseCertConfig([]byte(`{"ca":"test","dnsNames":["web.example.com","api.example.com"],"ipAddresses":["100.64.0.1"],"ttl":"24h"}`))
+	if err != nil {
+		t.Fatalf("ParseCertConfig: %v", err)
+	}
+	if !ca.NeedsRenewal(value, cfg2, now) {
+		t.Error("NeedsRenewal: certificate with changed names does not need renewal")
+	}
+	if !ca.NeedsRenewal([]byte("garbage"), cfg, now) {
+		t.Error("NeedsRenewal: invalid value does not need renewal")
+	}
+
+	// Revoked certificates are listed in the CRL, and reported by Status.
+	serial := ca.SerialString(cert.SerialNumber)
+	revoked := now.UTC()
+	reg := &ca.Registry{Certs: []*ca.IssuedCert{
+		{Serial: serial, Secret: "web", Version: 1, NotAfter: cert.NotAfter, RevokedAt: &revoked},
+	}}
+	der, err := auth.CRL(reg, now)
+	if err != nil {
+		t.Fatalf("CRL: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("ParseRevocationList: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(auth.Cert); err != nil {
+		t.Errorf("CRL signature: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("CRL entries: got %+v, want serial %s", crl.RevokedCertificateEntries, serial)
+	}
+	if st := reg.Status(serial, now); st.Status != "revoked" {
+		t.Errorf("Status: got %q, want revoked", st.Status)
+	}
+	if st := reg.Status("abc", now); st.Status != "unknown" {
+		t.Errorf("Status unknown serial: got %q, want unknown", st.Status)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	bad := []string{
+		`{}`,
+		`{"ca":"x"}`,
+		`{"ca":"x","dnsNames":["a"],"keyType":"dsa"}`,
+		`{"ca":"x","ipAddresses":["not-an-ip"]}`,
+		`{"ca":"x","dnsNames":["a"],"ttl":"1h","renewBefore":"2h"}`,
+	}
+	for _, in := range bad {
+		if _, err := ca.ParseCertConfig([]byte(in)); err == nil {
+			t.Errorf("ParseCertConfig(%s): got nil error", in)
+		}
+	}
+	if _, err := ca.ParseAuthority([]byte("not a CA")); err == nil {
+		t.Error("ParseAuthority: got nil error for invalid input")
+	}
+}
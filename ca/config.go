@@ -0,0 +1,235 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ca
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/leger-labs/leger/types/api"
+)
+
+// CertConfig describes a certificate secret. It is stored as JSON:
+//
+//	{
+//	  "ca": "internal",
+//	  "dnsNames": ["web.example.ts.net"],
+//	  "ttl": "720h",
+//	  "keyType": "ecdsa-p256"
+//	}
+type CertConfig struct {
+	// CA is the name of the authority that issues the certificate.
+	CA string `json:"ca"`
+
+	// CommonName is the subject common name of the certificate. If empty,
+	// the first of DNSNames is used.
+	CommonName string `json:"commonName,omitempty"`
+
+	// DNSNames and IPAddresses are the subject alternative names of the
+	// certificate. At least one name or address is required.
+	DNSNames    []string `json:"dnsNames,omitempty"`
+	IPAddresses []string `json:"ipAddresses,omitempty"`
+
+	// TTL is the lifetime of each certificate. If zero, 30 days is used.
+	// Certificates never outlive the authority that issued them.
+	TTL Duration `json:"ttl,omitempty"`
+
+	// RenewBefore is how long before a certificate expires that it is
+	// reissued. If zero, a third of the TTL is used.
+	RenewBefore Duration `json:"renewBefore,omitempty"`
+
+	// KeyType is the type of the certificate's private key.
+	// If empty, "ecdsa-p256" is used.
+	KeyType KeyType `json:"keyType,omitempty"`
+
+	ips []netip.Addr // parsed from IPAddresses
+}
+
+func (c *CertConfig) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(c.TTL)
+}
+
+func (c *CertConfig) renewBefore() time.Duration {
+	if c.RenewBefore <= 0 {
+		return c.ttl() / 3
+	}
+	return time.Duration(c.RenewBefore)
+}
+
+func (c *CertConfig) commonName() string {
+	if c.CommonName != "" {
+		return c.CommonName
+	} else if len(c.DNSNames) != 0 {
+		return c.DNSNames[0]
+	}
+	return ""
+}
+
+// ParseCertConfig parses and validates a JSON encoded CertConfig.
+func ParseCertConfig(data []byte) (*CertConfig, error) {
+	var cfg CertConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid certificate config: %w", err)
+	}
+	if cfg.CA == "" {
+		return nil, errors.New("invalid certificate config: no CA specified")
+	} else if len(cfg.DNSNames) == 0 && len(cfg.IPAddresses) == 0 {
+		return nil, errors.New("invalid certificate config: no DNS names or IP addresses")
+	} else if cfg.RenewBefore > 0 && time.Duration(cfg.RenewBefore) >= cfg.ttl() {
+		return nil, errors.New("invalid certificate config: renewBefore must be less than ttl")
+	}
+	if err := cfg.KeyType.check(); err != nil {
+		return nil, fmt.Errorf("invalid certificate config: %w", err)
+	}
+	for _, s := range cfg.IPAddresses {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate config: %w", err)
+		}
+		cfg.ips = append(cfg.ips, ip)
+	}
+	return &cfg, nil
+}
+
+// NeedsRenewal reports whether the certificate secret with the given value
+// should be reissued as of now: if value does not contain a certificate, if
+// the certificate is due for renewal according to cfg, or if it no longer
+// matches the names in cfg.
+func NeedsRenewal(value []byte, cfg *CertConfig, now time.Time) bool {
+	leaf, err := Leaf(value)
+	if err != nil {
+		return true
+	}
+	if leaf.NotAfter.Sub(now) < cfg.renewBefore() {
+		return true
+	}
+	if !slices.Equal(leaf.DNSNames, cfg.DNSNames) || leaf.Subject.CommonName != cfg.commonName() {
+		return true
+	}
+	var ips []netip.Addr
+	for _, ip := range leaf.IPAddresses {
+		addr, _ := netip.AddrFromSlice(ip)
+		ips = append(ips, addr.Unmap())
+	}
+	return !slices.Equal(ips, cfg.ips)
+}
+
+// Duration is a time.Duration that encodes to JSON as a string, like "720h".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Registry records the certificates issued by an authority. It is stored as
+// JSON in a secret alongside the authority.
+type Registry struct {
+	Certs []*IssuedCert `json:"certs"`
+}
+
+// IssuedCert is the record of a single issued certificate.
+type IssuedCert struct {
+	// Serial is the serial number of the certificate, in hexadecimal.
+	Serial string `json:"serial"`
+
+	// Secret and Version identify the certificate secret version that holds
+	// the certificate.
+	Secret  string            `json:"secret"`
+	Version api.SecretVersion `json:"version"`
+
+	// NotAfter is when the certificate expires.
+	NotAfter time.Time `json:"notAfter"`
+
+	// RevokedAt, if non-nil, is when the certificate was revoked.
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// ParseRegistry parses a JSON encoded Registry. An empty input yields an
+// empty registry.
+func ParseRegistry(data []byte) (*Registry, error) {
+	var r Registry
+	if len(data) == 0 {
+		return &r, nil
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid certificate registry: %w", err)
+	}
+	return &r, nil
+}
+
+// Encode returns the JSON encoding of r.
+func (r *Registry) Encode() []byte {
+	data, err := json.Marshal(r)
+	if err != nil {
+		panic(fmt.Sprintf("encoding registry: %v", err)) // cannot happen
+	}
+	return data
+}
+
+// Lookup returns the record for the certificate with the given serial
+// number, or nil if it is not in r.
+func (r *Registry) Lookup(serial string) *IssuedCert {
+	for _, c := range r.Certs {
+		if c.Serial == serial {
+			return c
+		}
+	}
+	return nil
+}
+
+// Find returns the record for the certificate stored in the specified
+// version of a certificate secret, or nil if it is not in r.
+func (r *Registry) Find(secret string, version api.SecretVersion) *IssuedCert {
+	for _, c := range r.Certs {
+		if c.Secret == secret && c.Version == version {
+			return c
+		}
+	}
+	return nil
+}
+
+// Prune discards the records of certificates that expired before now, since
+// they no longer need to appear in a CRL.
+func (r *Registry) Prune(now time.Time) {
+	r.Certs = slices.DeleteFunc(r.Certs, func(c *IssuedCert) bool {
+		return c.NotAfter.Before(now)
+	})
+}
+
+// Status returns the revocation status of the certificate with the given
+// serial number as of now.
+func (r *Registry) Status(serial string, now time.Time) *api.CertStatus {
+	c := r.Lookup(serial)
+	if c == nil {
+		return &api.CertStatus{Serial: serial, Status: api.CertUnknown}
+	}
+	st := &api.CertStatus{
+		Serial:    serial,
+		Status:    api.CertGood,
+		Secret:    c.Secret,
+		Version:   c.Version,
+		NotAfter:  c.NotAfter,
+		RevokedAt: c.RevokedAt,
+	}
+	if c.RevokedAt != nil {
+		st.Status = api.CertRevoked
+	} else if now.After(c.NotAfter) {
+		st.Status = api.CertExpired
+	}
+	return st
+}
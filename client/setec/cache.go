@@ -55,7 +55,9 @@ func (m *MemCache) Read() ([]byte, error) { return m.data, nil }
 func (m *MemCache) String() string { return string(m.data) }
 
 // FileCache is an implementation of the Cache interface that stores a value in
-// a file at the specified path.
+// a file at the specified path. The file is not encrypted, so secrets in the
+// cache are readable by anyone who can read the file; see EncryptedFileCache
+// for an alternative.
 type FileCache string
 
 // NewFileCache constructs a new file cache associated with the specified path.
@@ -57,42 +57,120 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/leger-labs/leger/telemetry"
 	"github.com/leger-labs/leger/types/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Client is a raw client to the secret management server.
 // If you're just consuming secrets, you probably want to use a Store
 // instead.
+//
+// If the server reports that the caller is being rate limited, the Client
+// waits as directed by the server and retries the request a few times before
+// reporting [api.ErrRateLimited].
+//
+// Calls that only read secrets may also be sent to replica servers, if the
+// primary server is unavailable, and retried as described by [RetryPolicy].
+// Calls that modify secrets are only sent to the primary server, and are not
+// retried.
 type Client struct {
 	// Server is the URL of the secrets server to talk to.
 	Server string
+	// Replicas are the URLs of additional servers that can serve reads, to
+	// try in order if Server is unavailable.
+	Replicas []string
 	// DoHTTP is the function to use to make HTTP requests. If nil,
 	// http.DefaultClient.Do is used.
 	DoHTTP func(*http.Request) (*http.Response, error)
+	// Retry, if non-nil, is the policy for retrying reads when servers are
+	// unavailable. If nil, each server is tried once.
+	Retry *RetryPolicy
 }
 
-func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RESP, error) {
+// maxRateLimitRetries is the number of times a request rejected by the server
+// with 429 Too Many Requests is retried before the client gives up.
+const maxRateLimitRetries = 3
+
+// maxRateLimitWait is the longest the client will wait before retrying a
+// request that was rate limited. If the server asks the client to wait longer
+// than this, for example because the caller is locked out, the client reports
+// api.ErrRateLimited without retrying.
+const maxRateLimitWait = 30 * time.Second
+
+func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (_ RESP, err error) {
 	var resp RESP
 
+	ctx, span := telemetry.Tracer().Start(ctx, "setec.Client "+path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("rpc.method", path)),
+	)
+	defer func() { telemetry.End(span, err) }()
+
 	bs, err := json.Marshal(req)
 	if err != nil {
 		return resp, fmt.Errorf("marshaling request: %w", err)
 	}
+	if !idempotentPaths[path] {
+		return doServer[RESP](ctx, c, c.Server, path, bs)
+	}
+	return withRetry(ctx, c, func(server string) (RESP, error) {
+		return doServer[RESP](ctx, c, server, path, bs)
+	})
+}
+
+// doServer makes an API call to the given server, retrying if the server
+// reports that the caller is rate limited.
+func doServer[RESP any](ctx context.Context, c Client, server, path string, bs []byte) (RESP, error) {
+	url := fmt.Sprintf("%s/%s", strings.TrimSuffix(server, "/"), strings.TrimPrefix(path, "/"))
+
+	// If the server reports that we are being rate limited, back off and
+	// retry, honoring the server's Retry-After hint if one was given.
+	wait := time.Second
+	for try := 0; ; try++ {
+		resp, retryAfter, err := doOnce[RESP](ctx, c, url, bs)
+		if !errors.Is(err, api.ErrRateLimited) || try == maxRateLimitRetries {
+			return resp, err
+		}
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if wait > maxRateLimitWait {
+			return resp, err
+		}
+		select {
+		case <-ctx.Done():
+			return resp, err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
 
-	url := fmt.Sprintf("%s/%s", strings.TrimSuffix(c.Server, "/"), strings.TrimPrefix(path, "/"))
+// doOnce makes a single API call to url with the given request body. If the
+// server reports the request was rate limited, doOnce returns an error
+// wrapping api.ErrRateLimited, along with the retry delay requested by the
+// server (or 0 if none was given).
+func doOnce[RESP any](ctx context.Context, c Client, url string, body []byte) (RESP, time.Duration, error) {
+	var resp RESP
 
-	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bs))
+	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		return resp, fmt.Errorf("constructing HTTP request: %w", err)
+		return resp, 0, fmt.Errorf("constructing HTTP request: %w", err)
 	}
 	r.Header.Set("Content-Type", "application/json")
 	// See the comment in server/server.go for what this does.
 	r.Header.Set("Sec-X-Tailscale-No-Browsers", "setec")
+	telemetry.Inject(ctx, r.Header)
 
 	do := c.DoHTTP
 	if do == nil {
@@ -100,36 +178,46 @@ func do[RESP, REQ any](ctx context.Context, c Client, path string, req REQ) (RES
 	}
 	httpResp, err := do(r)
 	if err != nil {
-		return resp, fmt.Errorf("making HTTP request: %w", err)
+		return resp, 0, &unavailableError{fmt.Errorf("making HTTP request: %w", err)}
 	}
 	defer httpResp.Body.Close()
 
 	if code := httpResp.StatusCode; code != http.StatusOK {
 		errBs, err := io.ReadAll(httpResp.Body)
 		if err != nil {
-			return resp, fmt.Errorf("reading error response body (HTTP status %d): %w", code, err)
+			return resp, 0, fmt.Errorf("reading error response body (HTTP status %d): %w", code, err)
 		}
 		switch code {
 		case http.StatusNotFound:
-			return resp, api.ErrNotFound
+			return resp, 0, api.ErrNotFound
 		case http.StatusForbidden:
-			return resp, api.ErrAccessDenied
+			return resp, 0, api.ErrAccessDenied
 		case http.StatusNotModified:
-			return resp, api.ErrValueNotChanged
+			return resp, 0, api.ErrValueNotChanged
+		case http.StatusTooManyRequests:
+			var retryAfter time.Duration
+			if secs, err := strconv.Atoi(httpResp.Header.Get("Retry-After")); err == nil && secs > 0 {
+				retryAfter = time.Duration(secs) * time.Second
+			}
+			return resp, retryAfter, fmt.Errorf("%w: %s", api.ErrRateLimited, bytes.TrimSpace(errBs))
 		}
-		return resp, fmt.Errorf("request returned status %d: %q", code, string(bytes.TrimSpace(errBs)))
+		err = fmt.Errorf("request returned status %d: %q", code, string(bytes.TrimSpace(errBs)))
+		if code >= 500 {
+			return resp, 0, &unavailableError{err}
+		}
+		return resp, 0, err
 	}
 
-	bs, err = io.ReadAll(httpResp.Body)
+	bs, err := io.ReadAll(httpResp.Body)
 	if err != nil {
-		return resp, err
+		return resp, 0, err
 	}
 
 	if err := json.Unmarshal(bs, &resp); err != nil {
-		return resp, fmt.Errorf("unmarshaling response: %w", err)
+		return resp, 0, fmt.Errorf("unmarshaling response: %w", err)
 	}
 
-	return resp, nil
+	return resp, 0, nil
 }
 
 // List fetches a list of secret names and associated metadata for all those
@@ -145,8 +233,9 @@ func (c Client) List(ctx context.Context) ([]*api.SecretInfo, error) {
 // Access requirement: "get"
 func (c Client) Get(ctx context.Context, name string) (*api.SecretValue, error) {
 	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
-		Name:    name,
-		Version: api.SecretVersionDefault,
+		Name:      name,
+		Version:   api.SecretVersionDefault,
+		RequestID: newRequestID(),
 	})
 }
 
@@ -165,6 +254,7 @@ func (c Client) GetIfChanged(ctx context.Context, name string, oldVersion api.Se
 		Name:            name,
 		Version:         oldVersion,
 		UpdateIfChanged: true,
+		RequestID:       newRequestID(),
 	})
 }
 
@@ -174,8 +264,9 @@ func (c Client) GetIfChanged(ctx context.Context, name string, oldVersion api.Se
 // Access requirement: "get"
 func (c Client) GetVersion(ctx context.Context, name string, version api.SecretVersion) (*api.SecretValue, error) {
 	return do[*api.SecretValue](ctx, c, "/api/get", api.GetRequest{
-		Name:    name,
-		Version: version,
+		Name:      name,
+		Version:   version,
+		RequestID: newRequestID(),
 	})
 }
 
@@ -236,3 +327,74 @@ func (c Client) Delete(ctx context.Context, name string) error {
 	})
 	return err
 }
+
+// RenewLease extends the lease with the given ID on a dynamic secret, to ttl
+// from now. If ttl is zero, the server uses the default TTL of the secret.
+// The server may grant a shorter TTL than requested; the returned LeaseInfo
+// reports the new expiration.
+//
+// Access requirement: "get", and the caller must hold the lease
+func (c Client) RenewLease(ctx context.Context, leaseID string, ttl time.Duration) (*api.LeaseInfo, error) {
+	return do[*api.LeaseInfo](ctx, c, "/api/lease/renew", api.RenewLeaseRequest{
+		LeaseID: leaseID,
+		TTL:     ttl,
+	})
+}
+
+// RevokeLease revokes the lease with the given ID on a dynamic secret, so
+// that its credential is no longer valid.
+//
+// Access requirement: "get" if the caller holds the lease, otherwise "delete"
+func (c Client) RevokeLease(ctx context.Context, leaseID string) error {
+	_, err := do[struct{}](ctx, c, "/api/lease/revoke", api.RevokeLeaseRequest{
+		LeaseID: leaseID,
+	})
+	return err
+}
+
+// IssueCert issues a new certificate for the named certificate secret, and
+// stores it as a new active version of the secret. It returns the new
+// version. The server issues and renews certificates on its own schedule;
+// IssueCert is for when a new certificate is needed immediately, such as
+// after changing the secret's configuration.
+//
+// Access requirement: "put" and "activate"
+func (c Client) IssueCert(ctx context.Context, name string) (api.SecretVersion, error) {
+	return do[api.SecretVersion](ctx, c, "/api/cert/issue", api.IssueCertRequest{
+		Name: name,
+	})
+}
+
+// CertStatus reports the revocation status of a certificate issued by the
+// server, identified as described by [api.CertStatusRequest].
+//
+// Access requirement: "info" to identify the certificate by secret name,
+// otherwise none
+func (c Client) CertStatus(ctx context.Context, req api.CertStatusRequest) (*api.CertStatus, error) {
+	return do[*api.CertStatus](ctx, c, "/api/cert/status", req)
+}
+
+// RevokeCert revokes the certificate stored in the specified version of a
+// certificate secret. If that version is active, the server issues a
+// replacement.
+//
+// Access requirement: "delete"
+func (c Client) RevokeCert(ctx context.Context, name string, version api.SecretVersion) error {
+	_, err := do[struct{}](ctx, c, "/api/cert/revoke", api.RevokeCertRequest{
+		Name:    name,
+		Version: version,
+	})
+	return err
+}
+
+// WebhookDeadLetters returns the record of webhook events that the server
+// could not deliver. If name is non-empty, only the events for the webhook
+// subscription called name are reported; otherwise the events for all the
+// subscriptions visible to the caller are.
+//
+// Access requirement: "info" on the subscription "_internal/webhook/<name>"
+func (c Client) WebhookDeadLetters(ctx context.Context, name string) ([]*api.WebhookDeadLetter, error) {
+	return do[[]*api.WebhookDeadLetter](ctx, c, "/api/webhook/dead-letters", api.WebhookDeadLettersRequest{
+		Name: name,
+	})
+}
@@ -5,14 +5,23 @@ package setec_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/leger-labs/leger/client/setec"
+	"github.com/leger-labs/leger/setectest"
 	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/types/logger"
 )
 
 const testSecrets = `{
@@ -107,3 +116,269 @@ func TestFileStore(t *testing.T) {
 		}
 	})
 }
+
+func TestWatchedFileClients(t *testing.T) {
+	ctx := context.Background()
+
+	// Each case provides a client and a function to set the value of a secret
+	// in its files.
+	dir := t.TempDir()
+	envPath := filepath.Join(t.TempDir(), ".env")
+	envVars := map[string]string{"API_KEY": "alpha", "OTHER": "constant"}
+	writeEnv := func() {
+		var sb strings.Builder
+		sb.WriteString("# test environment\n")
+		for _, k := range slices.Sorted(maps.Keys(envVars)) {
+			fmt.Fprintf(&sb, "export %s=%q\n", k, envVars[k])
+		}
+		if err := os.WriteFile(envPath, []byte(sb.String()), 0600); err != nil {
+			t.Fatalf("Write env file: %v", err)
+		}
+	}
+	writeEnv()
+
+	tests := []struct {
+		name, secret string
+		newClient    func() (*setec.FileClient, error)
+		set          func(value string)
+	}{
+		{"Dir", "app/db/password",
+			func() (*setec.FileClient, error) { return setec.NewDirFileClient(dir) },
+			func(value string) {
+				path := filepath.Join(dir, "app", "db", "password")
+				if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+					t.Fatalf("Create directory: %v", err)
+				}
+				if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+					t.Fatalf("Write secret file: %v", err)
+				}
+			}},
+		{"Env", "API_KEY",
+			func() (*setec.FileClient, error) { return setec.NewEnvFileClient(envPath) },
+			func(value string) { envVars["API_KEY"] = value; writeEnv() }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.set("alpha")
+			fc, err := tc.newClient()
+			if err != nil {
+				t.Fatalf("New client: unexpected error: %v", err)
+			}
+			for _, bad := range []string{"nonesuch", "../escape", "app", "/abs"} {
+				if _, err := fc.Get(ctx, bad); !errors.Is(err, api.ErrNotFound) {
+					t.Errorf("Get %q: got %v, want %v", bad, err, api.ErrNotFound)
+				}
+			}
+
+			st, err := setec.NewStore(ctx, setec.StoreConfig{
+				Client:       fc,
+				Secrets:      []string{tc.secret},
+				PollInterval: -1,
+				Logf:         logger.Discard,
+			})
+			if err != nil {
+				t.Fatalf("NewStore: unexpected error: %v", err)
+			}
+			defer st.Close()
+
+			var changes []string
+			st.OnChange(tc.secret, func(old, new api.SecretValue) {
+				changes = append(changes, fmt.Sprintf("%s@%d -> %s@%d", old.Value, old.Version, new.Value, new.Version))
+			})
+			refresh := func() {
+				t.Helper()
+				if err := st.Refresh(ctx); err != nil {
+					t.Fatalf("Refresh: unexpected error: %v", err)
+				}
+			}
+
+			// Refreshing without a change does not bump the version.
+			refresh()
+			checkSecretValue(t, st, tc.secret, "alpha")
+
+			tc.set("bravo")
+			refresh()
+			checkSecretValue(t, st, tc.secret, "bravo")
+
+			// Restoring an old value is a new version.
+			tc.set("alpha")
+			refresh()
+			checkSecretValue(t, st, tc.secret, "alpha")
+
+			want := []string{"alpha@1 -> bravo@2", "bravo@2 -> alpha@3"}
+			if !slices.Equal(changes, want) {
+				t.Errorf("Changes: got %q, want %q", changes, want)
+			}
+		})
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := setec.NewDirFileClient(envPath); err == nil {
+			t.Error("NewDirFileClient of a file: got nil, want error")
+		}
+		bad := filepath.Join(t.TempDir(), "bad.env")
+		if err := os.WriteFile(bad, []byte("NOT AN ASSIGNMENT\n"), 0600); err != nil {
+			t.Fatalf("Write bad env file: %v", err)
+		}
+		if _, err := setec.NewEnvFileClient(bad); err == nil {
+			t.Error("NewEnvFileClient of an invalid file: got nil, want error")
+		}
+	})
+}
+
+func TestClientRateLimited(t *testing.T) {
+	var calls int
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(&api.SecretValue{Value: []byte("ok"), Version: 1})
+	}))
+	defer hs.Close()
+
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	start := time.Now()
+	sv, err := cli.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	} else if string(sv.Value) != "ok" {
+		t.Errorf("Get: got %q, want ok", sv.Value)
+	}
+	if calls != 2 {
+		t.Errorf("Get: got %d calls, want 2", calls)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Get: retried after %v, want at least 1s", elapsed)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "test", "ok")
+	ts := setectest.NewServer(t, d, nil)
+	primary := setectest.NewFaultServer(t, ts.Mux)
+	replica := setectest.NewFaultServer(t, ts.Mux)
+
+	ctx := context.Background()
+	newClient := func(replicas ...string) setec.Client {
+		return setec.Client{
+			Server:   primary.URL,
+			Replicas: replicas,
+			DoHTTP:   primary.Client().Do,
+			Retry: &setec.RetryPolicy{
+				BaseDelay:        time.Millisecond,
+				BreakerThreshold: 3,
+				BreakerCooldown:  time.Hour,
+			},
+		}
+	}
+	checkRequests := func(fs *setectest.FaultServer, wantTotal, wantFailed int) {
+		t.Helper()
+		if total, failed := fs.Requests(); total != wantTotal || failed != wantFailed {
+			t.Errorf("Requests: got %d (%d failed), want %d (%d failed)", total, failed, wantTotal, wantFailed)
+		}
+	}
+
+	t.Run("Retry", func(t *testing.T) {
+		cli := newClient()
+		primary.FailNext(1, http.StatusServiceUnavailable)
+		if _, err := cli.Get(ctx, "test"); err != nil {
+			t.Fatalf("Get: unexpected error: %v", err)
+		}
+		primary.FailNext(1, 0) // dropped connection
+		if _, err := cli.Info(ctx, "test"); err != nil {
+			t.Fatalf("Info: unexpected error: %v", err)
+		}
+		checkRequests(primary, 4, 2)
+
+		// Errors other than unavailability are not retried.
+		if _, err := cli.Get(ctx, "nonesuch"); !errors.Is(err, api.ErrNotFound) {
+			t.Errorf("Get: got %v, want %v", err, api.ErrNotFound)
+		}
+		checkRequests(primary, 5, 2)
+
+		// Nor are calls that are not idempotent.
+		primary.FailNext(1, http.StatusServiceUnavailable)
+		if _, err := cli.Put(ctx, "test", []byte("new")); err == nil {
+			t.Error("Put: got nil, want error")
+		}
+		checkRequests(primary, 6, 3)
+
+		// Retries are bounded.
+		primary.FailNext(5, http.StatusInternalServerError)
+		if _, err := cli.Get(ctx, "test"); err == nil || !strings.Contains(err.Error(), "status 500") {
+			t.Errorf("Get: got %v, want status 500", err)
+		}
+		checkRequests(primary, 9, 6)
+		primary.FailNext(0, 0)
+	})
+
+	t.Run("Failover", func(t *testing.T) {
+		cli := newClient(replica.URL)
+		primary.SetDown(true)
+		defer primary.SetDown(false)
+		total, failed := primary.Requests()
+
+		for range 5 {
+			sv, err := cli.Get(ctx, "test")
+			if err != nil {
+				t.Fatalf("Get: unexpected error: %v", err)
+			} else if string(sv.Value) != "ok" {
+				t.Errorf("Get: got %q, want ok", sv.Value)
+			}
+		}
+		// After three failures, the breaker for the primary is open and the
+		// client goes directly to the replica.
+		checkRequests(primary, total+3, failed+3)
+		checkRequests(replica, 5, 0)
+
+		// With the replica down too, the breakers open and calls fail fast.
+		replica.SetDown(true)
+		defer replica.SetDown(false)
+		var err error
+		for range 2 {
+			_, err = cli.Get(ctx, "test")
+		}
+		if !errors.Is(err, setec.ErrCircuitOpen) {
+			t.Errorf("Get: got %v, want %v", err, setec.ErrCircuitOpen)
+		}
+	})
+
+	t.Run("Store", func(t *testing.T) {
+		cli := setec.Client{Server: primary.URL, DoHTTP: primary.Client().Do}
+		st, err := setec.NewStore(ctx, setec.StoreConfig{
+			Client:       cli,
+			Secrets:      []string{"test"},
+			Replicas:     []string{replica.URL},
+			Retry:        &setec.RetryPolicy{BaseDelay: time.Millisecond},
+			PollInterval: -1,
+			Logf:         logger.Discard,
+		})
+		if err != nil {
+			t.Fatalf("NewStore: unexpected error: %v", err)
+		}
+		defer st.Close()
+
+		// A restart of the primary does not disturb a refresh.
+		v2 := d.MustPut(d.Superuser, "test", "rotated")
+		d.MustActivate(d.Superuser, "test", v2)
+		primary.FailNext(1, 0)
+		if err := st.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh: unexpected error: %v", err)
+		}
+		checkSecretValue(t, st, "test", "rotated")
+
+		// Nor does the primary being down.
+		primary.SetDown(true)
+		defer primary.SetDown(false)
+		v3 := d.MustPut(d.Superuser, "test", "rotated again")
+		d.MustActivate(d.Superuser, "test", v3)
+		if err := st.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh: unexpected error: %v", err)
+		}
+		checkSecretValue(t, st, "test", "rotated again")
+	})
+}
@@ -0,0 +1,232 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"tailscale.com/atomicfile"
+)
+
+// ErrCacheTampered is reported by an EncryptedFileCache when the cache file
+// exists but cannot be authenticated, because it was corrupted, modified, or
+// encrypted with a different key.
+var ErrCacheTampered = errors.New("cache file failed authentication")
+
+// A KeySource provides the key material for an EncryptedFileCache.
+type KeySource interface {
+	// DeriveKey returns a 32-byte encryption key derived from the source
+	// and the given salt. It must return the same key for the same salt.
+	DeriveKey(salt []byte) ([]byte, error)
+}
+
+// KeyFile returns a KeySource that reads key material from the file at path.
+// The file must contain at least 32 bytes; it may be raw bytes or text, such
+// as the output of "openssl rand -base64 32". The file is read when a cache
+// first derives its key, and the key is kept for the life of the cache; to
+// rotate it, replace the file and restart the program, which then discards
+// the old cache and writes the next one under the new key.
+func KeyFile(path string) KeySource { return keyFile(path) }
+
+type keyFile string
+
+func (k keyFile) DeriveKey(salt []byte) ([]byte, error) {
+	data, err := os.ReadFile(string(k))
+	if err != nil {
+		return nil, fmt.Errorf("reading cache key: %w", err)
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) < 32 {
+		return nil, fmt.Errorf("cache key file %q is too short (%d bytes, want at least 32)", k, len(data))
+	}
+	return hkdf.Key(sha256.New, data, salt, "setec cache key", 32)
+}
+
+// SystemdCredential returns a KeySource that reads key material from the
+// systemd service credential with the given name, as provided by the
+// LoadCredential= or LoadCredentialEncrypted= unit settings. The credential
+// has the same format as a KeyFile.
+func SystemdCredential(name string) KeySource { return systemdCredential(name) }
+
+type systemdCredential string
+
+func (c systemdCredential) DeriveKey(salt []byte) ([]byte, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return nil, errors.New("no systemd credentials available (CREDENTIALS_DIRECTORY is not set)")
+	}
+	return keyFile(filepath.Join(dir, string(c))).DeriveKey(salt)
+}
+
+// Passphrase returns a KeySource that derives a key from a passphrase, using
+// PBKDF2 with a random salt stored in the cache file.
+func Passphrase(passphrase string) KeySource { return passphraseKey(passphrase) }
+
+type passphraseKey string
+
+// passphraseIterations is the PBKDF2 iteration count for passphrase keys, as
+// recommended by OWASP for PBKDF2-HMAC-SHA256.
+const passphraseIterations = 600_000
+
+func (p passphraseKey) DeriveKey(salt []byte) ([]byte, error) {
+	if p == "" {
+		return nil, errors.New("empty cache passphrase")
+	}
+	return pbkdf2.Key(sha256.New, string(p), salt, passphraseIterations, 32)
+}
+
+// EncryptedFileCache is an implementation of the Cache interface that stores
+// a value in a file at the specified path, sealed with AES-256-GCM under a key
+// provided by a KeySource.
+//
+// Unlike a FileCache, the contents of the file are not readable without the
+// key, and any modification of the file is detected: if the file cannot be
+// authenticated, Read reports an error wrapping ErrCacheTampered rather than
+// returning its contents, so that a Store does not use them.
+//
+// On disk, the cache is a JSON object:
+//
+//	{
+//	   "Version": 1,
+//	   "Salt": "<key-derivation-salt-base64>",
+//	   "Data": "<nonce-and-ciphertext-base64>"
+//	}
+type EncryptedFileCache struct {
+	path string
+	src  KeySource
+
+	mu   sync.Mutex
+	salt []byte // the salt in use, or nil if not yet chosen
+	aead cipher.AEAD
+}
+
+// encryptedCacheVersion is the (currently) only supported version of the
+// encrypted cache format.
+const encryptedCacheVersion = 1
+
+// encryptedCacheAD is the additional data authenticated with the cache.
+var encryptedCacheAD = []byte("setec cache v1")
+
+type encryptedCacheFile struct {
+	Version int
+	Salt    []byte
+	Data    []byte
+}
+
+// NewEncryptedFileCache constructs a new encrypted file cache associated with
+// the specified path, using keys from src. As with NewFileCache, the cache
+// file is not created, but an error is reported if the enclosing directory
+// cannot be created, or if the path exists but is not a plain file.
+func NewEncryptedFileCache(path string, src KeySource) (*EncryptedFileCache, error) {
+	if src == nil {
+		return nil, errors.New("no key source provided")
+	}
+	if _, err := NewFileCache(path); err != nil {
+		return nil, err
+	}
+	return &EncryptedFileCache{path: path, src: src}, nil
+}
+
+// cipherLocked returns the AEAD for the given salt, deriving a new key if
+// the salt differs from the one in use. The caller must hold c.mu.
+func (c *EncryptedFileCache) cipherLocked(salt []byte) (cipher.AEAD, error) {
+	if c.aead != nil && bytes.Equal(salt, c.salt) {
+		return c.aead, nil
+	}
+	key, err := c.src.DeriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.salt, c.aead = salt, aead
+	return aead, nil
+}
+
+// Write implements part of the Cache interface. The file is replaced
+// atomically, so a crash during a write leaves either the old or the new
+// contents.
+func (c *EncryptedFileCache) Write(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	salt := c.salt
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	}
+	aead, err := c.cipherLocked(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out, err := json.Marshal(encryptedCacheFile{
+		Version: encryptedCacheVersion,
+		Salt:    salt,
+		Data:    aead.Seal(nonce, nonce, data, encryptedCacheAD),
+	})
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(c.path, out, 0600)
+}
+
+// Read implements part of the Cache interface. If the cache file does not
+// exist, Read returns nil without error.
+func (c *EncryptedFileCache) Read() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	raw, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f encryptedCacheFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCacheTampered, err)
+	} else if f.Version != encryptedCacheVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCacheTampered, f.Version)
+	} else if len(f.Salt) == 0 {
+		return nil, fmt.Errorf("%w: missing salt", ErrCacheTampered)
+	}
+	aead, err := c.cipherLocked(f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Data) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated data", ErrCacheTampered)
+	}
+	nonce, sealed := f.Data[:aead.NonceSize()], f.Data[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, sealed, encryptedCacheAD)
+	if err != nil {
+		return nil, ErrCacheTampered
+	}
+	return data, nil
+}
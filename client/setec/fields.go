@@ -4,15 +4,27 @@
 package setec
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"path"
 	"reflect"
-	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leger-labs/leger/types/api"
 )
 
 // ErrNoFields is a sentinel error reported by ParseFields when its argument is
@@ -34,13 +46,13 @@ func ParseFields(v any, namePrefix string) (*Fields, error) {
 	if len(fi) == 0 {
 		return nil, fmt.Errorf("type %v: %w", reflect.TypeOf(v).Elem(), ErrNoFields)
 	}
-	return &Fields{prefix: namePrefix, fields: fi}, nil
+	return &Fields{prefix: namePrefix, value: reflect.ValueOf(v), fields: fi}, nil
 }
 
 // Fields is a helper for plumbing secrets to the fields of struct values.  The
 // [ParseFields] function recognizes fields of a struct with a tag like:
 //
-//	setec:"base-secret-name[,json]"
+//	setec:"base-secret-name[,json][,env=VAR][,file=PATH][,default=VALUE]"
 //
 // The resulting Fields value fetches the secrets identified by these tags from
 // a setec.Store, and injects their values into the fields.
@@ -86,6 +98,21 @@ func ParseFields(v any, namePrefix string) (*Fields, error) {
 //
 //   - A field of type [setec.Secret] is populated with a handle to the secret.
 //
+//   - A field of type [time.Duration] is parsed with [time.ParseDuration].
+//
+//   - A field of boolean, signed, or unsigned integer type is parsed with the
+//     corresponding function of the strconv package. Integers may have a base
+//     prefix, such as "0x".
+//
+//   - A field of type [tls.Certificate] is parsed from a PEM certificate chain
+//     and private key, in either order, combined in a single secret.
+//
+//   - A field of type *[x509.CertPool] receives a pool of the PEM certificates
+//     in the secret.
+//
+//   - A field of type [ed25519.PrivateKey] is parsed from a PEM PKCS #8 block,
+//     or from the raw bytes of a 32-byte seed or 64-byte private key.
+//
 //   - A field whose (pointer) type implements the [encoding.BinaryUnmarshaler]
 //     interface has its UnmarshalBinary method called with the secret value.
 //     This may be used to handle structured data, or to add validation.
@@ -108,10 +135,35 @@ func ParseFields(v any, namePrefix string) (*Fields, error) {
 //	{"iv":"aGVsbG8sIHdvcmxk","data":"c3VwZXIgc2VjcmV0IHNxdWlycmVsIHN0dWZm"}
 //
 // The ParseFields function will report an error for a tagged field whose type
-// does not fit within these constraints.
+// does not fit within these constraints. Surrounding whitespace is ignored
+// when parsing durations, booleans, and integers.
+//
+// # Fallbacks
+//
+// A tag may specify fallback sources for a secret that is not available from
+// the store, so the same struct can be used in development without access to
+// the secrets service:
+//
+//	DBPassword string        `setec:"db-password,env=DB_PASSWORD,file=/run/secrets/db"`
+//	Timeout    time.Duration `setec:"timeout,default=30s"`
+//
+// If the secret does not exist, or the store does not have it and does not
+// allow lookups, the value is taken from the named environment variable, if it
+// is set; otherwise from the contents of the named file, if it exists;
+// otherwise from the default value. Other errors, such as denied access, are
+// reported rather than masked by a fallback. A default value may be
+// empty, but may not contain a comma. A secret used only by fields that have
+// fallbacks is optional: a Store created with the struct does not wait for it
+// if the service reports it does not exist.
+//
+// # Updates
+//
+// Apply populates the fields once, with the current secret values. To keep a
+// struct up to date as secrets are rotated, use [Fields.Watch].
 type Fields struct {
-	prefix string      // empty means "no prefix"
-	fields []fieldInfo // fields needing populated
+	prefix string        // empty means "no prefix"
+	value  reflect.Value // pointer to the struct
+	fields []fieldInfo   // fields needing populated
 }
 
 // Secrets returns the full prefix-expanded names of the secrets needed by
@@ -124,6 +176,21 @@ func (f *Fields) Secrets() []string {
 	return out
 }
 
+// secretsByNeed partitions the full names of the secrets needed by f into
+// those required by some field, and those used only by fields that have a
+// fallback value.
+func (f *Fields) secretsByNeed() (required, optional []string) {
+	for _, fi := range f.fields {
+		name := path.Join(f.prefix, fi.secretName)
+		if fi.hasFallback() {
+			optional = append(optional, name)
+		} else {
+			required = append(required, name)
+		}
+	}
+	return required, optional
+}
+
 // Apply fetches and applies the secret values required by f to the
 // corresponding fields of the input struct. Each secret must either be known
 // to s at initialization, or s must be configured to allow lookups.
@@ -131,7 +198,10 @@ func (f *Fields) Secrets() []string {
 //
 // Note: When applying secrets to struct fields from an existing Store, the
 // AllowLookup option of the Store must be enabled, or else Apply will report
-// an error for any field that refers to a secret not already available.
+// an error for any field that refers to a secret not already available and
+// without a fallback.
+//
+// If s == nil, Apply uses only the fallback values of the fields.
 func (f *Fields) Apply(ctx context.Context, s *Store) error {
 	var errs []error
 	for _, fi := range f.fields {
@@ -143,57 +213,295 @@ func (f *Fields) Apply(ctx context.Context, s *Store) error {
 	return errors.Join(errs...)
 }
 
+// Watch applies the secret values required by f to the struct, as Apply does,
+// and then keeps them up to date: whenever any of the tagged secrets changes
+// in s, Watch populates a fresh copy of the struct with the current values and
+// publishes it atomically. Use the Load method of the returned StructWatcher
+// to obtain the latest copy; readers never observe a partially-updated struct.
+//
+// Each copy begins as a shallow copy of the original struct value, with its
+// tagged fields reset before the secrets are applied, so untagged fields carry
+// over unchanged. If populating a copy fails, the previous copy remains
+// current and the error is reported by the Err method.
+//
+// As with Apply, each secret must be known to s, or s must allow lookups.
+// Call Stop on the watcher to stop tracking updates.
+func (f *Fields) Watch(ctx context.Context, s *Store) (*StructWatcher, error) {
+	if err := f.Apply(ctx, s); err != nil {
+		return nil, err
+	}
+	w := &StructWatcher{
+		f:     f,
+		s:     s,
+		ready: make(chan struct{}, 1),
+	}
+	w.cur.Store(f.value.Interface())
+	for _, name := range f.Secrets() {
+		w.stop = append(w.stop, s.OnChange(name, w.onChange))
+	}
+	return w, nil
+}
+
+// A StructWatcher maintains an up-to-date copy of a struct whose fields are
+// populated from secrets. See [Fields.Watch].
+type StructWatcher struct {
+	f     *Fields
+	s     *Store
+	ready chan struct{}
+	stop  []func()
+
+	mu  sync.Mutex // serializes rebuilds
+	cur atomic.Value
+	err atomic.Pointer[error]
+}
+
+// Load returns a pointer to the current copy of the struct, of the same type
+// as the value passed to ParseFields. The caller must not modify the struct.
+//
+// For example:
+//
+//	cfg := w.Load().(*Config)
+func (w *StructWatcher) Load() any { return w.cur.Load() }
+
+// Ready returns a channel that delivers a value when a new copy of the struct
+// has been published. Like the Ready channel of a watcher, it is a level
+// trigger and is never closed.
+func (w *StructWatcher) Ready() <-chan struct{} { return w.ready }
+
+// Err reports the error, if any, from the latest attempt to update the struct.
+func (w *StructWatcher) Err() error {
+	if p := w.err.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Stop stops tracking updates. The current copy remains available from Load.
+func (w *StructWatcher) Stop() {
+	for _, stop := range w.stop {
+		stop()
+	}
+}
+
+func (w *StructWatcher) onChange(_, _ api.SecretValue) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.rebuild()
+	if err != nil {
+		w.s.logf("WARNING: error updating struct fields: %v (keeping old value)", err)
+	} else {
+		select {
+		case w.ready <- struct{}{}:
+		default:
+		}
+	}
+	w.err.Store(&err)
+}
+
+// rebuild populates a new copy of the struct and publishes it.
+func (w *StructWatcher) rebuild() error {
+	cur := reflect.ValueOf(w.cur.Load())
+	next := reflect.New(cur.Type().Elem())
+	next.Elem().Set(cur.Elem())
+
+	// Reset the tagged fields, so that pointers, maps, and slices are not
+	// shared with (and updated in place in) the copy readers may be using.
+	for _, fi := range w.f.fields {
+		next.Elem().FieldByIndex(fi.index).SetZero()
+	}
+	nf, err := parseFields(next.Interface())
+	if err != nil {
+		return err
+	}
+	if err := (&Fields{prefix: w.f.prefix, value: next, fields: nf}).Apply(context.Background(), w.s); err != nil {
+		return err
+	}
+	w.cur.Store(next.Interface())
+	return nil
+}
+
 // fieldInfo records information about a tagged field.
 type fieldInfo struct {
 	fieldName  string             // name in the type (for diagnostics)
+	index      []int              // index sequence of the field in the struct
 	secretName string             // name in the field tag (without prefix)
 	value      reflect.Value      // pointer to field
 	unmarshal  func([]byte) error // if non-nil, call to unmarshal the value
 	isJSON     bool               // if true, secret must be JSON encoded
 	vtype      reflect.Type       // type of field pointed to by value
+
+	env        string // if non-empty, environment variable fallback
+	file       string // if non-empty, file path fallback
+	defValue   string // the default value, if hasDefault
+	hasDefault bool   // whether a default value was given
 }
 
+// hasFallback reports whether f has any fallback for its secret value.
+func (f fieldInfo) hasFallback() bool { return f.env != "" || f.file != "" || f.hasDefault }
+
 // apply sets the target of fi.value to the secret named. It reports an error
-// if the requested secret could not be fetched from the store.
+// if the requested secret could not be fetched from the store, and no
+// fallback value is available for it.
 //
 // If f.isJSON is true, the data are unmarshaled as JSON.
 // Otherwise, the data are converted to the target type and copied.
 func (f fieldInfo) apply(ctx context.Context, s *Store, fullName string) error {
-	if f.isJSON {
-		v, err := s.LookupSecret(ctx, fullName)
-		if err != nil {
-			return err
-		}
-		return json.Unmarshal(v.Get(), f.value.Interface())
-	}
-
-	v, err := s.LookupSecret(ctx, fullName)
+	v, err := f.lookup(ctx, s, fullName)
 	if err != nil {
 		return err
 	}
+	if f.isJSON {
+		return json.Unmarshal(v.Get(), f.value.Interface())
+	}
 	if f.unmarshal != nil {
 		return f.unmarshal(v.Get())
 	}
 	switch f.vtype {
-	case bytesType:
-		f.value.Elem().Set(reflect.ValueOf(v.Get()))
-	case stringType:
-		f.value.Elem().Set(reflect.ValueOf(string(v.Get())))
 	case secretType:
 		f.value.Elem().Set(reflect.ValueOf(v))
+		return nil
+	case bytesType:
+		f.value.Elem().Set(reflect.ValueOf(v.Get()))
+		return nil
+	}
+	if conv, ok := fieldConverters[f.vtype]; ok {
+		val, err := conv(v.Get())
+		if err != nil {
+			return err
+		}
+		f.value.Elem().Set(reflect.ValueOf(val))
+		return nil
+	}
+
+	// The remaining types are converted from text. Secrets are often stored
+	// in files with a trailing newline, so ignore surrounding whitespace.
+	text := strings.TrimSpace(string(v.Get()))
+	switch f.vtype.Kind() {
+	case reflect.String:
+		f.value.Elem().SetString(string(v.Get()))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		f.value.Elem().SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 0, f.vtype.Bits())
+		if err != nil {
+			return err
+		}
+		f.value.Elem().SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(text, 0, f.vtype.Bits())
+		if err != nil {
+			return err
+		}
+		f.value.Elem().SetUint(n)
 	default:
 		return fmt.Errorf("unexpected field type %v", f.vtype)
 	}
 	return nil
 }
 
+// lookup returns the value for the secret named, from s if it is available
+// there, or otherwise from the first fallback of f that has a value.
+// If s == nil, only the fallbacks are consulted. The fallbacks are only used
+// if the secret does not exist, or s does not have it and may not look it
+// up; other errors, such as denied access or an unavailable server, are
+// reported.
+func (f fieldInfo) lookup(ctx context.Context, s *Store, fullName string) (Secret, error) {
+	var err error
+	if s != nil {
+		var v Secret
+		v, err = s.LookupSecret(ctx, fullName)
+		if err == nil {
+			return v, nil
+		} else if !f.hasFallback() || !(errors.Is(err, api.ErrNotFound) || errors.Is(err, errLookupDisabled)) {
+			return nil, err
+		}
+	}
+	if f.env != "" {
+		if ev, ok := os.LookupEnv(f.env); ok {
+			return StaticSecret(ev), nil
+		}
+	}
+	if f.file != "" {
+		v, ferr := StaticFile(f.file)
+		if ferr == nil {
+			return v, nil
+		} else if !errors.Is(ferr, fs.ErrNotExist) {
+			return nil, ferr
+		}
+	}
+	if f.hasDefault {
+		return StaticSecret(f.defValue), nil
+	}
+	if err == nil {
+		err = errors.New("no value available")
+	}
+	return nil, err
+}
+
 var (
 	bytesType  = reflect.TypeOf([]byte(nil))
 	secretType = reflect.TypeOf(Secret(nil))
-	stringType = reflect.TypeOf(string(""))
 	binaryType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
 )
 
+// fieldConverters are functions to construct values of specific field types
+// from the bytes of a secret. Other supported types are handled by kind.
+var fieldConverters = map[reflect.Type]func([]byte) (any, error){
+	reflect.TypeOf(time.Duration(0)): func(data []byte) (any, error) {
+		return time.ParseDuration(strings.TrimSpace(string(data)))
+	},
+	reflect.TypeOf(tls.Certificate{}): func(data []byte) (any, error) {
+		return tls.X509KeyPair(data, data)
+	},
+	reflect.TypeOf((*x509.CertPool)(nil)): func(data []byte) (any, error) {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no PEM certificates found")
+		}
+		return pool, nil
+	},
+	reflect.TypeOf(ed25519.PrivateKey(nil)): parseEd25519Key,
+}
+
+// parseEd25519Key parses an Ed25519 private key from a PEM-encoded PKCS #8
+// block, or from the raw bytes of a 32-byte seed or a 64-byte private key.
+func parseEd25519Key(data []byte) (any, error) {
+	if blk, _ := pem.Decode(data); blk != nil {
+		key, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ek, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is %T, not Ed25519", key)
+		}
+		return ek, nil
+	}
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(bytes.Clone(data)), nil
+	}
+	return nil, fmt.Errorf("invalid Ed25519 private key (%d bytes)", len(data))
+}
+
+// isTextKind reports whether t is a type converted from the text of a secret.
+func isTextKind(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
 // parseFields constructs a field list for obj, which must be a pointer to a
 // struct. The result contains one entry for each field of *obj having a
 // "setec" struct tag, giving the base name of the secret to use for that
@@ -217,21 +525,35 @@ func parseFields(obj any) ([]fieldInfo, error) {
 		}
 		fi := fieldInfo{
 			fieldName:  ft.Name,
+			index:      ft.Index,
 			secretName: parts[0],
 			value:      v.Elem().FieldByIndex(ft.Index).Addr(),
-			isJSON:     slices.Contains(parts[1:], "json"),
 			vtype:      ft.Type,
 		}
+		for _, opt := range parts[1:] {
+			key, val, ok := strings.Cut(opt, "=")
+			switch {
+			case !ok && opt == "json":
+				fi.isJSON = true
+			case !ok:
+				// Ignore unknown verbs, for compatibility.
+			case key == "env" && val != "":
+				fi.env = val
+			case key == "file" && val != "":
+				fi.file = val
+			case key == "default":
+				fi.defValue, fi.hasDefault = val, true
+			default:
+				return nil, fmt.Errorf("invalid option %q for tagged field %q", opt, ft.Name)
+			}
+		}
 		if !fi.isJSON {
-			if u := checkUnmarshal(fi.value); u != nil {
+			if _, ok := fieldConverters[ft.Type]; ok {
+				// OK, this type has a converter.
+			} else if u := checkUnmarshal(fi.value); u != nil {
 				fi.unmarshal = u
-			} else {
-				switch ft.Type {
-				case bytesType, stringType, secretType:
-					// OK, these types are supported.
-				default:
-					return nil, fmt.Errorf("unsupported type %v for tagged field %q", ft.Type, ft.Name)
-				}
+			} else if ft.Type != bytesType && ft.Type != secretType && !isTextKind(ft.Type) {
+				return nil, fmt.Errorf("unsupported type %v for tagged field %q", ft.Type, ft.Name)
 			}
 		}
 		out = append(out, fi)
@@ -6,15 +6,26 @@ package setec_test
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/leger-labs/leger/ca"
 	"github.com/leger-labs/leger/client/setec"
 	"github.com/leger-labs/leger/setectest"
+	"github.com/leger-labs/leger/types/api"
 	"tailscale.com/types/logger"
 )
 
@@ -127,6 +138,395 @@ func TestFields(t *testing.T) {
 	}
 }
 
+func TestFieldTypes(t *testing.T) {
+	caPEM, err := ca.NewAuthority("test", time.Hour, ca.ECDSAP256)
+	if err != nil {
+		t.Fatalf("NewAuthority: %v", err)
+	}
+	auth, err := ca.ParseAuthority(caPEM)
+	if err != nil {
+		t.Fatalf("ParseAuthority: %v", err)
+	}
+	leaf, _, err := auth.Issue(&ca.CertConfig{CommonName: "web"}, time.Now())
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+
+	secrets := map[string]string{
+		"timeout":  "1m30s\n",
+		"port":     "8080",
+		"mask":     "0xff",
+		"verbose":  "true",
+		"endpoint": "https://example.com/api",
+		"tls":      string(leaf),
+		"roots":    string(auth.CertPEM()),
+		"pem-key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+		"seed-key": string(edKey.Seed()),
+	}
+	db := setectest.NewDB(t, nil)
+	for name, val := range secrets {
+		db.MustPut(db.Superuser, "test/"+name, val)
+	}
+	ss := setectest.NewServer(t, db, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	type port uint16
+	var obj struct {
+		Timeout  time.Duration      `setec:"timeout"`
+		Port     port               `setec:"port"`
+		Mask     int32              `setec:"mask"`
+		Verbose  bool               `setec:"verbose"`
+		Endpoint *url.URL           `setec:"endpoint"`
+		TLS      tls.Certificate    `setec:"tls"`
+		Roots    *x509.CertPool     `setec:"roots"`
+		PEMKey   ed25519.PrivateKey `setec:"pem-key"`
+		SeedKey  ed25519.PrivateKey `setec:"seed-key"`
+	}
+	st, err := setec.NewStore(context.Background(), setec.StoreConfig{
+		Client:  setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do},
+		Structs: []setec.Struct{{Value: &obj, Prefix: "test"}},
+		Logf:    logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	defer st.Close()
+
+	if obj.Timeout != 90*time.Second {
+		t.Errorf("Timeout: got %v, want %v", obj.Timeout, 90*time.Second)
+	}
+	if obj.Port != 8080 {
+		t.Errorf("Port: got %v, want 8080", obj.Port)
+	}
+	if obj.Mask != 255 {
+		t.Errorf("Mask: got %v, want 255", obj.Mask)
+	}
+	if !obj.Verbose {
+		t.Error("Verbose: got false, want true")
+	}
+	if got := obj.Endpoint.String(); got != secrets["endpoint"] {
+		t.Errorf("Endpoint: got %q, want %q", got, secrets["endpoint"])
+	}
+	if obj.TLS.Leaf == nil || obj.TLS.Leaf.Subject.CommonName != "web" {
+		t.Errorf("TLS: got leaf %v, want CN web", obj.TLS.Leaf)
+	}
+	if _, err := obj.TLS.Leaf.Verify(x509.VerifyOptions{Roots: obj.Roots}); err != nil {
+		t.Errorf("Verify with Roots: unexpected error: %v", err)
+	}
+	if !obj.PEMKey.Equal(edKey) {
+		t.Error("PEMKey does not match")
+	}
+	if !obj.SeedKey.Equal(edKey) {
+		t.Error("SeedKey does not match")
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		db.MustPut(db.Superuser, "bad/port", "99999")
+		db.MustPut(db.Superuser, "bad/roots", "not a certificate")
+		var bad struct {
+			Port  port           `setec:"port"`
+			Roots *x509.CertPool `setec:"roots"`
+		}
+		f, err := setec.ParseFields(&bad, "bad")
+		if err != nil {
+			t.Fatalf("ParseFields: unexpected error: %v", err)
+		}
+		st, err := setec.NewStore(context.Background(), setec.StoreConfig{
+			Client:  setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do},
+			Secrets: f.Secrets(),
+			Logf:    logger.Discard,
+		})
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+		defer st.Close()
+		err = f.Apply(context.Background(), st)
+		for _, want := range []string{`"Port"`, `"Roots"`} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("Apply: got %v, want error for %s", err, want)
+			}
+		}
+	})
+}
+
+func TestFieldFallbacks(t *testing.T) {
+	t.Setenv("TEST_DB_PASSWORD", "from-env")
+
+	type testTarget struct {
+		Password string        `setec:"db-password,env=TEST_DB_PASSWORD,file=testdata/api-key"`
+		APIKey   []byte        `setec:"api-key,env=TEST_UNSET_VARIABLE,file=testdata/api-key"`
+		Timeout  time.Duration `setec:"timeout,default=30s"`
+		Token    setec.Secret  `setec:"token,env=TEST_UNSET_VARIABLE,default="`
+		Name     string        `setec:"name,default=fallback"`
+	}
+	want := testTarget{
+		Password: "from-env",
+		APIKey:   []byte("from-file\n"),
+		Timeout:  30 * time.Second,
+		Name:     "fallback",
+	}
+	opt := cmpopts.IgnoreFields(testTarget{}, "Token")
+
+	t.Run("NoStore", func(t *testing.T) {
+		var obj testTarget
+		f, err := setec.ParseFields(&obj, "")
+		if err != nil {
+			t.Fatalf("ParseFields: unexpected error: %v", err)
+		}
+		if err := f.Apply(context.Background(), nil); err != nil {
+			t.Fatalf("Apply: unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(obj, want, opt); diff != "" {
+			t.Errorf("Populated value (-got, +want):\n%s", diff)
+		}
+		if got := obj.Token.GetString(); got != "" {
+			t.Errorf("Token: got %q, want empty", got)
+		}
+	})
+
+	t.Run("FileClient", func(t *testing.T) {
+		// The store has only some of the secrets; the rest are optional, and
+		// the store does not wait for them.
+		path := filepath.Join(t.TempDir(), "secrets.json")
+		if err := os.WriteFile(path, []byte(`{
+  "name": {"secret": {"TextValue": "from-store", "Version": 1}}
+}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fc, err := setec.NewFileClient(path)
+		if err != nil {
+			t.Fatalf("NewFileClient: %v", err)
+		}
+
+		var obj testTarget
+		st, err := setec.NewStore(context.Background(), setec.StoreConfig{
+			Client:  fc,
+			Structs: []setec.Struct{{Value: &obj}},
+			Logf:    logger.Discard,
+		})
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+		defer st.Close()
+
+		want := want
+		want.Name = "from-store"
+		if diff := cmp.Diff(obj, want, opt); diff != "" {
+			t.Errorf("Populated value (-got, +want):\n%s", diff)
+		}
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		// Fallbacks do not mask errors other than a missing secret.
+		fake := setectest.NewFake(t, nil)
+		fake.Rotate("name", "from-store")
+		fake.SetRules(setectest.DefaultPrincipal)
+		st, err := setec.NewStore(context.Background(), setec.StoreConfig{
+			Client:      setec.Client{Server: fake.URL},
+			AllowLookup: true,
+			Logf:        logger.Discard,
+		})
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+		defer st.Close()
+
+		var obj struct {
+			Name string `setec:"name,default=fallback"`
+		}
+		f, err := setec.ParseFields(&obj, "")
+		if err != nil {
+			t.Fatalf("ParseFields: unexpected error: %v", err)
+		}
+		if err := f.Apply(context.Background(), st); !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("Apply: got %v, want %v", err, api.ErrAccessDenied)
+		}
+		if obj.Name != "" {
+			t.Errorf("Name: got %q, want it unset", obj.Name)
+		}
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		// A secret that some field requires is not optional.
+		var obj struct {
+			A string `setec:"name,default=fallback"`
+			B string `setec:"name"`
+		}
+		path := filepath.Join(t.TempDir(), "secrets.json")
+		if err := os.WriteFile(path, []byte(`{}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fc, err := setec.NewFileClient(path)
+		if err != nil {
+			t.Fatalf("NewFileClient: %v", err)
+		}
+		st, err := setec.NewStore(context.Background(), setec.StoreConfig{
+			Client:  fc,
+			Structs: []setec.Struct{{Value: &obj}},
+			Logf:    logger.Discard,
+		})
+		if err == nil {
+			st.Close()
+			t.Fatal("NewStore: got nil, want error")
+		}
+	})
+}
+
+func TestFieldsWatch(t *testing.T) {
+	db := setectest.NewDB(t, nil)
+	db.MustPut(db.Superuser, "test/apple", "1")
+	db.MustPut(db.Superuser, "test/bin-value-ptr", "peach:durian")
+	db.MustPut(db.Superuser, "test/object-value", `{"x":"hello","y":true}`)
+
+	ss := setectest.NewServer(t, db, nil)
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	type testTarget struct {
+		A  string    `setec:"apple"`
+		BP *binValue `setec:"bin-value-ptr"`
+		J  testObj   `setec:"object-value,json"`
+		X  string    // untagged, carried over
+	}
+	obj := testTarget{X: "untagged"}
+
+	ctx := context.Background()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:       cli,
+		Structs:      []setec.Struct{{Value: &obj, Prefix: "test"}},
+		PollInterval: -1,
+		Logf:         logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	defer st.Close()
+
+	f, err := setec.ParseFields(&obj, "test")
+	if err != nil {
+		t.Fatalf("ParseFields: unexpected error: %v", err)
+	}
+	w, err := f.Watch(ctx, st)
+	if err != nil {
+		t.Fatalf("Watch: unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	first := w.Load().(*testTarget)
+	want := testTarget{
+		A:  "1",
+		BP: &binValue{"peach", "durian"},
+		J:  testObj{X: "hello", Y: true},
+		X:  "untagged",
+	}
+	if diff := cmp.Diff(*first, want); diff != "" {
+		t.Errorf("Initial value (-got, +want):\n%s", diff)
+	}
+
+	// Update two of the secrets at once.
+	v2 := db.MustPut(db.Superuser, "test/bin-value-ptr", "plum:cherry")
+	db.MustActivate(db.Superuser, "test/bin-value-ptr", v2)
+	v2 = db.MustPut(db.Superuser, "test/object-value", `{"x":"goodbye"}`)
+	db.MustActivate(db.Superuser, "test/object-value", v2)
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	select {
+	case <-w.Ready():
+	default:
+		t.Error("Watcher is not ready after update")
+	}
+	if err := w.Err(); err != nil {
+		t.Errorf("Err: unexpected error: %v", err)
+	}
+
+	want.BP = &binValue{"plum", "cherry"}
+	want.J = testObj{X: "goodbye"}
+	if diff := cmp.Diff(*w.Load().(*testTarget), want); diff != "" {
+		t.Errorf("Updated value (-got, +want):\n%s", diff)
+	}
+
+	// The previous copy is not modified by the update.
+	if got := *first.BP; got != (binValue{"peach", "durian"}) {
+		t.Errorf("Previous copy was modified: got %q", got)
+	}
+
+	// An invalid value keeps the current copy and reports an error.
+	v3 := db.MustPut(db.Superuser, "test/bin-value-ptr", "no colon")
+	db.MustActivate(db.Superuser, "test/bin-value-ptr", v3)
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	if err := w.Err(); err == nil {
+		t.Error("Err: got nil, want error")
+	}
+	if diff := cmp.Diff(*w.Load().(*testTarget), want); diff != "" {
+		t.Errorf("Value after error (-got, +want):\n%s", diff)
+	}
+}
+
+func TestFieldsWatchRotation(t *testing.T) {
+	fake := setectest.NewFake(t, nil)
+	fake.Rotate("test/apple", "1")
+
+	type testTarget struct {
+		A string `setec:"apple"`
+	}
+	var obj testTarget
+	ctx := context.Background()
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:       setec.Client{Server: fake.URL},
+		Structs:      []setec.Struct{{Value: &obj, Prefix: "test"}},
+		PollInterval: -1,
+		Logf:         logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: unexpected error: %v", err)
+	}
+	defer st.Close()
+
+	f, err := setec.ParseFields(&obj, "test")
+	if err != nil {
+		t.Fatalf("ParseFields: unexpected error: %v", err)
+	}
+	w, err := f.Watch(ctx, st)
+	if err != nil {
+		t.Fatalf("Watch: unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	// Secrets rotating on a schedule are picked up by refreshes.
+	stop := fake.RotateEvery("test/apple", time.Millisecond, func(n int) string {
+		return strconv.Itoa(n + 1)
+	})
+	for deadline := time.Now().Add(5 * time.Second); w.Load().(*testTarget).A == "1"; {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for rotation")
+		}
+		time.Sleep(time.Millisecond)
+		if err := st.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh: unexpected error: %v", err)
+		}
+	}
+	stop()
+	if err := w.Err(); err != nil {
+		t.Errorf("Err: unexpected error: %v", err)
+	}
+	if got := fake.CallsTo("get"); len(got) == 0 || got[0].Principal != setectest.DefaultPrincipal {
+		t.Errorf("Get calls: got %+v, want calls from %q", got, setectest.DefaultPrincipal)
+	}
+}
+
 func TestParseErrors(t *testing.T) {
 	checkFail := func(input any, wantErr string) func(t *testing.T) {
 		return func(t *testing.T) {
@@ -140,6 +540,9 @@ func TestParseErrors(t *testing.T) {
 	}
 	t.Run("NonPointer", checkFail(struct{ X string }{}, "not a pointer"))
 	t.Run("NonStruct", checkFail(new(string), "not a pointer to a struct"))
+	t.Run("InvalidOption", checkFail(&struct {
+		X string `setec:"x,envx=FOO"`
+	}{}, "invalid option"))
 	t.Run("InvalidType", checkFail(&struct {
 		X float64 `setec:"x"` // N.B. not marked with JSON
 	}{}, "unsupported type"))
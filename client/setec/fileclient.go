@@ -4,11 +4,17 @@
 package setec
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sync"
 
+	"github.com/leger-labs/leger/internal/dotenv"
 	"github.com/leger-labs/leger/types/api"
 )
 
@@ -16,10 +22,18 @@ import (
 // secrets from a static collection of data stored locally on disk.
 //
 // This is intended for use in bootstrapping and deployments without access to
-// a separate secrets server.
+// a separate secrets server, and for local development. A FileClient created
+// by [NewFileClient] vends a fixed set of secrets; one created by
+// [NewDirFileClient] or [NewEnvFileClient] observes changes to its files.
 type FileClient struct {
-	path string                      // local filesystem path, for diagnostics
-	db   map[string]*api.SecretValue // :: secret name → static version
+	path string // local filesystem path, for diagnostics
+
+	// read, if non-nil, reads the current value of the named secret from
+	// disk. If nil, the secrets in db are static.
+	read func(name string) ([]byte, error)
+
+	mu sync.Mutex
+	db map[string]*api.SecretValue // :: secret name → static or latest version
 }
 
 // NewFileClient constructs a new FileClient using the contents of the
@@ -73,25 +87,145 @@ func NewFileClient(path string) (*FileClient, error) {
 	return &FileClient{path: path, db: db}, nil
 }
 
+// NewDirFileClient constructs a new FileClient that vends secrets from the
+// files in the specified directory tree. Each file holds the value of one
+// secret, verbatim, and the name of the secret is the path of the file
+// relative to dir, using "/" as a separator, so that the file "a/b/c" holds the
+// secret named "a/b/c".
+//
+// The files are read whenever a secret is fetched, so a Store using the client
+// observes changes each time it polls. The first value read for a secret is
+// version 1, and the version increases each time a change of content is seen.
+func NewDirFileClient(dir string) (*FileClient, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &FileClient{
+		path: dir,
+		read: func(name string) ([]byte, error) {
+			if !fs.ValidPath(name) || name == "." {
+				return nil, api.ErrNotFound
+			}
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+				return nil, api.ErrNotFound
+			}
+			data, err := os.ReadFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, api.ErrNotFound
+			}
+			return data, err
+		},
+		db: make(map[string]*api.SecretValue),
+	}, nil
+}
+
+// NewEnvFileClient constructs a new FileClient that vends secrets from the
+// specified environment file, in the common ".env" format:
+//
+//	# Comments and blank lines are ignored.
+//	API_KEY=xyzzy
+//	export DB_PASSWORD="hunter2"
+//
+// The name of each secret is the name of its variable. Values may be unquoted,
+// single-quoted to be used verbatim, or double-quoted to allow backslash
+// escapes and multiple lines.
+//
+// The file is read whenever a secret is fetched, so a Store using the client
+// observes changes each time it polls. The first value read for a secret is
+// version 1, and the version increases each time a change of content is seen.
+func NewEnvFileClient(path string) (*FileClient, error) {
+	if _, err := readEnvFile(path); err != nil {
+		return nil, err
+	}
+	return &FileClient{
+		path: path,
+		read: func(name string) ([]byte, error) {
+			vars, err := readEnvFile(path)
+			if err != nil {
+				return nil, err
+			}
+			v, ok := vars[name]
+			if !ok {
+				return nil, api.ErrNotFound
+			}
+			return []byte(v), nil
+		},
+		db: make(map[string]*api.SecretValue),
+	}, nil
+}
+
 // Get implements the corresponding method of StoreClient.
 func (fc *FileClient) Get(_ context.Context, name string) (*api.SecretValue, error) {
-	if s, ok := fc.db[name]; ok {
-		return s, nil
-	}
-	return nil, api.ErrNotFound
+	return fc.lookup(name)
 }
 
 // GetIfChanged implements the corresponding method of StoreClient.
 func (fc *FileClient) GetIfChanged(_ context.Context, name string, oldVersion api.SecretVersion) (*api.SecretValue, error) {
-	s, ok := fc.db[name]
-	if !ok {
-		return nil, api.ErrNotFound
+	s, err := fc.lookup(name)
+	if err != nil {
+		return nil, err
 	} else if s.Version == oldVersion {
 		return nil, api.ErrValueNotChanged
 	}
 	return s, nil
 }
 
+// lookup returns the current version of the named secret, reading it from
+// disk if fc observes changes.
+func (fc *FileClient) lookup(name string) (*api.SecretValue, error) {
+	var data []byte
+	if fc.read != nil {
+		var err error
+		data, err = fc.read(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	s, ok := fc.db[name]
+	if fc.read == nil {
+		if !ok {
+			return nil, api.ErrNotFound
+		}
+		return s, nil
+	}
+
+	// Record a new version if the content differs from what we last saw. The
+	// record is kept if the secret is removed, so that if it comes back, its
+	// version does not go backward.
+	if !ok || !bytes.Equal(s.Value, data) {
+		next := api.SecretVersion(1)
+		if ok {
+			next = s.Version + 1
+		}
+		s = &api.SecretValue{Value: data, Version: next}
+		fc.db[name] = s
+	}
+	return s, nil
+}
+
+// readEnvFile reads the variables of the environment file at path.
+func readEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vs, err := dotenv.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	vars := make(map[string]string, len(vs))
+	for _, v := range vs {
+		vars[v.Name] = v.Value // the last assignment wins
+	}
+	return vars, nil
+}
+
 // StoreClient is the interface to the setec API used by the Store.
 type StoreClient interface {
 	// Get fetches the current active secret value for name. See [Client.Get].
@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLSConfig returns a clone of base (or a new config if base == nil) whose
+// certificate is loaded from the named secret in s, and reloaded whenever a
+// new version of the secret becomes active. The secret must contain a PEM
+// certificate chain and its private key, in either order, as issued by the
+// certificate authority built into the server.
+//
+// The returned config sets GetCertificate and GetClientCertificate, so it is
+// suitable for both servers and clients. New handshakes use the current
+// certificate; established connections are not affected by a change.
+//
+// As with NewUpdater, the secret is looked up if s allows it, and an error is
+// reported if the initial value is not a valid certificate. If a later
+// version is not valid, the previous certificate continues to be used.
+func TLSConfig(ctx context.Context, s *Store, name string, base *tls.Config) (*tls.Config, error) {
+	u, err := NewUpdater(ctx, s, name, parseKeyPair)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate %q: %w", name, err)
+	}
+	cfg := base.Clone()
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	cfg.Certificates = nil
+	cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return u.Get(), nil
+	}
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return u.Get(), nil
+	}
+	return cfg, nil
+}
+
+func parseKeyPair(value []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(value, value)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// OpenDB returns a database handle for drv, whose data source name is
+// derived from the named secret in s. If dsn == nil, the secret value
+// (with surrounding whitespace removed) is the data source name; otherwise
+// dsn is called with the secret value to construct it, for example to insert
+// a password into a connection string.
+//
+// Each new connection opened by the database pool uses the data source name
+// from the current version of the secret, so rotated credentials take effect
+// without reopening the handle. Existing connections are not closed when the
+// secret changes; use the SetConnMaxLifetime method of the handle to bound
+// how long a connection with old credentials may be reused.
+//
+// As with NewUpdater, the secret is looked up if s allows it, and an error is
+// reported if the DSN cannot be constructed from the initial value.
+//
+// Database drivers usually export their driver value, for example
+// stdlib.GetDefaultDriver() in pgx, or &pq.Driver{} in lib/pq.
+func OpenDB(ctx context.Context, s *Store, drv driver.Driver, name string, dsn func([]byte) (string, error)) (*sql.DB, error) {
+	if drv == nil {
+		return nil, errors.New("no database driver")
+	}
+	if dsn == nil {
+		dsn = func(value []byte) (string, error) {
+			return strings.TrimSpace(string(value)), nil
+		}
+	}
+
+	u, err := NewUpdater(ctx, s, name, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("load data source name %q: %w", name, err)
+	}
+	return sql.OpenDB(secretConnector{driver: drv, dsn: u}), nil
+}
+
+// secretConnector is a driver.Connector that opens each connection with the
+// current data source name from an Updater.
+type secretConnector struct {
+	driver driver.Driver
+	dsn    *Updater[string]
+}
+
+func (c secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsn := c.dsn.Get()
+	if dsn == "" {
+		return nil, errors.New("empty data source name")
+	}
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		conn, err := dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return conn.Connect(ctx)
+	}
+	return c.driver.Open(dsn)
+}
+
+func (c secretConnector) Driver() driver.Driver { return c.driver }
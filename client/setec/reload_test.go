@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec_test
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/ca"
+	"github.com/leger-labs/leger/client/setec"
+	"github.com/leger-labs/leger/setectest"
+	"tailscale.com/types/logger"
+)
+
+func TestTLSConfig(t *testing.T) {
+	caPEM, err := ca.NewAuthority("test", 24*time.Hour, ca.ECDSAP256)
+	if err != nil {
+		t.Fatalf("NewAuthority: %v", err)
+	}
+	auth, err := ca.ParseAuthority(caPEM)
+	if err != nil {
+		t.Fatalf("ParseAuthority: %v", err)
+	}
+	issue := func(name string) string {
+		v, _, err := auth.Issue(&ca.CertConfig{CommonName: name}, time.Now())
+		if err != nil {
+			t.Fatalf("Issue %q: %v", name, err)
+		}
+		return string(v)
+	}
+
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "web/tls", issue("alpha"))
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:       setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do},
+		Secrets:      []string{"web/tls"},
+		PollInterval: -1,
+		Logf:         logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	defer st.Close()
+
+	base := &tls.Config{MinVersion: tls.VersionTLS13}
+	cfg, err := setec.TLSConfig(ctx, st, "web/tls", base)
+	if err != nil {
+		t.Fatalf("TLSConfig: unexpected error: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion: got %v, want %v", cfg.MinVersion, tls.VersionTLS13)
+	}
+	checkCN := func(want string) {
+		t.Helper()
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("GetCertificate: unexpected error: %v", err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != want {
+			t.Errorf("Certificate name: got %q, want %q", got, want)
+		}
+	}
+	checkCN("alpha")
+
+	v2 := d.MustPut(d.Superuser, "web/tls", issue("bravo"))
+	d.MustActivate(d.Superuser, "web/tls", v2)
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	checkCN("bravo")
+
+	// An invalid certificate is not installed.
+	v3 := d.MustPut(d.Superuser, "web/tls", "not a certificate")
+	d.MustActivate(d.Superuser, "web/tls", v3)
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	checkCN("bravo")
+}
+
+// fakeDriver is a database driver that records the names it opens.
+type fakeDriver struct {
+	mu     sync.Mutex
+	opened []string
+}
+
+func (f *fakeDriver) Open(name string) (driver.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opened = append(f.opened, name)
+	return fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+var testDriver = new(fakeDriver)
+
+func TestOpenDB(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "db/password", "hunter2\n")
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:       setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do},
+		Secrets:      []string{"db/password"},
+		PollInterval: -1,
+		Logf:         logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	defer st.Close()
+
+	db, err := setec.OpenDB(ctx, st, testDriver, "db/password", func(pw []byte) (string, error) {
+		return "user=app password=" + string(pw[:len(pw)-1]), nil
+	})
+	if err != nil {
+		t.Fatalf("OpenDB: unexpected error: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxIdleConns(0) // open a new connection for each use
+
+	if err := db.PingContext(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	v2 := d.MustPut(d.Superuser, "db/password", "correct horse\n")
+	d.MustActivate(d.Superuser, "db/password", v2)
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	testDriver.mu.Lock()
+	defer testDriver.mu.Unlock()
+	want := []string{"user=app password=hunter2", "user=app password=correct horse"}
+	if !slices.Equal(testDriver.opened, want) {
+		t.Errorf("Opened: got %q, want %q", testDriver.opened, want)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setec
+
+import (
+	"cmp"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrCircuitOpen is reported by a Client when it does not attempt a call
+// because the circuit breakers for all its servers are open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// A RetryPolicy configures how a [Client] retries idempotent calls (Get,
+// GetIfChanged, GetVersion, Info, and List) that fail because a server is
+// unavailable: when the server cannot be reached, or reports a 5xx status.
+// Other errors, such as a secret not being found, are reported immediately.
+//
+// Each attempt tries the servers of the client in order, starting with the
+// primary, skipping any whose circuit breaker is open. Between attempts, the
+// client waits with jittered exponential backoff.
+//
+// A RetryPolicy also holds the state of the circuit breakers, so a single
+// policy should be shared by the clients that talk to the same servers. A zero
+// RetryPolicy is ready for use with default settings. A RetryPolicy must not
+// be copied after first use.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts to make for each call,
+	// each of which tries every available server. If zero, the default is 3.
+	MaxAttempts int
+
+	// BaseDelay is the delay after the first failed attempt, which doubles
+	// after each subsequent attempt. If zero, the default is 100ms.
+	BaseDelay time.Duration
+
+	// MaxDelay is the maximum delay between attempts. If zero, the default is
+	// 5 seconds.
+	MaxDelay time.Duration
+
+	// BreakerThreshold is the number of consecutive failures for a server
+	// after which its circuit breaker opens, and calls skip that server until
+	// the cooldown expires. If zero, the default is 5. If negative, circuit
+	// breakers are disabled.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long a circuit breaker stays open before the
+	// server is tried again. If zero, the default is 30 seconds.
+	BreakerCooldown time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*breaker // :: server URL → breaker
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil {
+		return 1
+	} else if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) baseDelay() time.Duration {
+	if p.BaseDelay <= 0 {
+		return 100 * time.Millisecond
+	}
+	return p.BaseDelay
+}
+
+func (p *RetryPolicy) maxDelay() time.Duration {
+	if p.MaxDelay <= 0 {
+		return 5 * time.Second
+	}
+	return p.MaxDelay
+}
+
+// backoff returns the delay before the given attempt (1-based), with ±50%
+// jitter to avoid synchronized retries from many clients.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.baseDelay() << min(attempt-1, 30)
+	if d <= 0 || d > p.maxDelay() {
+		d = p.maxDelay()
+	}
+	return d/2 + rand.N(d)
+}
+
+// breaker returns the circuit breaker for server, or nil if p has breakers
+// disabled.
+func (p *RetryPolicy) breaker(server string) *breaker {
+	if p == nil || p.BreakerThreshold < 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.breakers[server]
+	if !ok {
+		b = &breaker{
+			threshold: cmp.Or(p.BreakerThreshold, 5),
+			cooldown:  cmp.Or(p.BreakerCooldown, 30*time.Second),
+		}
+		if p.breakers == nil {
+			p.breakers = make(map[string]*breaker)
+		}
+		p.breakers[server] = b
+	}
+	return b
+}
+
+// A breaker is a circuit breaker for a single server. A nil *breaker always
+// allows calls.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // when open, calls are not allowed until this time
+}
+
+// allow reports whether a call to the server should be attempted. Once the
+// cooldown of an open breaker expires, allow admits a single trial call, and
+// holds the breaker open for another cooldown unless the trial succeeds.
+func (b *breaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	} else if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+func (b *breaker) failure(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures == b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// unavailableError is an error indicating that a server could not handle a
+// call, so that the call may be retried on the same or another server.
+type unavailableError struct{ err error }
+
+func (u *unavailableError) Error() string { return u.err.Error() }
+func (u *unavailableError) Unwrap() error { return u.err }
+
+// isUnavailable reports whether err indicates the server was unavailable.
+func isUnavailable(err error) bool {
+	var u *unavailableError
+	return errors.As(err, &u)
+}
+
+// IsUnavailable reports whether err, returned by a call to a [Client],
+// indicates that no server could handle the call: the servers could not be
+// reached, reported an internal error, or were skipped because their circuit
+// breakers were open. Such calls may succeed if tried again later.
+func IsUnavailable(err error) bool {
+	return isUnavailable(err) || errors.Is(err, ErrCircuitOpen)
+}
+
+// idempotentPaths are the API methods that can safely be retried. A get of
+// a dynamic secret issues a new credential each time, but each get carries a
+// request ID, and the server revokes credentials issued for earlier attempts
+// with the same ID.
+var idempotentPaths = map[string]bool{
+	"/api/get":  true,
+	"/api/info": true,
+	"/api/list": true,
+}
+
+// servers returns the server URLs of c, primary first.
+func (c Client) servers() []string {
+	return append([]string{c.Server}, c.Replicas...)
+}
+
+// withRetry calls call for the servers of c in order, until a call succeeds
+// or fails for a reason other than the server being unavailable, retrying as
+// directed by the RetryPolicy of c.
+func withRetry[RESP any](ctx context.Context, c Client, call func(server string) (RESP, error)) (RESP, error) {
+	var resp RESP
+	var lastErr error
+	for try := range c.Retry.maxAttempts() {
+		if try > 0 {
+			trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+				attribute.Int("attempt", try+1),
+			))
+			select {
+			case <-ctx.Done():
+				return resp, lastErr
+			case <-time.After(c.Retry.backoff(try)):
+			}
+		}
+		var skipped []string
+		for _, srv := range c.servers() {
+			b := c.Retry.breaker(srv)
+			if !b.allow(time.Now()) {
+				skipped = append(skipped, srv)
+				continue
+			}
+			r, err := call(srv)
+			if !isUnavailable(err) {
+				b.success()
+				return r, err
+			}
+			b.failure(time.Now())
+			trace.SpanFromContext(ctx).AddEvent("server unavailable", trace.WithAttributes(
+				attribute.String("server.address", srv),
+			))
+			lastErr = err
+			if ctx.Err() != nil {
+				return resp, err
+			}
+		}
+		if lastErr == nil {
+			// Every server was skipped; there is no sense in waiting for the
+			// next attempt, since the breakers will not close that soon.
+			return resp, fmt.Errorf("%w: %s", ErrCircuitOpen, strings.Join(skipped, ", "))
+		}
+	}
+	return resp, lastErr
+}
+
+// newRequestID returns a random ID for an API call, sent with each attempt.
+func newRequestID() string {
+	var buf [16]byte
+	crand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
@@ -20,7 +20,9 @@ import (
 	"time"
 
 	"github.com/creachadair/msync/throttle"
+	"github.com/leger-labs/leger/telemetry"
 	"github.com/leger-labs/leger/types/api"
+	"go.opentelemetry.io/otel/attribute"
 	"tailscale.com/types/logger"
 )
 
@@ -47,6 +49,7 @@ type Store struct {
 		m map[string]*cachedSecret // :: secret name → active value
 		f map[string]Secret        // :: secret name → fetch function
 		w map[string][]watcher     // :: secret name → watchers
+		c map[string][]*onChange   // :: secret name → change callbacks
 	}
 
 	ctx    context.Context    // governs the polling task and lookups
@@ -77,6 +80,17 @@ type StoreConfig struct {
 	// The service URL must be non-empty.
 	Client StoreClient
 
+	// Replicas are the URLs of replica servers to read from if the primary
+	// server is unavailable. They are added to the Replicas of Client, which
+	// must be a setec.Client if any are given.
+	Replicas []string
+
+	// Retry is the policy for retrying reads when the servers are unavailable,
+	// so that polls for updates ride through brief server restarts. It is used
+	// if Client is a setec.Client without its own policy. If nil, each server
+	// is tried once.
+	Retry *RetryPolicy
+
 	// Secrets are the names of secrets this Store should retrieve.
 	//
 	// Unless AllowLookup is true, only secrets named here or in the Structs
@@ -103,7 +117,8 @@ type StoreConfig struct {
 	// Depending on the implementation, local caching may degrade security
 	// slightly by making secrets easier to get at, but in return allows the
 	// Store to initialize and run during outages of the secrets management
-	// service.
+	// service. An EncryptedFileCache keeps the cached secrets encrypted at
+	// rest, so that they are only as accessible as its key.
 	//
 	// If no cache is provided, the Store caches secrets in-memory for the
 	// lifetime of the process only.
@@ -155,6 +170,28 @@ func (c StoreConfig) pollInterval() time.Duration {
 
 func (c StoreConfig) cache() Cache { return c.Cache }
 
+// client returns the client for the store, with the replica and retry
+// settings of c applied.
+func (c StoreConfig) client() (StoreClient, error) {
+	var cli Client
+	switch t := c.Client.(type) {
+	case Client:
+		cli = t
+	case *Client:
+		cli = *t
+	default:
+		if len(c.Replicas) != 0 {
+			return nil, fmt.Errorf("replicas are not supported by a %T", c.Client)
+		}
+		return c.Client, nil
+	}
+	cli.Replicas = append(slices.Clip(cli.Replicas), c.Replicas...)
+	if cli.Retry == nil {
+		cli.Retry = c.Retry
+	}
+	return cli, nil
+}
+
 func (c StoreConfig) newTicker() func(time.Duration) Ticker {
 	if c.PollTicker == nil {
 		return func(d time.Duration) Ticker {
@@ -184,15 +221,20 @@ func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 		return nil, errors.New("no service client is set")
 	}
 
-	secrets, structs, err := cfg.secretNames()
+	secrets, optional, structs, err := cfg.secretNames()
 	if err != nil {
 		return nil, err
-	} else if len(secrets) == 0 && !cfg.AllowLookup {
+	} else if len(secrets) == 0 && len(optional) == 0 && !cfg.AllowLookup {
 		return nil, errors.New("no secrets are listed")
 	}
 
+	client, err := cfg.client()
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Store{
-		client:      cfg.Client,
+		client:      client,
 		logf:        cfg.logger(),
 		cache:       cfg.cache(),
 		allowLookup: cfg.AllowLookup,
@@ -205,10 +247,15 @@ func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 	s.active.m = make(map[string]*cachedSecret)
 	s.active.f = make(map[string]Secret)
 	s.active.w = make(map[string][]watcher)
+	s.active.c = make(map[string][]*onChange)
 
 	// If we have a cache, try to load data from there first.
 	data, err := s.loadCache()
-	if err != nil {
+	if errors.Is(err, ErrCacheTampered) {
+		// Do not trust any of the contents of a cache that fails
+		// authentication; it will be overwritten on the next flush.
+		s.logf("WARNING: cache failed authentication; discarding it")
+	} else if err != nil {
 		// If we fail to load the cache, treat it as empty.
 		s.logf("WARNING: error loading cache: %v (continuing)", err)
 	} else if len(data) != 0 {
@@ -229,7 +276,7 @@ func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 	// after completing initialization, so that we will have a cache of the
 	// latest data in case we restart before the next poll.
 	var wantFlush bool
-	for _, name := range secrets {
+	for _, name := range slices.Concat(secrets, optional) {
 		if _, ok := s.active.m[name]; ok {
 			s.active.m[name].Declared = true
 		} else {
@@ -239,7 +286,7 @@ func NewStore(ctx context.Context, cfg StoreConfig) (*Store, error) {
 	}
 
 	// Ensure we have values for all requested secrets.
-	if err := s.initializeActive(ctx); err != nil {
+	if err := s.initializeActive(ctx, optional); err != nil {
 		return nil, err
 	}
 	if wantFlush {
@@ -292,7 +339,10 @@ func (s *Store) Close() error {
 func (s *Store) Refresh(ctx context.Context) error {
 	// For a refresh, we don't have a specific secret to return so the non-error
 	// value will always be nil.
-	_, err := s.single.Call(ctx, "poll", func(ctx context.Context) (Secret, error) {
+	_, err := s.single.Call(ctx, "poll", func(ctx context.Context) (_ Secret, err error) {
+		ctx, span := telemetry.Tracer().Start(ctx, "setec.Store.Refresh")
+		defer func() { telemetry.End(span, err) }()
+
 		s.countPolls.Add(1)
 		s.latestPoll.Set(float64(time.Now().UTC().UnixMilli()) / 1000)
 		updates := make(map[string]*api.SecretValue)
@@ -300,6 +350,7 @@ func (s *Store) Refresh(ctx context.Context) error {
 			s.countPollErrors.Add(1)
 			return nil, fmt.Errorf("[store] update poll failed: %w", err)
 		}
+		span.SetAttributes(attribute.Int("setec.updates", len(updates)))
 		if err := s.applyUpdates(updates); err != nil {
 			return nil, fmt.Errorf("[store] applying updates failed: %w", err)
 		}
@@ -361,11 +412,15 @@ func (s *Store) LookupSecret(ctx context.Context, name string) (Secret, error) {
 	if f != nil {
 		return f, nil
 	} else if !s.allowLookup {
-		return nil, errors.New("lookup is not enabled")
+		return nil, errLookupDisabled
 	}
 	return s.lookupSecretInternal(ctx, name)
 }
 
+// errLookupDisabled is reported by LookupSecret for a secret unknown to a
+// store that does not allow lookups.
+var errLookupDisabled = errors.New("lookup is not enabled")
+
 // lookupSecretInternal fetches the specified secret from the service and,
 // if successful, installs it into the active set.
 // The caller must not hold the s.active lock; the call to the service is
@@ -562,11 +617,19 @@ func (s *Store) run(ctx context.Context, interval time.Duration, done chan<- str
 }
 
 // applyUpdates applies the specified updates to the secret values, and if a
-// cache is present flushes the data to the cache.
+// cache is present flushes the data to the cache. Change callbacks registered
+// with OnChange are invoked after the updates are applied and the lock is
+// released, so that they may safely read from the store.
 func (s *Store) applyUpdates(updates map[string]*api.SecretValue) error {
 	if len(updates) == 0 {
 		return nil // nothing to do
 	}
+	var changed []func()
+	defer func() {
+		for _, f := range changed {
+			f()
+		}
+	}()
 	s.active.Lock()
 	defer s.active.Unlock()
 	for name, sv := range updates {
@@ -591,6 +654,7 @@ func (s *Store) applyUpdates(updates map[string]*api.SecretValue) error {
 
 		// This is a new value for an unexpired secret.
 		// Note that new values do not update access times.
+		old := s.active.m[name].Secret
 		s.active.m[name].Secret = sv
 		s.logf("[store] update to version %d for secret %q", sv.Version, name)
 
@@ -598,6 +662,9 @@ func (s *Store) applyUpdates(updates map[string]*api.SecretValue) error {
 		for _, w := range s.active.w[name] {
 			w.notify()
 		}
+		for _, c := range s.active.c[name] {
+			changed = append(changed, func() { c.fn(*old, *sv) })
+		}
 	}
 	return s.flushCacheLocked()
 }
@@ -644,7 +711,11 @@ func sleepFor(ctx context.Context, d time.Duration) {
 // secrets.  Cached versions, even if stale, are OK at this point; they'll get
 // refreshed by the update poll.  Any error reported by this method should be
 // treated as fatal.
-func (s *Store) initializeActive(ctx context.Context) error {
+//
+// The optional secrets are those used only by struct fields that have a
+// fallback value. If the service reports that an optional secret does not
+// exist, it is removed from the store rather than waited for.
+func (s *Store) initializeActive(ctx context.Context, optional []string) error {
 	const baseRetryInterval = 1 * time.Millisecond
 	retryWait := baseRetryInterval
 
@@ -673,6 +744,10 @@ func (s *Store) initializeActive(ctx context.Context) error {
 				continue
 			} else if ctx.Err() != nil {
 				return err // context ended, give up
+			} else if errors.Is(err, api.ErrNotFound) && slices.Contains(optional, name) {
+				delete(s.active.m, name)
+				s.logf("[store] optional secret %q not found; using fallback", name)
+				continue
 			}
 			s.logf("[store] error fetching %q: %v (retrying)", name, err)
 			missing++
@@ -833,16 +908,21 @@ type Struct struct {
 	Prefix string
 }
 
-func (c StoreConfig) secretNames() ([]string, []*Fields, error) {
-	sec := c.Secrets
+// secretNames returns the names of the secrets required by c, the names of
+// optional secrets used only by struct fields with fallback values, and the
+// parsed struct fields.
+func (c StoreConfig) secretNames() (sec, opt []string, _ []*Fields, _ error) {
+	sec = slices.Clone(c.Secrets)
 	var svs []*Fields
 	for _, s := range c.Structs {
 		fs, err := ParseFields(s.Value, s.Prefix)
 		if err != nil {
-			return nil, nil, fmt.Errorf("parse struct fields: %w", err)
+			return nil, nil, nil, fmt.Errorf("parse struct fields: %w", err)
 		}
 
-		sec = append(sec, fs.Secrets()...)
+		req, o := fs.secretsByNeed()
+		sec = append(sec, req...)
+		opt = append(opt, o...)
 		svs = append(svs, fs)
 	}
 	// Sort and compact (deduplicate) secret names.
@@ -852,8 +932,14 @@ func (c StoreConfig) secretNames() ([]string, []*Fields, error) {
 	sec = slices.Compact(sec)
 	for _, name := range sec {
 		if name == "" {
-			return nil, nil, errors.New("empty secret name not allowed")
+			return nil, nil, nil, errors.New("empty secret name not allowed")
 		}
 	}
-	return sec, svs, nil
+	// A secret required anywhere is not optional.
+	slices.Sort(opt)
+	opt = slices.DeleteFunc(slices.Compact(opt), func(name string) bool {
+		_, found := slices.BinarySearch(sec, name)
+		return found
+	})
+	return sec, opt, svs, nil
 }
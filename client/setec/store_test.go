@@ -7,15 +7,20 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
 	"github.com/creachadair/mds/mtest"
+	"github.com/leger-labs/leger/acl"
 	"github.com/leger-labs/leger/client/setec"
 	"github.com/leger-labs/leger/setectest"
+	"github.com/leger-labs/leger/types/api"
 	"tailscale.com/types/logger"
 )
 
@@ -390,6 +395,73 @@ func TestUpdater(t *testing.T) {
 	})
 }
 
+func TestOnChange(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "label", "malarkey") // active
+	v2 := d.MustPut(d.Superuser, "label", "dog-faced pony soldier")
+	d.MustPut(d.Superuser, "other", "unchanged")
+
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:       cli,
+		Secrets:      []string{"label", "other"},
+		PollInterval: -1,
+		Logf:         logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: unexpected error: %v", err)
+	}
+	defer st.Close()
+
+	var got []string
+	cancel := st.OnChange("label", func(old, new api.SecretValue) {
+		// The new value is already visible through the store.
+		if cur := st.Secret("label").GetString(); cur != string(new.Value) {
+			t.Errorf("Secret during callback: got %q, want %q", cur, new.Value)
+		}
+		got = append(got, fmt.Sprintf("%s@%d -> %s@%d", old.Value, old.Version, new.Value, new.Version))
+	})
+	st.OnChange("other", func(old, new api.SecretValue) {
+		t.Errorf("Unexpected change to other: %q -> %q", old.Value, new.Value)
+	})
+
+	// Nothing has changed yet.
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Changes before update: got %q, want none", got)
+	}
+
+	if err := cli.Activate(ctx, "label", v2); err != nil {
+		t.Fatalf("Activate to %v: unexpected error: %v", v2, err)
+	}
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	if want := []string{"malarkey@1 -> dog-faced pony soldier@2"}; !slices.Equal(got, want) {
+		t.Errorf("Changes: got %q, want %q", got, want)
+	}
+
+	// After cancellation, updates are no longer reported.
+	cancel()
+	if err := cli.Activate(ctx, "label", 1); err != nil {
+		t.Fatalf("Activate to 1: unexpected error: %v", err)
+	}
+	if err := st.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh: unexpected error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("Changes after cancel: got %q, want 1", got)
+	}
+	checkSecretValue(t, st, "label", "malarkey")
+}
+
 func TestLookup(t *testing.T) {
 	d := setectest.NewDB(t, nil)
 	d.MustPut(d.Superuser, "red", "badge of courage") // active
@@ -597,6 +669,103 @@ func TestNewFileCache(t *testing.T) {
 	})
 }
 
+func TestEncryptedFileCache(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "cache.key")
+	if err := os.WriteFile(keyPath, []byte("VGhpcyBpcyBhIHRlc3Qga2V5LCBub3QgYSByZWFsIG9uZS4=\n"), 0600); err != nil {
+		t.Fatalf("Write key file: %v", err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	sources := []struct {
+		name string
+		src  setec.KeySource
+	}{
+		{"KeyFile", setec.KeyFile(keyPath)},
+		{"Passphrase", setec.Passphrase("correct horse battery staple")},
+		{"SystemdCredential", setec.SystemdCredential("cache.key")},
+	}
+	for _, tc := range sources {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.enc")
+			ec, err := setec.NewEncryptedFileCache(path, tc.src)
+			if err != nil {
+				t.Fatalf("NewEncryptedFileCache: unexpected error: %v", err)
+			}
+			if got, err := ec.Read(); err != nil || got != nil {
+				t.Fatalf("Read empty cache: got (%q, %v), want (nil, nil)", got, err)
+			}
+
+			const secret = `{"alpha":{"secret":{"Value":"c2VjcmV0","Version":1}}}`
+			if err := ec.Write([]byte(secret)); err != nil {
+				t.Fatalf("Write cache: unexpected error: %v", err)
+			}
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Read cache file: %v", err)
+			}
+			if bytes.Contains(raw, []byte("c2VjcmV0")) || bytes.Contains(raw, []byte("alpha")) {
+				t.Errorf("Cache file contains plaintext: %s", raw)
+			}
+
+			// A fresh cache with the same key source can read the data.
+			ec2, err := setec.NewEncryptedFileCache(path, tc.src)
+			if err != nil {
+				t.Fatalf("NewEncryptedFileCache: unexpected error: %v", err)
+			}
+			if got, err := ec2.Read(); err != nil || string(got) != secret {
+				t.Errorf("Read cache: got (%q, %v), want %q", got, err, secret)
+			}
+
+			// A different key fails closed.
+			other, err := setec.NewEncryptedFileCache(path, setec.Passphrase("wrong"))
+			if err != nil {
+				t.Fatalf("NewEncryptedFileCache: unexpected error: %v", err)
+			}
+			if got, err := other.Read(); !errors.Is(err, setec.ErrCacheTampered) {
+				t.Errorf("Read with wrong key: got (%q, %v), want %v", got, err, setec.ErrCacheTampered)
+			}
+
+			// So does a modified file.
+			i := bytes.LastIndex(raw, []byte(`"}`)) - 2
+			raw[i] ^= 'A' ^ 'B'
+			if err := os.WriteFile(path, raw, 0600); err != nil {
+				t.Fatalf("Write cache file: %v", err)
+			}
+			if got, err := ec2.Read(); !errors.Is(err, setec.ErrCacheTampered) {
+				t.Errorf("Read tampered cache: got (%q, %v), want %v", got, err, setec.ErrCacheTampered)
+			}
+		})
+	}
+
+	t.Run("Store", func(t *testing.T) {
+		d := setectest.NewDB(t, nil)
+		d.MustPut(d.Superuser, "alpha", "ok")
+		ts := setectest.NewServer(t, d, nil)
+		hs := httptest.NewServer(ts.Mux)
+		defer hs.Close()
+
+		ec, err := setec.NewEncryptedFileCache(filepath.Join(t.TempDir(), "cache.enc"), setec.KeyFile(keyPath))
+		if err != nil {
+			t.Fatalf("NewEncryptedFileCache: unexpected error: %v", err)
+		}
+		ctx := context.Background()
+		st, err := setec.NewStore(ctx, setec.StoreConfig{
+			Client:       setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do},
+			Secrets:      []string{"alpha"},
+			Cache:        ec,
+			PollInterval: -1,
+		})
+		if err != nil {
+			t.Fatalf("NewStore: unexpected error: %v", err)
+		}
+		defer st.Close()
+		if data, err := ec.Read(); err != nil || !bytes.Contains(data, []byte(`"alpha"`)) {
+			t.Errorf("Read cache: got (%q, %v), want alpha", data, err)
+		}
+	})
+}
+
 func TestNilSecret(t *testing.T) {
 	var s setec.Secret
 
@@ -622,3 +791,105 @@ func (c *closeable[T]) Close() error {
 	c.Closed = true
 	return nil
 }
+
+func TestStoreFake(t *testing.T) {
+	f := setectest.NewFake(t, nil)
+	f.Rotate("app/token", "alpha")
+	f.Rotate("app/other", "unchanged")
+	f.Rotate("ops/key", "secret")
+
+	appURL := f.AddPrincipal("tag:app", acl.Rule{
+		Action: []acl.Action{acl.ActionGet},
+		Secret: []acl.Secret{"app/*"},
+	})
+
+	ctx := context.Background()
+	cli := setec.Client{Server: appURL, Retry: &setec.RetryPolicy{BaseDelay: time.Millisecond}}
+
+	t.Run("Denied", func(t *testing.T) {
+		// The store waits for secrets it cannot fetch, until ctx ends.
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		_, err := setec.NewStore(ctx, setec.StoreConfig{
+			Client:  cli,
+			Secrets: []string{"app/token", "ops/key"},
+			Logf:    logger.Discard,
+		})
+		if err == nil {
+			t.Fatal("NewStore: got nil, want error")
+		}
+		var denied int
+		for _, c := range f.CallsTo("get") {
+			if c.Status == http.StatusForbidden {
+				if c.Secret != "ops/key" {
+					t.Errorf("Denied secret: got %q, want ops/key", c.Secret)
+				}
+				denied++
+			}
+		}
+		if denied == 0 {
+			t.Error("No denied calls recorded")
+		}
+	})
+
+	st, err := setec.NewStore(ctx, setec.StoreConfig{
+		Client:       cli,
+		Secrets:      []string{"app/token", "app/other"},
+		PollInterval: -1,
+		Logf:         logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("NewStore: unexpected error: %v", err)
+	}
+	defer st.Close()
+
+	var changes []string
+	st.OnChange("app/token", func(old, new api.SecretValue) {
+		changes = append(changes, fmt.Sprintf("%s -> %s", old.Value, new.Value))
+	})
+	refresh := func() {
+		t.Helper()
+		if err := st.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh: unexpected error: %v", err)
+		}
+	}
+
+	t.Run("Rotate", func(t *testing.T) {
+		f.Rotate("app/token", "bravo")
+		refresh()
+		checkSecretValue(t, st, "app/token", "bravo")
+		if want := []string{"alpha -> bravo"}; !slices.Equal(changes, want) {
+			t.Errorf("Changes: got %q, want %q", changes, want)
+		}
+	})
+
+	t.Run("Faults", func(t *testing.T) {
+		f.ResetCalls()
+		f.FailMethod("get", 2, http.StatusServiceUnavailable)
+		f.Rotate("app/token", "charlie")
+		refresh()
+		checkSecretValue(t, st, "app/token", "charlie")
+
+		var injected int
+		for _, c := range f.CallsTo("get") {
+			if c.Principal != "tag:app" {
+				t.Errorf("Call principal: got %q, want tag:app", c.Principal)
+			}
+			if c.Injected {
+				injected++
+			}
+		}
+		if injected != 2 {
+			t.Errorf("Injected faults: got %d, want 2", injected)
+		}
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		f.SetRules("tag:app")
+		f.Rotate("app/token", "delta")
+		if err := st.Refresh(ctx); !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("Refresh: got %v, want %v", err, api.ErrAccessDenied)
+		}
+		checkSecretValue(t, st, "app/token", "charlie") // last known value is kept
+	})
+}
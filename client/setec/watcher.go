@@ -6,6 +6,9 @@ package setec
 import (
 	"context"
 	"errors"
+	"slices"
+
+	"github.com/leger-labs/leger/types/api"
 )
 
 // A watcher monitors the current active value of a secret, and allows the user
@@ -61,3 +64,38 @@ func (s *Store) lookupWatcher(ctx context.Context, name string) (watcher, error)
 	s.active.w[name] = append(s.active.w[name], w)
 	return w, nil
 }
+
+// onChange is a change callback registered by OnChange. Callbacks are stored
+// by pointer so that they can be removed individually.
+type onChange struct {
+	fn func(old, new api.SecretValue)
+}
+
+// OnChange registers fn to be called whenever the store installs a new active
+// version of the named secret, with the previous and the new values. It
+// returns a function that cancels the registration.
+//
+// The callbacks for an update are called in order of registration, on the
+// goroutine performing the update (the poller, or a caller of Refresh), after
+// the new values are visible to readers of the store. A callback may read from
+// the store, but should not block for long, since later updates are delayed
+// until it returns. The store retains ownership of the values passed to fn.
+//
+// Updates are only observed for secrets known to s, either because they were
+// declared in the StoreConfig, or because they were added by a lookup. A
+// callback registered for a name that is not (yet) known is retained, and
+// takes effect once the secret is added to the store.
+func (s *Store) OnChange(name string, fn func(old, new api.SecretValue)) (cancel func()) {
+	c := &onChange{fn: fn}
+	s.active.Lock()
+	defer s.active.Unlock()
+	s.active.c[name] = append(s.active.c[name], c)
+	return func() {
+		s.active.Lock()
+		defer s.active.Unlock()
+		s.active.c[name] = slices.DeleteFunc(s.active.c[name], func(e *onChange) bool { return e == c })
+		if len(s.active.c[name]) == 0 {
+			delete(s.active.c, name)
+		}
+	}
+}
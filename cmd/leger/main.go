@@ -1,15 +1,50 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/leger-labs/leger/internal/cli"
+	"github.com/leger-labs/leger/telemetry"
+	"github.com/leger-labs/leger/telemetry/exporter"
 )
 
 func main() {
-	if err := cli.RootCmd.Execute(); err != nil {
+	os.Exit(run())
+}
+
+func run() int {
+	ctx := context.Background()
+	shutdown, err := exporter.Setup(ctx, exporter.ConfigFromEnv("leger"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown(ctx)
+	}()
+
+	ctx, span := telemetry.Tracer().Start(ctx, "leger "+strings.Join(commandPath(os.Args[1:]), " "))
+	err = cli.RootCmd.ExecuteContext(ctx)
+	telemetry.End(span, err)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return 1
+	}
+	return 0
+}
+
+// commandPath returns the leading subcommand names of args, omitting flags
+// and positional arguments that may name secrets or files.
+func commandPath(args []string) []string {
+	cmd, _, err := cli.RootCmd.Find(args)
+	if err != nil || cmd == cli.RootCmd {
+		return nil
 	}
+	return strings.Fields(cmd.CommandPath())[1:]
 }
@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/agent"
+	"github.com/leger-labs/leger/client/setec"
+	"tailscale.com/tsweb"
+)
+
+var agentArgs struct {
+	Listen          string        `flag:"listen,default=localhost:8080,Address to listen on: a localhost address, open to all local users, or unix:<path> for a socket"`
+	CacheFile       string        `flag:"cache-file,Persist the encrypted cache in this file (default: memory only)"`
+	CacheKeyFile    string        `flag:"cache-key-file,Read the cache encryption key from this file"`
+	CacheKeyCred    string        `flag:"cache-key-credential,Read the cache encryption key from this systemd credential"`
+	Allow           string        `flag:"allow,Comma-separated secret name patterns to serve (default: all)"`
+	MaxStale        time.Duration `flag:"max-stale,default=24h,Longest to serve cached values while the server is down (negative means no limit)"`
+	UpstreamTimeout time.Duration `flag:"upstream-timeout,default=5s,Time limit for each call to the server"`
+}
+
+func runAgent(env *command.Env) error {
+	if clientArgs.Server == "" {
+		return errors.New("no server address is set")
+	}
+
+	var cache setec.Cache
+	if agentArgs.CacheFile != "" {
+		var key setec.KeySource
+		switch {
+		case agentArgs.CacheKeyFile != "" && agentArgs.CacheKeyCred != "":
+			return errors.New("--cache-key-file and --cache-key-credential are mutually exclusive")
+		case agentArgs.CacheKeyFile != "":
+			key = setec.KeyFile(agentArgs.CacheKeyFile)
+		case agentArgs.CacheKeyCred != "":
+			key = setec.SystemdCredential(agentArgs.CacheKeyCred)
+		default:
+			return errors.New("--cache-file requires --cache-key-file or --cache-key-credential")
+		}
+		var err error
+		cache, err = setec.NewEncryptedFileCache(agentArgs.CacheFile, key)
+		if err != nil {
+			return fmt.Errorf("opening cache: %w", err)
+		}
+	}
+
+	var allow []acl.Secret
+	for _, pat := range strings.Split(agentArgs.Allow, ",") {
+		if pat = strings.TrimSpace(pat); pat != "" {
+			allow = append(allow, acl.Secret(pat))
+		}
+	}
+
+	mux := http.NewServeMux()
+	tsweb.Debugger(mux)
+	a, err := agent.New(agent.Config{
+		Client: setec.Client{
+			Server: clientArgs.Server,
+			// Give up quickly on an unavailable server, since the agent can
+			// serve from its cache instead.
+			Retry: &setec.RetryPolicy{MaxAttempts: 2, BreakerCooldown: 10 * time.Second},
+		},
+		Cache:           cache,
+		Allow:           allow,
+		MaxStale:        agentArgs.MaxStale,
+		UpstreamTimeout: agentArgs.UpstreamTimeout,
+		Mux:             mux,
+	})
+	if err != nil {
+		return fmt.Errorf("initializing agent: %w", err)
+	}
+	expvar.Publish("legerd_agent", a.Metrics())
+
+	l, err := listenAgent(agentArgs.Listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("Agent for %s listening on %s", clientArgs.Server, agentArgs.Listen)
+	if l.Addr().Network() == "tcp" {
+		log.Printf("WARNING: any local user can read this host's secrets through %s; use --listen=unix:<path> to restrict access", agentArgs.Listen)
+	}
+
+	hs := &http.Server{Handler: mux}
+	go func() {
+		<-env.Context().Done()
+		log.Print("Signal received, stopping...")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = hs.Shutdown(ctx)
+	}()
+	if err := hs.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serving HTTP: %v", err)
+	}
+	return nil
+}
+
+// listenAgent returns a listener for addr, which must be either "unix:"
+// followed by a socket path, or a host:port on the loopback interface. The
+// agent is unauthenticated, so it must not be reachable from other hosts.
+// A unix socket also limits it to the owner and group of the agent; on a
+// loopback address, every user of the host can reach it.
+func listenAgent(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// Only the owner and group of the agent may connect.
+		if err := os.Chmod(path, 0660); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("agent must listen on localhost or a unix socket, not %q", host)
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/creachadair/command"
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/bundle"
+	"github.com/leger-labs/leger/types/api"
+	"golang.org/x/term"
+	"tailscale.com/atomicfile"
+)
+
+var exportArgs struct {
+	Recipients  string `flag:"recipient,Comma-separated age public keys to encrypt the bundle to (required)"`
+	Filter      string `flag:"filter,Comma-separated secret name patterns to export (default: all)"`
+	AllVersions bool   `flag:"all-versions,Export all versions of each secret, not only the active one"`
+	Output      string `flag:"output,Write the bundle to this file (default: stdout)"`
+}
+
+func runExport(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if exportArgs.Recipients == "" {
+		return errors.New("at least one --recipient is required")
+	}
+	var recipients []age.Recipient
+	for _, s := range splitList(exportArgs.Recipients) {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", s, err)
+		}
+		recipients = append(recipients, r)
+	}
+	if exportArgs.Output == "" && term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("refusing to write a bundle to a terminal, use --output")
+	}
+
+	opts := &bundle.ExportOptions{AllVersions: exportArgs.AllVersions}
+	for _, pat := range splitList(exportArgs.Filter) {
+		opts.Filter = append(opts.Filter, acl.Secret(pat))
+	}
+	b, err := bundle.Export(env.Context(), c, opts)
+	if err != nil {
+		return fmt.Errorf("export failed: %w", err)
+	}
+
+	var nv int
+	for _, s := range b.Secrets {
+		nv += len(s.Versions)
+	}
+	var buf bytes.Buffer
+	if err := b.Encrypt(&buf, recipients...); err != nil {
+		return err
+	}
+	if exportArgs.Output == "" {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	} else if err := atomicfile.WriteFile(exportArgs.Output, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(env, "Exported %d secrets (%d versions)\n", len(b.Secrets), nv)
+	return nil
+}
+
+var importArgs struct {
+	Identity   string `flag:"identity,Path of an age identity file to decrypt the bundle (required)"`
+	OnConflict string `flag:"on-conflict,default=skip,What to do with existing secrets (skip, new-version, overwrite)"`
+}
+
+func runImport(env *command.Env, path string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	strategy, err := bundle.ParseStrategy(importArgs.OnConflict)
+	if err != nil {
+		return err
+	}
+	if importArgs.Identity == "" {
+		return errors.New("an --identity file is required")
+	}
+	idf, err := os.Open(importArgs.Identity)
+	if err != nil {
+		return err
+	}
+	defer idf.Close()
+	ids, err := age.ParseIdentities(idf)
+	if err != nil {
+		return fmt.Errorf("reading identities: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := bundle.Decrypt(f, ids...)
+	if err != nil {
+		return err
+	}
+
+	results, ierr := bundle.Import(env.Context(), c, b, strategy)
+	tw := newTabWriter(os.Stdout)
+	fmt.Fprint(tw, "NAME\tACTION\tVERSIONS\n")
+	for _, r := range results {
+		action := r.Action
+		if r.Err != nil {
+			action = "failed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, action, formatVersionMap(r.Versions))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if ierr != nil {
+		return fmt.Errorf("import failed: %w", ierr)
+	}
+	return nil
+}
+
+// formatVersionMap formats a mapping from bundle versions to server versions
+// as a comma-separated list of "old→new" pairs, in order by bundle version.
+func formatVersionMap(m map[api.SecretVersion]api.SecretVersion) string {
+	keys := make([]api.SecretVersion, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%v→%v", k, m[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitList splits a comma-separated list, discarding empty elements.
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
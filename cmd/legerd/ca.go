@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/creachadair/command"
+	"github.com/leger-labs/leger/ca"
+	"github.com/leger-labs/leger/db"
+	"github.com/leger-labs/leger/types/api"
+)
+
+var caInitArgs struct {
+	CommonName string        `flag:"cn,Common name of the CA certificate (default: the CA name)"`
+	TTL        time.Duration `flag:"ttl,default=87600h,Lifetime of the CA certificate"`
+	KeyType    string        `flag:"key-type,default=ecdsa-p256,Key type: ecdsa-p256, ecdsa-p384, ed25519, rsa-2048, rsa-4096"`
+	Output     string        `flag:"output,Also write the CA certificate to this file"`
+}
+
+func runCAInit(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	secret := db.CAPrefix + name
+	if _, err := c.Info(env.Context(), secret); err == nil {
+		return fmt.Errorf("CA %q already exists", name)
+	} else if !errors.Is(err, api.ErrNotFound) {
+		return fmt.Errorf("checking for existing CA: %w", err)
+	}
+
+	cn := caInitArgs.CommonName
+	if cn == "" {
+		cn = name
+	}
+	value, err := ca.NewAuthority(cn, caInitArgs.TTL, ca.KeyType(caInitArgs.KeyType))
+	if err != nil {
+		return err
+	}
+	if _, err := c.Put(env.Context(), secret, value); err != nil {
+		return fmt.Errorf("storing CA: %w", err)
+	}
+	auth, err := ca.ParseAuthority(value)
+	if err != nil {
+		return err
+	}
+	if caInitArgs.Output != "" {
+		if err := os.WriteFile(caInitArgs.Output, auth.CertPEM(), 0644); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Created CA %q (%s), valid until %s\n", name, cn, auth.Cert.NotAfter.Local().Format(time.DateTime))
+	fmt.Printf("The CA certificate is served at %s/ca/%s/cert\n", clientArgs.Server, name)
+	return nil
+}
+
+var certIssueArgs struct {
+	CA          string        `flag:"ca,Name of the issuing CA"`
+	CommonName  string        `flag:"cn,Subject common name (default: the first DNS name)"`
+	DNSNames    string        `flag:"dns,Comma-separated DNS names"`
+	IPAddresses string        `flag:"ip,Comma-separated IP addresses"`
+	TTL         time.Duration `flag:"ttl,Certificate lifetime (default 720h)"`
+	RenewBefore time.Duration `flag:"renew-before,Reissue this long before expiry (default: a third of the TTL)"`
+	KeyType     string        `flag:"key-type,Key type (default: ecdsa-p256)"`
+}
+
+func runCertIssue(env *command.Env, name string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	// If a CA is given, (re)define the certificate secret. Otherwise, the
+	// secret must already be defined, and is simply reissued.
+	if certIssueArgs.CA != "" {
+		cfg, err := json.Marshal(ca.CertConfig{
+			CA:          certIssueArgs.CA,
+			CommonName:  certIssueArgs.CommonName,
+			DNSNames:    splitList(certIssueArgs.DNSNames),
+			IPAddresses: splitList(certIssueArgs.IPAddresses),
+			TTL:         ca.Duration(certIssueArgs.TTL),
+			RenewBefore: ca.Duration(certIssueArgs.RenewBefore),
+			KeyType:     ca.KeyType(certIssueArgs.KeyType),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := ca.ParseCertConfig(cfg); err != nil {
+			return err
+		}
+		cfgName := db.CertConfigPrefix + name
+		ver, err := c.Put(env.Context(), cfgName, cfg)
+		if err != nil {
+			return fmt.Errorf("storing certificate config: %w", err)
+		}
+		if err := c.Activate(env.Context(), cfgName, ver); err != nil {
+			return fmt.Errorf("activating certificate config: %w", err)
+		}
+	}
+
+	ver, err := c.IssueCert(env.Context(), name)
+	if errors.Is(err, api.ErrNotFound) && certIssueArgs.CA == "" {
+		return fmt.Errorf("%q is not a certificate secret; use --ca and --dns to define it", name)
+	} else if err != nil {
+		return fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	fmt.Printf("Issued certificate for %q as version %v\n", name, ver)
+	return nil
+}
+
+func runCertStatus(env *command.Env, name string, rest ...string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	req := api.CertStatusRequest{Name: name}
+	switch len(rest) {
+	case 0:
+	case 1:
+		v, err := strconv.ParseUint(rest[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid version %q: %w", rest[0], err)
+		}
+		req.Version = api.SecretVersion(v)
+	default:
+		return env.Usagef("extra arguments after version")
+	}
+	st, err := c.CertStatus(env.Context(), req)
+	if err != nil {
+		return fmt.Errorf("failed to get certificate status: %w", err)
+	}
+	tw := newTabWriter(os.Stdout)
+	fmt.Fprintf(tw, "Secret:\t%s (version %v)\n", st.Secret, st.Version)
+	fmt.Fprintf(tw, "Serial:\t%s\n", st.Serial)
+	fmt.Fprintf(tw, "Status:\t%s\n", st.Status)
+	fmt.Fprintf(tw, "Expires:\t%s\n", st.NotAfter.Local().Format(time.DateTime))
+	if st.RevokedAt != nil {
+		fmt.Fprintf(tw, "Revoked:\t%s\n", st.RevokedAt.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func runCertRevoke(env *command.Env, name, versionString string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	v, err := strconv.ParseUint(versionString, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid version %q: %w", versionString, err)
+	}
+	if err := c.RevokeCert(env.Context(), name, api.SecretVersion(v)); err != nil {
+		return fmt.Errorf("failed to revoke certificate: %w", err)
+	}
+	fmt.Printf("Revoked certificate in %q version %v\n", name, v)
+	return nil
+}
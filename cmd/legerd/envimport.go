@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/creachadair/command"
+	"github.com/leger-labs/leger/internal/dotenv"
+	"github.com/leger-labs/leger/types/api"
+)
+
+var importEnvArgs struct {
+	Prefix   string `flag:"prefix,Prefix to add to each variable name to form the secret name"`
+	Activate bool   `flag:"activate,default=true,Activate new versions of existing secrets"`
+	DryRun   bool   `flag:"dry-run,Report what would be done without writing any secrets"`
+	EmptyOK  bool   `flag:"empty-ok,Import variables with empty values instead of skipping them"`
+	JSON     bool   `flag:"json,Print the results as JSON"`
+}
+
+// envResult is the result of importing one variable from an environment file.
+type envResult struct {
+	Name    string
+	Action  string            // "created", "updated", "unchanged", "exists", "skipped", or "failed"
+	Version api.SecretVersion `json:",omitempty"`
+	Error   string            `json:",omitempty"`
+}
+
+func runImportEnv(env *command.Env, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	vars, err := dotenv.Parse(data)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	// Apply the assignments in order, so the last one for each name wins.
+	// Values are stored exactly as the file defines them, since quoting in the
+	// file already makes any surrounding whitespace explicit.
+	values := make(map[string]string)
+	var names []string
+	for _, v := range vars {
+		name := importEnvArgs.Prefix + v.Name
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = v.Value
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no variables found in %s", path)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	ctx := env.Context()
+
+	var results []envResult
+	var failed int
+	for _, name := range names {
+		value := []byte(values[name])
+		res := envResult{Name: name}
+		if len(value) == 0 && !importEnvArgs.EmptyOK {
+			res.Action = "skipped"
+			results = append(results, res)
+			continue
+		}
+
+		// Put stores nothing new if the value equals the latest version, and
+		// reports that version, so the values need not be read to compare.
+		si, err := c.Info(ctx, name)
+		switch {
+		case errors.Is(err, api.ErrNotFound):
+			res.Action = "created"
+			if !importEnvArgs.DryRun {
+				res.Version, err = c.Put(ctx, name, value)
+			}
+		case err != nil:
+		case importEnvArgs.DryRun:
+			res.Action = "exists"
+		default:
+			res.Version, err = c.Put(ctx, name, value)
+			if err == nil && res.Version == si.ActiveVersion {
+				res.Action = "unchanged"
+			} else if err == nil {
+				res.Action = "updated"
+				if importEnvArgs.Activate {
+					err = c.Activate(ctx, name, res.Version)
+				}
+			}
+		}
+		if err != nil {
+			res.Action, res.Error = "failed", err.Error()
+		}
+		if res.Action == "failed" {
+			failed++
+		}
+		results = append(results, res)
+	}
+
+	if importEnvArgs.JSON {
+		if err := writeJSON(os.Stdout, results); err != nil {
+			return err
+		}
+	} else {
+		tw := newTabWriter(os.Stdout)
+		fmt.Fprint(tw, "NAME\tACTION\tVERSION\n")
+		for _, r := range results {
+			version := "-"
+			if r.Version != 0 {
+				version = r.Version.String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, r.Action, version)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		for _, r := range results {
+			if r.Error != "" {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", r.Name, r.Error)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to import %d of %d secrets", failed, len(results))
+	}
+	return nil
+}
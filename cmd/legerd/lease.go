@@ -0,0 +1,40 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/creachadair/command"
+)
+
+var renewArgs struct {
+	TTL time.Duration `flag:"ttl,Requested lease lifetime from now (default: the secret's TTL)"`
+}
+
+func runRenewLease(env *command.Env, leaseID string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	info, err := c.RenewLease(env.Context(), leaseID, renewArgs.TTL)
+	if err != nil {
+		return fmt.Errorf("failed to renew lease: %w", err)
+	}
+	fmt.Printf("Lease %s on %q renewed until %s\n", info.ID, info.Secret, info.Expires.Local().Format(time.DateTime))
+	return nil
+}
+
+func runRevokeLease(env *command.Env, leaseID string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.RevokeLease(env.Context(), leaseID); err != nil {
+		return fmt.Errorf("failed to revoke lease: %w", err)
+	}
+	fmt.Printf("Lease %s revoked\n", leaseID)
+	return nil
+}
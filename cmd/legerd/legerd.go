@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
@@ -30,6 +31,7 @@ import (
 	"github.com/leger-labs/leger/audit"
 	"github.com/leger-labs/leger/client/setec"
 	"github.com/leger-labs/leger/server"
+	"github.com/leger-labs/leger/telemetry/exporter"
 	"github.com/leger-labs/leger/types/api"
 	"github.com/tink-crypto/tink-go-awskms/integration/awskms"
 	"github.com/tink-crypto/tink-go/v2/testutil"
@@ -42,10 +44,11 @@ import (
 func main() {
 	root := &command.C{
 		Name:  filepath.Base(os.Args[0]),
-		Usage: "server [options]\ncommand [flags] ...\nhelp [command]",
+		Usage: "server [options]\nagent [options]\ncommand [flags] ...\nhelp [command]",
 		Help: `A server and command-line tool for the setec API.
 
 The "server" subcommand starts a server for the setec API.
+The "agent" subcommand starts a local caching agent for a server.
 The other subcommands call methods of a running setec server.
 
 Client commands must provide a server URL with the -s flag, or via the
@@ -65,21 +68,76 @@ the node on the tailnet.
 With the --dev flag, the server runs with a dummy KMS. This mode is intended
 for debugging and is NOT SAFE for production use.
 
-Otherwise you must provide a --kms-key-name to use to encrypt the database.`,
+Otherwise you must provide a --kms-key-name to use to encrypt the database.
+
+Use --rate-limit and --rate-burst to limit how often each caller may invoke
+each API method, and --lockout-threshold to temporarily lock out callers that
+are repeatedly denied access. Limited callers receive 429 Too Many Requests.`,
 
 				SetFlags: command.Flags(flax.MustBind, &serverArgs),
 				Run:      command.Adapt(runServer),
 			},
+			{
+				Name: "agent",
+				Help: `Run a caching agent for the setec server.
+
+The agent runs on each host, and serves the setec API on a localhost address
+or a unix socket (--listen=unix:<path>). It forwards reads to the server given
+by -s, and keeps a cache of the secrets this host has fetched. While the
+server is unavailable, the agent serves reads of cached secrets, marking the
+responses with an X-Leger-Cache: stale header and an Age header. The agent
+does not serve writes.
+
+The agent does not authenticate its callers. On a localhost address, any
+user of the host can read the host's secrets through it; listen on a unix
+socket, which only the agent's owner and group may connect to, to prevent
+that.
+
+Use --cache-file with --cache-key-file or --cache-key-credential to keep an
+encrypted copy of the cache on disk, so that it survives restarts. Use --allow
+to restrict the secrets the agent serves, and --max-stale (default 24h) to
+limit how old a cached value it will serve. Values of dynamic secrets are
+never cached.`,
+
+				SetFlags: command.Flags(flax.MustBind, &agentArgs),
+				Run:      command.Adapt(runAgent),
+			},
 			{
 				Name: "list",
-				Help: "List all secrets visible to the caller.",
-				Run:  command.Adapt(runList),
+				Help: `List all secrets visible to the caller.
+
+With --json, print the secrets as a JSON array of objects with the fields Name,
+ActiveVersion, Versions, and LastAccess.`,
+
+				SetFlags: command.Flags(flax.MustBind, &listArgs),
+				Run:      command.Adapt(runList),
 			},
 			{
 				Name:  "info",
 				Usage: "<secret-name>",
-				Help:  "Get metadata for the specified secret.",
-				Run:   command.Adapt(runInfo),
+				Help: `Get metadata for the specified secret.
+
+With --json, print the metadata as a JSON object with the fields Name,
+ActiveVersion, Versions, and LastAccess.`,
+
+				SetFlags: command.Flags(flax.MustBind, &infoArgs),
+				Run:      command.Adapt(runInfo),
+			},
+			{
+				Name: "stale",
+				Help: `List secrets and secret versions that have not been used recently.
+
+A secret is reported as stale if none of its versions has been fetched within
+the --unused-for period (for example "90d" or "2160h"). Inactive versions of
+other secrets that have not been fetched in that period are also reported, so
+they can be deleted.
+
+Access times are only known from when the server began tracking them, so a
+secret or version that has not been fetched since then is reported as "never
+since" that time; it may have been fetched before.`,
+
+				SetFlags: command.Flags(flax.MustBind, &staleArgs),
+				Run:      command.Adapt(runStale),
 			},
 			{
 				Name:  "get",
@@ -87,7 +145,11 @@ Otherwise you must provide a --kms-key-name to use to encrypt the database.`,
 				Help: `Get the active value of the specified secret.
 
 With --version, fetch the specified version instead of the active one.
-With --if-changed, return the active value only if it differs from --version.`,
+With --if-changed, return the active value only if it differs from --version.
+
+With --json, print a JSON object with the fields Name, Version, and Value (the
+value encoded in base64), and TextValue (the value as a string) if the value
+is valid UTF-8 text.`,
 
 				SetFlags: command.Flags(flax.MustBind, &getArgs),
 				Run:      command.Adapt(runGet),
@@ -97,9 +159,10 @@ With --if-changed, return the active value only if it differs from --version.`,
 				Usage: "<secret-name>",
 				Help: `Put a new value for the specified secret.
 
-With --from-file, the new value is read from the specified file; otherwise if
-stdin is connected to a pipe, its contents are fully read to obtain the new
-value. Otherwise, the user is prompted for a new value and confirmation.
+With --from-file, the new value is read from the specified file, or from stdin
+if the file is "-"; otherwise if stdin is connected to a pipe, its contents are
+fully read to obtain the new value. Otherwise, the user is prompted for a new
+value and confirmation.
 
 If the provided value is plain UTF-8 text with leading or trailing whitespace,
 you must specify what to do with the whitespace.  Use --verbatim to keep it, or
@@ -110,6 +173,34 @@ where whitespace matters, such as PEM-formatted certificates and SSH keys.`,
 				SetFlags: command.Flags(flax.MustBind, &putArgs),
 				Run:      command.Adapt(runPut),
 			},
+			{
+				Name:  "import-env",
+				Usage: "<env-file>",
+				Help: `Put the variables of an environment file as secrets.
+
+Each variable NAME=VALUE in the file (in the common ".env" format) is stored
+as the secret named by --prefix followed by NAME, and the last assignment to
+a name wins. A secret whose latest version already equals the variable is not
+written again, and is left unchanged if that version is active. Otherwise the
+value is added as a new version, or the latest version is reused, and it is
+activated unless --activate=false is given.
+
+A file that does not parse writes nothing. Otherwise the secrets are written
+one at a time, not as a batch: if one fails, the others are still written,
+and those written before a failure are kept. The results report what was done
+for each secret, and running the command again completes a partial import.
+
+Empty values are skipped unless --empty-ok is given. Use --dry-run to report
+what would be done without writing anything, and --json to print the results
+as a JSON array. Since values are never read, --dry-run reports existing
+secrets as "exists" rather than whether they would change.
+
+The caller must have "info" and "put" access to the secrets, and "activate"
+access unless --activate=false is given.`,
+
+				SetFlags: command.Flags(flax.MustBind, &importEnvArgs),
+				Run:      command.Adapt(runImportEnv),
+			},
 			{
 				Name:  "activate",
 				Usage: "<secret-name> <secret-version>",
@@ -136,6 +227,199 @@ generate the token, then re-run appending the provided value.`,
 
 				Run: command.Adapt(runDeleteSecret),
 			},
+			{
+				Name: "export",
+				Help: `Export secrets to an encrypted bundle.
+
+The bundle is encrypted with age to each of the --recipient public keys, and
+written to the --output file. By default all secrets visible to the caller are
+exported, with only their active versions. Use --filter to select secrets by
+name, with '*' wildcards, and --all-versions to include inactive versions.
+Reserved secrets, under "_internal/", are exported only if a --filter pattern
+beginning with "_internal/" selects them.
+
+The caller must have "info" and "get" access to the exported secrets.`,
+
+				SetFlags: command.Flags(flax.MustBind, &exportArgs),
+				Run:      command.Adapt(runExport),
+			},
+			{
+				Name:  "import",
+				Usage: "<bundle-file>",
+				Help: `Import secrets from an encrypted bundle.
+
+The bundle is decrypted using the age identities in the --identity file.
+Secrets that do not exist on the server are created with all the versions in
+the bundle. For secrets that already exist, --on-conflict selects what to do:
+
+  skip         leave the existing secret unchanged (default)
+  new-version  add the imported values as new versions and activate the
+               version that was active in the bundle
+  overwrite    as new-version, then delete all versions not imported
+
+The caller must have "info", "put" and "activate" access to the imported
+secrets, and "delete" access to overwrite them.`,
+
+				SetFlags: command.Flags(flax.MustBind, &importArgs),
+				Run:      command.Adapt(runImport),
+			},
+			{
+				Name: "lease",
+				Help: `Manage leases on dynamic secrets.
+
+Each time a dynamic secret is fetched, the server issues a new credential under
+a lease, whose ID is reported with the credential. The credential is revoked
+when the lease expires, unless the lease is renewed first.`,
+
+				Commands: []*command.C{
+					{
+						Name:  "renew",
+						Usage: "<lease-id>",
+						Help: `Extend the specified lease.
+
+The lease is extended by --ttl from now, or by the default TTL of the secret,
+but never beyond the maximum lifetime of the lease. Only the caller to whom
+the credential was issued can renew its lease.`,
+
+						SetFlags: command.Flags(flax.MustBind, &renewArgs),
+						Run:      command.Adapt(runRenewLease),
+					},
+					{
+						Name:  "revoke",
+						Usage: "<lease-id>",
+						Help: `Revoke the specified lease, invalidating its credential.
+
+The caller to whom the credential was issued can revoke its lease. Others must
+have "delete" access to the secret.`,
+
+						Run: command.Adapt(runRevokeLease),
+					},
+				},
+			},
+			{
+				Name: "webhook",
+				Help: `Manage webhook subscriptions.
+
+A webhook subscription asks the server to POST an event to a URL each time a
+secret matching one of its patterns is put, activated, or deleted. Events give
+the name and version of the secret and what changed, never its value. Each
+event is signed with a key shared with the subscriber, in the header
+X-Leger-Signature; see the webhook package for how to check it.
+
+Failed deliveries are retried with backoff. Events that cannot be delivered
+are recorded in a dead-letter log, which "webhook dead-letters" reports.`,
+
+				Commands: []*command.C{
+					{
+						Name:  "add",
+						Usage: "<name>",
+						Help: `Add (or replace) a webhook subscription.
+
+The subscription is stored on the server as the secret
+"_internal/webhook/<name>". Unless --key-file is given, a new signing key is
+generated and printed, for the subscriber to use.
+
+The caller must have "put" and "activate" access to the subscription secret,
+and "info" access to every secret matched by the --secrets patterns.`,
+
+						SetFlags: command.Flags(flax.MustBind, &webhookAddArgs),
+						Run:      command.Adapt(runWebhookAdd),
+					},
+					{
+						Name: "list",
+						Help: `List webhook subscriptions.
+
+The URL and patterns of a subscription are shown only if the caller has "get"
+access to its secret, since it contains the signing key.`,
+
+						Run: command.Adapt(runWebhookList),
+					},
+					{
+						Name:  "remove",
+						Usage: "<name>",
+						Help:  "Remove a webhook subscription.",
+						Run:   command.Adapt(runWebhookRemove),
+					},
+					{
+						Name:  "dead-letters",
+						Usage: "[<name>]",
+						Help: `List webhook events that could not be delivered.
+
+By default, the events for all the subscriptions to which the caller has
+"info" access are listed.`,
+
+						Run: command.Adapt(runWebhookDeadLetters),
+					},
+				},
+			},
+			{
+				Name: "ca",
+				Help: "Manage internal certificate authorities.",
+
+				Commands: []*command.C{
+					{
+						Name:  "init",
+						Usage: "<ca-name>",
+						Help: `Create a new certificate authority.
+
+A self-signed CA certificate and private key are generated locally and stored
+on the server as the secret "_internal/ca/<ca-name>". The key never leaves the
+server again. The CA certificate is served to anyone at /ca/<ca-name>/cert,
+and its certificate revocation list at /ca/<ca-name>/crl.`,
+
+						SetFlags: command.Flags(flax.MustBind, &caInitArgs),
+						Run:      command.Adapt(runCAInit),
+					},
+				},
+			},
+			{
+				Name: "cert",
+				Help: `Manage certificate secrets.
+
+A certificate secret holds a TLS certificate issued by an internal CA. Its
+value is the PEM encoded certificate chain followed by the private key. The
+server reissues the certificate as a new active version before it expires, so
+programs that watch the secret receive the new certificate automatically.`,
+
+				Commands: []*command.C{
+					{
+						Name:  "issue",
+						Usage: "<secret-name>",
+						Help: `Issue a certificate for the specified secret.
+
+With --ca, define (or redefine) the secret as a certificate issued by that CA,
+for the subject names given by --dns and --ip, then issue a certificate.
+Without --ca, issue a new certificate for an existing certificate secret.
+
+The caller must have "put" and "activate" access to the secret, and to its
+configuration "_internal/cert/<secret-name>" to define it. It must also have
+"info" access to the CA "_internal/ca/<ca-name>" through a rule that names
+the CA explicitly; a pattern such as "*" does not suffice.`,
+
+						SetFlags: command.Flags(flax.MustBind, &certIssueArgs),
+						Run:      command.Adapt(runCertIssue),
+					},
+					{
+						Name:  "status",
+						Usage: "<secret-name> [<secret-version>]",
+						Help: `Report the revocation status of a certificate.
+
+By default the certificate in the active version of the secret is reported.`,
+
+						Run: command.Adapt(runCertStatus),
+					},
+					{
+						Name:  "revoke",
+						Usage: "<secret-name> <secret-version>",
+						Help: `Revoke the certificate in the specified version of a secret.
+
+The certificate is listed in the CRL of its CA until it expires. If the revoked
+version is active, the server issues a replacement immediately.`,
+
+						Run: command.Adapt(runCertRevoke),
+					},
+				},
+			},
 			command.HelpCommand(nil),
 			command.VersionCommand(),
 		},
@@ -154,6 +438,16 @@ var serverArgs struct {
 	BackupBucketRegion string `flag:"backup-bucket-region,AWS region of the backup S3 bucket"`
 	BackupRole         string `flag:"backup-role,Name of AWS IAM role to assume to write backups"`
 	Dev                bool   `flag:"dev,Run in developer mode"`
+
+	RateLimit        float64       `flag:"rate-limit,Per-caller API calls per second for each method (0 means unlimited)"`
+	RateBurst        int           `flag:"rate-burst,default=10,Per-caller burst of API calls for each method"`
+	LockoutThreshold int           `flag:"lockout-threshold,Lock out callers after this many access denials (0 means never)"`
+	LockoutWindow    time.Duration `flag:"lockout-window,default=1m,Window over which access denials are counted"`
+	LockoutDuration  time.Duration `flag:"lockout-duration,default=5m,How long a caller stays locked out"`
+
+	TraceExporter    string `flag:"trace-exporter,Trace exporter to use: otlp, stdout, or none (default from $OTEL_TRACES_EXPORTER)"`
+	TraceEndpoint    string `flag:"trace-endpoint,OTLP/HTTP collector URL (default from $OTEL_EXPORTER_OTLP_ENDPOINT)"`
+	TraceSecretNames bool   `flag:"trace-secret-names,Record secret names in trace spans"`
 }
 
 var clientArgs struct {
@@ -227,6 +521,24 @@ func runServer(env *command.Env) error {
 	}
 	fqdn := doms[0]
 
+	tcfg := exporter.ConfigFromEnv("legerd")
+	if serverArgs.TraceExporter != "" {
+		tcfg.Exporter = serverArgs.TraceExporter
+	}
+	tcfg.Endpoint = serverArgs.TraceEndpoint
+	tcfg.RecordSecretNames = tcfg.RecordSecretNames || serverArgs.TraceSecretNames
+	shutdownTracing, err := exporter.Setup(env.Context(), tcfg)
+	if err != nil {
+		return fmt.Errorf("setting up tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Printf("Failed to flush traces: %v", err)
+		}
+	}()
+
 	mux := http.NewServeMux()
 	tsweb.Debugger(mux)
 
@@ -235,6 +547,16 @@ func runServer(env *command.Env) error {
 		return fmt.Errorf("opening audit log: %w", err)
 	}
 
+	var rateLimit *server.RateLimit
+	if serverArgs.RateLimit > 0 || serverArgs.LockoutThreshold > 0 {
+		rateLimit = &server.RateLimit{
+			Default:          server.Limit{Rate: serverArgs.RateLimit, Burst: serverArgs.RateBurst},
+			LockoutThreshold: serverArgs.LockoutThreshold,
+			LockoutWindow:    serverArgs.LockoutWindow,
+			LockoutDuration:  serverArgs.LockoutDuration,
+		}
+	}
+
 	srv, err := server.New(env.Context(), server.Config{
 		DBPath:             filepath.Join(serverArgs.StateDir, "database"),
 		Key:                kek,
@@ -243,6 +565,7 @@ func runServer(env *command.Env) error {
 		BackupBucket:       serverArgs.BackupBucket,
 		BackupBucketRegion: serverArgs.BackupBucketRegion,
 		BackupAssumeRole:   serverArgs.BackupRole,
+		RateLimit:          rateLimit,
 		Mux:                mux,
 	})
 	if err != nil {
@@ -280,6 +603,9 @@ func runServer(env *command.Env) error {
 	if err := hs.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("serving HTTPS: %v", err)
 	}
+	if err := srv.FlushAccess(); err != nil {
+		log.Printf("Failed to save access times: %v", err)
+	}
 
 	return nil
 }
@@ -291,6 +617,10 @@ func newClient() (*setec.Client, error) {
 	return &setec.Client{Server: clientArgs.Server}, nil
 }
 
+var listArgs struct {
+	JSON bool `flag:"json,Print the secrets as JSON"`
+}
+
 func runList(env *command.Env) error {
 	c, err := newClient()
 	if err != nil {
@@ -301,6 +631,12 @@ func runList(env *command.Env) error {
 	if err != nil {
 		return fmt.Errorf("failed to list secrets: %v", err)
 	}
+	if listArgs.JSON {
+		if secrets == nil {
+			secrets = []*api.SecretInfo{} // print [], not null
+		}
+		return writeJSON(os.Stdout, secrets)
+	}
 
 	tw := newTabWriter(os.Stdout)
 	_, _ = io.WriteString(tw, "NAME\tACTIVE\tVERSIONS\n")
@@ -314,6 +650,10 @@ func runList(env *command.Env) error {
 	return tw.Flush()
 }
 
+var infoArgs struct {
+	JSON bool `flag:"json,Print the metadata as JSON"`
+}
+
 func runInfo(env *command.Env, name string) error {
 	c, err := newClient()
 	if err != nil {
@@ -324,6 +664,9 @@ func runInfo(env *command.Env, name string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get secret info: %v", err)
 	}
+	if infoArgs.JSON {
+		return writeJSON(os.Stdout, info)
+	}
 	vers := make([]string, 0, len(info.Versions))
 	for _, v := range info.Versions {
 		vers = append(vers, v.String())
@@ -332,12 +675,111 @@ func runInfo(env *command.Env, name string) error {
 	fmt.Fprintf(tw, "Name:\t%s\n", info.Name)
 	fmt.Fprintf(tw, "Active version:\t%s\n", info.ActiveVersion)
 	fmt.Fprintf(tw, "Versions:\t%s\n", strings.Join(vers, ", "))
+	for _, v := range info.Versions {
+		if a := info.LastAccess[v]; a != nil {
+			fmt.Fprintf(tw, "Version %s last fetched:\t%s by %s\n", v, a.Time.Local().Format(time.DateTime), formatAccessor(a))
+		}
+	}
+	return tw.Flush()
+}
+
+var staleArgs struct {
+	UnusedFor string `flag:"unused-for,default=90d,Report secrets not fetched within this period"`
+}
+
+func runStale(env *command.Env) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	unusedFor, err := parseAge(staleArgs.UnusedFor)
+	if err != nil {
+		return fmt.Errorf("invalid --unused-for: %w", err)
+	}
+	cutoff := time.Now().Add(-unusedFor)
+
+	secrets, err := c.List(env.Context())
+	if err != nil {
+		return fmt.Errorf("failed to list secrets: %v", err)
+	}
+
+	tw := newTabWriter(os.Stdout)
+	_, _ = io.WriteString(tw, "NAME\tVERSION\tLAST FETCHED\tBY\n")
+	for _, s := range secrets {
+		var unused []api.SecretVersion
+		for _, v := range s.Versions {
+			if a := s.LastAccess[v]; a == nil || a.Time.Before(cutoff) {
+				unused = append(unused, v)
+			}
+		}
+		never := "never"
+		if !s.AccessSince.IsZero() {
+			never = "never since " + s.AccessSince.Local().Format(time.DateTime)
+		}
+		if len(unused) == len(s.Versions) {
+			// No version of the secret has been used: the whole secret is stale.
+			last, by := never, "-"
+			if a := latestAccess(s); a != nil {
+				last, by = a.Time.Local().Format(time.DateTime), formatAccessor(a)
+			}
+			fmt.Fprintf(tw, "%s\t(all)\t%s\t%s\n", s.Name, last, by)
+			continue
+		}
+		for _, v := range unused {
+			if v == s.ActiveVersion {
+				continue // in use via other versions, cannot be removed alone
+			}
+			last, by := never, "-"
+			if a := s.LastAccess[v]; a != nil {
+				last, by = a.Time.Local().Format(time.DateTime), formatAccessor(a)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, v, last, by)
+		}
+	}
 	return tw.Flush()
 }
 
+// latestAccess returns the most recent access to any version of s, or nil if
+// no version of s has been accessed.
+func latestAccess(s *api.SecretInfo) *api.AccessInfo {
+	var latest *api.AccessInfo
+	for _, a := range s.LastAccess {
+		if latest == nil || a.Time.After(latest.Time) {
+			latest = a
+		}
+	}
+	return latest
+}
+
+// formatAccessor returns a human-readable description of who made access a.
+func formatAccessor(a *api.AccessInfo) string {
+	if a.User != "" {
+		return fmt.Sprintf("%s (%s)", a.User, a.Hostname)
+	} else if len(a.Tags) != 0 {
+		return fmt.Sprintf("%s (%s)", a.Hostname, strings.Join(a.Tags, ","))
+	}
+	return a.Hostname
+}
+
+// parseAge parses a duration like time.ParseDuration, but also accepts a
+// whole number of days ("90d") or weeks ("12w").
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.ParseUint(n, 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(v) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
 var getArgs struct {
 	IfChanged bool   `flag:"if-changed,Get active version if changed from --version"`
 	Version   uint64 `flag:"version,Secret version to retrieve (default: the active version)"`
+	JSON      bool   `flag:"json,Print the secret as JSON"`
 }
 
 func runGet(env *command.Env, name string) error {
@@ -357,6 +799,13 @@ func runGet(env *command.Env, name string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get secret: %v", err)
 	}
+	if getArgs.JSON {
+		out := jsonSecret{Name: name, Version: val.Version, Value: val.Value}
+		if utf8.Valid(val.Value) {
+			out.TextValue = string(val.Value)
+		}
+		return writeJSON(os.Stdout, out)
+	}
 
 	// Print with a newline if a human's going to look at it,
 	// otherwise output just the secret bytes.
@@ -383,9 +832,14 @@ func runPut(env *command.Env, name string) error {
 
 	var value []byte
 	if putArgs.File != "" {
-		// The user requested we use input from a file.
+		// The user requested we use input from a file, or explicitly from
+		// stdin even if it is a terminal.
 		var err error
-		value, err = os.ReadFile(putArgs.File)
+		if putArgs.File == "-" {
+			value, err = io.ReadAll(os.Stdin)
+		} else {
+			value, err = os.ReadFile(putArgs.File)
+		}
 		if err != nil {
 			return err
 		}
@@ -537,6 +991,25 @@ func newTabWriter(w io.Writer) *tabwriter.Writer {
 	return tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
 }
 
+// jsonSecret is the JSON output format for a secret value. It has the same
+// structure as the secrets in the input file of a setec.FileClient.
+type jsonSecret struct {
+	Name      string
+	Version   api.SecretVersion
+	Value     []byte
+	TextValue string `json:",omitempty"`
+}
+
+// writeJSON writes v to w as indented JSON followed by a newline.
+func writeJSON(w io.Writer, v any) error {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
 // checkPutText checks whether value is plain UTF-8 text. If value is not
 // UTF-8, or if it has no leading or trailing whitespace, it returns (value,
 // nil).
@@ -0,0 +1,188 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/leger-labs/leger/audit"
+	"github.com/leger-labs/leger/types/api"
+	"github.com/tink-crypto/tink-go/v2/tink"
+	"tailscale.com/atomicfile"
+)
+
+// aeadContextAccess returns the AEAD encryption context to use for
+// cryptographic operations on the access table.
+func aeadContextAccess(version uint32) []byte {
+	return []byte(fmt.Sprintf("setec access v%d", version))
+}
+
+// accessSchemaVersion is the (currently) only valid schema version for the
+// on-disk access table.
+const accessSchemaVersion = 1
+
+// accessTable records the most recent fetch of each version of each secret.
+//
+// Secrets are read much more often than they are written, so rather than
+// rewriting the whole encrypted database on every read, access times are kept
+// in memory and persisted to a separate file alongside the database by
+// periodic calls to flush. Losing some updates in a crash is acceptable.
+//
+// On disk, the table is encoded as a JSON object with an unencrypted wrapper,
+// like the database itself, whose "Data" field is an AEAD encrypted blob,
+// encrypted with the database's DEK:
+//
+//	{
+//	   "Version": 1,
+//	   "Data": "<encrypted-access-table-base64>"
+//	}
+//
+// The contents of "Data" prior to encryption are a JSON-encoded
+// accessPersist object.
+type accessTable struct {
+	path   string
+	cipher tink.AEAD
+
+	since   time.Time
+	secrets map[string]map[api.SecretVersion]*api.AccessInfo
+	dirty   bool // there are changes not yet flushed to disk
+}
+
+// accessPersist is the portion of accessTable that is persisted to disk,
+// before encryption.
+type accessPersist struct {
+	// Since is when access tracking began.
+	Since time.Time
+	// Secrets maps a secret name to the last access of each of its versions.
+	Secrets map[string]map[api.SecretVersion]*api.AccessInfo
+}
+
+// accessWrapped is the access table as it is stored on disk.
+type accessWrapped struct {
+	Version uint32
+	Data    []byte
+}
+
+// accessPath returns the path of the access table for the database at
+// dbPath.
+func accessPath(dbPath string) string { return dbPath + ".access" }
+
+// openAccessTable loads the access table at path, decrypting it with cipher.
+// If no table exists at path, a new empty table is returned; it is not
+// written to disk until the first flush.
+func openAccessTable(path string, cipher tink.AEAD) (*accessTable, error) {
+	at := &accessTable{
+		path:    path,
+		cipher:  cipher,
+		secrets: make(map[string]map[api.SecretVersion]*api.AccessInfo),
+	}
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		at.since = time.Now().UTC()
+		return at, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var wrapped accessWrapped
+	if err := json.Unmarshal(bs, &wrapped); err != nil {
+		return nil, fmt.Errorf("loading access table: %w", err)
+	}
+	if wrapped.Version != accessSchemaVersion {
+		return nil, fmt.Errorf("unsupported access table version %d", wrapped.Version)
+	}
+	clear, err := cipher.Decrypt(wrapped.Data, aeadContextAccess(wrapped.Version))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting access table: %w", err)
+	}
+	var persist accessPersist
+	if err := json.Unmarshal(clear, &persist); err != nil {
+		return nil, fmt.Errorf("unmarshaling decrypted access table: %w", err)
+	}
+	at.since = persist.Since
+	if persist.Secrets != nil {
+		at.secrets = persist.Secrets
+	}
+	return at, nil
+}
+
+// record notes that p fetched the specified version of the named secret.
+func (at *accessTable) record(name string, version api.SecretVersion, p audit.Principal) {
+	m := at.secrets[name]
+	if m == nil {
+		m = make(map[api.SecretVersion]*api.AccessInfo)
+		at.secrets[name] = m
+	}
+	m[version] = &api.AccessInfo{
+		Time:     time.Now().UTC(),
+		Hostname: p.Hostname,
+		User:     p.User,
+		Tags:     p.Tags,
+	}
+	at.dirty = true
+}
+
+// lookup returns a copy of the last-access records for the named secret, or
+// nil if there are none.
+func (at *accessTable) lookup(name string) map[api.SecretVersion]*api.AccessInfo {
+	m := at.secrets[name]
+	if len(m) == 0 {
+		return nil
+	}
+	return maps.Clone(m)
+}
+
+// forgetVersion discards the record for one version of the named secret.
+func (at *accessTable) forgetVersion(name string, version api.SecretVersion) {
+	if m := at.secrets[name]; m != nil {
+		if _, ok := m[version]; ok {
+			delete(m, version)
+			at.dirty = true
+		}
+	}
+}
+
+// forget discards all records for the named secret.
+func (at *accessTable) forget(name string) {
+	if _, ok := at.secrets[name]; ok {
+		delete(at.secrets, name)
+		at.dirty = true
+	}
+}
+
+// flush writes the table to disk, if it has changed since the last flush.
+func (at *accessTable) flush() error {
+	if !at.dirty {
+		return nil
+	}
+	clearData, err := json.Marshal(accessPersist{
+		Since:   at.since,
+		Secrets: at.secrets,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := at.cipher.Encrypt(clearData, aeadContextAccess(accessSchemaVersion))
+	if err != nil {
+		return fmt.Errorf("encrypting access table: %w", err)
+	}
+	out, err := json.Marshal(accessWrapped{
+		Version: accessSchemaVersion,
+		Data:    data,
+	})
+	if err != nil {
+		return fmt.Errorf("serializing encrypted access table: %w", err)
+	}
+	if err := atomicfile.WriteFile(at.path, out, 0600); err != nil {
+		return fmt.Errorf("writing access table to %q: %w", at.path, err)
+	}
+	at.dirty = false
+	return nil
+}
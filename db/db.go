@@ -17,6 +17,7 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"slices"
@@ -25,8 +26,13 @@ import (
 
 	"github.com/leger-labs/leger/acl"
 	"github.com/leger-labs/leger/audit"
+	"github.com/leger-labs/leger/ca"
+	"github.com/leger-labs/leger/dynamic"
+	"github.com/leger-labs/leger/telemetry"
 	"github.com/leger-labs/leger/types/api"
+	"github.com/leger-labs/leger/webhook"
 	"github.com/tink-crypto/tink-go/v2/tink"
+	"go.opentelemetry.io/otel/trace"
 	"tailscale.com/util/multierr"
 )
 
@@ -34,7 +40,9 @@ import (
 type DB struct {
 	mu       sync.Mutex
 	kv       *kv
+	access   *accessTable
 	auditLog *audit.Writer
+	onChange func(webhook.Event) // if non-nil, called for each change
 }
 
 // We might store some of setec's configuration in the secrets
@@ -43,6 +51,68 @@ type DB struct {
 // internal use.
 const configPrefix = "_internal/"
 
+// DynamicConfigPrefix is the name prefix of secrets that configure dynamic
+// secrets. The configuration for the dynamic secret "x" is stored as the
+// secret DynamicConfigPrefix+"x". Values are validated on put; see
+// [dynamic.Config] for their format.
+const DynamicConfigPrefix = configPrefix + "dynamic/"
+
+// CAPrefix is the name prefix of secrets that hold certificate authorities.
+// The authority "x" is stored as the secret CAPrefix+"x", as a PEM encoded
+// certificate and private key; see [ca.ParseAuthority].
+const CAPrefix = configPrefix + "ca/"
+
+// CARegistryPrefix is the name prefix of secrets that record the
+// certificates issued by each authority; see [ca.Registry].
+const CARegistryPrefix = configPrefix + "ca-registry/"
+
+// CertConfigPrefix is the name prefix of secrets that define certificate
+// secrets. The configuration for the certificate secret "x" is stored as the
+// secret CertConfigPrefix+"x"; see [ca.CertConfig] for its format.
+const CertConfigPrefix = configPrefix + "cert/"
+
+// WebhookPrefix is the name prefix of secrets that define webhook
+// subscriptions. The subscription "x" is stored as the secret
+// WebhookPrefix+"x"; see [webhook.Subscription] for its format.
+const WebhookPrefix = configPrefix + "webhook/"
+
+// configValidators maps each name prefix of reserved secrets to a function
+// that validates values put to secrets with that prefix.
+var configValidators = map[string]func([]byte) error{
+	DynamicConfigPrefix: func(v []byte) error { _, err := dynamic.ParseConfig(v); return err },
+	CAPrefix:            func(v []byte) error { _, err := ca.ParseAuthority(v); return err },
+	CARegistryPrefix:    func(v []byte) error { _, err := ca.ParseRegistry(v); return err },
+	CertConfigPrefix:    func(v []byte) error { _, err := ca.ParseCertConfig(v); return err },
+	WebhookPrefix:       func(v []byte) error { _, err := webhook.ParseSubscription(v); return err },
+}
+
+// protectedPrefixes are the name prefixes of reserved secrets that hold
+// credentials the server uses itself, such as database passwords and private
+// keys. Reading them through the API requires a rule whose pattern names
+// configPrefix explicitly; a broader pattern such as "*" does not suffice.
+var protectedPrefixes = []string{DynamicConfigPrefix, CAPrefix, CertConfigPrefix, WebhookPrefix}
+
+// allow reports whether caller's permissions allow action on secret.
+func allow(caller Caller, action acl.Action, secret string) bool {
+	if action == acl.ActionGet && slices.ContainsFunc(protectedPrefixes, func(pfx string) bool {
+		return strings.HasPrefix(secret, pfx)
+	}) {
+		return caller.Permissions.AllowExplicit(action, secret, configPrefix)
+	}
+	return caller.Permissions.Allow(action, secret)
+}
+
+// configValidator returns the validator for the reserved secret called name,
+// or nil if name is not a known configuration value.
+func configValidator(name string) func([]byte) error {
+	for pfx, check := range configValidators {
+		if rest, ok := strings.CutPrefix(name, pfx); ok && rest != "" {
+			return check
+		}
+	}
+	return nil
+}
+
 var (
 	// ErrAccessDenied is the error returned by DB methods when the
 	// caller lacks necessary permissions.
@@ -50,6 +120,9 @@ var (
 	// ErrNotFound is the error returned by DB methods when the
 	// database lacks a necessary secret or secret version.
 	ErrNotFound = errors.New("not found")
+	// ErrInvalidConfig is the error returned by DB methods when the
+	// caller attempts to store an invalid configuration value.
+	ErrInvalidConfig = errors.New("invalid configuration")
 )
 
 // Open loads the secrets database at path, decrypting it using key.
@@ -63,9 +136,14 @@ func Open(path string, key tink.AEAD, auditLog *audit.Writer) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	access, err := openAccessTable(accessPath(path), kv.dekCipher)
+	if err != nil {
+		return nil, err
+	}
 
 	ret := &DB{
 		kv:       kv,
+		access:   access,
 		auditLog: auditLog,
 	}
 
@@ -81,6 +159,20 @@ type Caller struct {
 	Principal audit.Principal
 	// Permissions are the permissions the caller has.
 	Permissions acl.Rules
+	// Context, if non-nil, is the context of the request the caller is
+	// making. Database operations on behalf of the caller are traced as part
+	// of this context.
+	Context context.Context
+}
+
+// startSpan starts a trace span for the database operation op on the named
+// secret, on behalf of caller.
+func startSpan(caller Caller, op, name string) (context.Context, trace.Span) {
+	ctx := caller.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return telemetry.Tracer().Start(ctx, "db."+op, trace.WithAttributes(telemetry.SecretName(name)...))
 }
 
 // checkAndLog verifies that caller can perform action on secret, and
@@ -88,8 +180,14 @@ type Caller struct {
 // The caller must not perform the requested operation if an error is
 // returned.
 func (db *DB) checkAndLog(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion) error {
+	return db.logAccess(caller, action, secret, secretVersion, allow(caller, action, secret))
+}
+
+// logAccess writes an audit log entry recording whether caller was
+// authorized to perform action on secret, and returns ErrAccessDenied if it
+// was not.
+func (db *DB) logAccess(caller Caller, action acl.Action, secret string, secretVersion api.SecretVersion, authorized bool) error {
 	var errs []error
-	authorized := caller.Permissions.Allow(action, secret)
 	if !authorized {
 		errs = append(errs, ErrAccessDenied)
 	}
@@ -106,6 +204,23 @@ func (db *DB) checkAndLog(caller Caller, action acl.Action, secret string, secre
 	return multierr.New(errs...)
 }
 
+// LogRefused writes an audit log entry recording that caller was refused
+// permission to perform action for the given reason, independent of the ACLs
+// for any particular secret. This is used, for example, when a caller has been
+// locked out for making too many unauthorized requests.
+func (db *DB) LogRefused(caller Caller, action acl.Action, reason string) error {
+	err := db.auditLog.WriteEntries(&audit.Entry{
+		Principal:  caller.Principal,
+		Action:     action,
+		Authorized: false,
+		Reason:     reason,
+	})
+	if err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	return nil
+}
+
 // Path returns the path to the database file on disk.
 func (db *DB) Path() string {
 	db.mu.Lock()
@@ -123,9 +238,53 @@ func (db *DB) WriteGen() uint64 {
 	return db.kv.writeGen()
 }
 
+// FlushAccess writes any changes to the record of which secret versions were
+// last accessed, when, and by whom, to disk. Access records are kept in memory
+// as secrets are fetched, and are not saved until FlushAccess is called.
+// The caller should call it periodically, and before exiting.
+func (db *DB) FlushAccess() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.access.flush()
+}
+
+// OnChange arranges for fn to be called after each change to a secret is
+// saved, with an event describing the change. Changes to reserved
+// configuration secrets are not reported. The call is made while the database
+// is locked, so fn must not block or call methods of db.
+func (db *DB) OnChange(fn func(webhook.Event)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.onChange = fn
+}
+
+// changedLocked reports a change to the secret called name, if the change
+// should be reported. The caller must hold db.mu.
+func (db *DB) changedLocked(action, name string, version api.SecretVersion) {
+	if db.onChange == nil || strings.HasPrefix(name, configPrefix) {
+		return
+	}
+	db.onChange(webhook.Event{Action: action, Secret: name, Version: version})
+}
+
+// infoLocked returns metadata for the given secret, including its access
+// records. The caller must hold db.mu.
+func (db *DB) infoLocked(name string) (*api.SecretInfo, error) {
+	info, err := db.kv.info(name)
+	if err != nil {
+		return nil, err
+	}
+	info.LastAccess = db.access.lookup(name)
+	info.AccessSince = db.access.since
+	return info, nil
+}
+
 // List returns secret metadata for all secrets on which at least one
 // member of 'from' has acl.ActionInfo permissions.
-func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
+func (db *DB) List(caller Caller) (_ []*api.SecretInfo, err error) {
+	_, span := startSpan(caller, "List", "")
+	defer func() { telemetry.End(span, err) }()
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -137,7 +296,7 @@ func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
 	// to reflect that List took place, then do per-secret permission
 	// checks to construct the response without generating individual
 	// audit entries there.
-	err := db.auditLog.WriteEntries(&audit.Entry{
+	err = db.auditLog.WriteEntries(&audit.Entry{
 		Principal:  caller.Principal,
 		Action:     acl.ActionInfo,
 		Authorized: true,
@@ -151,7 +310,7 @@ func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
 		if !caller.Permissions.Allow(acl.ActionInfo, name) {
 			continue
 		}
-		info, err := db.kv.info(name)
+		info, err := db.infoLocked(name)
 		if err != nil {
 			return nil, err
 		}
@@ -162,34 +321,48 @@ func (db *DB) List(caller Caller) ([]*api.SecretInfo, error) {
 }
 
 // Info returns metadata for the given secret.
-func (db *DB) Info(caller Caller, name string) (*api.SecretInfo, error) {
+func (db *DB) Info(caller Caller, name string) (_ *api.SecretInfo, err error) {
+	_, span := startSpan(caller, "Info", name)
+	defer func() { telemetry.End(span, err) }()
+
 	if err := db.checkAndLog(caller, acl.ActionInfo, name, 0); err != nil {
 		return nil, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.info(name)
+	return db.infoLocked(name)
 }
 
 // Get returns a secret's active value.
-func (db *DB) Get(caller Caller, name string) (*api.SecretValue, error) {
+func (db *DB) Get(caller Caller, name string) (_ *api.SecretValue, err error) {
+	_, span := startSpan(caller, "Get", name)
+	defer func() { telemetry.End(span, err) }()
+
 	if err := db.checkAndLog(caller, acl.ActionGet, name, 0); err != nil {
 		return nil, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.get(name)
+	sv, err := db.kv.get(name)
+	if err != nil {
+		return nil, err
+	}
+	db.access.record(name, sv.Version, caller.Principal)
+	return sv, nil
 }
 
 // GetConditional returns a secret's active value if it is different from oldVersion.
 // If the active version is the same as oldVersion, it reports api.ErrValueNotChanged.
-func (db *DB) GetConditional(caller Caller, name string, oldVersion api.SecretVersion) (*api.SecretValue, error) {
+func (db *DB) GetConditional(caller Caller, name string, oldVersion api.SecretVersion) (_ *api.SecretValue, err error) {
+	_, span := startSpan(caller, "GetConditional", name)
+	defer func() { telemetry.End(span, err) }()
+
 	// This case is special in that we only log an access if the condition
 	// succeeds and we report a fresh value to the caller. However, we still
 	// want a log if authorization fails.
-	if !caller.Permissions.Allow(acl.ActionGet, name) {
+	if !allow(caller, acl.ActionGet, name) {
 		return nil, db.checkAndLog(caller, acl.ActionGet, name, 0)
 	}
 	db.mu.Lock()
@@ -197,7 +370,13 @@ func (db *DB) GetConditional(caller Caller, name string, oldVersion api.SecretVe
 	sv, err := db.kv.get(name)
 	if err != nil {
 		return nil, err
-	} else if sv.Version == oldVersion {
+	}
+
+	// Either way, the caller is now known to be holding the active version,
+	// so record that as an access. This matters for long-running clients that
+	// fetch a secret once and then only poll for changes.
+	db.access.record(name, sv.Version, caller.Principal)
+	if sv.Version == oldVersion {
 		return nil, api.ErrValueNotChanged
 	}
 
@@ -210,21 +389,33 @@ func (db *DB) GetConditional(caller Caller, name string, oldVersion api.SecretVe
 }
 
 // GetVersion returns a secret's value at a specific version.
-func (db *DB) GetVersion(caller Caller, name string, version api.SecretVersion) (*api.SecretValue, error) {
+func (db *DB) GetVersion(caller Caller, name string, version api.SecretVersion) (_ *api.SecretValue, err error) {
+	_, span := startSpan(caller, "GetVersion", name)
+	defer func() { telemetry.End(span, err) }()
+
 	if err := db.checkAndLog(caller, acl.ActionGet, name, version); err != nil {
 		return nil, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.kv.getVersion(name, version)
+	sv, err := db.kv.getVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+	db.access.record(name, sv.Version, caller.Principal)
+	return sv, nil
 }
 
 // Put writes value to the secret called name. If the secret already
-// exists, value is saved as a new inactive version. Otherwise, value
-// is saved as the initial version of the secret and immediately set
-// active. On success, returns the secret version for the new value.
-func (db *DB) Put(caller Caller, name string, value []byte) (api.SecretVersion, error) {
+// exists, value is saved as a new inactive version, unless it is the same
+// as the latest version. Otherwise, value is saved as the initial version of
+// the secret and immediately set active. On success, returns the secret
+// version for the new value.
+func (db *DB) Put(caller Caller, name string, value []byte) (_ api.SecretVersion, err error) {
+	ctx, span := startSpan(caller, "Put", name)
+	defer func() { telemetry.End(span, err) }()
+
 	if name == "" {
 		return 0, errors.New("empty secret name")
 	}
@@ -235,20 +426,41 @@ func (db *DB) Put(caller Caller, name string, value []byte) (api.SecretVersion,
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if strings.HasPrefix(name, configPrefix) {
-		return db.putConfigLocked(name, value)
+		return db.putConfigLocked(ctx, name, value)
 	}
-	return db.kv.put(name, value)
+	var latest api.SecretVersion
+	if s := db.kv.secrets[name]; s != nil {
+		latest = s.LatestVersion
+	}
+	ver, err := db.kv.put(ctx, name, value)
+	if err != nil {
+		return 0, err
+	}
+	if ver != latest {
+		db.changedLocked(webhook.ActionPut, name, ver)
+	}
+	if latest == 0 {
+		db.changedLocked(webhook.ActionActivate, name, ver)
+	}
+	return ver, nil
 }
 
-func (db *DB) putConfigLocked(name string, value []byte) (api.SecretVersion, error) {
-	switch name {
-	default:
+func (db *DB) putConfigLocked(ctx context.Context, name string, value []byte) (api.SecretVersion, error) {
+	check := configValidator(name)
+	if check == nil {
 		return 0, fmt.Errorf("unknown config value %q", name)
 	}
+	if err := check(value); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return db.kv.put(ctx, name, value)
 }
 
 // Activate changes the active version of the secret called name to version.
-func (db *DB) Activate(caller Caller, name string, version api.SecretVersion) error {
+func (db *DB) Activate(caller Caller, name string, version api.SecretVersion) (err error) {
+	ctx, span := startSpan(caller, "Activate", name)
+	defer func() { telemetry.End(span, err) }()
+
 	if name == "" {
 		return errors.New("empty secret name")
 	}
@@ -259,21 +471,28 @@ func (db *DB) Activate(caller Caller, name string, version api.SecretVersion) er
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if strings.HasPrefix(name, configPrefix) {
-		return db.activateConfigLocked(name, version)
+		return db.activateConfigLocked(ctx, name, version)
+	}
+	if err := db.kv.setActive(ctx, name, version); err != nil {
+		return err
 	}
-	return db.kv.setActive(name, version)
+	db.changedLocked(webhook.ActionActivate, name, version)
+	return nil
 }
 
-func (db *DB) activateConfigLocked(name string, version api.SecretVersion) error {
-	switch name {
-	default:
+func (db *DB) activateConfigLocked(ctx context.Context, name string, version api.SecretVersion) error {
+	if configValidator(name) == nil {
 		return fmt.Errorf("unknown config value %q", name)
 	}
+	return db.kv.setActive(ctx, name, version)
 }
 
 // DeleteVersion deletes the specified version of a secret.
 // It reports an error without change if version is the active version.
-func (db *DB) DeleteVersion(caller Caller, name string, version api.SecretVersion) error {
+func (db *DB) DeleteVersion(caller Caller, name string, version api.SecretVersion) (err error) {
+	ctx, span := startSpan(caller, "DeleteVersion", name)
+	defer func() { telemetry.End(span, err) }()
+
 	if err := db.checkAndLog(caller, acl.ActionDelete, name, version); err != nil {
 		return err
 	}
@@ -281,19 +500,30 @@ func (db *DB) DeleteVersion(caller Caller, name string, version api.SecretVersio
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if cfg, ok := strings.CutPrefix(name, configPrefix); ok {
-		return db.deleteConfigVersionLocked(cfg, version)
+		return db.deleteConfigVersionLocked(ctx, cfg, version)
+	}
+	if err := db.kv.deleteVersion(ctx, name, version); err != nil {
+		return err
 	}
-	return db.kv.deleteVersion(name, version)
+	db.access.forgetVersion(name, version)
+	db.changedLocked(webhook.ActionDeleteVersion, name, version)
+	return nil
 }
 
-func (db *DB) deleteConfigVersionLocked(name string, version api.SecretVersion) error {
+func (db *DB) deleteConfigVersionLocked(ctx context.Context, name string, version api.SecretVersion) error {
+	if configValidator(configPrefix+name) != nil {
+		return db.kv.deleteVersion(ctx, configPrefix+name, version)
+	}
 	return fmt.Errorf("unknown config value %q", name)
 }
 
 // Delete deletes all the versions of a secret. If the specified secret does
 // not exist, this is a no-op without error, provided the caller has access to
 // delete things at all.
-func (db *DB) Delete(caller Caller, name string) error {
+func (db *DB) Delete(caller Caller, name string) (err error) {
+	ctx, span := startSpan(caller, "Delete", name)
+	defer func() { telemetry.End(span, err) }()
+
 	if err := db.checkAndLog(caller, acl.ActionDelete, name, 0); err != nil {
 		return err
 	}
@@ -301,11 +531,72 @@ func (db *DB) Delete(caller Caller, name string) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if cfg, ok := strings.CutPrefix(name, configPrefix); ok {
-		return db.deleteConfigLocked(cfg)
+		return db.deleteConfigLocked(ctx, cfg)
 	}
-	return db.kv.deleteSecret(name)
+	_, exists := db.kv.secrets[name]
+	if err := db.kv.deleteSecret(ctx, name); err != nil {
+		return err
+	}
+	db.access.forget(name)
+	if exists {
+		db.changedLocked(webhook.ActionDelete, name, 0)
+	}
+	return nil
 }
 
-func (db *DB) deleteConfigLocked(name string) error {
+func (db *DB) deleteConfigLocked(ctx context.Context, name string) error {
+	if configValidator(configPrefix+name) != nil {
+		return db.kv.deleteSecret(ctx, configPrefix+name)
+	}
 	return fmt.Errorf("unknown config value %q", name)
 }
+
+// DynamicConfig returns the active configuration of the dynamic secret called
+// name, or ErrNotFound if name is not a dynamic secret. It does not check
+// permissions or write audit logs; the caller is responsible for using
+// Authorize before handing out credentials derived from the configuration.
+func (db *DB) DynamicConfig(name string) (*api.SecretValue, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.get(DynamicConfigPrefix + name)
+}
+
+// Peek returns the active value of the secret called name. Like
+// DynamicConfig, it does not check permissions, write audit logs, or record
+// an access. It is for the server's own background tasks, such as renewing
+// certificates, and must not be used to serve values to callers.
+func (db *DB) Peek(name string) (*api.SecretValue, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.kv.get(name)
+}
+
+// NamesWithPrefix returns the names of all secrets that begin with prefix,
+// in sorted order. Like Peek, it does not check permissions.
+func (db *DB) NamesWithPrefix(prefix string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var out []string
+	for _, name := range db.kv.list() {
+		if strings.HasPrefix(name, prefix) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Authorize verifies that caller can perform action on the specified version
+// of secret, and writes an audit log entry recording the attempt. It is for
+// operations on secrets that are not stored in the database, such as dynamic
+// secrets. The caller must not perform the operation if an error is returned.
+func (db *DB) Authorize(caller Caller, action acl.Action, secret string, version api.SecretVersion) error {
+	return db.checkAndLog(caller, action, secret, version)
+}
+
+// AuthorizeExplicit is like Authorize, but only a rule whose secret pattern
+// names the reserved secret prefix explicitly grants action, as for reading
+// reserved secrets. It is for operations that use a reserved secret on the
+// caller's behalf, such as issuing a certificate from an authority.
+func (db *DB) AuthorizeExplicit(caller Caller, action acl.Action, secret string, version api.SecretVersion) error {
+	return db.logAccess(caller, action, secret, version, caller.Permissions.AllowExplicit(action, secret, configPrefix))
+}
@@ -8,10 +8,13 @@ import (
 	"errors"
 	"io"
 	"os"
+	"slices"
 	"strconv"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/leger-labs/leger/acl"
 	"github.com/leger-labs/leger/audit"
 	"github.com/leger-labs/leger/db"
 	"github.com/leger-labs/leger/setectest"
@@ -52,7 +55,7 @@ func TestList(t *testing.T) {
 		if err != nil {
 			t.Fatalf("listing secrets: %v", err)
 		}
-		if diff := cmp.Diff(l, want); diff != "" {
+		if diff := cmp.Diff(l, want, cmpopts.IgnoreFields(api.SecretInfo{}, "AccessSince")); diff != "" {
 			t.Fatalf("unexpected secret list (-got+want):\n%s", diff)
 		}
 	}
@@ -171,6 +174,34 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestGetProtected(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	name := db.DynamicConfigPrefix + "token"
+	value := `{"backend":"hmac","hmac":{"key":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}}`
+	ver := d.MustPut(d.Superuser, name, value)
+
+	// A rule for "*" does not grant reading the credentials the server uses.
+	if _, err := d.Actual.Get(d.Superuser, name); !errors.Is(err, db.ErrAccessDenied) {
+		t.Errorf("Get with *: got %v, want %v", err, db.ErrAccessDenied)
+	}
+	if _, err := d.Actual.GetVersion(d.Superuser, name, ver); !errors.Is(err, db.ErrAccessDenied) {
+		t.Errorf("GetVersion with *: got %v, want %v", err, db.ErrAccessDenied)
+	}
+	if _, err := d.Actual.GetConditional(d.Superuser, name, 0); !errors.Is(err, db.ErrAccessDenied) {
+		t.Errorf("GetConditional with *: got %v, want %v", err, db.ErrAccessDenied)
+	}
+
+	// A rule naming the reserved prefix does.
+	admin := d.Superuser
+	admin.Permissions = acl.Rules{{Action: []acl.Action{acl.ActionGet}, Secret: []acl.Secret{"_internal/*"}}}
+	if sv, err := d.Actual.Get(admin, name); err != nil || string(sv.Value) != value {
+		t.Errorf("Get with _internal/*: got %v, %v", sv, err)
+	}
+	if sv, err := d.Actual.Peek(name); err != nil || sv.Version != ver {
+		t.Errorf("Peek: got %v, %v", sv, err)
+	}
+}
+
 func TestPut(t *testing.T) {
 	d := setectest.NewDB(t, nil)
 	id := d.Superuser
@@ -282,6 +313,83 @@ func TestDeleteVersion(t *testing.T) {
 	d.MustGetVersion(id, testName, v1)
 }
 
+func TestLastAccess(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	id := d.Superuser
+
+	v1 := d.MustPut(id, "test", "v1") // active
+	v2 := d.MustPut(id, "test", "v2")
+	v3 := d.MustPut(id, "test", "v3")
+
+	checkAccess := func(d *db.DB, want ...api.SecretVersion) {
+		t.Helper()
+		info, err := d.Info(id, "test")
+		if err != nil {
+			t.Fatalf("Info: unexpected error: %v", err)
+		}
+		var got []api.SecretVersion
+		for v, a := range info.LastAccess {
+			got = append(got, v)
+			if a.Hostname != id.Principal.Hostname || a.User != id.Principal.User || a.Time.IsZero() {
+				t.Errorf("LastAccess[%v]: got %+v, want access by %v", v, a, id.Principal)
+			}
+		}
+		slices.Sort(got)
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("LastAccess versions (-got, +want):\n%s", diff)
+		}
+	}
+
+	// Nothing has been fetched yet.
+	checkAccess(d.Actual)
+	info, err := d.Actual.Info(id, "test")
+	if err != nil {
+		t.Fatalf("Info: unexpected error: %v", err)
+	}
+	since := info.AccessSince
+	if since.IsZero() {
+		t.Error("AccessSince: got zero, want the start of tracking")
+	}
+
+	d.MustGet(id, "test")
+	d.MustGetVersion(id, "test", v2)
+	checkAccess(d.Actual, v1, v2)
+
+	// A conditional get records an access even if the value did not change.
+	d.MustActivate(id, "test", v3)
+	if _, err := d.Actual.GetConditional(id, "test", v3); !errors.Is(err, api.ErrValueNotChanged) {
+		t.Fatalf("GetConditional: got %v, want %v", err, api.ErrValueNotChanged)
+	}
+	checkAccess(d.Actual, v1, v2, v3)
+
+	// Access records are not persisted until flushed.
+	d2, err := db.Open(d.Path, d.Key, audit.New(io.Discard))
+	if err != nil {
+		t.Fatalf("reopening database: %v", err)
+	}
+	checkAccess(d2)
+
+	if err := d.Actual.FlushAccess(); err != nil {
+		t.Fatalf("FlushAccess: unexpected error: %v", err)
+	}
+	d3, err := db.Open(d.Path, d.Key, audit.New(io.Discard))
+	if err != nil {
+		t.Fatalf("reopening database: %v", err)
+	}
+	checkAccess(d3, v1, v2, v3)
+	if info, err := d3.Info(id, "test"); err != nil {
+		t.Fatalf("Info: unexpected error: %v", err)
+	} else if !info.AccessSince.Equal(since) {
+		t.Errorf("AccessSince after reopening: got %v, want %v", info.AccessSince, since)
+	}
+
+	// Deleting a version discards its access record.
+	if err := d.Actual.DeleteVersion(id, "test", v2); err != nil {
+		t.Fatalf("DeleteVersion: unexpected error: %v", err)
+	}
+	checkAccess(d.Actual, v1, v3)
+}
+
 // TODO(corp/13375): tests that verify ACL enforcement. Not
 // implementing yet because the structure and behavior of ACLs is
 // about to change a bunch, and I'd like to not have to implement the
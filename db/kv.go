@@ -5,6 +5,7 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -14,10 +15,12 @@ import (
 	"os"
 	"slices"
 
+	"github.com/leger-labs/leger/telemetry"
 	"github.com/leger-labs/leger/types/api"
 	"github.com/tink-crypto/tink-go/v2/aead"
 	"github.com/tink-crypto/tink-go/v2/keyset"
 	"github.com/tink-crypto/tink-go/v2/tink"
+	"go.opentelemetry.io/otel/attribute"
 	"tailscale.com/atomicfile"
 )
 
@@ -211,7 +214,7 @@ func newKV(path string, key tink.AEAD) (*kv, error) {
 		dekRaw:    encryptedDEK.Bytes(),
 		kekCipher: key,
 	}
-	if err := ret.save(); err != nil {
+	if err := ret.save(context.Background()); err != nil {
 		return nil, fmt.Errorf("creating database: %w", err)
 	}
 	return ret, nil
@@ -219,11 +222,13 @@ func newKV(path string, key tink.AEAD) (*kv, error) {
 
 // save encrypts and writes the kv to kv.path. If save return an
 // error, the file at kv.path is unchanged.
-func (kv *kv) save() (err error) {
+func (kv *kv) save(ctx context.Context) (err error) {
+	_, span := telemetry.Tracer().Start(ctx, "kv.save")
 	defer func() {
 		if err == nil {
 			kv.gen++
 		}
+		telemetry.End(span, err)
 	}()
 
 	clearDB, err := json.Marshal(persist{
@@ -244,6 +249,7 @@ func (kv *kv) save() (err error) {
 	if err != nil {
 		return fmt.Errorf("serializing encrypted database: %w", err)
 	}
+	span.SetAttributes(attribute.Int("kv.size", len(out)))
 	if err := atomicfile.WriteFile(kv.path, out, 0600); err != nil {
 		return fmt.Errorf("writing database to %q: %w", kv.path, err)
 	}
@@ -320,7 +326,7 @@ func (kv *kv) getVersion(name string, version api.SecretVersion) (*api.SecretVal
 // exists, value is saved as a new inactive version. Otherwise, value
 // is saved as the initial version of the secret and immediately set
 // active. On success, returns the secret version for the new value.
-func (kv *kv) put(name string, value []byte) (api.SecretVersion, error) {
+func (kv *kv) put(ctx context.Context, name string, value []byte) (api.SecretVersion, error) {
 	s := kv.secrets[name]
 	if s == nil {
 		kv.secrets[name] = &secret{
@@ -330,7 +336,7 @@ func (kv *kv) put(name string, value []byte) (api.SecretVersion, error) {
 				1: byteString(value),
 			},
 		}
-		if err := kv.save(); err != nil {
+		if err := kv.save(ctx); err != nil {
 			delete(kv.secrets, name)
 			return 0, err
 		}
@@ -346,7 +352,7 @@ func (kv *kv) put(name string, value []byte) (api.SecretVersion, error) {
 
 	s.LatestVersion++
 	s.Versions[s.LatestVersion] = bsValue
-	if err := kv.save(); err != nil {
+	if err := kv.save(ctx); err != nil {
 		delete(s.Versions, s.LatestVersion)
 		s.LatestVersion--
 		return 0, err
@@ -356,7 +362,7 @@ func (kv *kv) put(name string, value []byte) (api.SecretVersion, error) {
 
 // setActive changes the active version of the secret called name to
 // version.
-func (kv *kv) setActive(name string, version api.SecretVersion) error {
+func (kv *kv) setActive(ctx context.Context, name string, version api.SecretVersion) error {
 	if version == api.SecretVersionDefault {
 		return errors.New("invalid version")
 	}
@@ -372,7 +378,7 @@ func (kv *kv) setActive(name string, version api.SecretVersion) error {
 	}
 	old := secret.ActiveVersion
 	secret.ActiveVersion = version
-	if err := kv.save(); err != nil {
+	if err := kv.save(ctx); err != nil {
 		secret.ActiveVersion = old
 		return err
 	}
@@ -380,7 +386,7 @@ func (kv *kv) setActive(name string, version api.SecretVersion) error {
 }
 
 // deleteVersion deletes the specified version of a secret.
-func (kv *kv) deleteVersion(name string, version api.SecretVersion) error {
+func (kv *kv) deleteVersion(ctx context.Context, name string, version api.SecretVersion) error {
 	if version == api.SecretVersionDefault {
 		return errors.New("invalid version")
 	}
@@ -395,7 +401,7 @@ func (kv *kv) deleteVersion(name string, version api.SecretVersion) error {
 		return fmt.Errorf("version %v: %w", version, ErrNotFound)
 	}
 	delete(secret.Versions, version)
-	if err := kv.save(); err != nil {
+	if err := kv.save(ctx); err != nil {
 		secret.Versions[version] = old
 		return err
 	}
@@ -403,13 +409,13 @@ func (kv *kv) deleteVersion(name string, version api.SecretVersion) error {
 }
 
 // deleteSecret deletes all versions of a secret.
-func (kv *kv) deleteSecret(name string) error {
+func (kv *kv) deleteSecret(ctx context.Context, name string) error {
 	secret := kv.secrets[name]
 	if secret == nil {
 		return nil // the secret (already) has no version
 	}
 	delete(kv.secrets, name)
-	if err := kv.save(); err != nil {
+	if err := kv.save(ctx); err != nil {
 		kv.secrets[name] = secret
 		return err
 	}
@@ -0,0 +1,642 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package dynamic implements dynamic secrets, whose values are short-lived
+// credentials issued on demand by a backend.
+//
+// A dynamic secret is defined by a [Config], stored in the secrets database,
+// that names a backend and the parameters it needs. Each time a caller fetches
+// the secret, a [Manager] asks the backend to issue a fresh credential and
+// records a [Lease] for it. Leases expire after a TTL unless renewed, at which
+// point the Manager asks the backend to revoke the credential.
+//
+// The following backends are supported:
+//
+//   - "postgres" creates a PostgreSQL role with a random password for each
+//     lease, and drops the role when the lease ends (see [PostgresConfig]).
+//
+//   - "hmac" issues a bearer token signed with a shared HMAC key, which
+//     services can check with [VerifyToken] (see [HMACConfig]).
+package dynamic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/leger-labs/leger/audit"
+	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/atomicfile"
+)
+
+// ErrNotRenewable is reported when a lease is renewed whose backend cannot
+// extend the lifetime of a credential once it is issued.
+var ErrNotRenewable = errors.New("lease is not renewable")
+
+// Config is the configuration of a dynamic secret. It is stored as JSON:
+//
+//	{
+//	  "backend": "postgres",
+//	  "ttl": "1h",
+//	  "maxTTL": "24h",
+//	  "postgres": { ... }
+//	}
+type Config struct {
+	// Backend is the name of the backend that issues credentials.
+	Backend string `json:"backend"`
+
+	// TTL is the default lifetime of a lease. If zero, 1 hour is used.
+	TTL Duration `json:"ttl,omitempty"`
+
+	// MaxTTL is the longest a lease can be kept alive by renewing it,
+	// measured from when it was first issued. If zero, 24 hours is used.
+	MaxTTL Duration `json:"maxTTL,omitempty"`
+
+	// Postgres configures the "postgres" backend.
+	Postgres *PostgresConfig `json:"postgres,omitempty"`
+
+	// HMAC configures the "hmac" backend.
+	HMAC *HMACConfig `json:"hmac,omitempty"`
+}
+
+func (c *Config) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.TTL)
+}
+
+func (c *Config) maxTTL() time.Duration {
+	if c.MaxTTL <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.MaxTTL)
+}
+
+// ParseConfig parses and validates a JSON encoded dynamic secret Config.
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid dynamic secret config: %w", err)
+	}
+	if cfg.TTL > cfg.MaxTTL && cfg.MaxTTL > 0 {
+		return nil, errors.New("invalid dynamic secret config: ttl exceeds maxTTL")
+	}
+	var err error
+	switch cfg.Backend {
+	case "postgres":
+		err = cfg.Postgres.check()
+	case "hmac":
+		err = cfg.HMAC.check()
+	case "":
+		err = errors.New("no backend specified")
+	default:
+		err = fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid dynamic secret config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// newBackend constructs the backend described by cfg, which must be valid.
+func newBackend(cfg *Config) (Backend, error) {
+	switch cfg.Backend {
+	case "postgres":
+		return newPostgres(cfg.Postgres)
+	case "hmac":
+		return newHMAC(cfg.HMAC)
+	}
+	return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+}
+
+// Duration is a time.Duration that encodes to JSON as a string, like "1h30m".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// A Backend issues and revokes the credentials for a dynamic secret.
+type Backend interface {
+	// Issue creates a new credential valid until lease.Expires, and returns
+	// its fields. Issue may record in lease.State any information it needs to
+	// renew or revoke the credential later; this must not include secret
+	// material, as leases are stored unencrypted.
+	Issue(ctx context.Context, lease *Lease) (map[string]string, error)
+
+	// Renew extends the validity of the credential for lease until
+	// lease.Expires. If the backend cannot extend a credential once issued,
+	// Renew reports ErrNotRenewable.
+	Renew(ctx context.Context, lease *Lease) error
+
+	// Revoke invalidates the credential for lease.
+	Revoke(ctx context.Context, lease *Lease) error
+
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+// Lease records a credential issued for a dynamic secret.
+type Lease struct {
+	// ID is the unique identifier of the lease.
+	ID string `json:"id"`
+
+	// Secret is the name of the dynamic secret.
+	Secret string `json:"secret"`
+
+	// Serial is the version number reported to the caller for the credential.
+	// Serials increase with each lease issued for a secret.
+	Serial api.SecretVersion `json:"serial"`
+
+	// ConfigVersion is the version of the secret's configuration that was
+	// used to issue the credential.
+	ConfigVersion api.SecretVersion `json:"configVersion"`
+
+	// Principal is the caller to whom the credential was issued.
+	Principal audit.Principal `json:"principal"`
+
+	// RequestID, if set, identifies the call that issued the credential, so
+	// that a retry of the call can revoke the credential if it was lost.
+	RequestID string `json:"requestID,omitempty"`
+
+	// Issued is when the lease was created.
+	Issued time.Time `json:"issued"`
+
+	// Expires is when the lease expires, unless renewed.
+	Expires time.Time `json:"expires"`
+
+	// MaxExpires is the latest time to which the lease can be renewed.
+	MaxExpires time.Time `json:"maxExpires"`
+
+	// State is backend-specific information about the credential.
+	State map[string]string `json:"state,omitempty"`
+}
+
+// Info returns the public description of l.
+func (l *Lease) Info() *api.LeaseInfo {
+	return &api.LeaseInfo{ID: l.ID, Secret: l.Secret, Expires: l.Expires}
+}
+
+// HeldBy reports whether l was issued to p.
+func (l *Lease) HeldBy(p audit.Principal) bool {
+	return l.Principal.Hostname == p.Hostname && l.Principal.User == p.User
+}
+
+// ConfigFunc returns the active configuration of the dynamic secret called
+// name. The Value of the result is a JSON encoded Config. If name is not a
+// dynamic secret, ConfigFunc reports an error wrapping api.ErrNotFound.
+type ConfigFunc func(name string) (*api.SecretValue, error)
+
+// reapInterval is how often the Manager checks for expired leases.
+const reapInterval = 30 * time.Second
+
+// Manager issues, renews, and revokes leases on dynamic secrets.
+//
+// Leases are persisted to a file, so that credentials can be revoked when
+// they expire even if the server restarts in the meantime.
+//
+// Calls to backends are made without holding the Manager's lock, so that a
+// slow backend delays only the callers waiting on it.
+type Manager struct {
+	path       string
+	config     ConfigFunc
+	timeNow    func() time.Time
+	newBackend func(*Config) (Backend, error)
+
+	mu       sync.Mutex
+	leases   map[string]*Lease            // :: lease ID → lease
+	serials  map[string]api.SecretVersion // :: secret name → latest serial
+	backends map[string]*cachedBackend    // :: secret name → backend
+}
+
+type cachedBackend struct {
+	version api.SecretVersion // of the config used to construct it
+	cfg     *Config
+	Backend
+
+	// Guarded by Manager.mu.
+	refs  int  // calls in progress
+	stale bool // replaced by a newer config; closed when refs drops to zero
+}
+
+// leaseFile is the on-disk format of the lease file.
+type leaseFile struct {
+	Serials map[string]api.SecretVersion `json:"serials"`
+	Leases  []*Lease                     `json:"leases"`
+}
+
+// NewManager constructs a Manager that persists its leases at path, and uses
+// config to look up the configurations of dynamic secrets. If a lease file
+// exists at path, its leases are loaded.
+func NewManager(path string, config ConfigFunc) (*Manager, error) {
+	m := &Manager{
+		path:       path,
+		config:     config,
+		timeNow:    time.Now,
+		newBackend: newBackend,
+		leases:     make(map[string]*Lease),
+		serials:    make(map[string]api.SecretVersion),
+		backends:   make(map[string]*cachedBackend),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var lf leaseFile
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return nil, fmt.Errorf("loading leases: %w", err)
+	}
+	for _, l := range lf.Leases {
+		m.leases[l.ID] = l
+	}
+	if lf.Serials != nil {
+		m.serials = lf.Serials
+	}
+	return m, nil
+}
+
+// IsDynamic reports whether name is a dynamic secret.
+func (m *Manager) IsDynamic(name string) bool {
+	_, err := m.config(name)
+	return err == nil
+}
+
+// acquireLocked returns a backend for the named secret, constructing it from
+// the current active configuration if necessary. The caller must hold m.mu,
+// and must call release when done with the backend.
+func (m *Manager) acquireLocked(name string) (*cachedBackend, error) {
+	sv, err := m.config(name)
+	if err != nil {
+		return nil, err
+	}
+	if cb := m.backends[name]; cb != nil && cb.version == sv.Version {
+		cb.refs++
+		return cb, nil
+	}
+	cfg, err := ParseConfig(sv.Value)
+	if err != nil {
+		return nil, err
+	}
+	b, err := m.newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if old := m.backends[name]; old != nil {
+		old.stale = true
+		if old.refs == 0 {
+			old.Close()
+		}
+	}
+	cb := &cachedBackend{version: sv.Version, cfg: cfg, Backend: b, refs: 1}
+	m.backends[name] = cb
+	return cb, nil
+}
+
+// releaseLocked releases a backend returned by acquireLocked, closing it if
+// it has been replaced and is no longer in use. The caller must hold m.mu.
+func (m *Manager) releaseLocked(cb *cachedBackend) {
+	cb.refs--
+	if cb.stale && cb.refs == 0 {
+		cb.Close()
+	}
+}
+
+// release is like releaseLocked, but acquires m.mu.
+func (m *Manager) release(cb *cachedBackend) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releaseLocked(cb)
+}
+
+// Issue issues a new credential for the dynamic secret called name to p.
+//
+// If oldSerial is non-zero and identifies a lease held by p that has more than
+// a third of its TTL remaining, Issue reports api.ErrValueNotChanged instead of
+// issuing a new credential. This allows clients to poll for updates cheaply.
+//
+// If requestID is non-empty, it identifies the call: a client that retries a
+// call whose response was lost sends the same ID. Only the newest credential
+// issued for a request ID is kept; earlier ones are revoked, since the caller
+// never received them.
+func (m *Manager) Issue(ctx context.Context, name string, p audit.Principal, oldSerial api.SecretVersion, requestID string) (*api.SecretValue, error) {
+	m.mu.Lock()
+	cb, err := m.acquireLocked(name)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	now := m.timeNow().UTC()
+	if oldSerial != 0 {
+		for _, l := range m.leases {
+			if l.Secret == name && l.Serial == oldSerial && l.HeldBy(p) &&
+				l.Expires.Sub(now) > cb.cfg.ttl()/3 {
+				m.releaseLocked(cb)
+				m.mu.Unlock()
+				return nil, api.ErrValueNotChanged
+			}
+		}
+	}
+
+	// Reserve the serial, and issue the credential without holding the lock.
+	// A serial whose issue fails is skipped.
+	lease := &Lease{
+		ID:            newLeaseID(),
+		Secret:        name,
+		Serial:        m.serials[name] + 1,
+		ConfigVersion: cb.version,
+		Principal:     p,
+		RequestID:     requestID,
+		Issued:        now,
+		Expires:       now.Add(cb.cfg.ttl()),
+		MaxExpires:    now.Add(cb.cfg.maxTTL()),
+	}
+	m.serials[name] = lease.Serial
+	m.mu.Unlock()
+	defer m.release(cb)
+
+	data, err := cb.Issue(ctx, lease)
+	if err != nil {
+		return nil, fmt.Errorf("issuing credential for %q: %w", name, err)
+	}
+
+	m.mu.Lock()
+	superseded, newer := m.retriedLocked(lease)
+	if newer {
+		err = errors.New("superseded by a retry of the request")
+	} else {
+		for _, l := range superseded {
+			delete(m.leases, l.ID)
+		}
+		m.leases[lease.ID] = lease
+		err = m.saveLocked()
+		if err != nil {
+			delete(m.leases, lease.ID)
+			for _, l := range superseded {
+				m.leases[l.ID] = l
+			}
+			superseded = nil
+		}
+	}
+	m.mu.Unlock()
+	if err != nil {
+		// If we can't record the lease, we won't be able to revoke it later,
+		// so don't hand it out. Likewise if a retry has been answered
+		// instead.
+		if rerr := cb.Revoke(ctx, lease); rerr != nil {
+			log.Printf("dynamic: failed to revoke unsaved lease %s on %q: %v", lease.ID, name, rerr)
+		}
+		if newer {
+			return nil, err
+		}
+		return nil, fmt.Errorf("saving lease: %w", err)
+	}
+	if len(superseded) > 0 {
+		if err := m.revoke(ctx, superseded); err != nil {
+			log.Printf("dynamic: revoking leases superseded by a retry: %v", err)
+		}
+	}
+
+	value, err := json.Marshal(api.DynamicValue{
+		LeaseID: lease.ID,
+		Expires: lease.Expires,
+		Data:    data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.SecretValue{Value: value, Version: lease.Serial}, nil
+}
+
+// retriedLocked returns the leases issued for earlier attempts of the request
+// that issued lease, and reports whether one was issued for a later attempt.
+// The caller must hold m.mu.
+func (m *Manager) retriedLocked(lease *Lease) (earlier []*Lease, later bool) {
+	if lease.RequestID == "" {
+		return nil, false
+	}
+	for _, l := range m.leases {
+		if l.RequestID != lease.RequestID || l.Secret != lease.Secret || !l.HeldBy(lease.Principal) {
+			continue
+		}
+		if l.Serial > lease.Serial {
+			later = true
+		} else {
+			earlier = append(earlier, l)
+		}
+	}
+	return earlier, later
+}
+
+// Lookup returns the lease with the given ID, or an error wrapping
+// api.ErrNotFound if there is no such lease.
+func (m *Manager) Lookup(id string) (*Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.leases[id]
+	if !ok {
+		return nil, fmt.Errorf("lease %q: %w", id, api.ErrNotFound)
+	}
+	cp := *l
+	return &cp, nil
+}
+
+// Renew extends the lease with the given ID by ttl from now, or by the default
+// TTL of its secret if ttl is zero. The lease is never extended beyond its
+// maximum lifetime.
+func (m *Manager) Renew(ctx context.Context, id string, ttl time.Duration) (*api.LeaseInfo, error) {
+	m.mu.Lock()
+	l, ok := m.leases[id]
+	if !ok {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("lease %q: %w", id, api.ErrNotFound)
+	}
+	cb, err := m.acquireLocked(l.Secret)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = cb.cfg.ttl()
+	}
+	now := m.timeNow().UTC()
+	if !now.Before(l.Expires) {
+		m.releaseLocked(cb)
+		m.mu.Unlock()
+		return nil, fmt.Errorf("lease %q has expired: %w", id, api.ErrNotFound)
+	}
+
+	// The backend renews a copy of the lease without holding the lock, and
+	// the copy replaces the lease if it has not been revoked meanwhile.
+	renewed := *l
+	renewed.State = maps.Clone(l.State)
+	renewed.Expires = now.Add(ttl)
+	if renewed.Expires.After(renewed.MaxExpires) {
+		renewed.Expires = renewed.MaxExpires
+	}
+	m.mu.Unlock()
+	defer m.release(cb)
+
+	if err := cb.Renew(ctx, &renewed); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.leases[id]; !ok {
+		return nil, fmt.Errorf("lease %q was revoked: %w", id, api.ErrNotFound)
+	}
+	m.leases[id] = &renewed
+	if err := m.saveLocked(); err != nil {
+		return nil, fmt.Errorf("saving lease: %w", err)
+	}
+	return renewed.Info(), nil
+}
+
+// Revoke revokes the lease with the given ID immediately.
+func (m *Manager) Revoke(ctx context.Context, id string) error {
+	m.mu.Lock()
+	l, ok := m.leases[id]
+	if ok {
+		delete(m.leases, id)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("lease %q: %w", id, api.ErrNotFound)
+	}
+	return m.revoke(ctx, []*Lease{l})
+}
+
+// revoke revokes leases, which the caller has removed from m.leases so that
+// no one else renews or revokes them, and saves the outcome. Leases that
+// could not be revoked are put back, to be retried. If a secret's
+// configuration no longer exists, its leases are discarded without revoking
+// them, since there is no way to reach its backend. The caller must not hold
+// m.mu.
+func (m *Manager) revoke(ctx context.Context, leases []*Lease) error {
+	var errs []error
+	var failed []*Lease
+	for _, l := range leases {
+		if err := m.revokeOne(ctx, l); err != nil {
+			errs = append(errs, err)
+			failed = append(failed, l)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range failed {
+		m.leases[l.ID] = l
+	}
+	if err := m.saveLocked(); err != nil {
+		errs = append(errs, fmt.Errorf("saving leases: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// revokeOne revokes the credential for l with its backend. The caller must
+// not hold m.mu.
+func (m *Manager) revokeOne(ctx context.Context, l *Lease) error {
+	m.mu.Lock()
+	cb, err := m.acquireLocked(l.Secret)
+	m.mu.Unlock()
+	if errors.Is(err, api.ErrNotFound) {
+		log.Printf("dynamic: secret %q no longer exists; discarding lease %s", l.Secret, l.ID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer m.release(cb)
+	if err := cb.Revoke(ctx, l); err != nil {
+		return fmt.Errorf("revoking lease %s on %q: %w", l.ID, l.Secret, err)
+	}
+	return nil
+}
+
+// Reap revokes all leases that have expired. It attempts to revoke every
+// expired lease before reporting an error; leases that could not be revoked
+// are retried on the next call.
+func (m *Manager) Reap(ctx context.Context) error {
+	m.mu.Lock()
+	now := m.timeNow()
+	var expired []*Lease
+	for _, id := range slices.Sorted(maps.Keys(m.leases)) {
+		if l := m.leases[id]; !now.Before(l.Expires) {
+			expired = append(expired, l)
+			delete(m.leases, id)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(expired) == 0 {
+		return nil
+	}
+	return m.revoke(ctx, expired)
+}
+
+// Run reaps expired leases periodically until ctx ends.
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(reapInterval):
+		case <-ctx.Done():
+			return
+		}
+		if err := m.Reap(ctx); err != nil {
+			log.Printf("dynamic: reaping expired leases: %v", err)
+		}
+	}
+}
+
+// Leases returns a snapshot of all current leases, ordered by ID.
+func (m *Manager) Leases() []*Lease {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*Lease, 0, len(m.leases))
+	for _, id := range slices.Sorted(maps.Keys(m.leases)) {
+		cp := *m.leases[id]
+		out = append(out, &cp)
+	}
+	return out
+}
+
+// saveLocked writes the leases to disk. The caller must hold m.mu.
+func (m *Manager) saveLocked() error {
+	lf := leaseFile{Serials: m.serials}
+	for _, id := range slices.Sorted(maps.Keys(m.leases)) {
+		lf.Leases = append(lf.Leases, m.leases[id])
+	}
+	data, err := json.Marshal(lf)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(m.path, data, 0600)
+}
+
+func newLeaseID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("generating lease ID: %v", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,389 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dynamic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/audit"
+	"github.com/leger-labs/leger/types/api"
+)
+
+// fakeBackend is a Backend that records which credentials are live.
+type fakeBackend struct {
+	live map[string]time.Time // :: lease ID → expiration
+}
+
+func (f *fakeBackend) Issue(_ context.Context, l *Lease) (map[string]string, error) {
+	f.live[l.ID] = l.Expires
+	l.State = map[string]string{"user": "u-" + l.ID}
+	return map[string]string{"username": "u-" + l.ID, "password": "p"}, nil
+}
+
+func (f *fakeBackend) Renew(_ context.Context, l *Lease) error {
+	f.live[l.ID] = l.Expires
+	return nil
+}
+
+func (f *fakeBackend) Revoke(_ context.Context, l *Lease) error {
+	delete(f.live, l.ID)
+	return nil
+}
+
+func (*fakeBackend) Close() error { return nil }
+
+// configs is a ConfigFunc backed by a map.
+type configs map[string]string
+
+func (c configs) lookup(name string) (*api.SecretValue, error) {
+	v, ok := c[name]
+	if !ok {
+		return nil, fmt.Errorf("config %q: %w", name, api.ErrNotFound)
+	}
+	return &api.SecretValue{Value: []byte(v), Version: 1}, nil
+}
+
+func newTestManager(t *testing.T, path string, cfgs configs, fb *fakeBackend, now *time.Time) *Manager {
+	t.Helper()
+	m, err := NewManager(path, cfgs.lookup)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	m.timeNow = func() time.Time { return *now }
+	m.newBackend = func(cfg *Config) (Backend, error) {
+		if cfg.Backend == "hmac" {
+			return newHMAC(cfg.HMAC)
+		}
+		return fb, nil
+	}
+	return m
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{`{"backend":"postgres","postgres":{"dsn":"postgres://x"}}`, true},
+		{`{"backend":"postgres","ttl":"10m","maxTTL":"1h","postgres":{"dsn":"x","prefix":"app_"}}`, true},
+		{`{"backend":"hmac","hmac":{"key":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}}`, true},
+		{`{}`, false},
+		{`{"backend":"nonesuch"}`, false},
+		{`{"backend":"postgres"}`, false},
+		{`{"backend":"postgres","postgres":{"dsn":"x","prefix":"a;b"}}`, false},
+		{`{"backend":"hmac","hmac":{"key":"c2hvcnQ="}}`, false},
+		{`{"backend":"hmac","ttl":"2h","maxTTL":"1h","hmac":{"key":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}}`, false},
+		{`{"backend":"hmac","ttl":"bogus"}`, false},
+		{`not json`, false},
+	}
+	for _, tc := range tests {
+		_, err := ParseConfig([]byte(tc.input))
+		if got := err == nil; got != tc.ok {
+			t.Errorf("ParseConfig(%s): got err=%v, want ok=%v", tc.input, err, tc.ok)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "leases")
+	cfgs := configs{"db/app": `{"backend":"postgres","ttl":"1h","maxTTL":"3h","postgres":{"dsn":"x"}}`}
+	fb := &fakeBackend{live: make(map[string]time.Time)}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	alice := audit.Principal{Hostname: "box", User: "alice@example.com"}
+	bob := audit.Principal{Hostname: "box", User: "bob@example.com"}
+
+	m := newTestManager(t, path, cfgs, fb, &now)
+
+	issue := func(p audit.Principal, old api.SecretVersion) (*api.SecretValue, *api.DynamicValue) {
+		t.Helper()
+		sv, err := m.Issue(ctx, "db/app", p, old, "")
+		if err != nil {
+			t.Fatalf("Issue: unexpected error: %v", err)
+		}
+		var dv api.DynamicValue
+		if err := json.Unmarshal(sv.Value, &dv); err != nil {
+			t.Fatalf("Decode value: %v", err)
+		}
+		return sv, &dv
+	}
+
+	sv1, dv1 := issue(alice, 0)
+	if sv1.Version != 1 || dv1.Data["username"] != "u-"+dv1.LeaseID || !dv1.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("Issue: got version %v, value %+v", sv1.Version, dv1)
+	}
+	if _, err := m.Issue(ctx, "nonesuch", alice, 0, ""); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Issue nonesuch: got %v, want %v", err, api.ErrNotFound)
+	}
+
+	// A conditional fetch by the holder of a fresh lease does not issue a new
+	// credential, but one by another caller does.
+	if _, err := m.Issue(ctx, "db/app", alice, sv1.Version, ""); !errors.Is(err, api.ErrValueNotChanged) {
+		t.Errorf("Issue conditional: got %v, want %v", err, api.ErrValueNotChanged)
+	}
+	sv2, _ := issue(bob, sv1.Version)
+	if sv2.Version != 2 {
+		t.Errorf("Issue bob: got version %v, want 2", sv2.Version)
+	}
+
+	// Once a lease nears expiry, a conditional fetch issues a new credential.
+	now = now.Add(50 * time.Minute)
+	if sv, _ := issue(alice, sv1.Version); sv.Version != 3 {
+		t.Errorf("Issue near expiry: got version %v, want 3", sv.Version)
+	}
+
+	// Renewal extends the lease, but not past its maximum lifetime.
+	info, err := m.Renew(ctx, dv1.LeaseID, 0)
+	if err != nil {
+		t.Fatalf("Renew: unexpected error: %v", err)
+	}
+	if want := now.Add(time.Hour); !info.Expires.Equal(want) || !fb.live[dv1.LeaseID].Equal(want) {
+		t.Errorf("Renew: got expiry %v, want %v", info.Expires, want)
+	}
+	info, err = m.Renew(ctx, dv1.LeaseID, 10*time.Hour)
+	if err != nil {
+		t.Fatalf("Renew: unexpected error: %v", err)
+	}
+	if want := now.Add(-50 * time.Minute).Add(3 * time.Hour); !info.Expires.Equal(want) {
+		t.Errorf("Renew past max: got expiry %v, want %v", info.Expires, want)
+	}
+
+	// Leases survive a restart.
+	m = newTestManager(t, path, cfgs, fb, &now)
+	if got := len(m.Leases()); got != 3 {
+		t.Errorf("Reloaded leases: got %d, want 3", got)
+	}
+	if sv, _ := issue(alice, 0); sv.Version != 4 {
+		t.Errorf("Issue after reload: got version %v, want 4", sv.Version)
+	}
+
+	// Expired leases are revoked by Reap; the renewed one remains.
+	now = now.Add(90 * time.Minute)
+	if err := m.Reap(ctx); err != nil {
+		t.Fatalf("Reap: unexpected error: %v", err)
+	}
+	if got := m.Leases(); len(got) != 1 || got[0].ID != dv1.LeaseID {
+		t.Errorf("Leases after reap: got %+v, want only %s", got, dv1.LeaseID)
+	}
+	if len(fb.live) != 1 {
+		t.Errorf("Live credentials after reap: got %v, want 1", fb.live)
+	}
+
+	// Explicit revocation.
+	if err := m.Revoke(ctx, dv1.LeaseID); err != nil {
+		t.Fatalf("Revoke: unexpected error: %v", err)
+	}
+	if len(fb.live) != 0 || len(m.Leases()) != 0 {
+		t.Errorf("After revoke: live=%v, leases=%v", fb.live, m.Leases())
+	}
+	if err := m.Revoke(ctx, dv1.LeaseID); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("Revoke again: got %v, want %v", err, api.ErrNotFound)
+	}
+
+	// The lease file does not contain credentials.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Read lease file: %v", err)
+	}
+	var lf leaseFile
+	if err := json.Unmarshal(data, &lf); err != nil {
+		t.Fatalf("Decode lease file: %v", err)
+	}
+	if lf.Serials["db/app"] != 4 {
+		t.Errorf("Lease file serial: got %v, want 4", lf.Serials["db/app"])
+	}
+}
+
+func TestRetriedIssue(t *testing.T) {
+	ctx := context.Background()
+	cfgs := configs{"db/app": `{"backend":"postgres","postgres":{"dsn":"x"}}`}
+	fb := &fakeBackend{live: make(map[string]time.Time)}
+	now := time.Now()
+	m := newTestManager(t, filepath.Join(t.TempDir(), "leases"), cfgs, fb, &now)
+	bob := audit.Principal{Hostname: "box", User: "bob"}
+
+	issue := func(requestID string) *api.DynamicValue {
+		t.Helper()
+		sv, err := m.Issue(ctx, "db/app", bob, 0, requestID)
+		if err != nil {
+			t.Fatalf("Issue %s: unexpected error: %v", requestID, err)
+		}
+		var dv api.DynamicValue
+		if err := json.Unmarshal(sv.Value, &dv); err != nil {
+			t.Fatalf("Decode value: %v", err)
+		}
+		return &dv
+	}
+
+	// A retry of a request whose response was lost revokes the credential
+	// issued for the earlier attempt, but not those of other requests.
+	other := issue("req0")
+	lost := issue("req1")
+	retry := issue("req1")
+	if _, ok := fb.live[lost.LeaseID]; ok {
+		t.Errorf("Credential of lost response is still live")
+	}
+	var ids []string
+	for _, l := range m.Leases() {
+		ids = append(ids, l.ID)
+	}
+	want := []string{other.LeaseID, retry.LeaseID}
+	slices.Sort(want)
+	if !slices.Equal(ids, want) {
+		t.Errorf("Leases: got %v, want %v", ids, want)
+	}
+}
+
+// blockingBackend is a Backend whose Issue waits until release is closed.
+type blockingBackend struct {
+	fakeBackend
+	release chan struct{}
+}
+
+func (b *blockingBackend) Issue(context.Context, *Lease) (map[string]string, error) {
+	<-b.release
+	return map[string]string{"username": "slow"}, nil
+}
+
+func TestSlowBackend(t *testing.T) {
+	ctx := context.Background()
+	key := []byte("0123456789012345678901234567890123456789")
+	tok, err := json.Marshal(Config{Backend: "hmac", HMAC: &HMACConfig{Key: key}})
+	if err != nil {
+		t.Fatalf("Marshal config: %v", err)
+	}
+	cfgs := configs{
+		"db/slow": `{"backend":"postgres","postgres":{"dsn":"x"}}`,
+		"tok":     string(tok),
+	}
+	now := time.Now()
+	slow := &blockingBackend{release: make(chan struct{})}
+	m := newTestManager(t, filepath.Join(t.TempDir(), "leases"), cfgs, nil, &now)
+	m.newBackend = func(cfg *Config) (Backend, error) {
+		if cfg.Backend == "hmac" {
+			return newHMAC(cfg.HMAC)
+		}
+		return slow, nil
+	}
+	alice := audit.Principal{Hostname: "box", User: "alice"}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Issue(ctx, "db/slow", alice, 0, "")
+		done <- err
+	}()
+
+	// While the slow backend is issuing, other secrets are still served.
+	sv, err := m.Issue(ctx, "tok", alice, 0, "")
+	if err != nil {
+		t.Fatalf("Issue tok: unexpected error: %v", err)
+	}
+	var dv api.DynamicValue
+	if err := json.Unmarshal(sv.Value, &dv); err != nil {
+		t.Fatalf("Decode value: %v", err)
+	}
+	if err := m.Revoke(ctx, dv.LeaseID); err != nil {
+		t.Errorf("Revoke tok: unexpected error: %v", err)
+	}
+
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Issue db/slow: unexpected error: %v", err)
+	}
+	if got := m.Leases(); len(got) != 1 || got[0].Secret != "db/slow" {
+		t.Errorf("Leases: got %+v, want one on db/slow", got)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	ctx := context.Background()
+	key := []byte("0123456789012345678901234567890123456789")
+	cfg, err := json.Marshal(Config{Backend: "hmac", TTL: Duration(time.Minute), HMAC: &HMACConfig{Key: key, Audience: "svc"}})
+	if err != nil {
+		t.Fatalf("Marshal config: %v", err)
+	}
+	now := time.Now()
+	m := newTestManager(t, filepath.Join(t.TempDir(), "leases"), configs{"tok": string(cfg)}, nil, &now)
+
+	sv, err := m.Issue(ctx, "tok", audit.Principal{Hostname: "box", User: "alice"}, 0, "")
+	if err != nil {
+		t.Fatalf("Issue: unexpected error: %v", err)
+	}
+	var dv api.DynamicValue
+	if err := json.Unmarshal(sv.Value, &dv); err != nil {
+		t.Fatalf("Decode value: %v", err)
+	}
+	token := dv.Data["token"]
+
+	claims, err := VerifyToken(key, token, "svc", now)
+	if err != nil {
+		t.Fatalf("VerifyToken: unexpected error: %v", err)
+	}
+	if claims.Subject != "box/alice" || claims.LeaseID != dv.LeaseID {
+		t.Errorf("VerifyToken: got claims %+v", claims)
+	}
+	if _, err := VerifyToken(key, token, "other", now); err == nil {
+		t.Error("VerifyToken with wrong audience: got nil error")
+	}
+	if _, err := VerifyToken(key, token, "svc", now.Add(2*time.Minute)); err == nil {
+		t.Error("VerifyToken after expiry: got nil error")
+	}
+	if _, err := VerifyToken([]byte("wrong key wrong key wrong key wrong"), token, "svc", now); err == nil {
+		t.Error("VerifyToken with wrong key: got nil error")
+	}
+
+	if _, err := m.Renew(ctx, dv.LeaseID, 0); !errors.Is(err, ErrNotRenewable) {
+		t.Errorf("Renew: got %v, want %v", err, ErrNotRenewable)
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("LEGER_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("LEGER_TEST_POSTGRES_DSN is not set")
+	}
+	ctx := context.Background()
+	pg, err := newPostgres(&PostgresConfig{DSN: dsn, Prefix: "legertest_"})
+	if err != nil {
+		t.Fatalf("newPostgres: %v", err)
+	}
+	defer pg.Close()
+
+	lease := &Lease{ID: "test", Expires: time.Now().Add(time.Hour)}
+	creds, err := pg.Issue(ctx, lease)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	var exists bool
+	check := func() bool {
+		t.Helper()
+		err := pg.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`,
+			creds["username"]).Scan(&exists)
+		if err != nil {
+			t.Fatalf("Query role: %v", err)
+		}
+		return exists
+	}
+	if !check() {
+		t.Errorf("Role %q was not created", creds["username"])
+	}
+	lease.Expires = lease.Expires.Add(time.Hour)
+	if err := pg.Renew(ctx, lease); err != nil {
+		t.Errorf("Renew: %v", err)
+	}
+	if err := pg.Revoke(ctx, lease); err != nil {
+		t.Errorf("Revoke: %v", err)
+	}
+	if check() {
+		t.Errorf("Role %q was not dropped", creds["username"])
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dynamic
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HMACConfig configures the "hmac" backend, which issues bearer tokens signed
+// with a shared key. A service that holds the same key can check a token with
+// [VerifyToken], without contacting the server.
+//
+// Tokens cannot be revoked before they expire, nor renewed: a caller that
+// needs a token for longer should fetch a new one.
+type HMACConfig struct {
+	// Key is the HMAC-SHA256 signing key. It must be at least 32 bytes.
+	// In JSON it is encoded as base64.
+	Key []byte `json:"key"`
+
+	// Audience, if set, is included in each token and identifies the service
+	// the token is intended for.
+	Audience string `json:"audience,omitempty"`
+}
+
+func (c *HMACConfig) check() error {
+	if c == nil {
+		return errors.New(`missing "hmac" settings`)
+	} else if len(c.Key) < 32 {
+		return errors.New("hmac key must be at least 32 bytes")
+	}
+	return nil
+}
+
+// TokenClaims are the contents of a token issued by the "hmac" backend.
+type TokenClaims struct {
+	// LeaseID is the ID of the lease the token was issued under.
+	LeaseID string `json:"lid"`
+
+	// Subject identifies the caller to whom the token was issued: the
+	// hostname of the node, and the login name of the user if the node is not
+	// tagged.
+	Subject string `json:"sub"`
+
+	// Audience is the Audience of the backend configuration, if any.
+	Audience string `json:"aud,omitempty"`
+
+	// IssuedAt and Expires are the validity period of the token, in seconds
+	// since the Unix epoch.
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+}
+
+type hmacBackend struct {
+	cfg *HMACConfig
+}
+
+func newHMAC(cfg *HMACConfig) (*hmacBackend, error) { return &hmacBackend{cfg: cfg}, nil }
+
+// Issue implements part of the Backend interface. The resulting credential
+// has a single "token" field.
+func (h *hmacBackend) Issue(_ context.Context, lease *Lease) (map[string]string, error) {
+	sub := lease.Principal.Hostname
+	if lease.Principal.User != "" {
+		sub += "/" + lease.Principal.User
+	}
+	payload, err := json.Marshal(TokenClaims{
+		LeaseID:  lease.ID,
+		Subject:  sub,
+		Audience: h.cfg.Audience,
+		IssuedAt: lease.Issued.Unix(),
+		Expires:  lease.Expires.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	return map[string]string{"token": enc + "." + sign(h.cfg.Key, enc)}, nil
+}
+
+// Renew implements part of the Backend interface. Tokens cannot be renewed,
+// since their expiration is part of the signed payload.
+func (*hmacBackend) Renew(context.Context, *Lease) error { return ErrNotRenewable }
+
+// Revoke implements part of the Backend interface. Tokens remain valid until
+// they expire, so there is nothing to do.
+func (*hmacBackend) Revoke(context.Context, *Lease) error { return nil }
+
+// Close implements part of the Backend interface.
+func (*hmacBackend) Close() error { return nil }
+
+func sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyToken checks that token was issued by an "hmac" backend using key,
+// and has not expired as of now. If audience is non-empty, the token must
+// have been issued for that audience. On success, it returns the claims of
+// the token.
+func VerifyToken(key []byte, token, audience string, now time.Time) (*TokenClaims, error) {
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("malformed token")
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(key, enc))) {
+		return nil, errors.New("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %w", err)
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token: %w", err)
+	}
+	if now.Unix() >= claims.Expires {
+		return nil, errors.New("token has expired")
+	}
+	if audience != "" && claims.Audience != audience {
+		return nil, fmt.Errorf("token audience is %q, want %q", claims.Audience, audience)
+	}
+	return &claims, nil
+}
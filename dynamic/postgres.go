@@ -0,0 +1,170 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dynamic
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresConfig configures the "postgres" backend, which creates a database
+// role for each lease.
+//
+// The statements used to manage roles are templates, in which the following
+// placeholders are replaced before execution:
+//
+//	{{name}}        the quoted name of the role
+//	{{password}}    the quoted password of the role
+//	{{expiration}}  the quoted expiration time of the lease, as a timestamp
+//
+// Names and passwords are generated by the server and contain only letters
+// and digits, but they are quoted regardless.
+type PostgresConfig struct {
+	// DSN is the connection string for the database, which must grant
+	// permission to create and drop roles.
+	DSN string `json:"dsn"`
+
+	// Creation are the statements executed to create a role.
+	// If empty, the role is created with LOGIN and VALID UNTIL the expiration.
+	Creation []string `json:"creation,omitempty"`
+
+	// Renewal are the statements executed to extend a role's lifetime.
+	// If empty, the VALID UNTIL of the role is updated.
+	Renewal []string `json:"renewal,omitempty"`
+
+	// Revocation are the statements executed to remove a role.
+	// If empty, the role is dropped.
+	Revocation []string `json:"revocation,omitempty"`
+
+	// Prefix is prepended to the names of generated roles.
+	// If empty, "leger_" is used.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+var (
+	defaultCreation = []string{
+		`CREATE ROLE {{name}} WITH LOGIN PASSWORD {{password}} VALID UNTIL {{expiration}}`,
+	}
+	defaultRenewal = []string{
+		`ALTER ROLE {{name}} VALID UNTIL {{expiration}}`,
+	}
+	defaultRevocation = []string{
+		`DROP ROLE IF EXISTS {{name}}`,
+	}
+)
+
+func (c *PostgresConfig) check() error {
+	if c == nil {
+		return errors.New(`missing "postgres" settings`)
+	} else if c.DSN == "" {
+		return errors.New("postgres dsn is required")
+	}
+	for _, p := range c.Prefix {
+		if !isAlnum(p) && p != '_' {
+			return fmt.Errorf("invalid character %q in role prefix", p)
+		}
+	}
+	return nil
+}
+
+func isAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+type postgresBackend struct {
+	cfg *PostgresConfig
+	db  *sql.DB
+}
+
+func newPostgres(cfg *PostgresConfig) (*postgresBackend, error) {
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresBackend{cfg: cfg, db: db}, nil
+}
+
+// Issue implements part of the Backend interface. The resulting credential
+// has "username" and "password" fields.
+func (p *postgresBackend) Issue(ctx context.Context, lease *Lease) (map[string]string, error) {
+	prefix := p.cfg.Prefix
+	if prefix == "" {
+		prefix = "leger_"
+	}
+	name := prefix + strings.ToLower(randomString(10))
+	password := randomString(32)
+	if err := p.exec(ctx, orDefault(p.cfg.Creation, defaultCreation), name, password, lease.Expires); err != nil {
+		// Creation may have partially succeeded; clean up as best we can.
+		p.exec(ctx, orDefault(p.cfg.Revocation, defaultRevocation), name, "", lease.Expires)
+		return nil, err
+	}
+	lease.State = map[string]string{"username": name}
+	return map[string]string{"username": name, "password": password}, nil
+}
+
+// Renew implements part of the Backend interface.
+func (p *postgresBackend) Renew(ctx context.Context, lease *Lease) error {
+	return p.exec(ctx, orDefault(p.cfg.Renewal, defaultRenewal), lease.State["username"], "", lease.Expires)
+}
+
+// Revoke implements part of the Backend interface.
+func (p *postgresBackend) Revoke(ctx context.Context, lease *Lease) error {
+	name := lease.State["username"]
+	if name == "" {
+		return nil // nothing was created
+	}
+	return p.exec(ctx, orDefault(p.cfg.Revocation, defaultRevocation), name, "", lease.Expires)
+}
+
+// Close implements part of the Backend interface.
+func (p *postgresBackend) Close() error { return p.db.Close() }
+
+// exec executes stmts in a single transaction, after expanding them.
+func (p *postgresBackend) exec(ctx context.Context, stmts []string, name, password string, expires time.Time) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, expand(stmt, name, password, expires)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// expand replaces the placeholders in stmt with quoted values.
+func expand(stmt, name, password string, expires time.Time) string {
+	return strings.NewReplacer(
+		"{{name}}", pq.QuoteIdentifier(name),
+		"{{password}}", pq.QuoteLiteral(password),
+		"{{expiration}}", pq.QuoteLiteral(expires.UTC().Format(time.RFC3339)),
+	).Replace(stmt)
+}
+
+func orDefault(stmts, dflt []string) []string {
+	if len(stmts) == 0 {
+		return dflt
+	}
+	return stmts
+}
+
+// randomString returns a random string of n letters and digits.
+func randomString(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("generating random string: %v", err))
+	}
+	s := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return s[:n]
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/leger-labs/leger/internal/backup"
+	"github.com/leger-labs/leger/internal/state"
 	"github.com/spf13/cobra"
 )
 
@@ -252,8 +253,10 @@ Examples:
 			fmt.Println("Starting services...")
 
 			if err := backupMgr.Restore(backupID); err != nil {
+				recordFailure(b.DeploymentName, state.ActionRestore, "", "", err)
 				return err
 			}
+			recordDeployment(b.DeploymentName, state.ActionRestore, "", "", "from backup "+backupID)
 
 			fmt.Printf("\n✓ Restored successfully from %s\n", backupID)
 
@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/spf13/cobra"
+)
+
+// cacheCmd returns the cache command group
+func cacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the Git source cache",
+		Long: `Manage the cache of Git repositories that quadlets are installed from.
+
+Each repository is kept as a bare mirror under ~/.local/share/leger/git-cache,
+so later installs and updates only fetch new commits.
+
+Examples:
+  leger cache list
+  leger cache prune
+  leger cache prune --older-than 168h
+  leger cache prune --all`,
+	}
+
+	cmd.AddCommand(cacheListCmd())
+	cmd.AddCommand(cachePruneCmd())
+
+	return cmd
+}
+
+// cacheListCmd returns the cache list command
+func cacheListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List cached repositories",
+		Long:  `List the cached Git repositories with their size and when they were last used.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cache, err := git.NewCache()
+			if err != nil {
+				return err
+			}
+
+			entries, err := cache.List()
+			if err != nil {
+				return err
+			}
+
+			if len(entries) == 0 {
+				fmt.Println("No cached repositories")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tSIZE\tLAST USED")
+			fmt.Fprintln(w, strings.Repeat("-", 80))
+
+			var total int64
+			for _, e := range entries {
+				lastUsed := "never"
+				if !e.LastUsed.IsZero() {
+					lastUsed = e.LastUsed.Local().Format("2006-01-02 15:04")
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", e.URL, formatSize(e.Size), lastUsed)
+				total += e.Size
+			}
+
+			w.Flush()
+
+			fmt.Printf("\nTotal: %d repositories, %s in %s\n", len(entries), formatSize(total), cache.Dir)
+
+			return nil
+		},
+	}
+}
+
+// cachePruneCmd returns the cache prune command
+func cachePruneCmd() *cobra.Command {
+	var olderThan time.Duration
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove unused cached repositories",
+		Long: `Remove cached repositories that have not been used recently.
+
+Checkouts left behind by interrupted invocations are removed as well.
+Removed repositories are cloned again the next time they are used.
+
+Flags:
+  --older-than duration   Remove repositories unused for this long (default: 720h)
+  --all                   Remove all cached repositories
+
+Examples:
+  leger cache prune
+  leger cache prune --older-than 168h
+  leger cache prune --all`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if olderThan <= 0 && !all {
+				return fmt.Errorf("--older-than must be positive (use --all to remove everything)")
+			}
+			if all {
+				olderThan = 0
+			}
+
+			cache, err := git.NewCache()
+			if err != nil {
+				return err
+			}
+
+			removed, err := cache.Prune(olderThan)
+			for _, e := range removed {
+				fmt.Printf("✓ Removed %s (%s)\n", e.URL, formatSize(e.Size))
+			}
+			if err != nil {
+				return fmt.Errorf("failed to prune cache: %w", err)
+			}
+			if len(removed) == 0 {
+				fmt.Println("No cached repositories to remove")
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationVar(&olderThan, "older-than", 30*24*time.Hour, "Remove repositories unused for this long")
+	cmd.Flags().BoolVar(&all, "all", false, "Remove all cached repositories")
+
+	return cmd
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	"github.com/leger-labs/leger/internal/auth"
+	"github.com/leger-labs/leger/internal/config"
 	"github.com/leger-labs/leger/internal/git"
 	"github.com/leger-labs/leger/internal/legerrun"
 	"github.com/leger-labs/leger/pkg/types"
@@ -200,3 +201,21 @@ repository locations, and legerd connection details.`,
 		},
 	}
 }
+
+// loadConfig loads the config file named by --config, or the default one,
+// and registers the Git forges it configures.
+func loadConfig() (*config.Config, error) {
+	path, _ := RootCmd.PersistentFlags().GetString("config")
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	for host, name := range cfg.Git.Forges {
+		forge, err := git.ParseForge(name)
+		if err != nil {
+			return nil, fmt.Errorf("config: git.forges: %s: %w", host, err)
+		}
+		git.RegisterForge(host, forge)
+	}
+	return cfg, nil
+}
@@ -1,10 +1,10 @@
 package cli
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -15,9 +15,13 @@ import (
 	"github.com/leger-labs/leger/internal/daemon"
 	"github.com/leger-labs/leger/internal/git"
 	"github.com/leger-labs/leger/internal/legerrun"
+	"github.com/leger-labs/leger/internal/overlay"
 	"github.com/leger-labs/leger/internal/podman"
 	"github.com/leger-labs/leger/internal/quadlet"
+	"github.com/leger-labs/leger/internal/render"
 	"github.com/leger-labs/leger/internal/staging"
+	"github.com/leger-labs/leger/internal/state"
+	"github.com/leger-labs/leger/internal/txn"
 	"github.com/leger-labs/leger/internal/ui"
 	"github.com/leger-labs/leger/internal/validation"
 	"github.com/spf13/cobra"
@@ -35,16 +39,34 @@ func deployCmd() *cobra.Command {
 	cmd.AddCommand(deployUpdateCmd())
 	cmd.AddCommand(deployListCmd())
 	cmd.AddCommand(deployRemoveCmd())
+	cmd.AddCommand(deployShowCmd())
+	cmd.AddCommand(deployHistoryCmd())
 
 	return cmd
 }
 
+// Values of the install --on-failure flag.
+const (
+	onFailureRollback = "rollback"
+	onFailureKeep     = "keep"
+)
+
 var installFlags struct {
 	source    string
 	noStart   bool
 	dryRun    bool
 	force     bool
 	noSecrets bool
+	onFailure string
+
+	allowedSigners string
+	values         []string
+	set            []string
+	overlay        string
+
+	// commit is checked out if the Git source is not pinned to a ref, so
+	// that sync installs the commit it planned with. It is not a flag.
+	commit string
 }
 
 // deployInstallCmd returns the deploy install command
@@ -58,16 +80,42 @@ This command:
 1. Validates authentication and legerd connectivity
 2. Downloads quadlet files from source repository
 3. Parses quadlet files for Secret= directives
-4. Creates setec.Store with AllowLookup enabled
-5. Fetches required secrets from legerd
-6. Creates Podman secrets for each required secret
+4. Validates quadlets and checks for port conflicts
+5. Fetches required secrets from legerd and creates Podman secrets
+6. Saves the deployment to the active directory
 7. Installs quadlets using: podman quadlet install --user
 8. Starts services (unless --no-start)
 
+Steps 5 to 8 form a transaction. If any of them fails, the completed steps
+are undone: created secrets are removed, replaced secrets get their previous
+values back, installed quadlets are removed or restored, services that were
+not already running are stopped, and systemd is reloaded. With
+--on-failure=keep the partial install is left in place for debugging, and
+its journal is kept under ~/.local/share/leger/journal.
+
 Source can be:
 - Empty (uses your leger.run repository)
 - Git URL (e.g., https://github.com/org/repo)
+- Git URL pinned to a tag or commit (e.g., https://github.com/org/repo@v1.2.0)
 - Local path (e.g., ~/quadlets)
+
+If an allowed-signers file is given with --allowed-signers, or exists at
+~/.config/leger/allowed_signers, Git sources must carry an SSH or GPG
+signature from an allowed signer, on the pinned tag or on the commit.
+
+Files ending in .tmpl (e.g., app.container.tmpl) are rendered with Go
+templates before the quadlets are parsed, validated and installed. Values
+come from the manifest's values section, then values/<hostname>.yaml in the
+source, then --values files, then --set key=value. Templates can also call
+hostname, shortHostname, tailscaleHostname, tailscaleIP and tailscaleTailnet.
+Secrets are never available to templates; keep using Secret= lines.
+
+An overlay directory, given with --overlay or found at
+~/.config/leger/overlays/<name>, patches the quadlets after rendering: its
+overlay.yaml can replace images, set, add and remove keys and remove files,
+and its other files (e.g., app.container.d/10-host.conf) are added. The
+quadlets before the overlay are kept, so that later updates can show
+upstream changes and the overlay's separately.
 `,
 		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -78,6 +126,12 @@ Source can be:
 				name = args[0]
 			}
 
+			switch installFlags.onFailure {
+			case onFailureRollback, onFailureKeep:
+			default:
+				return fmt.Errorf("invalid --on-failure %q: must be %q or %q", installFlags.onFailure, onFailureRollback, onFailureKeep)
+			}
+
 			return runDeployInstall(ctx, name)
 		},
 	}
@@ -87,15 +141,20 @@ Source can be:
 	cmd.Flags().BoolVar(&installFlags.dryRun, "dry-run", false, "Validate and show what would be installed")
 	cmd.Flags().BoolVar(&installFlags.force, "force", false, "Skip conflict checks")
 	cmd.Flags().BoolVar(&installFlags.noSecrets, "no-secrets", false, "Skip secret injection (for testing)")
+	cmd.Flags().StringVar(&installFlags.allowedSigners, "allowed-signers", "", "Require Git sources signed by a key in this file (default: ~/.config/leger/allowed_signers, if present)")
+	cmd.Flags().StringVar(&installFlags.onFailure, "on-failure", onFailureRollback, "On failure, rollback completed steps or keep them")
+	cmd.Flags().StringArrayVar(&installFlags.values, "values", nil, "Values file for rendering templates (repeatable)")
+	cmd.Flags().StringArrayVar(&installFlags.set, "set", nil, "Set a template value, key=value (repeatable)")
+	cmd.Flags().StringVar(&installFlags.overlay, "overlay", "", "Overlay directory patching the quadlets (default: ~/.config/leger/overlays/<name>, if present)")
 
 	return cmd
 }
 
-func runDeployInstall(ctx context.Context, name string) error {
+func runDeployInstall(ctx context.Context, name string) (err error) {
 	ui.InfoPrintf("Installing deployment: %s\n\n", name)
 
 	// Step 1: Verify prerequisites
-	fmt.Println(ui.Bold("Step 1/7: Verifying prerequisites..."))
+	fmt.Println(ui.Bold("Step 1/8: Verifying prerequisites..."))
 
 	var userUUID string
 	var daemonClient *daemon.Client
@@ -121,16 +180,20 @@ func runDeployInstall(ctx context.Context, name string) error {
 	ui.SuccessPrintf("✓ Prerequisites verified\n\n")
 
 	// Step 2: Download/locate quadlet files
-	fmt.Println("Step 2/7: Locating quadlet files...")
+	fmt.Println("Step 2/8: Locating quadlet files...")
 
 	var quadletDir string
-	var err error
 	if installFlags.source == "" {
 		// Use leger.run repository
 		quadletDir, err = downloadFromLegerRun(ctx, userUUID, name)
 	} else if isURL(installFlags.source) {
 		// Clone from Git
-		quadletDir, err = cloneGitRepo(ctx, installFlags.source, name)
+		var co *git.Checkout
+		co, err = cloneGitRepo(ctx, installFlags.source, name)
+		if err == nil {
+			defer co.Close()
+			quadletDir = co.Dir
+		}
 	} else {
 		// Use local path
 		quadletDir = installFlags.source
@@ -144,10 +207,40 @@ func runDeployInstall(ctx context.Context, name string) error {
 	}
 
 	fmt.Printf("✓ Quadlet directory: %s\n", quadletDir)
+
+	// Templates are rendered into a copy, and the rest of the install
+	// works on the rendered quadlets.
+	sourceDir := quadletDir
+	if ok, err := render.HasTemplates(quadletDir); err != nil {
+		return err
+	} else if ok {
+		opts := render.Options{ValuesFiles: installFlags.values, Set: installFlags.set}
+		quadletDir, err = renderTemplates(ctx, sourceDir, name, opts)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(quadletDir)
+	}
+
+	// The overlay is applied to another copy, and the quadlets before it
+	// are kept as the deployment's base.
+	ov, err := overlay.Find(installFlags.overlay, name)
+	if err != nil {
+		return err
+	}
+	var baseDir string
+	if ov != nil {
+		baseDir = quadletDir
+		quadletDir, err = applyOverlay(baseDir, ov)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(quadletDir)
+	}
 	fmt.Println()
 
 	// Step 3: Parse quadlet files for secrets
-	fmt.Println("Step 3/7: Parsing quadlet files...")
+	fmt.Println("Step 3/8: Parsing quadlet files...")
 
 	parseResult, err := quadlet.ParseDirectory(quadletDir)
 	if err != nil {
@@ -165,23 +258,8 @@ func runDeployInstall(ctx context.Context, name string) error {
 	}
 	fmt.Println()
 
-	// Step 4: Create setec.Store and fetch secrets
-	if len(parseResult.Secrets) > 0 && !installFlags.noSecrets {
-		fmt.Println("Step 4/7: Fetching secrets from legerd...")
-
-		if err := fetchAndCreateSecrets(ctx, daemonClient, userUUID, parseResult); err != nil {
-			return fmt.Errorf("failed to handle secrets: %w", err)
-		}
-
-		fmt.Printf("✓ All %d secrets available\n", len(parseResult.Secrets))
-		fmt.Println()
-	} else {
-		fmt.Println("Step 4/7: No secrets to fetch")
-		fmt.Println()
-	}
-
-	// Step 5: Validate quadlets
-	fmt.Println("Step 5/7: Validating quadlets...")
+	// Step 4: Validate quadlets
+	fmt.Println("Step 4/8: Validating quadlets...")
 
 	if err := validateQuadlets(quadletDir); err != nil {
 		return fmt.Errorf("validation failed: %w", err)
@@ -195,10 +273,103 @@ func runDeployInstall(ctx context.Context, name string) error {
 		return nil
 	}
 
+	// From here on the host is modified, so record the outcome.
+	// Local sources are recorded as absolute paths, so that they can be
+	// staged again from any working directory.
+	source := installFlags.source
+	if source == "" {
+		source = "leger.run"
+	} else if !isURL(source) {
+		source = sourceDir
+	}
+	version := sourceVersion(sourceDir)
+	defer func() {
+		if err != nil {
+			recordFailure(name, state.ActionInstall, source, version, err)
+		}
+	}()
+
+	// The remaining steps run as a transaction: if any of them fails, the
+	// steps already completed are undone, unless --on-failure=keep.
+	tx, err := beginInstall(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			err = finishFailedInstall(ctx, tx, err)
+		}
+	}()
+
+	// Step 5: Create setec.Store and fetch secrets
+	if len(parseResult.Secrets) > 0 && !installFlags.noSecrets {
+		fmt.Println("Step 5/8: Fetching secrets from legerd...")
+
+		var changes podmanSecretChanges
+		err := tx.Run(ctx, txn.Step{
+			Name: "create secrets",
+			Do: func(ctx context.Context) error {
+				return fetchAndCreateSecrets(ctx, daemonClient, userUUID, parseResult, &changes)
+			},
+			Undo: changes.undo,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to handle secrets: %w", err)
+		}
+
+		fmt.Printf("✓ All %d secrets available\n", len(parseResult.Secrets))
+		fmt.Println()
+	} else {
+		fmt.Println("Step 5/8: No secrets to fetch")
+		fmt.Println()
+	}
+
 	// Step 6: Save deployment to active directory (for tracking and backups)
 	fmt.Println("Step 6/8: Saving deployment...")
 
-	if err := saveDeployment(name, quadletDir); err != nil {
+	activeDir, err := activeDeploymentDir(name)
+	if err != nil {
+		return err
+	}
+	activeBaseDir, err := deploymentBaseDir(name)
+	if err != nil {
+		return err
+	}
+	savedDirs := []string{activeDir, activeBaseDir}
+	err = tx.Run(ctx, txn.Step{
+		Name: "save deployment",
+		Do: func(context.Context) error {
+			// Set the previous deployment aside rather than copying over it,
+			// so that it can be put back and stale files do not linger.
+			for _, dir := range savedDirs {
+				os.RemoveAll(dir + ".previous")
+				if err := os.Rename(dir, dir+".previous"); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			if err := saveDeployment(name, quadletDir); err != nil {
+				return err
+			}
+			if baseDir != "" {
+				if err := copyQuadlets(baseDir, activeBaseDir); err != nil {
+					return fmt.Errorf("failed to save base quadlets: %w", err)
+				}
+			}
+			return nil
+		},
+		Undo: func(context.Context) error {
+			for _, dir := range savedDirs {
+				if err := os.RemoveAll(dir); err != nil {
+					return err
+				}
+				if err := os.Rename(dir+".previous", dir); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
 		return fmt.Errorf("failed to save deployment: %w", err)
 	}
 
@@ -208,7 +379,22 @@ func runDeployInstall(ctx context.Context, name string) error {
 	// Step 7: Install quadlets using podman
 	fmt.Println("Step 7/8: Installing quadlets...")
 
-	if err := installQuadlets(ctx, quadletDir); err != nil {
+	var replaced map[string][]byte
+	err = tx.Run(ctx, txn.Step{
+		Name: "install quadlets",
+		Do: func(ctx context.Context) error {
+			var err error
+			replaced, err = snapshotInstalledQuadlets(quadletDir)
+			if err != nil {
+				return err
+			}
+			return installQuadlets(ctx, quadletDir)
+		},
+		Undo: func(ctx context.Context) error {
+			return restoreInstalledQuadlets(ctx, replaced)
+		},
+	})
+	if err != nil {
 		return fmt.Errorf("failed to install quadlets: %w", err)
 	}
 
@@ -219,7 +405,17 @@ func runDeployInstall(ctx context.Context, name string) error {
 	if !installFlags.noStart {
 		fmt.Println("Step 8/8: Starting services...")
 
-		if err := startServices(ctx, parseResult); err != nil {
+		var started []string
+		err := tx.Run(ctx, txn.Step{
+			Name: "start services",
+			Do: func(ctx context.Context) error {
+				return startServices(ctx, parseResult, &started)
+			},
+			Undo: func(ctx context.Context) error {
+				return stopServices(ctx, started)
+			},
+		})
+		if err != nil {
 			return fmt.Errorf("failed to start services: %w", err)
 		}
 
@@ -229,6 +425,15 @@ func runDeployInstall(ctx context.Context, name string) error {
 	}
 	fmt.Println()
 
+	if err := tx.Commit(); err != nil {
+		ui.WarningPrintf("⚠ Warning: %v\n", err)
+	}
+	for _, dir := range savedDirs {
+		os.RemoveAll(dir + ".previous")
+	}
+	recordDeployment(name, state.ActionInstall, source, version, "")
+	recordOptions(name, newDeploymentOptions(render.Options{ValuesFiles: installFlags.values, Set: installFlags.set}, installFlags.overlay))
+
 	fmt.Println("✓ Deployment complete!")
 	fmt.Println()
 	fmt.Println("Next steps:")
@@ -239,8 +444,9 @@ func runDeployInstall(ctx context.Context, name string) error {
 	return nil
 }
 
-// fetchAndCreateSecrets uses setec.Store to fetch secrets and create Podman secrets
-func fetchAndCreateSecrets(ctx context.Context, client *daemon.Client, userUUID string, parseResult *quadlet.ParseResult) error {
+// fetchAndCreateSecrets uses setec.Store to fetch secrets and create Podman secrets.
+// The secrets created or replaced are recorded in changes.
+func fetchAndCreateSecrets(ctx context.Context, client *daemon.Client, userUUID string, parseResult *quadlet.ParseResult, changes *podmanSecretChanges) error {
 	// Create context with timeout for store operations
 	storeCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
@@ -280,7 +486,7 @@ func fetchAndCreateSecrets(ctx context.Context, client *daemon.Client, userUUID
 		}
 
 		// Create Podman secret
-		if err := createPodmanSecret(ctx, secretName, secret.Get()); err != nil {
+		if err := createPodmanSecret(ctx, secretName, secret.Get(), changes); err != nil {
 			return fmt.Errorf("failed to create Podman secret %q: %w", secretName, err)
 		}
 
@@ -290,82 +496,46 @@ func fetchAndCreateSecrets(ctx context.Context, client *daemon.Client, userUUID
 	return nil
 }
 
-// createPodmanSecret creates or updates a Podman secret
-func createPodmanSecret(ctx context.Context, name string, value []byte) error {
-	// Check if secret already exists
-	checkCmd := exec.CommandContext(ctx, "podman", "secret", "inspect", name)
-	if err := checkCmd.Run(); err == nil {
-		// Secret exists, remove it first
-		rmCmd := exec.CommandContext(ctx, "podman", "secret", "rm", name)
-		if err := rmCmd.Run(); err != nil {
-			return fmt.Errorf("failed to remove existing secret: %w", err)
+// createPodmanSecret creates or updates a Podman secret, and records the
+// change in changes. The previous value of an existing secret is recorded
+// before it is replaced, so that undoing the change can restore it.
+func createPodmanSecret(ctx context.Context, name string, value []byte, changes *podmanSecretChanges) error {
+	previous, exists, err := podmanSecretValue(ctx, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if changes.replaced == nil {
+			changes.replaced = make(map[string][]byte)
+		}
+		if _, ok := changes.replaced[name]; !ok {
+			changes.replaced[name] = previous
 		}
 	}
 
-	// Create new secret
-	cmd := exec.CommandContext(ctx, "podman", "secret", "create", name, "-")
-	cmd.Stdin = bytes.NewReader(value)
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("podman secret create failed: %w\nStderr: %s", err, stderr.String())
+	// Replace the secret in one step, so that it is never missing.
+	if err := putPodmanSecret(ctx, name, value); err != nil {
+		return err
+	}
+	if !exists {
+		changes.created = append(changes.created, name)
 	}
-
 	return nil
 }
 
 // saveDeployment saves a copy of the quadlet files to the active directory for tracking
 func saveDeployment(name, quadletDir string) error {
-	homeDir, err := os.UserHomeDir()
+	// Create active deployment directory
+	activeDir, err := activeDeploymentDir(name)
 	if err != nil {
-		return fmt.Errorf("failed to get home directory: %w", err)
+		return err
 	}
-
-	// Create active deployment directory
-	activeDir := filepath.Join(homeDir, ".local", "share", "bluebuild-quadlets", "active", name)
 	if err := os.MkdirAll(activeDir, 0755); err != nil {
 		return fmt.Errorf("failed to create active directory: %w", err)
 	}
 
 	// Copy all files from quadletDir to activeDir
-	err = filepath.Walk(quadletDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get relative path
-		relPath, err := filepath.Rel(quadletDir, path)
-		if err != nil {
-			return err
-		}
-
-		// Skip the root directory itself
-		if relPath == "." {
-			return nil
-		}
-
-		destPath := filepath.Join(activeDir, relPath)
-
-		if info.IsDir() {
-			// Create directory
-			return os.MkdirAll(destPath, info.Mode())
-		}
-
-		// Copy file
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("failed to read %s: %w", path, err)
-		}
-
-		if err := os.WriteFile(destPath, data, info.Mode()); err != nil {
-			return fmt.Errorf("failed to write %s: %w", destPath, err)
-		}
-
-		return nil
-	})
-
+	err = copyQuadlets(quadletDir, activeDir)
 	if err != nil {
 		return fmt.Errorf("failed to copy quadlet files: %w", err)
 	}
@@ -417,29 +587,126 @@ func validateQuadlets(quadletDir string) error {
 	return nil
 }
 
-// startServices starts the installed services
-func startServices(ctx context.Context, parseResult *quadlet.ParseResult) error {
+// startServices starts the installed services. The names of the services
+// that were not already running are appended to started, so that undoing the
+// step stops only those, and services of a deployment being reinstalled keep
+// running. It reports an error if any service failed to start, after
+// attempting all of them.
+func startServices(ctx context.Context, parseResult *quadlet.ParseResult, started *[]string) error {
+	var failed []string
 	// Extract service names from quadlet files
 	for _, qfile := range parseResult.QuadletFiles {
-		base := filepath.Base(qfile)
-		serviceName := base[:len(base)-len(filepath.Ext(base))] + ".service"
+		serviceName := podman.GeneratedServiceName(qfile)
+		active := exec.CommandContext(ctx, "systemctl", "--user", "is-active", "--quiet", serviceName).Run() == nil
 
 		cmd := exec.CommandContext(ctx, "systemctl", "--user", "start", serviceName)
 		if err := cmd.Run(); err != nil {
 			fmt.Printf("  ⚠ Failed to start %s: %v\n", serviceName, err)
+			failed = append(failed, serviceName)
 			continue
 		}
 
+		if !active {
+			*started = append(*started, serviceName)
+		}
 		fmt.Printf("  ✓ Started: %s\n", serviceName)
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d services failed to start: %s", len(failed), len(parseResult.QuadletFiles), strings.Join(failed, ", "))
+	}
 	return nil
 }
 
 // Helper functions
 
+// renderTemplates copies the quadlets in dir to a temporary directory and
+// renders their templates there for the named deployment. The caller must
+// remove the directory returned.
+func renderTemplates(ctx context.Context, dir, name string, opts render.Options) (string, error) {
+	data, err := render.Load(dir, name, opts)
+	if err != nil {
+		return "", err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "leger-render-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	err = copyQuadlets(dir, tmpDir)
+	if err == nil {
+		var rendered []string
+		if rendered, err = render.Dir(ctx, tmpDir, data); err == nil {
+			fmt.Printf("  Rendered %d templates: %s\n", len(rendered), strings.Join(rendered, ", "))
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", fmt.Errorf("failed to render templates: %w", err)
+	}
+	return tmpDir, nil
+}
+
+// applyOverlay copies the quadlets in dir to a temporary directory and
+// applies ov to them there. The caller must remove the directory returned.
+func applyOverlay(dir string, ov *overlay.Overlay) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "leger-overlay-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	err = copyQuadlets(dir, tmpDir)
+	if err == nil {
+		var changed []string
+		if changed, err = ov.Apply(tmpDir); err == nil {
+			fmt.Printf("  Applied overlay %s: %s\n", ov.Dir, strings.Join(changed, ", "))
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", fmt.Errorf("failed to apply overlay %s: %w", ov.Dir, err)
+	}
+	return tmpDir, nil
+}
+
+// copyQuadlets copies the files in src to dst, without Git metadata.
+func copyQuadlets(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() == ".git" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(dst, relPath)
+		if d.IsDir() {
+			return os.MkdirAll(destPath, 0755)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if err := os.WriteFile(destPath, data, info.Mode()); err != nil {
+			return fmt.Errorf("failed to write %s: %w", destPath, err)
+		}
+		return nil
+	})
+}
+
+// isURL reports whether s names a remote source, a Git repository or
+// leger.run URL, rather than a local directory.
 func isURL(s string) bool {
-	return len(s) > 7 && (s[:7] == "http://" || s[:8] == "https://")
+	return git.IsGitURL(s) || git.DetectSourceType(s) == git.SourceTypeLegerRun
 }
 
 func downloadFromLegerRun(ctx context.Context, userUUID, name string) (string, error) {
@@ -511,20 +778,101 @@ func downloadFromLegerRun(ctx context.Context, userUUID, name string) (string, e
 	return tmpDir, nil
 }
 
-func cloneGitRepo(ctx context.Context, url, name string) (string, error) {
+func cloneGitRepo(ctx context.Context, url, name string) (*git.Checkout, error) {
+	if _, err := loadConfig(); err != nil {
+		return nil, err
+	}
+
 	// Parse Git URL
 	repo, err := git.ParseURL(url, "")
 	if err != nil {
-		return "", fmt.Errorf("invalid Git URL: %w", err)
+		return nil, fmt.Errorf("invalid Git URL: %w", err)
+	}
+
+	if repo.Ref == "" {
+		repo.Ref = installFlags.commit
+	}
+
+	policy, err := signaturePolicy(installFlags.allowedSigners)
+	if err != nil {
+		return nil, err
+	}
+	if repo.Ref != "" {
+		fmt.Printf("  Pinned to %s\n", repo.Ref)
+	}
+
+	creds, err := gitCredentials(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		fmt.Println("  Using configured credentials")
 	}
 
 	// Clone repository
-	path, err := git.Clone(repo)
+	co, err := git.Clone(repo, policy, creds)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if policy != nil {
+		fmt.Println("  ✓ Signature verified")
 	}
 
-	return path, nil
+	fmt.Printf("  Commit: %s\n", co.Commit)
+	return co, nil
+}
+
+// signaturePolicy returns the policy that Git sources must satisfy. If path
+// is empty, the default allowed-signers file is used if it exists, and
+// otherwise signatures are not required.
+func signaturePolicy(path string) (*git.VerifyPolicy, error) {
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %w", err)
+		}
+		path = filepath.Join(homeDir, ".config", "leger", "allowed_signers")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("allowed signers file: %w", err)
+	}
+	return &git.VerifyPolicy{AllowedSigners: path}, nil
+}
+
+// gitCredentials returns the credentials configured for repo in the leger
+// config file, or nil if there are none. Access tokens are read from legerd.
+func gitCredentials(ctx context.Context, repo *git.Repository) (*git.Credentials, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	src := cfg.Git.Source(git.RepositoryKey(repo.GetCloneURL()))
+	if src == nil {
+		return nil, nil
+	}
+
+	creds := &git.Credentials{
+		SSHKey:     src.SSHKey,
+		KnownHosts: src.KnownHosts,
+		SSHUser:    src.SSHUser,
+		SSHPort:    src.SSHPort,
+		Username:   src.Username,
+		Helper:     src.CredentialHelper,
+	}
+	if src.TokenSecret != "" {
+		token, err := daemon.NewClient("").GetSecret(ctx, src.TokenSecret)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to read Git token for %s: %w
+
+The token is read from the legerd secret %q:
+  leger secrets set %s`, src.Match, err, src.TokenSecret, src.TokenSecret)
+		}
+		creds.Token = strings.TrimSpace(string(token))
+	}
+	return creds, nil
 }
 
 // Stub commands for other deploy subcommands
@@ -533,6 +881,7 @@ func deployUpdateCmd() *cobra.Command {
 	var dryRun bool
 	var noBackup bool
 	var force bool
+	var overlayDir string
 
 	cmd := &cobra.Command{
 		Use:   "update [deployment]",
@@ -545,6 +894,9 @@ Workflow:
   3. Prompts for confirmation
   4. Applies updates (leger apply)
 
+The deployment's overlay is applied again to the new quadlets, and the diff
+shows the upstream changes and the overlay's result separately.
+
 Flags allow skipping steps for automation.`,
 		Args: cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -559,6 +911,27 @@ Flags allow skipping steps for automation.`,
 			if err != nil {
 				return err
 			}
+			m.SignaturePolicy, err = signaturePolicy("")
+			if err != nil {
+				return err
+			}
+			m.Credentials = func(repo *git.Repository) (*git.Credentials, error) {
+				return gitCredentials(ctx, repo)
+			}
+			// Render and overlay as the deployment was installed, unless
+			// another overlay is given.
+			opts, recorded := recordedOptions(deploymentName)
+			if overlayDir == "" {
+				overlayDir = recorded
+			}
+			m.Render = opts
+			m.Overlay, err = overlay.Find(overlayDir, deploymentName)
+			if err != nil {
+				return err
+			}
+			if _, err := loadConfig(); err != nil {
+				return err
+			}
 
 			// 1. Stage updates
 			fmt.Println("Staging updates...")
@@ -592,9 +965,12 @@ Flags allow skipping steps for automation.`,
 
 			// 5. Apply updates
 			fmt.Println()
-			if err := m.ApplyStaged(ctx, deploymentName); err != nil {
+			if err := applyAndRecord(ctx, m, deploymentName, state.ActionUpdate); err != nil {
 				return err
 			}
+			if overlayDir != recorded {
+				recordOptions(deploymentName, newDeploymentOptions(opts, overlayDir))
+			}
 
 			fmt.Println("\n✓ Update complete")
 			return nil
@@ -604,6 +980,7 @@ Flags allow skipping steps for automation.`,
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Preview changes without applying")
 	cmd.Flags().BoolVar(&noBackup, "no-backup", false, "Skip automatic backup (not recommended)")
 	cmd.Flags().BoolVar(&force, "force", false, "Skip confirmation prompt")
+	cmd.Flags().StringVar(&overlayDir, "overlay", "", "Overlay directory patching the quadlets (default: ~/.config/leger/overlays/<deployment>, if present)")
 
 	return cmd
 }
@@ -669,6 +1046,55 @@ var removeFlags struct {
 	backupVolumes bool
 }
 
+// removeDeployment stops the services of the named deployment, uninstalls
+// its quadlets and their drop-ins, and discards its files and recorded state.
+// A name without an active deployment directory is taken to be a single
+// installed quadlet, as deployments were once installed.
+func removeDeployment(ctx context.Context, name string) error {
+	qm := podman.NewQuadletManager("user")
+	sm := podman.NewSystemdManager("user")
+
+	activeDir, err := activeDeploymentDir(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stopping services for %s...\n", name)
+	files, err := qm.DiscoverQuadletFiles(activeDir)
+	if err != nil {
+		if err := sm.StopService(podman.QuadletNameToServiceName(name)); err != nil {
+			ui.WarningPrintf("⚠ Warning: failed to stop service: %v\n", err)
+		}
+		fmt.Printf("Removing quadlet %s...\n", name)
+		if err := qm.Remove(name); err != nil {
+			return err
+		}
+	} else {
+		for _, file := range files {
+			svc := podman.GeneratedServiceName(file)
+			if err := sm.StopService(svc); err != nil {
+				ui.WarningPrintf("⚠ Warning: failed to stop %s: %v\n", svc, err)
+			}
+		}
+		fmt.Printf("Removing quadlets for %s...\n", name)
+		if err := qm.Uninstall(activeDir); err != nil {
+			return err
+		}
+	}
+	if err := exec.CommandContext(ctx, "systemctl", "--user", "daemon-reload").Run(); err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to reload systemd: %v\n", err)
+	}
+
+	if err := os.RemoveAll(activeDir); err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to remove active directory: %v\n", err)
+	}
+	if baseDir, err := deploymentBaseDir(name); err == nil {
+		os.RemoveAll(baseDir)
+	}
+	recordRemoval(name)
+	fmt.Printf("✓ Removed %s\n", name)
+	return nil
+}
+
 func deployRemoveCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "remove <name>",
@@ -677,9 +1103,6 @@ func deployRemoveCmd() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			quadletName := args[0]
 
-			qm := podman.NewQuadletManager("user")
-			sm := podman.NewSystemdManager("user")
-
 			// Confirm unless --force
 			if !removeFlags.force {
 				if !ui.Confirm(fmt.Sprintf("Are you sure you want to remove %s?", quadletName)) {
@@ -688,11 +1111,8 @@ func deployRemoveCmd() *cobra.Command {
 				}
 			}
 
-			// Stop service
-			fmt.Printf("Stopping services for %s...\n", quadletName)
-			serviceName := podman.QuadletNameToServiceName(quadletName)
-			if err := sm.StopService(serviceName); err != nil {
-				fmt.Printf("⚠ Warning: failed to stop service: %v\n", err)
+			if err := removeDeployment(cmd.Context(), quadletName); err != nil {
+				return err
 			}
 
 			// Handle volumes if requested
@@ -707,23 +1127,6 @@ func deployRemoveCmd() *cobra.Command {
 			} else if removeFlags.backupVolumes {
 				fmt.Println("⚠ Backup volumes not yet implemented (coming in Issue #17)")
 			}
-
-			// Remove quadlet from systemd
-			fmt.Printf("Removing quadlet %s...\n", quadletName)
-			if err := qm.Remove(quadletName); err != nil {
-				return err
-			}
-
-			// Remove from active directory
-			homeDir, err := os.UserHomeDir()
-			if err == nil {
-				activeDir := filepath.Join(homeDir, ".local", "share", "bluebuild-quadlets", "active", quadletName)
-				if err := os.RemoveAll(activeDir); err != nil {
-					fmt.Printf("⚠ Warning: failed to remove active directory: %v\n", err)
-				}
-			}
-
-			fmt.Printf("✓ Successfully removed %s\n", quadletName)
 			return nil
 		},
 	}
@@ -0,0 +1,369 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/leger-labs/leger/internal/legerrun"
+	"github.com/leger-labs/leger/internal/podman"
+	"github.com/leger-labs/leger/internal/render"
+	"github.com/leger-labs/leger/internal/staging"
+	"github.com/leger-labs/leger/internal/state"
+	"github.com/leger-labs/leger/internal/ui"
+	"github.com/leger-labs/leger/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+// activeDeploymentDir returns the directory holding the active quadlets of
+// the named deployment.
+func activeDeploymentDir(name string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".local", "share", "bluebuild-quadlets", "active", name), nil
+}
+
+// deploymentBaseDir returns the directory holding the base quadlets of the
+// named deployment, as they were before its overlay was applied.
+func deploymentBaseDir(name string) (string, error) {
+	m, err := staging.NewManager()
+	if err != nil {
+		return "", err
+	}
+	return m.GetBasePath(name), nil
+}
+
+// sourceVersion reports the version of the quadlets in dir: the commit
+// checked out, if dir is a Git repository, or else the version of its
+// leger.run manifest. It returns "" if neither is known.
+func sourceVersion(dir string) string {
+	if commit, err := git.HeadCommit(dir); err == nil {
+		return commit
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "manifest.json")); err == nil {
+		if m, err := legerrun.ParseManifest(data); err == nil {
+			return fmt.Sprintf("v%d", m.Version)
+		}
+	}
+	return ""
+}
+
+// newDeploymentOptions returns the options to record for a deployment
+// rendered with opts and overlaid with overlayDir, with absolute paths, so
+// that updates run from any directory use the same files.
+func newDeploymentOptions(opts render.Options, overlayDir string) *types.DeploymentOptions {
+	abs := func(path string) string {
+		if p, err := filepath.Abs(path); err == nil && path != "" {
+			return p
+		}
+		return path
+	}
+	o := &types.DeploymentOptions{Set: opts.Set, Overlay: abs(overlayDir)}
+	for _, v := range opts.ValuesFiles {
+		o.Values = append(o.Values, abs(v))
+	}
+	return o
+}
+
+// deploymentOptions returns the render options and overlay directory
+// recorded for the deployment st. Deployments recorded without options are
+// rendered with none and get their default overlay.
+func deploymentOptions(st *types.DeploymentState) (render.Options, string) {
+	if st == nil || st.Options == nil {
+		return render.Options{}, ""
+	}
+	return render.Options{ValuesFiles: st.Options.Values, Set: st.Options.Set}, st.Options.Overlay
+}
+
+// recordedOptions returns the render options and overlay directory recorded
+// for the named deployment, as deploymentOptions does.
+func recordedOptions(name string) (render.Options, string) {
+	var st *types.DeploymentState
+	if store, err := state.NewStore(); err == nil {
+		st, _ = store.Get(name)
+	}
+	return deploymentOptions(st)
+}
+
+// recordOptions records the options the named deployment was installed or
+// updated with. Failures are reported as warnings, as for recordDeployment.
+func recordOptions(name string, opts *types.DeploymentOptions) {
+	store, err := state.NewStore()
+	if err == nil {
+		var st *types.DeploymentState
+		if st, err = store.Get(name); err == nil {
+			st.Options = opts
+			err = store.Save(st)
+		}
+	}
+	if err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to record deployment options: %v\n", err)
+	}
+}
+
+// recordDeployment updates the recorded state of the named deployment from
+// its active quadlets and appends a successful event to its history.
+// The deployment has already changed by the time this is called, so failures
+// are reported as warnings rather than errors.
+func recordDeployment(name, action, source, version, message string) {
+	store, err := state.NewStore()
+	if err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to record deployment state: %v\n", err)
+		return
+	}
+
+	now := time.Now()
+	st, err := store.Get(name)
+	if errors.Is(err, state.ErrNotFound) {
+		st = &types.DeploymentState{Name: name, Scope: "user", InstalledAt: now}
+	} else if err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to record deployment state: %v\n", err)
+		return
+	}
+	if action == state.ActionInstall {
+		st.InstalledAt = now
+	}
+	st.UpdatedAt = now
+	if source != "" {
+		st.Source = source
+	}
+	if version != "" {
+		st.Version = version
+	}
+
+	if dir, err := activeDeploymentDir(name); err == nil {
+		if err := state.Inspect(st, dir); err != nil {
+			ui.WarningPrintf("⚠ Warning: %v\n", err)
+		}
+	}
+	if err := store.Save(st); err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to record deployment state: %v\n", err)
+	}
+	recordEvent(store, name, types.DeploymentHistory{
+		Action:  action,
+		Version: st.Version,
+		Source:  st.Source,
+		Success: true,
+		Message: message,
+	})
+}
+
+// recordFailure appends a failed event to the history of the named
+// deployment. Its recorded state is left unchanged.
+func recordFailure(name, action, source, version string, cause error) {
+	store, err := state.NewStore()
+	if err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to record deployment history: %v\n", err)
+		return
+	}
+	recordEvent(store, name, types.DeploymentHistory{
+		Action:  action,
+		Version: version,
+		Source:  source,
+		Message: cause.Error(),
+	})
+}
+
+// recordRemoval discards the recorded state of the named deployment and
+// appends a removal event to its history.
+func recordRemoval(name string) {
+	store, err := state.NewStore()
+	if err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to record deployment history: %v\n", err)
+		return
+	}
+	event := types.DeploymentHistory{Action: state.ActionRemove, Success: true}
+	if st, err := store.Get(name); err == nil {
+		event.Version, event.Source = st.Version, st.Source
+	}
+	if err := store.Remove(name); err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to remove deployment state: %v\n", err)
+	}
+	recordEvent(store, name, event)
+}
+
+func recordEvent(store *state.Store, name string, event types.DeploymentHistory) {
+	if err := store.Record(name, event); err != nil {
+		ui.WarningPrintf("⚠ Warning: failed to record deployment history: %v\n", err)
+	}
+}
+
+// applyAndRecord applies the staged updates of the named deployment and
+// records the outcome under action. If the apply failed and the previous
+// deployment was restored, the rollback is recorded as well.
+func applyAndRecord(ctx context.Context, m *staging.Manager, name, action string) error {
+	var source, version string
+	if meta, err := m.LoadMetadata(name); err == nil {
+		source, version = meta.SourceURL, meta.StagedVersion
+	}
+
+	if err := m.ApplyStaged(ctx, name); err != nil {
+		recordFailure(name, action, source, version, err)
+		if errors.Is(err, staging.ErrRolledBack) {
+			recordDeployment(name, state.ActionRollback, "", "", "restored after failed "+action)
+		}
+		return err
+	}
+	recordDeployment(name, action, source, version, "")
+	return nil
+}
+
+// shortVersion abbreviates commit hashes for display.
+func shortVersion(v string) string {
+	if v == "" {
+		return "-"
+	}
+	if len(v) == 40 && strings.Trim(v, "0123456789abcdef") == "" {
+		return v[:12]
+	}
+	return v
+}
+
+func deployShowCmd() *cobra.Command {
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "show <name>",
+		Short: "Show the recorded state of a deployment",
+		Long: `Show the source, version, services, volumes and secrets recorded for a
+deployment, with the current status of each service.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := state.NewStore()
+			if err != nil {
+				return err
+			}
+			st, err := store.Get(args[0])
+			if err != nil {
+				return err
+			}
+
+			sm := podman.NewSystemdManager("user")
+			for i, svc := range st.Services {
+				st.Services[i].Status = "unknown"
+				if svc.ServiceName == "" {
+					continue
+				}
+				if status, err := sm.GetServiceStatus(svc.ServiceName); err == nil {
+					st.Services[i].Status = status.ActiveState
+				}
+			}
+
+			if asJSON {
+				data, err := json.MarshalIndent(st, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(data))
+				return nil
+			}
+
+			fmt.Printf("Deployment: %s\n", st.Name)
+			fmt.Printf("  Source:    %s\n", st.Source)
+			fmt.Printf("  Version:   %s\n", shortVersion(st.Version))
+			fmt.Printf("  Scope:     %s\n", st.Scope)
+			fmt.Printf("  Installed: %s\n", st.InstalledAt.Local().Format(time.DateTime))
+			if !st.UpdatedAt.IsZero() {
+				fmt.Printf("  Updated:   %s\n", st.UpdatedAt.Local().Format(time.DateTime))
+			}
+			fmt.Println()
+
+			if len(st.Services) > 0 {
+				rows := make([][]string, 0, len(st.Services))
+				for _, svc := range st.Services {
+					ports := strings.Join(svc.Ports, ", ")
+					if ports == "" {
+						ports = "-"
+					}
+					rows = append(rows, []string{svc.Name, svc.Type, svc.Status, ports})
+				}
+				ui.PrintTable([]string{"SERVICE", "TYPE", "STATUS", "PORTS"}, rows)
+				fmt.Println()
+			}
+			if len(st.Volumes) > 0 {
+				fmt.Println("Volumes:")
+				for _, v := range st.Volumes {
+					fmt.Printf("  - %s\n", v.Name)
+				}
+			}
+			if len(st.Secrets) > 0 {
+				fmt.Println("Secrets:")
+				for _, s := range st.Secrets {
+					fmt.Printf("  - %s\n", s)
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the state as JSON")
+
+	return cmd
+}
+
+func deployHistoryCmd() *cobra.Command {
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "history <name>",
+		Short: "Show the change history of a deployment",
+		Long: `Show every install, update, apply, rollback, restore and removal recorded
+for a deployment, oldest first. History is kept after a deployment is removed.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := state.NewStore()
+			if err != nil {
+				return err
+			}
+			events, err := store.History(args[0])
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				if events == nil {
+					events = []types.DeploymentHistory{}
+				}
+				data, err := json.MarshalIndent(events, "", "  ")
+				if err != nil {
+					return err
+				}
+				fmt.Println(string(data))
+				return nil
+			}
+
+			if len(events) == 0 {
+				ui.InfoPrintf("No history recorded for %s\n", args[0])
+				return nil
+			}
+			rows := make([][]string, 0, len(events))
+			for _, ev := range events {
+				result := "ok"
+				if !ev.Success {
+					result = "failed"
+				}
+				rows = append(rows, []string{
+					ev.Timestamp.Local().Format(time.DateTime),
+					ev.Action,
+					shortVersion(ev.Version),
+					result,
+					ev.Message,
+				})
+			}
+			ui.PrintTable([]string{"TIME", "ACTION", "VERSION", "RESULT", "MESSAGE"}, rows)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the history as JSON")
+
+	return cmd
+}
@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/leger-labs/leger/internal/podman"
+	"github.com/leger-labs/leger/internal/state"
+	"github.com/leger-labs/leger/internal/txn"
+	"github.com/leger-labs/leger/internal/ui"
+)
+
+// beginInstall starts the transaction for installing the named deployment.
+// Its journal is kept under ~/.local/share/leger/journal.
+func beginInstall(name string) (*txn.Transaction, error) {
+	store, err := state.NewStore()
+	if err != nil {
+		return nil, err
+	}
+	return txn.Begin("install "+name, filepath.Join(store.Dir, "journal", name+".json"))
+}
+
+// finishFailedInstall rolls back tx after the install failed with cause, or
+// leaves it in place if --on-failure=keep. It returns the error to report.
+func finishFailedInstall(ctx context.Context, tx *txn.Transaction, cause error) error {
+	fmt.Println()
+	if installFlags.onFailure == onFailureKeep {
+		if err := tx.Abandon(cause); err != nil {
+			ui.WarningPrintf("⚠ Warning: %v\n", err)
+		}
+		ui.WarningPrintf("⚠ Partial install kept (--on-failure=keep); journal: %s\n", tx.JournalPath())
+		return cause
+	}
+
+	fmt.Println("Rolling back install...")
+	// Undo even if the install was cancelled.
+	if err := tx.Rollback(context.WithoutCancel(ctx), cause); err != nil {
+		return fmt.Errorf("%w\n\nrollback incomplete, see journal %s:\n%v", cause, tx.JournalPath(), err)
+	}
+	fmt.Println("✓ Rolled back")
+	return fmt.Errorf("%w (install rolled back)", cause)
+}
+
+// podmanSecretChanges records the Podman secrets created or replaced by an
+// install, so that they can be undone.
+type podmanSecretChanges struct {
+	created  []string
+	replaced map[string][]byte // secret name → previous value
+}
+
+// undo removes the created secrets and restores the previous values of the
+// replaced ones.
+func (c *podmanSecretChanges) undo(ctx context.Context) error {
+	errs := []error{removePodmanSecrets(ctx, c.created)}
+	for name, value := range c.replaced {
+		if err := putPodmanSecret(ctx, name, value); err != nil {
+			errs = append(errs, fmt.Errorf("restore secret %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// podmanSecretValue returns the value of the named Podman secret, and reports
+// whether it exists.
+func podmanSecretValue(ctx context.Context, name string) (value []byte, exists bool, err error) {
+	if exec.CommandContext(ctx, "podman", "secret", "exists", name).Run() != nil {
+		return nil, false, nil
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "podman", "secret", "inspect", "--showsecret", "--format", "{{.SecretData}}", name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read existing secret: %w\nStderr: %s", err, stderr.String())
+	}
+	// The template output ends with a newline that is not part of the value.
+	return bytes.TrimSuffix(out, []byte("\n")), true, nil
+}
+
+// putPodmanSecret creates the named Podman secret with value, replacing any
+// existing secret of that name.
+func putPodmanSecret(ctx context.Context, name string, value []byte) error {
+	cmd := exec.CommandContext(ctx, "podman", "secret", "create", "--replace", name, "-")
+	cmd.Stdin = bytes.NewReader(value)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("podman secret create failed: %w\nStderr: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// removePodmanSecrets removes the named Podman secrets.
+func removePodmanSecrets(ctx context.Context, names []string) error {
+	var errs []error
+	for _, name := range names {
+		if err := exec.CommandContext(ctx, "podman", "secret", "rm", name).Run(); err != nil {
+			errs = append(errs, fmt.Errorf("remove secret %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopServices stops the named systemd user services.
+func stopServices(ctx context.Context, names []string) error {
+	var errs []error
+	for _, name := range names {
+		if err := exec.CommandContext(ctx, "systemctl", "--user", "stop", name).Run(); err != nil {
+			errs = append(errs, fmt.Errorf("stop %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// snapshotInstalledQuadlets records the installed quadlet files and drop-ins
+// that installing quadletDir would overwrite. The result maps the path of each
+// installed file to its previous contents, or to nil if it did not exist.
+func snapshotInstalledQuadlets(quadletDir string) (map[string][]byte, error) {
+	qm := podman.NewQuadletManager("user")
+	installDir, err := qm.InstallDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := qm.DiscoverInstallFiles(quadletDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := make(map[string][]byte)
+	for _, file := range files {
+		rel, err := filepath.Rel(quadletDir, file)
+		if err != nil {
+			return nil, err
+		}
+		dest := filepath.Join(installDir, rel)
+		data, err := os.ReadFile(dest)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read installed quadlet: %w", err)
+		}
+		snap[dest] = data
+	}
+	return snap, nil
+}
+
+// restoreInstalledQuadlets puts back the installed quadlet files recorded by
+// snapshotInstalledQuadlets and reloads systemd.
+func restoreInstalledQuadlets(ctx context.Context, snap map[string][]byte) error {
+	var errs []error
+	for path, data := range snap {
+		var err error
+		if data == nil {
+			err = os.Remove(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = os.WriteFile(path, data, 0644)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := exec.CommandContext(ctx, "systemctl", "--user", "daemon-reload").Run(); err != nil {
+		errs = append(errs, fmt.Errorf("systemctl daemon-reload failed: %w", err))
+	}
+	return errors.Join(errs...)
+}
@@ -22,18 +22,21 @@ func init() {
 	RootCmd.SetVersionTemplate(version.Long() + "\n")
 
 	// Global flags
-	RootCmd.PersistentFlags().StringP("config", "c", "", "config file (default: /etc/leger/config.yaml)")
+	RootCmd.PersistentFlags().StringP("config", "c", "", "config file (default: ~/.config/leger/config.yaml, or /etc/leger/config.yaml)")
 	RootCmd.PersistentFlags().BoolP("verbose", "v", false, "verbose output")
 
 	// Command groups
 	RootCmd.AddCommand(authCmd())
 	RootCmd.AddCommand(backupCmd())
+	RootCmd.AddCommand(cacheCmd())
 	RootCmd.AddCommand(configCmd())
 	RootCmd.AddCommand(deployCmd())
 	RootCmd.AddCommand(secretsCmd())
 	RootCmd.AddCommand(serviceCmd())
 	RootCmd.AddCommand(stagedCmd())
 	RootCmd.AddCommand(statusCmd())
+	RootCmd.AddCommand(syncCmd())
 	RootCmd.AddCommand(validateCmd())
+	RootCmd.AddCommand(watchCmd())
 	RootCmd.AddCommand(checkConflictsCmd())
 }
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/leger-labs/leger/internal/overlay"
+	"github.com/leger-labs/leger/internal/render"
 	"github.com/leger-labs/leger/internal/staging"
+	"github.com/leger-labs/leger/internal/state"
 	"github.com/spf13/cobra"
 )
 
@@ -94,12 +98,21 @@ Shows deployment name, version information, source, and staging timestamp.`,
 
 // stageCmd returns the stage command
 func stageCmd() *cobra.Command {
-	return &cobra.Command{
+	var allowedSigners string
+	var opts render.Options
+	var overlayDir string
+
+	cmd := &cobra.Command{
 		Use:   "stage [source]",
 		Short: "Stage updates for review",
 		Long: `Download updates to staging area for preview.
 
 If no source is provided, stages from leger.run default repository.
+Git sources may be pinned to a tag or commit with an @ref suffix, and must
+be signed by an allowed signer if an allowed-signers file is configured.
+Templates (*.tmpl) are rendered for this host while staging, so the diff
+shows the quadlets that will be installed. The deployment's overlay, from
+--overlay or ~/.config/leger/overlays/<deployment>, is then applied.
 
 After staging, use:
   leger diff <deployment>      # Preview changes
@@ -122,6 +135,21 @@ After staging, use:
 			if err != nil {
 				return err
 			}
+			m.SignaturePolicy, err = signaturePolicy(allowedSigners)
+			if err != nil {
+				return err
+			}
+			m.Credentials = func(repo *git.Repository) (*git.Credentials, error) {
+				return gitCredentials(ctx, repo)
+			}
+			m.Render = opts
+			m.Overlay, err = overlay.Find(overlayDir, deploymentName)
+			if err != nil {
+				return err
+			}
+			if _, err := loadConfig(); err != nil {
+				return err
+			}
 
 			fmt.Printf("Staging updates for deployment: %s\n", deploymentName)
 
@@ -141,6 +169,13 @@ After staging, use:
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&allowedSigners, "allowed-signers", "", "Require Git sources signed by a key in this file (default: ~/.config/leger/allowed_signers, if present)")
+	cmd.Flags().StringArrayVar(&opts.ValuesFiles, "values", nil, "Values file for rendering templates (repeatable)")
+	cmd.Flags().StringArrayVar(&opts.Set, "set", nil, "Set a template value, key=value (repeatable)")
+	cmd.Flags().StringVar(&overlayDir, "overlay", "", "Overlay directory patching the quadlets (default: ~/.config/leger/overlays/<deployment>, if present)")
+
+	return cmd
 }
 
 // diffCmd returns the diff command
@@ -152,6 +187,8 @@ func diffCmd() *cobra.Command {
 
 Shows:
   - Modified quadlet files (unified diff)
+  - For deployments with an overlay, upstream changes to the base and
+    the overlay's result, separately
   - Added files
   - Removed files
   - Affected services
@@ -262,7 +299,7 @@ Stage updates first:
 
 			// Apply updates
 			fmt.Println()
-			if err := m.ApplyStaged(ctx, deploymentName); err != nil {
+			if err := applyAndRecord(ctx, m, deploymentName, state.ActionApply); err != nil {
 				return err
 			}
 
@@ -0,0 +1,336 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/leger-labs/leger/internal/auth"
+	"github.com/leger-labs/leger/internal/daemon"
+	"github.com/leger-labs/leger/internal/desired"
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/leger-labs/leger/internal/overlay"
+	"github.com/leger-labs/leger/internal/staging"
+	"github.com/leger-labs/leger/internal/state"
+	"github.com/leger-labs/leger/internal/ui"
+	"github.com/spf13/cobra"
+)
+
+var syncFlags struct {
+	file   string
+	prune  bool
+	dryRun bool
+	force  bool
+}
+
+// syncCmd returns the sync command
+func syncCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Reconcile deployments with a desired state file",
+		Long: `Install, update and remove deployments to match a desired state file.
+
+The file (default: ~/.config/leger/deployments.yaml) lists every deployment
+the host should run:
+
+  deployments:
+    - name: web
+      source: https://github.com/acme/quadlets//web
+      ref: v1.2.0                 # tag or commit to pin to
+      scope: user                 # only user is supported
+      overlay: ~/overlays/web     # default: ~/.config/leger/overlays/web
+      values: [~/values/web.yaml]
+      set: {image.tag: "1.27"}
+      secrets: [web/api-key]      # must exist in legerd
+
+Each listed deployment is staged to compute the plan: deployments not yet
+installed are installed, and installed ones whose quadlets change are
+updated. The plan is shown with the staged diffs, and applied after
+confirmation. Deployments that are installed but not listed are left alone,
+unless --prune is given, in which case they are removed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSync(cmd.Context())
+		},
+	}
+
+	cmd.Flags().StringVarP(&syncFlags.file, "file", "f", "", "Desired state file (default: ~/.config/leger/deployments.yaml)")
+	cmd.Flags().BoolVar(&syncFlags.prune, "prune", false, "Remove installed deployments that are not listed")
+	cmd.Flags().BoolVar(&syncFlags.dryRun, "dry-run", false, "Show the plan without applying it")
+	cmd.Flags().BoolVar(&syncFlags.force, "force", false, "Skip confirmation prompt")
+
+	return cmd
+}
+
+func runSync(ctx context.Context) error {
+	path := syncFlags.file
+	if path == "" {
+		var err error
+		if path, err = desired.DefaultPath(); err != nil {
+			return err
+		}
+	}
+	// The config registers the Git forges that source URLs are parsed with.
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	ds, err := desired.Load(path)
+	if err != nil {
+		return err
+	}
+
+	store, err := state.NewStore()
+	if err != nil {
+		return err
+	}
+	installed, err := store.List()
+	if err != nil {
+		return err
+	}
+	changes := desired.Plan(ds, installed, syncFlags.prune)
+
+	m, err := staging.NewManager()
+	if err != nil {
+		return err
+	}
+	m.SignaturePolicy, err = signaturePolicy("")
+	if err != nil {
+		return err
+	}
+	m.Credentials = func(repo *git.Repository) (*git.Credentials, error) {
+		return gitCredentials(ctx, repo)
+	}
+
+	// Every listed deployment is staged, and staged updates are discarded
+	// unless they are applied.
+	var staged []string
+	discard := func() {
+		for _, name := range staged {
+			m.DiscardStaged(name)
+		}
+	}
+
+	ui.InfoPrintf("Planning sync from %s\n\n", path)
+	diffs := make(map[string]*staging.DiffResult)
+	for i := range changes {
+		c := &changes[i]
+		if c.Deployment == nil {
+			continue
+		}
+		diff, err := stageDesired(ctx, m, c.Deployment)
+		if err != nil {
+			discard()
+			return fmt.Errorf("failed to stage %s: %w", c.Name, err)
+		}
+		staged = append(staged, c.Name)
+		if c.Action == desired.ActionUpdate && !diff.HasChanges() {
+			c.Action = desired.ActionNone
+			continue
+		}
+		diffs[c.Name] = diff
+	}
+
+	missing, err := missingSecrets(ctx, changes)
+	if err != nil {
+		discard()
+		return err
+	}
+
+	if !printPlan(m, changes, diffs, missing) {
+		discard()
+		if !syncFlags.dryRun {
+			for _, c := range changes {
+				recordDesiredOptions(&c)
+			}
+		}
+		fmt.Println()
+		ui.SuccessPrintf("✓ Host matches the desired state\n")
+		return nil
+	}
+
+	if len(missing) > 0 {
+		discard()
+		return fmt.Errorf("required secrets are missing from legerd\n\nSync them first: leger secrets sync")
+	}
+	if syncFlags.dryRun {
+		discard()
+		fmt.Println("\n--dry-run: no changes applied")
+		return nil
+	}
+	if !syncFlags.force && !ui.Confirm("\nApply this plan?") {
+		discard()
+		ui.InfoPrintf("Sync cancelled\n")
+		return nil
+	}
+
+	var failed []string
+	for _, c := range changes {
+		var err error
+		switch c.Action {
+		case desired.ActionInstall:
+			fmt.Println()
+			// The install fetches the source again, with its own
+			// validation, secrets and rollback, at the commit planned.
+			var commit string
+			if meta, err := m.LoadMetadata(c.Name); err == nil && git.IsGitURL(c.Deployment.Source) {
+				commit = meta.StagedVersion
+			}
+			m.DiscardStaged(c.Name)
+			err = installDesired(ctx, c.Deployment, commit)
+		case desired.ActionUpdate:
+			fmt.Printf("\nUpdating deployment: %s\n", c.Name)
+			if err = applyAndRecord(ctx, m, c.Name, state.ActionUpdate); err == nil {
+				recordDesiredOptions(&c)
+			}
+		case desired.ActionRemove:
+			fmt.Printf("\nRemoving deployment: %s\n", c.Name)
+			err = removeDeployment(ctx, c.Name)
+		default:
+			m.DiscardStaged(c.Name)
+			recordDesiredOptions(&c)
+			continue
+		}
+		if err != nil {
+			ui.ErrorPrintf("✗ %s %s failed: %v\n", c.Action, c.Name, err)
+			failed = append(failed, c.Name)
+		}
+	}
+
+	fmt.Println()
+	if len(failed) > 0 {
+		return fmt.Errorf("sync failed for %s", strings.Join(failed, ", "))
+	}
+	ui.SuccessPrintf("✓ Sync complete\n")
+	return nil
+}
+
+// stageDesired stages the desired deployment d and returns the diff from
+// its active quadlets.
+func stageDesired(ctx context.Context, m *staging.Manager, d *desired.Deployment) (*staging.DiffResult, error) {
+	var err error
+	m.Render = d.RenderOptions()
+	m.Overlay, err = overlay.Find(d.Overlay, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.StageUpdate(ctx, d.SourceURL(), d.Name); err != nil {
+		return nil, err
+	}
+	return m.GenerateDiff(d.Name)
+}
+
+// missingSecrets returns the secrets required by the deployments to be
+// installed or updated that are not available in legerd, by deployment.
+func missingSecrets(ctx context.Context, changes []desired.Change) (map[string][]string, error) {
+	var required bool
+	for _, c := range changes {
+		if c.Deployment != nil && len(c.Deployment.Secrets) > 0 &&
+			(c.Action == desired.ActionInstall || c.Action == desired.ActionUpdate) {
+			required = true
+		}
+	}
+	if !required {
+		return nil, nil
+	}
+
+	storedAuth, err := auth.RequireAuth()
+	if err != nil {
+		return nil, err
+	}
+	client := daemon.NewClient("")
+	if err := client.Health(ctx); err != nil {
+		return nil, fmt.Errorf("legerd not running: %w\n\nStart with: systemctl --user start legerd.service", err)
+	}
+
+	missing := make(map[string][]string)
+	for _, c := range changes {
+		if c.Action != desired.ActionInstall && c.Action != desired.ActionUpdate {
+			continue
+		}
+		for _, name := range c.Deployment.Secrets {
+			fullName := fmt.Sprintf("leger/%s/%s", storedAuth.UserUUID, name)
+			if _, err := client.InfoSecret(ctx, fullName); err != nil {
+				missing[c.Name] = append(missing[c.Name], name)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// printPlan prints the changes of a plan with their diffs, and reports
+// whether there are any.
+func printPlan(m *staging.Manager, changes []desired.Change, diffs map[string]*staging.DiffResult, missing map[string][]string) bool {
+	var rows [][]string
+	var unmanaged []string
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.Action]++
+		if c.Action == desired.ActionNone {
+			if c.Deployment == nil {
+				unmanaged = append(unmanaged, c.Name)
+			}
+			continue
+		}
+
+		source, from, to := "-", "-", "-"
+		if c.Deployment != nil {
+			source = c.Deployment.SourceURL()
+			if meta, err := m.LoadMetadata(c.Name); err == nil {
+				to = shortVersion(meta.StagedVersion)
+			}
+		}
+		if c.Installed != nil {
+			from = shortVersion(c.Installed.Version)
+			if c.Deployment == nil {
+				source = c.Installed.Source
+			}
+		}
+		rows = append(rows, []string{c.Action, c.Name, source, from + " → " + to})
+	}
+
+	if len(rows) > 0 {
+		ui.PrintTable([]string{"ACTION", "NAME", "SOURCE", "VERSION"}, rows)
+	}
+	fmt.Printf("\nPlan: %d to install, %d to update, %d to remove, %d unchanged\n",
+		counts[desired.ActionInstall], counts[desired.ActionUpdate], counts[desired.ActionRemove],
+		counts[desired.ActionNone]-len(unmanaged))
+	if len(unmanaged) > 0 {
+		fmt.Printf("Not in the desired state (remove with --prune): %s\n", strings.Join(unmanaged, ", "))
+	}
+
+	for _, c := range changes {
+		if names := missing[c.Name]; len(names) > 0 {
+			ui.ErrorPrintf("✗ %s requires secrets missing from legerd: %s\n", c.Name, strings.Join(names, ", "))
+		}
+	}
+	for _, c := range changes {
+		if diff := diffs[c.Name]; diff != nil {
+			fmt.Printf("\n=== %s %s ===\n", c.Action, c.Name)
+			diff.Display()
+		}
+	}
+	return len(rows) > 0
+}
+
+// recordDesiredOptions records the options of the desired deployment of c
+// for the installed deployment it leaves in place or updates, so that
+// leger watch renders it the same way.
+func recordDesiredOptions(c *desired.Change) {
+	if c.Deployment == nil || c.Installed == nil {
+		return
+	}
+	recordOptions(c.Name, newDeploymentOptions(c.Deployment.RenderOptions(), c.Deployment.Overlay))
+}
+
+// installDesired installs the desired deployment d, as deploy install does.
+// If its source is a Git URL not pinned to a ref, commit is checked out.
+func installDesired(ctx context.Context, d *desired.Deployment, commit string) error {
+	opts := d.RenderOptions()
+	installFlags.source = d.SourceURL()
+	installFlags.values = opts.ValuesFiles
+	installFlags.set = opts.Set
+	installFlags.overlay = d.Overlay
+	installFlags.onFailure = onFailureRollback
+	installFlags.commit = commit
+	return runDeployInstall(ctx, d.Name)
+}
@@ -0,0 +1,367 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/leger-labs/leger/internal/health"
+	"github.com/leger-labs/leger/internal/overlay"
+	"github.com/leger-labs/leger/internal/podman"
+	"github.com/leger-labs/leger/internal/quadlet"
+	"github.com/leger-labs/leger/internal/staging"
+	"github.com/leger-labs/leger/internal/state"
+	"github.com/leger-labs/leger/internal/ui"
+	"github.com/leger-labs/leger/internal/watch"
+	"github.com/leger-labs/leger/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var watchFlags struct {
+	interval time.Duration
+	once     bool
+}
+
+// watchCmd returns the watch command
+func watchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Update deployments automatically",
+		Long: `Poll the sources of installed deployments and apply updates automatically.
+
+Each deployment follows the policy set in the watch section of the config
+file (default: never):
+
+  watch:
+    interval: 5m                  # how often sources are polled
+    health_timeout: 2m            # how long services have to become healthy
+    policy: never                 # default policy
+    deployments:
+      web:
+        policy: patch-only
+        windows: ["Mon-Fri 02:00-04:00"]
+      tools:
+        policy: always
+
+Policies:
+  never        Leave the deployment alone
+  patch-only   Move a source pinned to a version tag (e.g., @v1.2.3) to the
+               newest patch release with the same major and minor version
+  always       Move a source pinned to a version tag to the newest release,
+               and apply new commits of unpinned sources and changes to
+               local sources
+
+Updates are staged, rendered and overlaid as by leger deploy update, and
+applied only within the deployment's maintenance windows, if it has any.
+After an update, its services must be active, and pass the health checks
+of their x-health-url labels, within the health timeout, or the update is
+rolled back. Updates and rollbacks are recorded in the deployment history.
+A deployment with staged updates awaiting review is left alone.
+
+Run as a service with: systemctl --user enable --now leger-watch.service`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runWatch(cmd.Context())
+		},
+	}
+
+	cmd.Flags().DurationVar(&watchFlags.interval, "interval", 0, "Poll interval (default: watch.interval from the config file, or 5m)")
+	cmd.Flags().BoolVar(&watchFlags.once, "once", false, "Check every deployment once and exit")
+
+	return cmd
+}
+
+func runWatch(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	rules, err := watch.NewRules(&cfg.Watch)
+	if err != nil {
+		return err
+	}
+	if watchFlags.interval > 0 {
+		rules.Interval = watchFlags.interval
+	}
+
+	store, err := state.NewStore()
+	if err != nil {
+		return err
+	}
+	m, err := staging.NewManager()
+	if err != nil {
+		return err
+	}
+	m.SignaturePolicy, err = signaturePolicy("")
+	if err != nil {
+		return err
+	}
+	m.Credentials = func(repo *git.Repository) (*git.Credentials, error) {
+		return gitCredentials(ctx, repo)
+	}
+
+	w := &watcher{rules: rules, store: store, m: m, failed: make(map[string]string)}
+	if !watchFlags.once {
+		ui.InfoPrintf("Watching deployments every %s\n", rules.Interval)
+	}
+	for {
+		w.poll(ctx)
+		if watchFlags.once {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(rules.Interval):
+		}
+	}
+}
+
+// watcher updates deployments according to their rules.
+type watcher struct {
+	rules *watch.Rules
+	store *state.Store
+	m     *staging.Manager
+
+	// failed maps deployments to the version whose update last failed, so
+	// that it is not retried until the source moves on.
+	failed map[string]string
+}
+
+// poll checks every installed deployment once.
+func (w *watcher) poll(ctx context.Context) {
+	deployments, err := w.store.List()
+	if err != nil {
+		ui.ErrorPrintf("✗ %v\n", err)
+		return
+	}
+	for i := range deployments {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := w.check(ctx, &deployments[i]); err != nil {
+			ui.ErrorPrintf("✗ %s: %v\n", deployments[i].Name, err)
+		}
+	}
+}
+
+// check updates the deployment st if its rule allows it now and its source
+// has changed.
+func (w *watcher) check(ctx context.Context, st *types.DeploymentState) error {
+	name := st.Name
+	rule := w.rules.For(name)
+	if rule.Policy == watch.PolicyNever || !rule.InWindow(time.Now()) {
+		return nil
+	}
+	if _, err := os.Stat(w.m.GetStagingPath(name)); err == nil {
+		fmt.Printf("%s: staged updates await review, skipping (leger apply or leger discard)\n", name)
+		return nil
+	}
+
+	target, err := w.target(ctx, st.Source, rule.Policy)
+	if err != nil || target == "" {
+		return err
+	}
+
+	// Stage with the values and overlay the deployment was installed with.
+	var overlayDir string
+	w.m.Render, overlayDir = deploymentOptions(st)
+	if w.m.Overlay, err = overlay.Find(overlayDir, name); err != nil {
+		return err
+	}
+	if err := w.m.StageUpdate(ctx, target, name); err != nil {
+		w.m.DiscardStaged(name)
+		return fmt.Errorf("failed to stage %s: %w", target, err)
+	}
+	meta, err := w.m.LoadMetadata(name)
+	if err != nil {
+		w.m.DiscardStaged(name)
+		return err
+	}
+	if v := meta.StagedVersion; v != "" && v == w.failed[name] {
+		return w.m.DiscardStaged(name)
+	}
+	diff, err := w.m.GenerateDiff(name)
+	if err != nil {
+		w.m.DiscardStaged(name)
+		return err
+	}
+	if !diff.HasChanges() {
+		if err := w.m.DiscardStaged(name); err != nil {
+			return err
+		}
+		// A new tag with the same quadlets is recorded, so that it is not
+		// fetched again.
+		if target != st.Source {
+			recordDeployment(name, state.ActionUpdate, target, meta.StagedVersion, "auto-update: quadlets unchanged")
+		}
+		return nil
+	}
+
+	fmt.Printf("%s: updating %s → %s (policy %s)\n", name, shortVersion(st.Version), shortVersion(meta.StagedVersion), rule.Policy)
+	if err := w.apply(ctx, name, meta, rule); err != nil {
+		w.failed[name] = meta.StagedVersion
+		return err
+	}
+	delete(w.failed, name)
+	fmt.Printf("✓ %s: updated\n", name)
+	return nil
+}
+
+// target returns the source to update a deployment installed from source to
+// under policy, or "" if there is none. Sources pinned to a version tag move
+// to a newer tag; unpinned sources are fetched again only under always.
+func (w *watcher) target(ctx context.Context, source, policy string) (string, error) {
+	if !git.IsGitURL(source) {
+		// Local sources are staged again if they still exist, but leger.run
+		// sources are not supported by staging yet, and relative paths
+		// recorded by older versions are ambiguous.
+		if policy != watch.PolicyAlways || !filepath.IsAbs(source) {
+			return "", nil
+		}
+		if info, err := os.Stat(source); err != nil || !info.IsDir() {
+			return "", nil
+		}
+		return source, nil
+	}
+
+	repo, err := git.ParseURL(source, "")
+	if err != nil {
+		return "", err
+	}
+	if repo.Ref == "" {
+		if policy == watch.PolicyAlways {
+			return source, nil
+		}
+		return "", nil
+	}
+	if !watch.IsVersion(repo.Ref) {
+		return "", nil
+	}
+
+	creds, err := gitCredentials(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+	tags, err := git.RemoteTags(repo, creds)
+	if err != nil {
+		return "", err
+	}
+	next, ok := watch.NextTag(repo.Ref, tags, policy)
+	if !ok {
+		return "", nil
+	}
+	return strings.TrimSuffix(source, "@"+repo.Ref) + "@" + next, nil
+}
+
+// apply applies the staged update of the named deployment, and rolls it
+// back if its services do not become healthy. The outcome is recorded in
+// the deployment's history.
+func (w *watcher) apply(ctx context.Context, name string, meta *staging.StagingMetadata, rule watch.Rule) error {
+	source, version := meta.SourceURL, meta.StagedVersion
+
+	if err := w.m.ApplyStaged(ctx, name); err != nil {
+		recordFailure(name, state.ActionUpdate, source, version, err)
+		if errors.Is(err, staging.ErrRolledBack) {
+			recordDeployment(name, state.ActionRollback, "", "", "restored after failed auto-update")
+		}
+		return err
+	}
+
+	if err := waitHealthy(ctx, name, w.rules.HealthTimeout); err != nil {
+		fmt.Printf("%s: health check failed, rolling back...\n", name)
+		if rbErr := w.m.Rollback(ctx, name); rbErr != nil {
+			err = fmt.Errorf("%w; rollback failed: %v", err, rbErr)
+			recordFailure(name, state.ActionUpdate, source, version, err)
+			return err
+		}
+		recordFailure(name, state.ActionUpdate, source, version, err)
+		recordDeployment(name, state.ActionRollback, "", "", "restored after failed health check")
+		return err
+	}
+
+	recordDeployment(name, state.ActionUpdate, source, version, "auto-update ("+rule.Policy+")")
+	return nil
+}
+
+// healthTarget is a service of a deployment and its health check, if any.
+type healthTarget struct {
+	service string
+	check   *health.HealthCheck
+}
+
+// waitHealthy waits until the services of the named deployment are active
+// and pass their health checks, for at most timeout.
+func waitHealthy(ctx context.Context, name string, timeout time.Duration) error {
+	dir, err := activeDeploymentDir(name)
+	if err != nil {
+		return err
+	}
+	var targets []healthTarget
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".container" {
+			return err
+		}
+		qf, err := quadlet.ParseQuadletFile(path)
+		if err != nil {
+			return err
+		}
+		t := healthTarget{service: qf.GetServiceName()}
+		if labels, err := quadlet.ParseLabels(path); err == nil {
+			t.check = health.ParseHealthCheckLabels(labels)
+		}
+		targets = append(targets, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sm := podman.NewSystemdManager("user")
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkHealth(ctx, sm, targets)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not healthy after %s: %w", timeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// checkHealth reports an error for the first of targets that is not active
+// or fails its health check.
+func checkHealth(ctx context.Context, sm *podman.SystemdManager, targets []healthTarget) error {
+	for _, t := range targets {
+		status, err := sm.GetServiceStatus(t.service)
+		if err != nil {
+			return err
+		}
+		if status.ActiveState != "active" {
+			return fmt.Errorf("%s is %s", t.service, status.ActiveState)
+		}
+		if t.check == nil {
+			continue
+		}
+		if result := t.check.Check(ctx); result.Status != health.StatusHealthy {
+			return fmt.Errorf("%s: %v", t.service, result.Error)
+		}
+	}
+	return nil
+}
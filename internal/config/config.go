@@ -0,0 +1,172 @@
+// Package config loads the leger configuration file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SystemPath is the configuration file used when the user has none.
+const SystemPath = "/etc/leger/config.yaml"
+
+// Config is the leger configuration file. Sections not used by the CLI
+// are ignored.
+type Config struct {
+	Git   GitConfig   `yaml:"git"`
+	Watch WatchConfig `yaml:"watch"`
+}
+
+// GitConfig configures how Git sources are fetched.
+type GitConfig struct {
+	// Forges maps self-hosted Git hosts to the forge they run, one of
+	// github, gitlab, gitea, forgejo, sourcehut or generic, so that their
+	// browse URLs are understood.
+	Forges map[string]string `yaml:"forges"`
+
+	Sources []GitSource `yaml:"sources"`
+}
+
+// GitSource holds the credentials for the repositories matching Match.
+// At most one of TokenSecret and CredentialHelper may be set.
+type GitSource struct {
+	// Match is a host, or a host and path prefix, such as github.com/acme.
+	Match string `yaml:"match"`
+
+	// SSHKey is the private key to fetch over SSH with, and KnownHosts the
+	// only known_hosts file to trust. HTTPS sources are fetched over SSH as
+	// SSHUser (default git) on SSHPort (default 22).
+	SSHKey     string `yaml:"ssh_key"`
+	KnownHosts string `yaml:"known_hosts"`
+	SSHUser    string `yaml:"ssh_user"`
+	SSHPort    int    `yaml:"ssh_port"`
+
+	// TokenSecret names the legerd secret holding an HTTPS access token,
+	// sent with Username.
+	TokenSecret string `yaml:"token_secret"`
+	Username    string `yaml:"username"`
+
+	// CredentialHelper is a Git credential helper, as for credential.helper.
+	CredentialHelper string `yaml:"credential_helper"`
+}
+
+// WatchConfig configures automatic updates by leger watch.
+type WatchConfig struct {
+	// Interval is how often sources are polled, and HealthTimeout how long
+	// updated services have to become healthy before they are rolled back.
+	Interval      time.Duration `yaml:"interval"`
+	HealthTimeout time.Duration `yaml:"health_timeout"`
+
+	// The default policy, and the policies of individual deployments.
+	WatchPolicy `yaml:",inline"`
+	Deployments map[string]WatchPolicy `yaml:"deployments"`
+}
+
+// WatchPolicy is how a deployment is updated: its policy, one of never,
+// patch-only or always, and the maintenance windows updates are applied
+// in, such as "Mon-Fri 02:00-04:00".
+type WatchPolicy struct {
+	Policy  string   `yaml:"policy"`
+	Windows []string `yaml:"windows"`
+}
+
+// DefaultPath returns ~/.config/leger/config.yaml if it exists, and
+// otherwise SystemPath.
+func DefaultPath() string {
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		path := filepath.Join(homeDir, ".config", "leger", "config.yaml")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return SystemPath
+}
+
+// Load reads the configuration file at path, or at DefaultPath if path is
+// empty. A missing default file is an empty configuration.
+func Load(path string) (*Config, error) {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultPath()
+	}
+
+	cfg := &Config{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	forges := make(map[string]string, len(cfg.Git.Forges))
+	for host, forge := range cfg.Git.Forges {
+		forges[strings.ToLower(host)] = forge
+	}
+	cfg.Git.Forges = forges
+
+	for i := range cfg.Git.Sources {
+		src := &cfg.Git.Sources[i]
+		if err := src.check(); err != nil {
+			return nil, fmt.Errorf("config %s: git.sources[%d]: %w", path, i, err)
+		}
+		src.Match = strings.ToLower(strings.Trim(src.Match, "/"))
+		src.SSHKey = ExpandHome(src.SSHKey)
+		src.KnownHosts = ExpandHome(src.KnownHosts)
+	}
+	return cfg, nil
+}
+
+func (s *GitSource) check() error {
+	switch {
+	case strings.Trim(s.Match, "/") == "":
+		return fmt.Errorf("match is required")
+	case s.TokenSecret != "" && s.CredentialHelper != "":
+		return fmt.Errorf("token_secret and credential_helper cannot both be set")
+	case s.KnownHosts != "" && s.SSHKey == "":
+		return fmt.Errorf("known_hosts requires ssh_key")
+	case (s.SSHUser != "" || s.SSHPort != 0) && s.SSHKey == "":
+		return fmt.Errorf("ssh_user and ssh_port require ssh_key")
+	case s.SSHPort < 0 || s.SSHPort > 65535:
+		return fmt.Errorf("invalid ssh_port %d", s.SSHPort)
+	case s.Username != "" && s.TokenSecret == "":
+		return fmt.Errorf("username requires token_secret")
+	}
+	return nil
+}
+
+// Source returns the source whose Match is the longest prefix of key, a
+// repository's host and path as git.RepositoryKey returns, or nil if none
+// matches.
+func (g *GitConfig) Source(key string) *GitSource {
+	key = strings.ToLower(key)
+	var best *GitSource
+	for i := range g.Sources {
+		src := &g.Sources[i]
+		if key != src.Match && !strings.HasPrefix(key, src.Match+"/") {
+			continue
+		}
+		if best == nil || len(src.Match) > len(best.Match) {
+			best = src
+		}
+	}
+	return best
+}
+
+// ExpandHome replaces a leading ~/ in path with the user's home directory.
+func ExpandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(homeDir, rest)
+		}
+	}
+	return path
+}
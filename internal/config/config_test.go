@@ -0,0 +1,106 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("HOME", "/home/test")
+	path := writeConfig(t, `
+daemon:
+  url: "http://localhost:9090"
+git:
+  forges:
+    Git.Internal.Example: forgejo
+  sources:
+    - match: GitHub.com/acme/
+      ssh_key: ~/.ssh/acme_deploy
+      known_hosts: ~/.config/leger/known_hosts
+    - match: github.com/acme/private
+      token_secret: github-token
+    - match: git.example.com
+      credential_helper: store
+watch:
+  interval: 10m
+  policy: patch-only
+  deployments:
+    web:
+      policy: always
+      windows: ["Mon-Fri 02:00-04:00"]
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Git.Forges["git.internal.example"] != "forgejo" {
+		t.Errorf("Forges: got %v", cfg.Git.Forges)
+	}
+	if len(cfg.Git.Sources) != 3 {
+		t.Fatalf("Sources: got %+v", cfg.Git.Sources)
+	}
+	if w := cfg.Watch; w.Interval != 10*time.Minute || w.Policy != "patch-only" ||
+		w.Deployments["web"].Policy != "always" || len(w.Deployments["web"].Windows) != 1 {
+		t.Errorf("Watch: got %+v", w)
+	}
+	src := cfg.Git.Sources[0]
+	if src.Match != "github.com/acme" || src.SSHKey != "/home/test/.ssh/acme_deploy" ||
+		src.KnownHosts != "/home/test/.config/leger/known_hosts" {
+		t.Errorf("Source: got %+v", src)
+	}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"github.com/acme/app", "github.com/acme"},
+		{"github.com/acme/private", "github.com/acme/private"},
+		{"github.com/acme/private-tools", "github.com/acme"},
+		{"git.example.com/team/repo", "git.example.com"},
+		{"github.com/acmecorp/app", ""},
+		{"gitlab.com/acme/app", ""},
+	}
+	for _, tc := range tests {
+		got := ""
+		if src := cfg.Git.Source(tc.key); src != nil {
+			got = src.Match
+		}
+		if got != tc.want {
+			t.Errorf("Source(%q): got %q, want %q", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"NoMatch":         "git:\n  sources:\n    - ssh_key: /key\n",
+		"TokenAndHelper":  "git:\n  sources:\n    - match: a.com\n      token_secret: t\n      credential_helper: store\n",
+		"KnownHostsOnly":  "git:\n  sources:\n    - match: a.com\n      known_hosts: /kh\n",
+		"UsernameNoToken": "git:\n  sources:\n    - match: a.com\n      username: bot\n",
+		"SSHUserNoKey":    "git:\n  sources:\n    - match: a.com\n      ssh_user: forgejo\n",
+		"SSHPortRange":    "git:\n  sources:\n    - match: a.com\n      ssh_key: /key\n      ssh_port: 70000\n",
+		"Syntax":          "git: [",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(writeConfig(t, data)); err == nil {
+				t.Error("Load: expected error")
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Load of missing explicit path: expected error")
+	}
+}
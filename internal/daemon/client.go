@@ -3,7 +3,9 @@ package daemon
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/leger-labs/leger/client/setec"
@@ -14,20 +16,39 @@ import (
 type Client struct {
 	setecClient setec.Client
 	baseURL     string
+	httpClient  *http.Client
 }
 
-// NewClient creates a new legerd client wrapping setec.Client
+// NewClient creates a new legerd client wrapping setec.Client.
+// A baseURL of the form "unix:<path>" connects to a legerd agent listening on
+// the unix socket at path.
 func NewClient(baseURL string) *Client {
 	if baseURL == "" {
 		baseURL = "http://localhost:8080"
 	}
 
-	return &Client{
+	c := &Client{
 		setecClient: setec.Client{
 			Server: baseURL,
 		},
-		baseURL: baseURL,
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: 3 * time.Second},
 	}
+	if path, ok := strings.CutPrefix(baseURL, "unix:"); ok {
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		c.httpClient = &http.Client{Transport: tr, Timeout: 3 * time.Second}
+		c.baseURL = "http://legerd-agent"
+		c.setecClient = setec.Client{
+			Server: c.baseURL,
+			DoHTTP: (&http.Client{Transport: tr}).Do,
+		}
+	}
+	return c
 }
 
 // SetecClient returns the underlying setec.Client for advanced operations
@@ -162,8 +183,7 @@ func (c *Client) HealthHTTP(ctx context.Context) error {
 		return err
 	}
 
-	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("legerd not reachable: %w", err)
 	}
@@ -2,10 +2,21 @@ package daemon
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/agent"
+	"github.com/leger-labs/leger/client/setec"
 	"github.com/leger-labs/leger/setectest"
+	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/types/logger"
 )
 
 func TestClientSetecIntegration(t *testing.T) {
@@ -138,6 +149,74 @@ func TestClientSetecIntegration(t *testing.T) {
 	})
 }
 
+func TestClientFake(t *testing.T) {
+	fake := setectest.NewFake(t, nil)
+	fake.Rotate("svc/token", "v1")
+	fake.Rotate("ops/key", "hidden")
+
+	// The service may only read its own secrets.
+	client := NewClient(fake.AddPrincipal("tag:svc", acl.Rule{
+		Action: []acl.Action{acl.ActionGet, acl.ActionInfo},
+		Secret: []acl.Secret{"svc/*"},
+	}))
+	ctx := context.Background()
+
+	t.Run("AccessDenied", func(t *testing.T) {
+		if _, err := client.GetSecret(ctx, "ops/key"); !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("GetSecret(ops/key) error = %v, want %v", err, api.ErrAccessDenied)
+		}
+		if _, err := client.PutSecret(ctx, "svc/token", []byte("v2")); !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("PutSecret(svc/token) error = %v, want %v", err, api.ErrAccessDenied)
+		}
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		for _, want := range []string{"v1", "v2"} {
+			if want != "v1" {
+				fake.Rotate("svc/token", want)
+			}
+			got, err := client.GetSecret(ctx, "svc/token")
+			if err != nil {
+				t.Fatalf("GetSecret() failed: %v", err)
+			}
+			if string(got) != want {
+				t.Errorf("GetSecret() = %q, want %q", got, want)
+			}
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		fake.FailMethod("list", -1, http.StatusInternalServerError)
+		defer fake.ClearFaults()
+		if err := client.Health(ctx); err == nil {
+			t.Error("Health() with failing server should return error")
+		}
+	})
+
+	t.Run("Latency", func(t *testing.T) {
+		fake.SetLatency("*", 20*time.Millisecond)
+		defer fake.ClearFaults()
+		start := time.Now()
+		if err := client.Health(ctx); err != nil {
+			t.Fatalf("Health() failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("Health() took %v, want at least 20ms", elapsed)
+		}
+	})
+
+	t.Run("Calls", func(t *testing.T) {
+		for _, c := range fake.Calls() {
+			if c.Principal != "tag:svc" {
+				t.Errorf("Call to %q from %q, want tag:svc", c.Method, c.Principal)
+			}
+		}
+		if n := len(fake.CallsTo("put")); n != 1 {
+			t.Errorf("Got %d put calls, want 1", n)
+		}
+	})
+}
+
 func TestClientDefaults(t *testing.T) {
 	client := NewClient("")
 
@@ -162,3 +241,44 @@ func TestClientCustomURL(t *testing.T) {
 		t.Errorf("NewClient(%q).setecClient.Server = %q, want %q", customURL, client.setecClient.Server, customURL)
 	}
 }
+
+func TestClientAgentSocket(t *testing.T) {
+	// Socket paths are limited in length, so avoid the long test directory.
+	dir, err := os.MkdirTemp("", "legerd")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "agent.sock")
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	fake := setectest.NewFake(t, nil)
+	fake.Rotate("svc/token", "v1")
+	mux := http.NewServeMux()
+	if _, err := agent.New(agent.Config{
+		Client: setec.Client{Server: fake.URL},
+		Mux:    mux,
+		Logf:   logger.Discard,
+	}); err != nil {
+		t.Fatalf("agent.New: %v", err)
+	}
+	hs := &http.Server{Handler: mux}
+	go hs.Serve(l)
+	defer hs.Close()
+
+	client := NewClient("unix:" + sock)
+	ctx := context.Background()
+	if err := client.Health(ctx); err != nil {
+		t.Errorf("Health() failed: %v", err)
+	}
+	got, err := client.GetSecret(ctx, "svc/token")
+	if err != nil {
+		t.Fatalf("GetSecret() failed: %v", err)
+	}
+	if string(got) != "v1" {
+		t.Errorf("GetSecret() = %q, want %q", got, "v1")
+	}
+}
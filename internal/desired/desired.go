@@ -0,0 +1,196 @@
+// Package desired reads the desired state of a host's deployments and plans
+// the changes that reconcile the host with it.
+//
+// The desired state is a YAML file listing every deployment the host should
+// run, with its source and the options it is installed with, so that hosts
+// can be managed from a Git repository of such files.
+package desired
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/leger-labs/leger/internal/config"
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/leger-labs/leger/internal/render"
+	"github.com/leger-labs/leger/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// State is the desired state of a host.
+type State struct {
+	Deployments []Deployment `yaml:"deployments"`
+}
+
+// Deployment is a deployment the host should run.
+type Deployment struct {
+	Name string `yaml:"name"`
+
+	// Source is a Git URL or local path, and Ref the tag or commit of a
+	// Git source to pin it to.
+	Source string `yaml:"source"`
+	Ref    string `yaml:"ref"`
+
+	// Scope is where the deployment is installed. Only "user" is
+	// supported, which is also the default.
+	Scope string `yaml:"scope"`
+
+	// Overlay is the overlay directory to apply, by default the one in
+	// ~/.config/leger/overlays/<name>, if present.
+	Overlay string `yaml:"overlay"`
+
+	// Values and Set are the values files and key=value assignments to
+	// render templates with, as for --values and --set.
+	Values []string          `yaml:"values"`
+	Set    map[string]string `yaml:"set"`
+
+	// Secrets lists the secrets the deployment requires, which must be
+	// available in legerd before it is installed or updated.
+	Secrets []string `yaml:"secrets"`
+}
+
+// DefaultPath returns the desired state file used when none is given:
+// ~/.config/leger/deployments.yaml.
+func DefaultPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "leger", "deployments.yaml"), nil
+}
+
+// Load reads the desired state file at path.
+func Load(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read desired state: %w", err)
+	}
+	s := &State{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i := range s.Deployments {
+		d := &s.Deployments[i]
+		if err := d.check(); err != nil {
+			return nil, fmt.Errorf("%s: deployments[%d]: %w", path, i, err)
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("%s: deployment %s is listed twice", path, d.Name)
+		}
+		seen[d.Name] = true
+		if d.Scope == "" {
+			d.Scope = "user"
+		}
+		d.Source = config.ExpandHome(d.Source)
+		d.Overlay = config.ExpandHome(d.Overlay)
+		for j, v := range d.Values {
+			d.Values[j] = config.ExpandHome(v)
+		}
+	}
+	return s, nil
+}
+
+func (d *Deployment) check() error {
+	switch {
+	case d.Name == "":
+		return fmt.Errorf("name is required")
+	case strings.ContainsAny(d.Name, `/\`) || d.Name == "." || d.Name == "..":
+		return fmt.Errorf("invalid name %q", d.Name)
+	case d.Source == "":
+		return fmt.Errorf("%s: source is required", d.Name)
+	case d.Scope != "" && d.Scope != "user":
+		return fmt.Errorf("%s: scope %q is not supported (only user)", d.Name, d.Scope)
+	}
+	if d.Ref != "" {
+		if !git.IsGitURL(d.Source) {
+			return fmt.Errorf("%s: ref requires a Git source", d.Name)
+		}
+		repo, err := git.ParseURL(d.Source, "")
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.Name, err)
+		}
+		if repo.Ref != "" {
+			return fmt.Errorf("%s: source is already pinned to %s", d.Name, repo.Ref)
+		}
+	}
+	return nil
+}
+
+// SourceURL returns the source to fetch the deployment from, pinned to Ref.
+func (d *Deployment) SourceURL() string {
+	if d.Ref == "" {
+		return d.Source
+	}
+	return d.Source + "@" + d.Ref
+}
+
+// RenderOptions returns the options to render the deployment's templates
+// with.
+func (d *Deployment) RenderOptions() render.Options {
+	opts := render.Options{ValuesFiles: d.Values}
+	for _, key := range slices.Sorted(maps.Keys(d.Set)) {
+		opts.Set = append(opts.Set, key+"="+d.Set[key])
+	}
+	return opts
+}
+
+// Actions of a plan.
+const (
+	ActionInstall = "install"
+	ActionUpdate  = "update"
+	ActionRemove  = "remove"
+	ActionNone    = "none"
+)
+
+// Change is a step of a plan.
+type Change struct {
+	Action string
+	Name   string
+
+	// Deployment is the desired deployment, or nil for removals and for
+	// deployments not in the desired state.
+	Deployment *Deployment
+
+	// Installed is the recorded state of the deployment, or nil if it is
+	// not installed.
+	Installed *types.DeploymentState
+}
+
+// Plan returns the changes that reconcile the installed deployments with
+// the desired state, in order by name. Desired deployments that are
+// installed are planned as updates; whether they change is only known once
+// their source is fetched. Installed deployments not in the desired state
+// are removed if prune is set, and otherwise left alone.
+func Plan(s *State, installed []types.DeploymentState, prune bool) []Change {
+	byName := make(map[string]*types.DeploymentState, len(installed))
+	for i := range installed {
+		byName[installed[i].Name] = &installed[i]
+	}
+
+	var changes []Change
+	for i := range s.Deployments {
+		d := &s.Deployments[i]
+		c := Change{Action: ActionInstall, Name: d.Name, Deployment: d}
+		if st, ok := byName[d.Name]; ok {
+			c.Action, c.Installed = ActionUpdate, st
+			delete(byName, d.Name)
+		}
+		changes = append(changes, c)
+	}
+	for name, st := range byName {
+		c := Change{Action: ActionNone, Name: name, Installed: st}
+		if prune {
+			c.Action = ActionRemove
+		}
+		changes = append(changes, c)
+	}
+
+	slices.SortFunc(changes, func(a, b Change) int { return strings.Compare(a.Name, b.Name) })
+	return changes
+}
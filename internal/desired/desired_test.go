@@ -0,0 +1,109 @@
+package desired
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/leger-labs/leger/pkg/types"
+)
+
+func writeState(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "deployments.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("HOME", "/home/test")
+	s, err := Load(writeState(t, `
+deployments:
+  - name: web
+    source: https://github.com/acme/quadlets//web
+    ref: v1.2.0
+    overlay: ~/overlays/web
+    values: [~/values/web.yaml]
+    set:
+      image.tag: "1.27"
+      port: "8080"
+    secrets: [web/api-key]
+  - name: tools
+    source: ~/quadlets/tools
+`))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(s.Deployments) != 2 {
+		t.Fatalf("Deployments: got %+v", s.Deployments)
+	}
+
+	web := s.Deployments[0]
+	if got, want := web.SourceURL(), "https://github.com/acme/quadlets//web@v1.2.0"; got != want {
+		t.Errorf("SourceURL: got %q, want %q", got, want)
+	}
+	if web.Scope != "user" || web.Overlay != "/home/test/overlays/web" {
+		t.Errorf("Deployment: got %+v", web)
+	}
+	opts := web.RenderOptions()
+	if !reflect.DeepEqual(opts.ValuesFiles, []string{"/home/test/values/web.yaml"}) ||
+		!reflect.DeepEqual(opts.Set, []string{"image.tag=1.27", "port=8080"}) {
+		t.Errorf("RenderOptions: got %+v", opts)
+	}
+	if got := s.Deployments[1].SourceURL(); got != "/home/test/quadlets/tools" {
+		t.Errorf("SourceURL: got %q", got)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"NoName":      "deployments:\n  - source: /q\n",
+		"BadName":     "deployments:\n  - name: a/b\n    source: /q\n",
+		"NoSource":    "deployments:\n  - name: a\n",
+		"Duplicate":   "deployments:\n  - name: a\n    source: /q\n  - name: a\n    source: /r\n",
+		"SystemScope": "deployments:\n  - name: a\n    source: /q\n    scope: system\n",
+		"LocalRef":    "deployments:\n  - name: a\n    source: /q\n    ref: v1\n",
+		"TwoRefs":     "deployments:\n  - name: a\n    source: https://github.com/acme/q@v1\n    ref: v2\n",
+		"Syntax":      "deployments: [",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(writeState(t, data)); err == nil {
+				t.Error("Load: expected error")
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	s := &State{Deployments: []Deployment{
+		{Name: "web", Source: "/q/web"},
+		{Name: "db", Source: "/q/db"},
+	}}
+	installed := []types.DeploymentState{{Name: "web"}, {Name: "old"}}
+
+	actions := func(changes []Change) map[string]string {
+		out := make(map[string]string)
+		for _, c := range changes {
+			out[c.Name] = c.Action
+		}
+		return out
+	}
+
+	changes := Plan(s, installed, false)
+	want := map[string]string{"db": ActionInstall, "old": ActionNone, "web": ActionUpdate}
+	if got := actions(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan: got %v, want %v", got, want)
+	}
+	if changes[0].Name != "db" || changes[2].Installed == nil || changes[2].Deployment == nil {
+		t.Errorf("Plan: got %+v", changes)
+	}
+
+	want["old"] = ActionRemove
+	if got := actions(Plan(s, installed, true)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan with prune: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,142 @@
+// Package dotenv parses environment files in the common ".env" format.
+package dotenv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Var is a variable assignment in an environment file.
+type Var struct {
+	Name  string
+	Value string
+	Line  int // 1-based line number of the assignment
+}
+
+// Parse parses the contents of an environment file and returns its
+// assignments in order of appearance. If a name is assigned more than once,
+// each assignment is reported; the last one wins when applied in order.
+//
+// Each non-blank line not starting with "#" has the form NAME=VALUE, with an
+// optional "export " prefix. Values may be:
+//
+//   - unquoted, in which case surrounding whitespace and any trailing comment
+//     introduced by " #" are removed;
+//   - single-quoted, in which case the text between the quotes is used
+//     verbatim;
+//   - double-quoted, in which case the escapes \n, \r, \t, \", \$ and \\ are
+//     interpreted, and the value may span multiple lines.
+func Parse(data []byte) ([]Var, error) {
+	var out []Var
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		text = strings.TrimPrefix(text, "export ")
+		name, rest, ok := strings.Cut(text, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validName(name) {
+			return nil, fmt.Errorf("line %d: invalid assignment %q", line, sc.Text())
+		}
+		v := Var{Name: name, Line: line}
+		rest = strings.TrimSpace(rest)
+
+		switch {
+		case strings.HasPrefix(rest, "'"):
+			end := strings.Index(rest[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single-quoted value", line)
+			}
+			v.Value = rest[1 : end+1]
+
+		case strings.HasPrefix(rest, `"`):
+			// A double-quoted value may continue onto following lines.
+			raw := rest[1:]
+			for {
+				val, done, err := unquote(raw)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", line, err)
+				} else if done {
+					v.Value = val
+					break
+				}
+				if !sc.Scan() {
+					return nil, fmt.Errorf("line %d: unterminated double-quoted value", v.Line)
+				}
+				line++
+				raw += "\n" + sc.Text()
+			}
+
+		default:
+			if i := strings.Index(rest, " #"); i >= 0 {
+				rest = rest[:i]
+			}
+			v.Value = strings.TrimSpace(rest)
+		}
+		out = append(out, v)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// unquote decodes the body of a double-quoted value, not including the
+// opening quote. It reports done == false if s does not contain the closing
+// quote.
+func unquote(s string) (_ string, done bool, _ error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return sb.String(), true, nil
+		case '\\':
+			if i+1 == len(s) {
+				return "", false, nil
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case '"', '\\', '$':
+				sb.WriteByte(s[i])
+			case '\n':
+				// A backslash at the end of a line continues the value.
+			default:
+				return "", false, fmt.Errorf("invalid escape %q", s[i-1:i+1])
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", false, nil
+}
+
+// validName reports whether name is a valid variable name.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		case c == '.' || c == '-' || c == '/':
+			// Allowed so that secret names can be used directly as keys.
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package dotenv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	input := `# A comment
+API_KEY=xyzzy
+export DB_PASSWORD = "hunter2"
+
+PLAIN=some value # trailing comment
+HASH=abc#def
+SINGLE='raw \n $HOME'
+DOUBLE="line one\nline \"two\""
+MULTI="first
+second"
+EMPTY=
+app/db-url=postgres://localhost
+API_KEY=override
+`
+	got, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := []Var{
+		{Name: "API_KEY", Value: "xyzzy", Line: 2},
+		{Name: "DB_PASSWORD", Value: "hunter2", Line: 3},
+		{Name: "PLAIN", Value: "some value", Line: 5},
+		{Name: "HASH", Value: "abc#def", Line: 6},
+		{Name: "SINGLE", Value: `raw \n $HOME`, Line: 7},
+		{Name: "DOUBLE", Value: "line one\nline \"two\"", Line: 8},
+		{Name: "MULTI", Value: "first\nsecond", Line: 9},
+		{Name: "EMPTY", Value: "", Line: 11},
+		{Name: "app/db-url", Value: "postgres://localhost", Line: 12},
+		{Name: "API_KEY", Value: "override", Line: 13},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"no assignment", "JUST_A_NAME\n"},
+		{"empty name", "=value\n"},
+		{"invalid name", "1ABC=value\n"},
+		{"space in name", "MY KEY=value\n"},
+		{"unterminated single", "A='oops\n"},
+		{"unterminated double", "A=\"oops\nB=1\n"},
+		{"invalid escape", `A="\q"` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Parse([]byte(tt.input)); err == nil {
+				t.Errorf("Parse(%q) = %+v, want error", tt.input, got)
+			}
+		})
+	}
+}
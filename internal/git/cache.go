@@ -0,0 +1,381 @@
+package git
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Cache keeps a bare mirror of each repository that sources are cloned from,
+// so that later clones only fetch what changed. Checkouts are Git worktrees
+// of a mirror, limited to the source's subdirectory with a sparse checkout.
+//
+// Mirrors are stored under Dir by host and path, for example
+// github.com/org/repo.git, each with a lock file beside it so that concurrent
+// invocations do not update a mirror at the same time. Checkouts are stored
+// under Dir/checkouts until they are closed.
+type Cache struct {
+	Dir string
+}
+
+// CacheEntry describes a mirror in the cache.
+type CacheEntry struct {
+	URL      string    // Repository the mirror was cloned from
+	Path     string    // Path of the mirror
+	Size     int64     // Size of the mirror in bytes
+	LastUsed time.Time // Last time a checkout was made from the mirror
+}
+
+// Checkout is a working copy of a repository from the cache.
+type Checkout struct {
+	Root   string // Root of the working copy
+	Dir    string // Directory of the source within Root
+	Commit string // Commit checked out
+
+	mirror string
+}
+
+const (
+	checkoutsDirName = "checkouts"
+	usedFileName     = "leger-last-used"
+
+	// staleCheckoutAge is how old a checkout must be before Prune treats it
+	// as left over from an invocation that did not clean up.
+	staleCheckoutAge = 24 * time.Hour
+)
+
+// NewCache returns the cache in the default location,
+// ~/.local/share/leger/git-cache.
+func NewCache() (*Cache, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return &Cache{Dir: filepath.Join(homeDir, ".local", "share", "leger", "git-cache")}, nil
+}
+
+// Checkout updates the mirror of repo and checks out repo.Ref, or the head of
+// repo.Branch. If policy is not nil, the checkout must be signed as the
+// policy requires. The mirror is fetched with creds, if not nil.
+// The caller must Close the checkout when done with it.
+func (c *Cache) Checkout(repo *Repository, policy *VerifyPolicy, creds *Credentials) (*Checkout, error) {
+	return c.checkout(repo.GetCloneURL(), repo.Branch, repo.Ref, repo.SubPath, policy, creds)
+}
+
+func (c *Cache) checkout(cloneURL, branch, ref, subPath string, policy *VerifyPolicy, creds *Credentials) (_ *Checkout, err error) {
+	if err := creds.Validate(); err != nil {
+		return nil, err
+	}
+	cloneURL = creds.cloneURL(cloneURL)
+	mirror, err := c.mirrorPath(cloneURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(mirror), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	unlock, err := lockFile(mirror + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rev, err := updateMirror(mirror, cloneURL, branch, ref, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	co := &Checkout{mirror: mirror}
+	co.Root, err = c.newCheckoutDir()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			co.remove()
+		}
+	}()
+
+	if err := runGit("-C", mirror, "worktree", "add", "--quiet", "--no-checkout", "--detach", co.Root, rev); err != nil {
+		return nil, err
+	}
+	if subPath != "" {
+		if err := runGit("-C", co.Root, "sparse-checkout", "set", subPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := runGit("-C", co.Root, "checkout", "--quiet", "--detach", "HEAD"); err != nil {
+		return nil, err
+	}
+	co.Commit, err = HeadCommit(co.Root)
+	if err != nil {
+		return nil, err
+	}
+	os.WriteFile(filepath.Join(mirror, usedFileName), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+
+	if policy != nil {
+		if _, err := policy.Verify(co.Root, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	co.Dir = co.Root
+	if subPath != "" {
+		co.Dir = filepath.Join(co.Root, subPath)
+		if _, err := os.Stat(co.Dir); err != nil {
+			return nil, fmt.Errorf(`subdirectory not found in repository: %s
+
+Verify the path exists in the repository`, subPath)
+		}
+	}
+	return co, nil
+}
+
+// updateMirror creates or updates the mirror of cloneURL, fetching with
+// creds, and returns the revision to check out for branch and ref.
+func updateMirror(mirror, cloneURL, branch, ref string, creds *Credentials) (string, error) {
+	fetched := false
+	if _, err := os.Stat(mirror); errors.Is(err, fs.ErrNotExist) {
+		if err := runGitEnv(creds.env(), "clone", "--quiet", "--mirror", cloneURL, mirror); err != nil {
+			os.RemoveAll(mirror)
+			return "", err
+		}
+		fetched = true
+	} else if err != nil {
+		return "", err
+	}
+
+	commit := IsCommit(ref) && !hasTag(mirror, cloneURL, ref, creds)
+	rev := ref
+	switch {
+	case IsCommit(ref) && !commit:
+		rev = "refs/tags/" + ref
+	case rev != "":
+	case branch != "":
+		rev = "refs/heads/" + branch
+	default:
+		rev = "HEAD"
+	}
+	rev += "^{commit}"
+
+	if !fetched && (!commit || !hasRev(mirror, rev)) {
+		// A pinned commit that is already present cannot have changed, so
+		// there is no need to fetch it, and it can be checked out offline.
+		// The URL is updated in case credentials now fetch it over SSH.
+		if err := runGit("-C", mirror, "remote", "set-url", "origin", cloneURL); err != nil {
+			return "", err
+		}
+		if err := runGitEnv(creds.env(), "-C", mirror, "fetch", "--quiet", "--prune", "origin"); err != nil {
+			return "", err
+		}
+	}
+
+	out, err := exec.Command("git", "-C", mirror, "rev-parse", "--verify", "--quiet", rev).Output()
+	if err != nil {
+		want := ref
+		if want == "" {
+			want = branch
+		}
+		return "", fmt.Errorf("ref %q not found in repository %s", want, cloneURL)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// hasTag reports whether ref, which looks like a commit hash, names a tag of
+// the repository at cloneURL. A tag takes precedence, so a ref is a commit
+// only if no tag matches. The remote is asked, since the tag may be newer
+// than the mirror; if it cannot be reached, the mirror's tags are used.
+func hasTag(mirror, cloneURL, ref string, creds *Credentials) bool {
+	tags, err := remoteTags(cloneURL, creds, "refs/tags/"+ref)
+	if err != nil {
+		return hasRev(mirror, "refs/tags/"+ref)
+	}
+	return slices.Contains(tags, ref)
+}
+
+// hasRev reports whether rev resolves in the repository at dir.
+func hasRev(dir, rev string) bool {
+	return exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", rev).Run() == nil
+}
+
+// Close removes the working copy. The mirror is kept.
+func (co *Checkout) Close() error {
+	unlock, err := lockFile(co.mirror + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return co.remove()
+}
+
+func (co *Checkout) remove() error {
+	err := os.RemoveAll(co.Root)
+	// Forget the worktree even if removing it failed.
+	if perr := runGit("-C", co.mirror, "worktree", "prune"); err == nil {
+		err = perr
+	}
+	return err
+}
+
+// newCheckoutDir returns an unused path for a checkout.
+func (c *Cache) newCheckoutDir() (string, error) {
+	dir := filepath.Join(c.Dir, checkoutsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	var buf [8]byte
+	rand.Read(buf[:])
+	return filepath.Join(dir, time.Now().Format("20060102-150405")+"-"+hex.EncodeToString(buf[:])), nil
+}
+
+// mirrorPath returns the path of the mirror for cloneURL.
+func (c *Cache) mirrorPath(cloneURL string) (string, error) {
+	key := RepositoryKey(cloneURL)
+	if u, err := url.Parse(cloneURL); key == "" && err == nil && u.Scheme == "file" {
+		key = "local/" + u.Path
+	} else if key == "" {
+		// Local repositories are stored by their absolute path.
+		abs, err := filepath.Abs(cloneURL)
+		if err != nil {
+			return "", err
+		}
+		key = "local/" + filepath.ToSlash(abs)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(key, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("invalid repository URL %q", cloneURL)
+		}
+		parts = append(parts, strings.ReplaceAll(part, ":", "_"))
+	}
+	if len(parts) == 0 || parts[0] == checkoutsDirName {
+		return "", fmt.Errorf("invalid repository URL %q", cloneURL)
+	}
+	return filepath.Join(c.Dir, strings.TrimSuffix(filepath.Join(parts...), ".git")) + ".git", nil
+}
+
+// List returns the mirrors in the cache, in order by URL.
+func (c *Cache) List() ([]CacheEntry, error) {
+	var out []CacheEntry
+	err := filepath.WalkDir(c.Dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == c.Dir {
+			return fs.SkipAll
+		} else if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == c.Dir {
+			return nil
+		}
+		if path == filepath.Join(c.Dir, checkoutsDirName) {
+			return fs.SkipDir
+		}
+		if !strings.HasSuffix(path, ".git") {
+			return nil
+		}
+		entry, err := inspectMirror(path)
+		if err != nil {
+			return err
+		}
+		out = append(out, *entry)
+		return fs.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache: %w", err)
+	}
+	slices.SortFunc(out, func(a, b CacheEntry) int { return strings.Compare(a.URL, b.URL) })
+	return out, nil
+}
+
+func inspectMirror(path string) (*CacheEntry, error) {
+	entry := &CacheEntry{Path: path}
+	if out, err := exec.Command("git", "-C", path, "config", "remote.origin.url").Output(); err == nil {
+		entry.URL = strings.TrimSpace(string(out))
+	}
+	if data, err := os.ReadFile(filepath.Join(path, usedFileName)); err == nil {
+		entry.LastUsed, _ = time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	}
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Prune removes mirrors that have not been used within maxAge, or all mirrors
+// if maxAge is zero, and returns those removed. Checkouts older than a day,
+// left behind by invocations that did not clean up, are removed too.
+func (c *Cache) Prune(maxAge time.Duration) ([]CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []CacheEntry
+	var errs []error
+	for _, entry := range entries {
+		if maxAge > 0 && time.Since(entry.LastUsed) < maxAge {
+			continue
+		}
+		if err := removeMirror(entry.Path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, entry)
+	}
+
+	checkouts := filepath.Join(c.Dir, checkoutsDirName)
+	dirs, err := os.ReadDir(checkouts)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	for _, d := range dirs {
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < staleCheckoutAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(checkouts, d.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(entry.Path); err == nil {
+			runGit("-C", entry.Path, "worktree", "prune")
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+func removeMirror(path string) error {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
@@ -1,77 +1,118 @@
 package git
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
 )
 
-// Clone clones a Git repository and returns the path to the quadlet files
-// If repo.SubPath is set, extracts only that subdirectory
-func Clone(repo *Repository) (string, error) {
+// Clone checks out a Git repository from the default cache and returns the
+// checkout; its Dir is the path to the quadlet files.
+// If repo.SubPath is set, only that subdirectory is checked out.
+// If repo.Ref is set, the tag or commit it names is checked out instead of
+// the head of repo.Branch. If policy is not nil, the checkout must be signed
+// as the policy requires. If creds is not nil, the repository is fetched
+// with them rather than the user's own Git configuration.
+// The caller must Close the checkout.
+func Clone(repo *Repository, policy *VerifyPolicy, creds *Credentials) (*Checkout, error) {
 	if repo.IsLegerRun() {
-		return "", fmt.Errorf("leger.run URLs should be handled by legerrun package, not git clone")
+		return nil, fmt.Errorf("leger.run URLs should be handled by legerrun package, not git clone")
 	}
 
-	// Create temp directory for cloning
-	tmpDir, err := os.MkdirTemp("", "leger-git-*")
+	cache, err := NewCache()
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+		return nil, err
 	}
 
-	// Clone repository (shallow clone for speed)
 	cloneURL := repo.GetCloneURL()
-
-	args := []string{"clone", "--depth", "1"}
-
-	// Add branch if specified
-	if repo.Branch != "" {
-		args = append(args, "--branch", repo.Branch)
+	ref := repo.Branch
+	if repo.Ref != "" {
+		ref = repo.Ref
 	}
 
-	args = append(args, cloneURL, tmpDir)
-
-	cmd := exec.Command("git", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		// Clean up temp directory on failure
-		os.RemoveAll(tmpDir)
-		return "", fmt.Errorf(`failed to clone repository: %w
+	co, err := cache.Checkout(repo, policy, creds)
+	if errors.Is(err, ErrUnverified) {
+		return nil, fmt.Errorf("%w\n\nRepository: %s\nRef: %s", err, cloneURL, ref)
+	} else if err != nil {
+		return nil, fmt.Errorf(`failed to clone repository: %w
 
 Repository: %s
-Branch: %s
-
-Output: %s
+Ref: %s
+Subpath: %s
 
 Verify the repository URL is correct and accessible.
-If this is a private repository, ensure your SSH keys are configured:
-  git clone %s`, err, cloneURL, repo.Branch, string(output), cloneURL)
+If this is a private repository, configure credentials for it in the
+git.sources section of ~/.config/leger/config.yaml, or check that this works:
+  git clone %s`, err, cloneURL, ref, repo.SubPath, cloneURL)
 	}
+	return co, nil
+}
 
-	// If there's a subpath, return path to that subdirectory
-	if repo.SubPath != "" {
-		subDir := filepath.Join(tmpDir, repo.SubPath)
-
-		// Verify subdirectory exists
-		if _, err := os.Stat(subDir); err != nil {
-			os.RemoveAll(tmpDir)
-			return "", fmt.Errorf(`subdirectory not found in repository: %s
-
-Repository: %s
-Branch: %s
-Subpath: %s
+// runGit runs git with args, and includes its output in any error.
+func runGit(args ...string) error {
+	return runGitEnv(nil, args...)
+}
 
-Verify the path exists in the repository`, repo.SubPath, cloneURL, repo.Branch, repo.SubPath)
+// runGitEnv runs git with args and env added to the environment, and
+// includes its output in any error.
+func runGitEnv(env []string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		cmd := args[0]
+		if cmd == "-C" && len(args) > 2 {
+			cmd = args[2]
 		}
+		return fmt.Errorf("git %s: %w\n\nOutput: %s", cmd, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
 
-		return subDir, nil
+// HeadCommit returns the full hash of the commit checked out in the Git
+// working tree containing dir.
+func HeadCommit(dir string) (string, error) {
+	cmd := exec.Command("git", "-C", dir, "rev-parse", "HEAD")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get commit of %s: %w", dir, err)
 	}
+	return strings.TrimSpace(string(output)), nil
+}
 
-	return tmpDir, nil
+// RemoteTags returns the names of the tags of repo, listed from its remote
+// without fetching it, with creds.
+func RemoteTags(repo *Repository, creds *Credentials) ([]string, error) {
+	if err := creds.Validate(); err != nil {
+		return nil, err
+	}
+	return remoteTags(repo.GetCloneURL(), creds)
 }
 
-// CleanupClone removes a cloned repository directory
-func CleanupClone(path string) error {
-	return os.RemoveAll(path)
+// remoteTags lists the tags of the repository at cloneURL matching patterns,
+// or all of them if there are none, with creds.
+func remoteTags(cloneURL string, creds *Credentials, patterns ...string) ([]string, error) {
+	args := append([]string{"ls-remote", "--tags", "--refs", creds.cloneURL(cloneURL)}, patterns...)
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, creds.env()...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags of %s: %w\n\nOutput: %s", cloneURL, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var tags []string
+	for _, line := range strings.Split(string(output), "\n") {
+		_, ref, ok := strings.Cut(line, "\t")
+		if tag, isTag := strings.CutPrefix(ref, "refs/tags/"); ok && isTag {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
 }
@@ -0,0 +1,346 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRepo is a bare repository with a working copy used to add commits.
+type testRepo struct {
+	t    *testing.T
+	bare string
+	work string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	// Keep the user's Git configuration out of the tests.
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_AUTHOR_NAME", "Test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	dir := t.TempDir()
+	r := &testRepo{t: t, bare: filepath.Join(dir, "repo.git"), work: filepath.Join(dir, "work")}
+	r.git("", "init", "--quiet", "--bare", "--initial-branch=main", r.bare)
+	r.git("", "clone", "--quiet", r.bare, r.work)
+	r.git(r.work, "checkout", "--quiet", "-b", "main")
+	return r
+}
+
+func (r *testRepo) git(dir string, args ...string) string {
+	r.t.Helper()
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit adds a commit setting file to content, pushes it, and returns its
+// hash.
+func (r *testRepo) commit(file, content string) string {
+	r.t.Helper()
+	if err := os.WriteFile(filepath.Join(r.work, file), []byte(content), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	r.git(r.work, "add", file)
+	r.git(r.work, "commit", "--quiet", "-m", "update "+file)
+	r.git(r.work, "push", "--quiet", "origin", "main")
+	return r.git(r.work, "rev-parse", "HEAD")
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCheckout(t *testing.T) {
+	r := newTestRepo(t)
+	first := r.commit("app.container", "v1")
+	r.git(r.work, "tag", "v1.0.0")
+	r.git(r.work, "push", "--quiet", "origin", "v1.0.0")
+	r.commit("app.container", "v2")
+
+	c := &Cache{Dir: t.TempDir()}
+	tests := []struct {
+		name       string
+		ref        string
+		wantCommit string
+		want       string
+	}{
+		{"BranchHead", "", "", "v2"},
+		{"Tag", "v1.0.0", first, "v1"},
+		{"Commit", first, first, "v1"},
+		{"AbbreviatedCommit", first[:10], first, "v1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			co, err := c.checkout(r.bare, "main", tc.ref, "", nil, nil)
+			if err != nil {
+				t.Fatalf("checkout failed: %v", err)
+			}
+			defer co.Close()
+			if got := readFile(t, filepath.Join(co.Dir, "app.container")); got != tc.want {
+				t.Errorf("Content: got %q, want %q", got, tc.want)
+			}
+			if tc.wantCommit != "" && co.Commit != tc.wantCommit {
+				t.Errorf("Commit: got %q, want %q", co.Commit, tc.wantCommit)
+			}
+		})
+	}
+
+	// A tag whose name looks like a hash is resolved as a tag, even though
+	// a commit matches it too.
+	tag := r.git(r.work, "rev-parse", "HEAD")[:7]
+	r.git(r.work, "tag", tag, first)
+	r.git(r.work, "push", "--quiet", "origin", tag)
+	co, err := c.checkout(r.bare, "main", tag, "", nil, nil)
+	if err != nil {
+		t.Fatalf("checkout of hash-like tag failed: %v", err)
+	}
+	if co.Commit != first {
+		t.Errorf("Commit of hash-like tag: got %q, want %q", co.Commit, first)
+	}
+	co.Close()
+
+	if co, err := c.checkout(r.bare, "main", "0000000000", "", nil, nil); err == nil {
+		co.Close()
+		t.Error("checkout of unknown commit: expected error")
+	}
+}
+
+func TestRemoteTags(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit("app.container", "v1")
+	for _, tag := range []string{"v1.0.0", "v1.0.1"} {
+		r.git(r.work, "tag", "-a", "-m", tag, tag)
+	}
+	r.git(r.work, "push", "--quiet", "origin", "--tags")
+
+	tags, err := RemoteTags(&Repository{CloneURL: r.bare}, nil)
+	if err != nil {
+		t.Fatalf("RemoteTags failed: %v", err)
+	}
+	if strings.Join(tags, " ") != "v1.0.0 v1.0.1" {
+		t.Errorf("Tags: got %v", tags)
+	}
+
+	if _, err := RemoteTags(&Repository{CloneURL: filepath.Join(t.TempDir(), "missing.git")}, nil); err == nil {
+		t.Error("RemoteTags of missing repository: expected error")
+	}
+}
+
+func TestCache(t *testing.T) {
+	r := newTestRepo(t)
+	if err := os.MkdirAll(filepath.Join(r.work, "quadlets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r.commit("other.txt", "unrelated")
+	r.commit("quadlets/app.container", "v1")
+
+	c := &Cache{Dir: t.TempDir()}
+	co, err := c.checkout(r.bare, "main", "", "quadlets", nil, nil)
+	if err != nil {
+		t.Fatalf("checkout failed: %v", err)
+	}
+	if got := readFile(t, filepath.Join(co.Dir, "app.container")); got != "v1" {
+		t.Errorf("Content: got %q, want v1", got)
+	}
+	if co.Dir != filepath.Join(co.Root, "quadlets") {
+		t.Errorf("Dir: got %q, want quadlets under %q", co.Dir, co.Root)
+	}
+
+	// A second checkout fetches new commits into the existing mirror.
+	r.commit("quadlets/app.container", "v2")
+	co2, err := c.checkout(r.bare, "main", "", "quadlets", nil, nil)
+	if err != nil {
+		t.Fatalf("checkout failed: %v", err)
+	}
+	if got := readFile(t, filepath.Join(co2.Dir, "app.container")); got != "v2" {
+		t.Errorf("Content after update: got %q, want v2", got)
+	}
+
+	for _, co := range []*Checkout{co, co2} {
+		if err := co.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		if _, err := os.Stat(co.Root); !os.IsNotExist(err) {
+			t.Errorf("Checkout %s still exists: %v", co.Root, err)
+		}
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].URL != r.bare || entries[0].Size == 0 || entries[0].LastUsed.IsZero() {
+		t.Fatalf("List: got %+v, want one mirror of %s", entries, r.bare)
+	}
+
+	// Recently used mirrors are kept unless all are pruned.
+	if removed, err := c.Prune(time.Hour); err != nil || len(removed) != 0 {
+		t.Errorf("Prune(1h): got %+v, %v; want none removed", removed, err)
+	}
+	if removed, err := c.Prune(0); err != nil || len(removed) != 1 {
+		t.Errorf("Prune(0): got %+v, %v; want one removed", removed, err)
+	}
+	if entries, err := c.List(); err != nil || len(entries) != 0 {
+		t.Errorf("List after Prune: got %+v, %v; want none", entries, err)
+	}
+}
+
+func TestMirrorPath(t *testing.T) {
+	c := &Cache{Dir: "/cache"}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/org/repo", "/cache/github.com/org/repo.git"},
+		{"https://github.com/org/repo.git", "/cache/github.com/org/repo.git"},
+		{"ssh://git@git.example.com:2222/org/repo", "/cache/git.example.com_2222/org/repo.git"},
+		{"git@github.com:org/repo.git", "/cache/github.com/org/repo.git"},
+		{"/srv/git/repo.git", "/cache/local/srv/git/repo.git"},
+		{"file:///srv/git/repo", "/cache/local/srv/git/repo.git"},
+	}
+	for _, tc := range tests {
+		got, err := c.mirrorPath(tc.url)
+		if err != nil || got != tc.want {
+			t.Errorf("mirrorPath(%q): got %q, %v; want %q", tc.url, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{"https://github.com/org/../../x", "https://checkouts/x"} {
+		if got, err := c.mirrorPath(bad); err == nil {
+			t.Errorf("mirrorPath(%q): got %q, want error", bad, got)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	r := newTestRepo(t)
+
+	keys := t.TempDir()
+	newKey := func(name string) string {
+		key := filepath.Join(keys, name)
+		if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", key).CombinedOutput(); err != nil {
+			t.Fatalf("ssh-keygen: %v\n%s", err, out)
+		}
+		return key
+	}
+	trusted, untrusted := newKey("trusted"), newKey("untrusted")
+
+	signers := filepath.Join(keys, "allowed_signers")
+	pub := readFile(t, trusted+".pub")
+	allowed := "# release keys\nrelease@example.com " + strings.Join(strings.Fields(pub)[:2], " ") + "\n" +
+		"release@example.com gpg 0123 4567 89AB CDEF 0123 4567 89AB CDEF 0123 4567\n"
+	if err := os.WriteFile(signers, []byte(allowed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	policy := &VerifyPolicy{AllowedSigners: signers}
+
+	sign := func(key string) []string {
+		return []string{"-c", "gpg.format=ssh", "-c", "user.signingkey=" + key + ".pub"}
+	}
+	commitSigned := func(key, content string) string {
+		args := append(sign(key), "-C", r.work, "commit", "--quiet", "-S", "-am", "signed")
+		if err := os.WriteFile(filepath.Join(r.work, "app.container"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		r.git("", args...)
+		r.git(r.work, "push", "--quiet", "origin", "main")
+		return r.git(r.work, "rev-parse", "HEAD")
+	}
+
+	unsigned := r.commit("app.container", "unsigned")
+	r.git("", append(sign(trusted), "-C", r.work, "tag", "-s", "-m", "release", "v1.0.0")...)
+	r.git(r.work, "push", "--quiet", "origin", "v1.0.0")
+	hexTag := "abcdef0"
+	r.git("", append(sign(trusted), "-C", r.work, "tag", "-s", "-m", "release", hexTag)...)
+	r.git(r.work, "push", "--quiet", "origin", hexTag)
+	good := commitSigned(trusted, "good")
+	bad := commitSigned(untrusted, "bad")
+
+	c := &Cache{Dir: t.TempDir()}
+	tests := []struct {
+		name   string
+		ref    string
+		object string
+		ok     bool
+	}{
+		{"SignedCommit", good, "commit", true},
+		{"SignedTag", "v1.0.0", "tag", true},
+		{"SignedHashLikeTag", hexTag, "tag", true},
+		{"UnsignedCommit", unsigned, "", false},
+		{"UntrustedCommit", bad, "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			co, err := c.checkout(r.bare, "main", tc.ref, "", nil, nil)
+			if err != nil {
+				t.Fatalf("checkout failed: %v", err)
+			}
+			defer co.Close()
+			sig, err := policy.Verify(co.Root, tc.ref)
+			if !tc.ok {
+				if !errors.Is(err, ErrUnverified) {
+					t.Errorf("Verify: got %+v, %v; want %v", sig, err, ErrUnverified)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+			if sig.Object != tc.object || sig.Format != "ssh" || sig.Signer != "release@example.com" {
+				t.Errorf("Signature: got %+v", sig)
+			}
+		})
+	}
+}
+
+func TestReadAllowedSigners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowed_signers")
+	data := "a@example.com ssh-ed25519 AAAAkey\n" +
+		"b@example.com gpg 0123 4567 89ab cdef 0123  4567 89AB CDEF 0123 4567\n" +
+		"# comment\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ssh, gpg, err := readAllowedSigners(path)
+	if err != nil {
+		t.Fatalf("readAllowedSigners failed: %v", err)
+	}
+	if want := "a@example.com ssh-ed25519 AAAAkey\n# comment\n"; string(ssh) != want {
+		t.Errorf("SSH signers: got %q, want %q", ssh, want)
+	}
+	if !gpg["0123456789ABCDEF0123456789ABCDEF01234567"] || len(gpg) != 1 {
+		t.Errorf("GPG keys: got %v", gpg)
+	}
+
+	status := "[GNUPG:] NEWSIG\n[GNUPG:] VALIDSIG AAAA 2025-01-01 1735689600 0 4 0 1 10 00 BBBB\n"
+	if got := gpgValidSig(status); len(got) != 2 || got[0] != "AAAA" || got[1] != "BBBB" {
+		t.Errorf("gpgValidSig: got %v, want [AAAA BBBB]", got)
+	}
+	if got := gpgValidSig("Good \"git\" signature"); got != nil {
+		t.Errorf("gpgValidSig without status: got %v, want nil", got)
+	}
+}
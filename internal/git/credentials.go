@@ -0,0 +1,148 @@
+package git
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Credentials authenticate fetches of a private repository. They are passed
+// to the Git commands that talk to the remote through the environment, so
+// they apply to that repository only and are never written to the cache.
+type Credentials struct {
+	// SSHKey is the path of a private key to fetch over SSH with. An HTTPS
+	// source with an SSH key is fetched from the same host over SSH instead,
+	// as SSHUser (default git) and on SSHPort (default 22), since the port
+	// of the HTTPS URL is not the SSH port. Sources given as SSH URLs are
+	// fetched as given.
+	SSHKey  string
+	SSHUser string
+	SSHPort int
+	// KnownHosts, if set, is the only known_hosts file trusted for SSH, and
+	// hosts not listed in it are rejected.
+	KnownHosts string
+
+	// Token is a password or access token for HTTPS, sent with Username.
+	Token    string
+	Username string
+
+	// Helper is a Git credential helper, as for credential.helper, used
+	// instead of the user's configured helpers.
+	Helper string
+}
+
+// defaultTokenUsername is sent with tokens when no username is configured.
+// GitHub, GitLab, Gitea and Forgejo all accept it with an access token.
+const defaultTokenUsername = "oauth2"
+
+// tokenHelper is a credential helper that answers with the token from the
+// environment, so the token does not appear in any command line.
+const tokenHelper = `!f() { test "$1" = get && echo "username=${LEGER_GIT_USERNAME}" && echo "password=${LEGER_GIT_TOKEN}"; }; f`
+
+// Validate reports an error if the files the credentials name do not exist.
+func (c *Credentials) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Token != "" && c.Helper != "" {
+		return fmt.Errorf("git credentials: a token and a credential helper cannot both be used")
+	}
+	for _, f := range []struct{ name, path string }{{"SSH key", c.SSHKey}, {"known_hosts", c.KnownHosts}} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("git credentials: %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// cloneURL returns the URL to fetch cloneURL from with the credentials.
+func (c *Credentials) cloneURL(cloneURL string) string {
+	if c == nil || c.SSHKey == "" {
+		return cloneURL
+	}
+	u, err := url.Parse(cloneURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return cloneURL
+	}
+	user := c.SSHUser
+	if user == "" {
+		user = defaultSSHUser
+	}
+	host := u.Hostname()
+	if c.SSHPort != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.SSHPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	ssh := url.URL{
+		Scheme: "ssh",
+		User:   url.User(user),
+		Host:   host,
+		Path:   "/" + strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git") + ".git",
+	}
+	return ssh.String()
+}
+
+// defaultSSHUser is the user HTTPS sources are fetched over SSH as, which
+// GitHub, GitLab, Gitea and Forgejo all use.
+const defaultSSHUser = "git"
+
+// env returns the environment to run Git with, in addition to the current
+// environment.
+func (c *Credentials) env() []string {
+	if c == nil {
+		return nil
+	}
+	// Never fall back to prompting, which would hang a non-interactive run.
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+
+	if c.SSHKey != "" {
+		ssh := "ssh -i " + shellQuote(c.SSHKey) + " -o IdentitiesOnly=yes -o BatchMode=yes"
+		if c.KnownHosts != "" {
+			ssh += " -o UserKnownHostsFile=" + shellQuote(c.KnownHosts) +
+				" -o GlobalKnownHostsFile=/dev/null -o StrictHostKeyChecking=yes"
+		}
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	}
+
+	helper := c.Helper
+	if c.Token != "" {
+		username := c.Username
+		if username == "" {
+			username = defaultTokenUsername
+		}
+		helper = tokenHelper
+		env = append(env, "LEGER_GIT_USERNAME="+username, "LEGER_GIT_TOKEN="+c.Token)
+	}
+	if helper != "" {
+		// The empty helper clears any configured by the user, so that only
+		// this one is asked.
+		env = append(env, configEnv(
+			"credential.helper", "",
+			"credential.helper", helper,
+		)...)
+	}
+	return env
+}
+
+// configEnv returns the environment that sets the Git configuration in kvs,
+// alternating keys and values, for a single command.
+func configEnv(kvs ...string) []string {
+	env := []string{"GIT_CONFIG_COUNT=" + strconv.Itoa(len(kvs)/2)}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		n := strconv.Itoa(i / 2)
+		env = append(env, "GIT_CONFIG_KEY_"+n+"="+kvs[i], "GIT_CONFIG_VALUE_"+n+"="+kvs[i+1])
+	}
+	return env
+}
+
+// shellQuote quotes s for sh, which runs GIT_SSH_COMMAND.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,155 @@
+package git
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// knownForges maps public hosts to the forge they run.
+var knownForges = map[string]SourceType{
+	"github.com":   SourceTypeGitHub,
+	"gitlab.com":   SourceTypeGitLab,
+	"codeberg.org": SourceTypeGitea,
+	"gitea.com":    SourceTypeGitea,
+	"git.sr.ht":    SourceTypeSourcehut,
+}
+
+var (
+	forgesMu   sync.RWMutex
+	forgeHosts = map[string]SourceType{}
+)
+
+// RegisterForge records that host runs forge, so that browse URLs on host
+// are parsed accordingly even when their paths do not identify the forge.
+// host may include a port. Registered hosts take precedence over known ones.
+func RegisterForge(host string, forge SourceType) {
+	forgesMu.Lock()
+	defer forgesMu.Unlock()
+	forgeHosts[strings.ToLower(host)] = forge
+}
+
+// ParseForge returns the forge called name: github, gitlab, gitea, forgejo,
+// sourcehut or generic.
+func ParseForge(name string) (SourceType, error) {
+	switch strings.ToLower(name) {
+	case "github":
+		return SourceTypeGitHub, nil
+	case "gitlab":
+		return SourceTypeGitLab, nil
+	case "gitea", "forgejo":
+		return SourceTypeGitea, nil
+	case "sourcehut", "srht":
+		return SourceTypeSourcehut, nil
+	case "generic", "git":
+		return SourceTypeGenericGit, nil
+	}
+	return SourceTypeUnknown, fmt.Errorf("unknown forge %q (want github, gitlab, gitea, forgejo, sourcehut or generic)", name)
+}
+
+// forgeFor returns the forge at host: the one registered or known for it,
+// or else the one whose browse URLs have the layout of the path parts.
+func forgeFor(host string, parts []string) SourceType {
+	host = strings.ToLower(host)
+	forgesMu.RLock()
+	forge, ok := forgeHosts[host]
+	if !ok {
+		forge, ok = forgeHosts[hostname(host)]
+	}
+	forgesMu.RUnlock()
+	if ok {
+		return forge
+	}
+	if forge, ok := knownForges[hostname(host)]; ok {
+		return forge
+	}
+
+	// Self-hosted forges are recognized by their browse URLs.
+	switch {
+	case slices.Index(parts, "-") >= 2:
+		return SourceTypeGitLab
+	case len(parts) >= 3 && parts[2] == "src":
+		return SourceTypeGitea
+	case len(parts) >= 2 && strings.HasPrefix(parts[0], "~"):
+		return SourceTypeSourcehut
+	case len(parts) >= 3 && parts[2] == "tree":
+		return SourceTypeGitHub
+	}
+	return SourceTypeGenericGit
+}
+
+// hostname returns host without a port.
+func hostname(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		return host[:i]
+	}
+	return host
+}
+
+// parseBrowsePath sets the branch, ref and subpath of repo from the parts of
+// the path of a browse URL on forge, and returns how many leading parts name
+// the repository:
+//
+//	GitHub:       owner/repo/tree/<branch>/<path>
+//	GitLab:       group/subgroup/repo/-/tree/<branch>/<path>
+//	Gitea:        owner/repo/src/branch/<branch>/<path>
+//	              owner/repo/src/tag/<tag>/<path>
+//	              owner/repo/src/commit/<commit>/<path>
+//	Sourcehut:    ~owner/repo/tree/<branch>/item/<path>
+//
+// Paths on other hosts name only the repository.
+func parseBrowsePath(repo *Repository, forge SourceType, parts []string) (int, error) {
+	var n int
+	var sub []string
+	switch forge {
+	case SourceTypeGitHub:
+		n = 2
+		if rest := parts[min(n, len(parts)):]; len(rest) >= 2 && rest[0] == "tree" {
+			repo.Branch, sub = rest[1], rest[2:]
+		}
+	case SourceTypeGitLab:
+		n = len(parts)
+		if i := slices.Index(parts, "-"); i >= 0 {
+			n = i
+			if rest := parts[i+1:]; len(rest) >= 2 && rest[0] == "tree" {
+				repo.Branch, sub = rest[1], rest[2:]
+			}
+		}
+	case SourceTypeGitea:
+		n = 2
+		if rest := parts[min(n, len(parts)):]; len(rest) >= 3 && rest[0] == "src" {
+			switch rest[1] {
+			case "branch":
+				repo.Branch = rest[2]
+			case "tag", "commit":
+				// An @ref suffix takes precedence.
+				if repo.Ref == "" {
+					if err := checkRef(rest[2]); err != nil {
+						return 0, err
+					}
+					repo.Ref = rest[2]
+				}
+			default:
+				return 0, fmt.Errorf("invalid Gitea URL: expected src/branch, src/tag or src/commit")
+			}
+			sub = rest[3:]
+		}
+	case SourceTypeSourcehut:
+		n = 2
+		if rest := parts[min(n, len(parts)):]; len(rest) >= 2 && rest[0] == "tree" {
+			repo.Branch = rest[1]
+			if len(rest) >= 3 && rest[2] == "item" {
+				sub = rest[3:]
+			}
+		}
+	default:
+		return len(parts), nil
+	}
+
+	if len(parts) < n || n < 2 {
+		return 0, fmt.Errorf("invalid Git URL: expected format https://host/owner/repo")
+	}
+	repo.SubPath = strings.Join(sub, "/")
+	return n, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package git
+
+// lockFile does not lock on platforms without flock(2); leger only manages
+// deployments on Linux.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
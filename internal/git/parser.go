@@ -3,6 +3,7 @@ package git
 import (
 	"fmt"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -12,8 +13,20 @@ import (
 // Supports formats:
 // - https://github.com/org/repo
 // - https://github.com/org/repo/tree/branch/path
-// - https://gitlab.com/org/repo/-/tree/branch/path
+// - https://gitlab.com/group/subgroup/repo/-/tree/branch/path
+// - https://codeberg.org/org/repo/src/branch/main/path (Gitea, Forgejo)
+// - https://git.sr.ht/~user/repo/tree/branch/item/path
+// - ssh://git@host/org/repo.git, git@host:org/repo.git, git://host/repo.git
+// - file:///srv/git/repo.git
 // - https://static.leger.run/{uuid}/latest/
+//
+// The forge a self-hosted URL belongs to is recognized from its path, or
+// from a host registered with RegisterForge. Any repository URL may be
+// followed by //path to select a subdirectory, as in
+// git@host:org/repo.git//quadlets.
+//
+// Any of the Git formats may end in @<tag> or @<commit> to pin the source to
+// that ref rather than the head of a branch.
 func ParseURL(gitURL, defaultBranch string) (*Repository, error) {
 	if gitURL == "" {
 		return nil, fmt.Errorf("empty Git URL")
@@ -24,54 +37,137 @@ func ParseURL(gitURL, defaultBranch string) (*Repository, error) {
 		return parseLegerRunURL(gitURL)
 	}
 
-	// Parse URL
-	u, err := url.Parse(gitURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid URL: %w", err)
-	}
-
-	if u.Scheme != "http" && u.Scheme != "https" {
-		return nil, fmt.Errorf("unsupported URL scheme: %s (only http/https supported)", u.Scheme)
-	}
-
 	repo := &Repository{
 		URL:    gitURL,
 		Branch: defaultBranch,
-		Host:   u.Host,
 	}
 
 	if repo.Branch == "" {
 		repo.Branch = "main" // default
 	}
 
+	// Split the URL into the part before the repository path, and the path
+	var base, path string
+	web := false
+	if userHost, p, ok := splitSCP(gitURL); ok {
+		base, path = userHost+":", p
+		repo.Host = userHost
+		if _, host, ok := strings.Cut(userHost, "@"); ok {
+			repo.Host = host
+		}
+	} else {
+		u, err := url.Parse(gitURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https":
+			web = true
+		case "ssh", "git":
+		case "file":
+			if u.Host != "" {
+				return nil, fmt.Errorf("invalid file URL: expected file:///path/to/repo")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported URL scheme: %q (use https, ssh, git, file or host:path)", u.Scheme)
+		}
+		if u.Scheme != "file" && u.Host == "" {
+			return nil, fmt.Errorf("invalid Git URL: missing host")
+		}
+		repo.Host = u.Host
+		path = u.Path
+		base = (&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host}).String()
+		if u.Scheme == "file" {
+			base = "file://"
+		}
+	}
+
+	// A trailing @ref pins the source to a tag or commit
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		repo.Ref = path[i+1:]
+		path = path[:i]
+		if err := checkRef(repo.Ref); err != nil {
+			return nil, err
+		}
+	}
+
+	// A // separates the repository from a subdirectory
+	lead := ""
+	if strings.HasPrefix(path, "/") {
+		lead, path = "/", path[1:]
+	}
+	path, subPath, hasSub := strings.Cut(path, "//")
+
 	// Parse path components
-	path := strings.Trim(u.Path, "/")
+	path = strings.Trim(path, "/")
 	parts := strings.Split(path, "/")
-
-	if len(parts) < 2 {
+	if path == "" {
 		return nil, fmt.Errorf("invalid Git URL: expected format https://host/owner/repo")
 	}
 
-	repo.Owner = parts[0]
-	repo.RepoName = parts[1]
-
-	// Check for GitHub-style tree path: /tree/branch/path
-	if len(parts) >= 4 && parts[2] == "tree" {
-		repo.Branch = parts[3]
-		if len(parts) > 4 {
-			repo.SubPath = strings.Join(parts[4:], "/")
+	n := len(parts)
+	if web {
+		repo.SourceType = forgeFor(repo.Host, parts)
+		var err error
+		if n, err = parseBrowsePath(repo, repo.SourceType, parts); err != nil {
+			return nil, err
 		}
-	} else if len(parts) >= 5 && parts[2] == "-" && parts[3] == "tree" {
-		// GitLab-style: /org/repo/-/tree/branch/path
-		repo.Branch = parts[4]
-		if len(parts) > 5 {
-			repo.SubPath = strings.Join(parts[5:], "/")
+	} else if base == "file://" {
+		repo.SourceType = SourceTypeGenericGit
+	} else {
+		repo.SourceType = forgeFor(repo.Host, nil)
+	}
+	if hasSub {
+		repo.SubPath = strings.Trim(subPath, "/")
+	}
+	for _, part := range strings.Split(repo.SubPath, "/") {
+		if part == ".." {
+			return nil, fmt.Errorf("invalid Git URL: subpath %q leaves the repository", repo.SubPath)
 		}
 	}
 
+	repo.Owner = strings.Join(parts[:n-1], "/")
+	repo.RepoName = strings.TrimSuffix(parts[n-1], ".git")
+	repo.CloneURL = base + lead + strings.Join(parts[:n], "/")
+
 	return repo, nil
 }
 
+// splitSCP splits a URL in Git's scp-like syntax, [user@]host:path, into
+// its user and host, and path.
+func splitSCP(s string) (userHost, path string, ok bool) {
+	if strings.Contains(s, "://") {
+		return "", "", false
+	}
+	userHost, path, ok = strings.Cut(s, ":")
+	// A one-letter host is a Windows drive, and a slash makes it a path.
+	if !ok || len(userHost) < 2 || strings.Contains(userHost, "/") || path == "" {
+		return "", "", false
+	}
+	return userHost, path, true
+}
+
+// commitPattern matches full or abbreviated commit hashes.
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// IsCommit reports whether ref looks like a commit hash. A tag may have such
+// a name too; checkouts resolve ref as a tag first if one matches.
+func IsCommit(ref string) bool {
+	return commitPattern.MatchString(ref)
+}
+
+// checkRef reports an error if ref cannot be used to pin a Git source.
+func checkRef(ref string) error {
+	if ref == "" {
+		return fmt.Errorf("invalid Git URL: empty ref after @")
+	}
+	if strings.HasPrefix(ref, "-") || strings.HasSuffix(ref, "/") || strings.Contains(ref, "..") ||
+		strings.ContainsAny(ref, " ~^:?*[\\") {
+		return fmt.Errorf("invalid Git ref %q", ref)
+	}
+	return nil
+}
+
 // parseLegerRunURL parses a leger.run static URL
 // Format: https://static.leger.run/{uuid}/latest/
 func parseLegerRunURL(gitURL string) (*Repository, error) {
@@ -104,11 +200,35 @@ func (r *Repository) GetCloneURL() string {
 		// leger.run URLs are not Git repositories
 		return r.URL
 	}
+	if r.CloneURL != "" {
+		return r.CloneURL
+	}
 
 	// Reconstruct base URL without /tree/branch/path
 	return fmt.Sprintf("https://%s/%s/%s", r.Host, r.Owner, r.RepoName)
 }
 
+// RepositoryKey returns the host and path of the repository at cloneURL,
+// such as github.com/org/repo, without the scheme, user or a .git suffix.
+// It returns "" for local repositories.
+func RepositoryKey(cloneURL string) string {
+	var host, path string
+	if u, err := url.Parse(cloneURL); err == nil && u.Host != "" {
+		host, path = u.Host, u.Path
+	} else if err == nil && u.Scheme != "" {
+		return ""
+	} else if h, p, ok := strings.Cut(cloneURL, ":"); ok && !strings.Contains(h, "/") && len(h) > 1 {
+		// scp-like syntax: [user@]host:path
+		if _, after, ok := strings.Cut(h, "@"); ok {
+			h = after
+		}
+		host, path = h, p
+	} else {
+		return ""
+	}
+	return strings.ToLower(host) + "/" + strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+}
+
 // IsLegerRun returns true if this is a leger.run URL
 func (r *Repository) IsLegerRun() bool {
 	return r.Host == "static.leger.run"
@@ -120,36 +240,56 @@ func DetectSourceType(urlOrPath string) SourceType {
 		return SourceTypeUnknown
 	}
 
-	// Check for local path
-	if !strings.HasPrefix(urlOrPath, "http://") && !strings.HasPrefix(urlOrPath, "https://") {
-		if filepath.IsAbs(urlOrPath) || strings.HasPrefix(urlOrPath, ".") || strings.HasPrefix(urlOrPath, "file://") {
-			return SourceTypeLocal
-		}
-	}
-
 	// Check for leger.run
 	if strings.Contains(urlOrPath, "static.leger.run") || strings.Contains(urlOrPath, "api.leger.run") {
 		return SourceTypeLegerRun
 	}
 
-	// Check for GitHub
-	if strings.Contains(urlOrPath, "github.com") {
-		return SourceTypeGitHub
+	// Check for local path; file:// URLs of Git repositories are cloned
+	if rest, ok := strings.CutPrefix(urlOrPath, "file://"); ok {
+		if isGitDir(rest) {
+			return SourceTypeGenericGit
+		}
+		return SourceTypeLocal
+	}
+	if filepath.IsAbs(urlOrPath) || strings.HasPrefix(urlOrPath, ".") || strings.HasPrefix(urlOrPath, "~") {
+		return SourceTypeLocal
+	}
+
+	// Anything else must be a Git URL
+	repo, err := ParseURL(urlOrPath, "")
+	if err != nil {
+		return SourceTypeUnknown
 	}
+	return repo.SourceType
+}
 
-	// Check for GitLab
-	if strings.Contains(urlOrPath, "gitlab.com") {
-		return SourceTypeGitLab
+// IsGitURL reports whether s is the URL of a Git repository, rather than a
+// local path or a leger.run URL.
+func IsGitURL(s string) bool {
+	switch DetectSourceType(s) {
+	case SourceTypeGitHub, SourceTypeGitLab, SourceTypeGitea, SourceTypeSourcehut, SourceTypeGenericGit:
+		return true
 	}
+	return false
+}
 
-	// Check for generic git URL patterns
-	if strings.HasPrefix(urlOrPath, "http://") || strings.HasPrefix(urlOrPath, "https://") {
-		if strings.HasSuffix(urlOrPath, ".git") || strings.Contains(urlOrPath, "/") {
-			return SourceTypeGenericGit
+// isGitDir reports whether the path of a file:// URL, which may name a
+// subdirectory after // or end in @ref, is a Git repository.
+func isGitDir(path string) bool {
+	path, _, _ = strings.Cut(path, "//")
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		path = path[:i]
+	}
+	if strings.HasSuffix(strings.TrimSuffix(path, "/"), ".git") {
+		return true
+	}
+	for _, name := range []string{"HEAD", ".git"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			return true
 		}
 	}
-
-	return SourceTypeUnknown
+	return false
 }
 
 // ExtractUserUUID extracts the user UUID from a leger.run URL
@@ -217,10 +357,13 @@ Options:
 
 Supported formats:
   - leger.run:  https://static.leger.run/{uuid}/latest/
-  - GitHub:     https://github.com/org/repo
-  - GitLab:     https://gitlab.com/org/repo
+  - GitHub:     https://github.com/org/repo/tree/main/path
+  - GitLab:     https://gitlab.com/group/repo/-/tree/main/path
+  - Forgejo:    https://codeberg.org/org/repo/src/branch/main/path
+  - Sourcehut:  https://git.sr.ht/~user/repo/tree/main/item/path
+  - SSH:        git@git.example.com:org/repo.git//path
   - Local:      /path/to/quadlets
-  - Generic:    https://git.example.com/org/repo.git`, urlOrName)
+  - Generic:    https://git.example.com/org/repo.git//path`, urlOrName)
 	}
 
 	// Handle local paths differently (they don't need URL parsing)
@@ -45,6 +45,26 @@ func TestDetectSourceType(t *testing.T) {
 			urlOrPath: "file:///home/user/quadlets",
 			wantType:  SourceTypeLocal,
 		},
+		{
+			name:      "Forgejo URL",
+			urlOrPath: "https://codeberg.org/org/repo/src/branch/main/quadlets",
+			wantType:  SourceTypeGitea,
+		},
+		{
+			name:      "Sourcehut URL",
+			urlOrPath: "https://git.sr.ht/~user/repo",
+			wantType:  SourceTypeSourcehut,
+		},
+		{
+			name:      "SSH URL",
+			urlOrPath: "git@git.example.com:org/repo.git",
+			wantType:  SourceTypeGenericGit,
+		},
+		{
+			name:      "File URL of bare repository",
+			urlOrPath: "file:///srv/git/quadlets.git//web",
+			wantType:  SourceTypeGenericGit,
+		},
 		{
 			name:      "Empty string",
 			urlOrPath: "",
@@ -107,6 +107,59 @@ func TestParseURL(t *testing.T) {
 	}
 }
 
+func TestParseURLRef(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		wantRepo    string
+		wantBranch  string
+		wantRef     string
+		wantSubPath string
+		wantErr     bool
+	}{
+		{
+			name:     "Tag",
+			url:      "https://github.com/org/repo@v1.2.0",
+			wantRepo: "repo", wantBranch: "main", wantRef: "v1.2.0",
+		},
+		{
+			name:     "Commit",
+			url:      "https://github.com/org/repo@3f2c1a9b7d4e",
+			wantRepo: "repo", wantBranch: "main", wantRef: "3f2c1a9b7d4e",
+		},
+		{
+			name:     "Tree path with tag",
+			url:      "https://github.com/org/repo/tree/main/quadlets@release/v2",
+			wantRepo: "repo", wantBranch: "main", wantRef: "release/v2", wantSubPath: "quadlets",
+		},
+		{name: "Empty ref", url: "https://github.com/org/repo@", wantErr: true},
+		{name: "Invalid ref", url: "https://github.com/org/repo@a..b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseURL(tt.url, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.RepoName != tt.wantRepo || got.Branch != tt.wantBranch || got.Ref != tt.wantRef || got.SubPath != tt.wantSubPath {
+				t.Errorf("ParseURL() = repo %q branch %q ref %q subpath %q, want %q %q %q %q",
+					got.RepoName, got.Branch, got.Ref, got.SubPath, tt.wantRepo, tt.wantBranch, tt.wantRef, tt.wantSubPath)
+			}
+			if want := "https://github.com/org/repo"; got.GetCloneURL() != want {
+				t.Errorf("GetCloneURL() = %v, want %v", got.GetCloneURL(), want)
+			}
+		})
+	}
+
+	if !IsCommit("3f2c1a9") || IsCommit("v1.2.0") || IsCommit("abc") {
+		t.Error("IsCommit misclassified refs")
+	}
+}
+
 func TestGetCloneURL(t *testing.T) {
 	tests := []struct {
 		name string
@@ -174,3 +227,137 @@ func TestIsLegerRun(t *testing.T) {
 		})
 	}
 }
+
+func TestParseURLForges(t *testing.T) {
+	RegisterForge("git.internal.example", SourceTypeGitea)
+	RegisterForge("code.example.com:8443", SourceTypeGitLab)
+
+	tests := []struct {
+		name        string
+		url         string
+		wantType    SourceType
+		wantClone   string
+		wantOwner   string
+		wantRepo    string
+		wantBranch  string
+		wantRef     string
+		wantSubPath string
+	}{
+		{
+			name:     "GitLab nested groups",
+			url:      "https://gitlab.com/group/sub/repo/-/tree/dev/deploy/quadlets",
+			wantType: SourceTypeGitLab, wantClone: "https://gitlab.com/group/sub/repo",
+			wantOwner: "group/sub", wantRepo: "repo", wantBranch: "dev", wantSubPath: "deploy/quadlets",
+		},
+		{
+			name:     "GitLab nested groups without tree",
+			url:      "https://gitlab.com/group/sub/repo",
+			wantType: SourceTypeGitLab, wantClone: "https://gitlab.com/group/sub/repo",
+			wantOwner: "group/sub", wantRepo: "repo", wantBranch: "main",
+		},
+		{
+			name:     "Self-hosted GitLab by path",
+			url:      "https://git.corp.example/infra/repo/-/tree/main/quadlets",
+			wantType: SourceTypeGitLab, wantClone: "https://git.corp.example/infra/repo",
+			wantOwner: "infra", wantRepo: "repo", wantBranch: "main", wantSubPath: "quadlets",
+		},
+		{
+			name:     "Registered GitLab with port",
+			url:      "https://code.example.com:8443/a/b/c",
+			wantType: SourceTypeGitLab, wantClone: "https://code.example.com:8443/a/b/c",
+			wantOwner: "a/b", wantRepo: "c", wantBranch: "main",
+		},
+		{
+			name:     "Forgejo branch",
+			url:      "https://codeberg.org/org/repo/src/branch/prod/quadlets",
+			wantType: SourceTypeGitea, wantClone: "https://codeberg.org/org/repo",
+			wantOwner: "org", wantRepo: "repo", wantBranch: "prod", wantSubPath: "quadlets",
+		},
+		{
+			name:     "Forgejo tag",
+			url:      "https://git.internal.example/org/repo/src/tag/v1.2.0/quadlets",
+			wantType: SourceTypeGitea, wantClone: "https://git.internal.example/org/repo",
+			wantOwner: "org", wantRepo: "repo", wantBranch: "main", wantRef: "v1.2.0", wantSubPath: "quadlets",
+		},
+		{
+			name:     "Self-hosted Gitea commit by path",
+			url:      "https://gitea.corp.example/org/repo/src/commit/3f2c1a9b7d4e",
+			wantType: SourceTypeGitea, wantClone: "https://gitea.corp.example/org/repo",
+			wantOwner: "org", wantRepo: "repo", wantBranch: "main", wantRef: "3f2c1a9b7d4e",
+		},
+		{
+			name:     "Sourcehut",
+			url:      "https://git.sr.ht/~user/repo/tree/trunk/item/quadlets/web",
+			wantType: SourceTypeSourcehut, wantClone: "https://git.sr.ht/~user/repo",
+			wantOwner: "~user", wantRepo: "repo", wantBranch: "trunk", wantSubPath: "quadlets/web",
+		},
+		{
+			name:     "Generic HTTPS with subpath",
+			url:      "https://git.example.com/repos/quadlets.git//web@v2",
+			wantType: SourceTypeGenericGit, wantClone: "https://git.example.com/repos/quadlets.git",
+			wantOwner: "repos", wantRepo: "quadlets", wantBranch: "main", wantRef: "v2", wantSubPath: "web",
+		},
+		{
+			name:     "SSH URL",
+			url:      "ssh://git@git.internal.example:2222/org/repo.git//quadlets",
+			wantType: SourceTypeGitea, wantClone: "ssh://git@git.internal.example:2222/org/repo.git",
+			wantOwner: "org", wantRepo: "repo", wantBranch: "main", wantSubPath: "quadlets",
+		},
+		{
+			name:     "scp-like URL",
+			url:      "git@github.com:org/repo.git@3f2c1a9",
+			wantType: SourceTypeGitHub, wantClone: "git@github.com:org/repo.git",
+			wantOwner: "org", wantRepo: "repo", wantBranch: "main", wantRef: "3f2c1a9",
+		},
+		{
+			name:     "Sourcehut over SSH",
+			url:      "git@git.sr.ht:~user/repo",
+			wantType: SourceTypeSourcehut, wantClone: "git@git.sr.ht:~user/repo",
+			wantOwner: "~user", wantRepo: "repo", wantBranch: "main",
+		},
+		{
+			name:     "File URL",
+			url:      "file:///srv/git/quadlets.git//web",
+			wantType: SourceTypeGenericGit, wantClone: "file:///srv/git/quadlets.git",
+			wantOwner: "srv/git", wantRepo: "quadlets", wantBranch: "main", wantSubPath: "web",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseURL(tt.url, "")
+			if err != nil {
+				t.Fatalf("ParseURL() failed: %v", err)
+			}
+			if got.SourceType != tt.wantType || got.GetCloneURL() != tt.wantClone {
+				t.Errorf("ParseURL() = type %v clone URL %q, want %v %q", got.SourceType, got.GetCloneURL(), tt.wantType, tt.wantClone)
+			}
+			if got.Owner != tt.wantOwner || got.RepoName != tt.wantRepo {
+				t.Errorf("ParseURL() = owner %q repo %q, want %q %q", got.Owner, got.RepoName, tt.wantOwner, tt.wantRepo)
+			}
+			if got.Branch != tt.wantBranch || got.Ref != tt.wantRef || got.SubPath != tt.wantSubPath {
+				t.Errorf("ParseURL() = branch %q ref %q subpath %q, want %q %q %q",
+					got.Branch, got.Ref, got.SubPath, tt.wantBranch, tt.wantRef, tt.wantSubPath)
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"https://codeberg.org/org/repo/src/blob/main",
+		"https://github.com/org/repo//../../etc",
+		"file://host/srv/repo.git",
+		"ssh:///org/repo.git",
+		"https://gitlab.com/repo",
+	} {
+		if got, err := ParseURL(bad, ""); err == nil {
+			t.Errorf("ParseURL(%q) = %+v, want error", bad, got)
+		}
+	}
+
+	if _, err := ParseForge("forgejo"); err != nil {
+		t.Errorf("ParseForge(forgejo) failed: %v", err)
+	}
+	if _, err := ParseForge("svn"); err == nil {
+		t.Error("ParseForge(svn): expected error")
+	}
+}
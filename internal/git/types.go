@@ -16,6 +16,10 @@ const (
 	SourceTypeGenericGit
 	// SourceTypeLocal represents a local filesystem path
 	SourceTypeLocal
+	// SourceTypeGitea represents a Gitea or Forgejo repository
+	SourceTypeGitea
+	// SourceTypeSourcehut represents a Sourcehut repository
+	SourceTypeSourcehut
 )
 
 // String returns a string representation of the SourceType
@@ -31,6 +35,10 @@ func (s SourceType) String() string {
 		return "Git"
 	case SourceTypeLocal:
 		return "Local"
+	case SourceTypeGitea:
+		return "Gitea"
+	case SourceTypeSourcehut:
+		return "Sourcehut"
 	default:
 		return "Unknown"
 	}
@@ -39,10 +47,12 @@ func (s SourceType) String() string {
 // Repository represents a Git repository source
 type Repository struct {
 	URL        string     // Full Git URL
+	CloneURL   string     // URL to clone, without browse paths, subpath or ref
 	Branch     string     // Branch name (default: main)
+	Ref        string     // Pinned tag or commit from an @ref suffix; overrides Branch
 	SubPath    string     // Subpath within repository (e.g., /path/to/quadlets)
 	Host       string     // Git host (github.com, gitlab.com, etc.)
-	Owner      string     // Repository owner/organization
+	Owner      string     // Repository owner/organization, or GitLab group path
 	RepoName   string     // Repository name
 	SourceType SourceType // Type of source (leger.run, GitHub, etc.)
 }
@@ -0,0 +1,172 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ErrUnverified is reported when a checkout is not signed by an allowed signer.
+var ErrUnverified = errors.New("signature verification failed")
+
+// VerifyPolicy requires that a checkout be signed by an allowed signer,
+// either on the commit checked out or on the tag it was pinned to.
+type VerifyPolicy struct {
+	// AllowedSigners is the path of an allowed-signers file, in the format
+	// used by ssh-keygen(1) and git's gpg.ssh.allowedSignersFile:
+	//
+	//	release@example.com ssh-ed25519 AAAA...
+	//
+	// A line whose key type is "gpg" instead allows the GPG key with the
+	// given fingerprint, which must also be in the user's GPG keyring:
+	//
+	//	release@example.com gpg 0123456789ABCDEF0123456789ABCDEF01234567
+	AllowedSigners string
+}
+
+// Signature describes a verified signature.
+type Signature struct {
+	Object string // "tag" or "commit"
+	Format string // "ssh" or "gpg"
+	Signer string // SSH principal or GPG key fingerprint
+}
+
+var sshGoodPattern = regexp.MustCompile(`Good "git" signature for (\S+) with`)
+
+// Verify checks the checkout in dir against the policy. If ref names a tag,
+// even one whose name looks like a commit hash, a valid signature on the tag
+// is accepted; otherwise, or failing that, the commit checked out must be
+// signed.
+func (p *VerifyPolicy) Verify(dir, ref string) (*Signature, error) {
+	sshSigners, gpgKeys, err := readAllowedSigners(p.AllowedSigners)
+	if err != nil {
+		return nil, err
+	}
+
+	// Give git only the SSH lines, since it does not understand ours.
+	f, err := os.CreateTemp("", "leger-allowed-signers-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create allowed signers file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(sshSigners)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write allowed signers file: %w", err)
+	}
+
+	type object struct{ kind, name string }
+	objects := []object{{"commit", "HEAD"}}
+	if ref != "" && !IsCommit(ref) {
+		objects = []object{{"tag", ref}, {"commit", "HEAD"}}
+	} else if IsCommit(ref) && hasRev(dir, "refs/tags/"+ref) {
+		// A tag whose name looks like a hash was checked out as a tag.
+		objects = []object{{"tag", "refs/tags/" + ref}, {"commit", "HEAD"}}
+	}
+
+	var reasons []string
+	for _, obj := range objects {
+		sig, err := verifyObject(dir, f.Name(), obj.kind, obj.name, gpgKeys)
+		if err == nil {
+			return sig, nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s %s: %v", obj.kind, obj.name, err))
+	}
+	return nil, fmt.Errorf("%w:\n  %s\n\nAllowed signers: %s", ErrUnverified, strings.Join(reasons, "\n  "), p.AllowedSigners)
+}
+
+// verifyObject verifies the signature on a single commit or tag.
+func verifyObject(dir, sshSignersFile, kind, name string, gpgKeys map[string]bool) (*Signature, error) {
+	cmd := exec.Command("git", "-C", dir,
+		"-c", "gpg.ssh.allowedSignersFile="+sshSignersFile,
+		"verify-"+kind, "--raw", name)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	runErr := cmd.Run()
+	output := out.String()
+
+	if fprs := gpgValidSig(output); fprs != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("bad GPG signature")
+		}
+		for _, fpr := range fprs {
+			if gpgKeys[fpr] {
+				return &Signature{Object: kind, Format: "gpg", Signer: fpr}, nil
+			}
+		}
+		return nil, fmt.Errorf("GPG key %s is not an allowed signer", fprs[0])
+	}
+	if runErr != nil {
+		if strings.TrimSpace(output) == "" {
+			return nil, fmt.Errorf("not signed")
+		}
+		return nil, fmt.Errorf("invalid signature: %s", firstLine(output))
+	}
+	if m := sshGoodPattern.FindStringSubmatch(output); m != nil {
+		return &Signature{Object: kind, Format: "ssh", Signer: m[1]}, nil
+	}
+	// Git accepts a valid SSH signature by an unknown key, but reports that
+	// no principal matched.
+	return nil, fmt.Errorf("signer is not in the allowed signers file: %s", firstLine(output))
+}
+
+// readAllowedSigners reads an allowed-signers file, returning its SSH lines
+// and the fingerprints of its GPG keys.
+func readAllowedSigners(path string) ([]byte, map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read allowed signers: %w", err)
+	}
+
+	var ssh bytes.Buffer
+	gpgKeys := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == "gpg" {
+			fpr := strings.ToUpper(strings.Join(fields[2:], ""))
+			gpgKeys[fpr] = true
+			continue
+		}
+		ssh.WriteString(line)
+		ssh.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read allowed signers: %w", err)
+	}
+	return ssh.Bytes(), gpgKeys, nil
+}
+
+// gpgValidSig returns the fingerprints of the signing key and its primary key
+// from the VALIDSIG status line in GPG output, or nil if there is none.
+func gpgValidSig(output string) []string {
+	for line := range strings.Lines(output) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" || fields[1] != "VALIDSIG" {
+			continue
+		}
+		fprs := []string{fields[2]}
+		if len(fields) >= 12 {
+			fprs = append(fprs, fields[11])
+		}
+		return fprs
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,389 @@
+// Package overlay applies host-specific overlays to a deployment's quadlets.
+//
+// An overlay is a local directory that patches the base quadlets of a
+// deployment, typically fetched from Git, in the manner of kustomize. Its
+// overlay.yaml may replace images, set, add and remove keys in sections of
+// quadlet files, and remove files from the base. Every other file in the
+// directory, such as a drop-in app.container.d/10-host.conf or a new
+// quadlet, is added to the result. The base itself is never modified, so
+// the overlay is applied again to each new version of it.
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the name of the file describing an overlay.
+const File = "overlay.yaml"
+
+// Overlay is the content of an overlay directory.
+type Overlay struct {
+	// Dir is the overlay directory.
+	Dir string `yaml:"-"`
+
+	// Images maps image names, without tag or digest, to the image that
+	// replaces them in Image= keys.
+	Images map[string]string `yaml:"images"`
+
+	// Patches edit quadlet files, in order.
+	Patches []Patch `yaml:"patches"`
+
+	// Remove lists files of the base to remove.
+	Remove []string `yaml:"remove"`
+}
+
+// Patch edits a section of a quadlet file.
+type Patch struct {
+	File    string `yaml:"file"`
+	Section string `yaml:"section"`
+
+	// Set replaces every value of a key with one value, adding the key if
+	// it is missing.
+	Set map[string]string `yaml:"set"`
+
+	// Add appends values for keys that may be repeated, such as
+	// Environment or Label.
+	Add map[string][]string `yaml:"add"`
+
+	// Remove removes keys, or single values given as Key=value.
+	Remove []string `yaml:"remove"`
+}
+
+// DefaultDir returns the overlay directory used for a deployment when none
+// is given: ~/.config/leger/overlays/<deployment>.
+func DefaultDir(deployment string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "leger", "overlays", deployment), nil
+}
+
+// Find loads the overlay in dir, or if dir is empty, the one in the
+// deployment's default directory. It returns nil if dir is empty and the
+// default directory does not exist.
+func Find(dir, deployment string) (*Overlay, error) {
+	if dir == "" {
+		def, err := DefaultDir(deployment)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(def); errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		dir = def
+	}
+	return Load(dir)
+}
+
+// Load loads the overlay in dir. overlay.yaml is optional: an overlay may
+// only add files.
+func Load(dir string) (*Overlay, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlay: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("overlay %s is not a directory", dir)
+	}
+
+	o := &Overlay{}
+	data, err := os.ReadFile(filepath.Join(dir, File))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read overlay: %w", err)
+	}
+	if err := yaml.Unmarshal(data, o); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filepath.Join(dir, File), err)
+	}
+	o.Dir = dir
+
+	for i, p := range o.Patches {
+		if err := p.check(); err != nil {
+			return nil, fmt.Errorf("overlay %s: patches[%d]: %w", dir, i, err)
+		}
+	}
+	for _, name := range o.Remove {
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("overlay %s: invalid file to remove %q", dir, name)
+		}
+	}
+	return o, nil
+}
+
+func (p *Patch) check() error {
+	switch {
+	case p.File == "":
+		return fmt.Errorf("file is required")
+	case !filepath.IsLocal(p.File):
+		return fmt.Errorf("invalid file %q", p.File)
+	case p.Section == "":
+		return fmt.Errorf("section is required")
+	case len(p.Set) == 0 && len(p.Add) == 0 && len(p.Remove) == 0:
+		return fmt.Errorf("one of set, add or remove is required")
+	}
+	for key := range p.Set {
+		if _, ok := p.Add[key]; ok {
+			return fmt.Errorf("key %s cannot be both set and added", key)
+		}
+	}
+	return nil
+}
+
+// Apply applies the overlay to the quadlets in dir, in place: it removes
+// files, adds the overlay's files, replaces images and applies patches, in
+// that order. A patch of a file that is missing, or an added file that
+// would overwrite one of the base, is an error, so that changes to the
+// base that an overlay depends on are noticed rather than lost. It returns
+// the names of the files changed, relative to dir.
+func (o *Overlay) Apply(dir string) ([]string, error) {
+	var changed []string
+
+	for _, name := range o.Remove {
+		path := filepath.Join(dir, name)
+		if _, err := os.Lstat(path); err != nil {
+			return nil, fmt.Errorf("overlay removes %s, which is not in the base", name)
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+		changed = append(changed, name)
+	}
+
+	added, err := o.addFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	changed = append(changed, added...)
+
+	if len(o.Images) > 0 {
+		replaced, err := o.replaceImages(dir)
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, replaced...)
+	}
+
+	for _, p := range o.Patches {
+		path := filepath.Join(dir, p.File)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("overlay patches %s, which is not in the base", p.File)
+		} else if err != nil {
+			return nil, err
+		}
+		if err := writeLines(path, p.apply(splitLines(data))); err != nil {
+			return nil, err
+		}
+		changed = append(changed, p.File)
+	}
+
+	slices.Sort(changed)
+	return slices.Compact(changed), nil
+}
+
+// addFiles copies the files of the overlay, other than overlay.yaml, into
+// dir, and returns their names.
+func (o *Overlay) addFiles(dir string) ([]string, error) {
+	var added []string
+	err := filepath.WalkDir(o.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(o.Dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		if rel == File {
+			return nil
+		}
+
+		target := filepath.Join(dir, rel)
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("overlay file %s would overwrite %s of the base; patch it, or list it under remove", rel, rel)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		added = append(added, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add overlay files: %w", err)
+	}
+	return added, nil
+}
+
+// replaceImages replaces the Image= values in the quadlets in dir that name
+// an image in o.Images, and returns the names of the files changed.
+func (o *Overlay) replaceImages(dir string) ([]string, error) {
+	var changed []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		lines := splitLines(data)
+		replaced := false
+		for i, line := range lines {
+			key, value, ok := keyValue(line)
+			if !ok || key != "Image" {
+				continue
+			}
+			if image, ok := o.Images[imageName(value)]; ok && image != value {
+				lines[i] = "Image=" + image
+				replaced = true
+			}
+		}
+		if !replaced {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		changed = append(changed, rel)
+		return writeLines(path, lines)
+	})
+	return changed, err
+}
+
+// imageName returns image without its tag or digest.
+func imageName(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// apply returns lines with the patch applied to its section, which is
+// added at the end if it is missing.
+func (p *Patch) apply(lines []string) []string {
+	start, end := section(lines, p.Section)
+	if start < 0 {
+		if n := len(lines); n > 0 && strings.TrimSpace(lines[n-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "["+p.Section+"]")
+		start, end = len(lines)-1, len(lines)
+	}
+	body := slices.Clone(lines[start+1 : end])
+
+	// Keep trailing blank lines and comments after the keys added.
+	tail := len(body)
+	for tail > 0 {
+		if _, _, ok := keyValue(body[tail-1]); ok {
+			break
+		}
+		tail--
+	}
+	rest := slices.Clone(body[tail:])
+	body = body[:tail]
+
+	for _, r := range p.Remove {
+		key, value, byValue := strings.Cut(r, "=")
+		body = slices.DeleteFunc(body, func(line string) bool {
+			k, v, ok := keyValue(line)
+			return ok && k == key && (!byValue || v == value)
+		})
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(p.Set)) {
+		kv := key + "=" + p.Set[key]
+		i := slices.IndexFunc(body, func(line string) bool {
+			k, _, ok := keyValue(line)
+			return ok && k == key
+		})
+		if i < 0 {
+			body = append(body, kv)
+			continue
+		}
+		body[i] = kv
+		body = append(body[:i+1], slices.DeleteFunc(body[i+1:], func(line string) bool {
+			k, _, ok := keyValue(line)
+			return ok && k == key
+		})...)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(p.Add)) {
+		for _, value := range p.Add[key] {
+			body = append(body, key+"="+value)
+		}
+	}
+
+	out := slices.Clone(lines[:start+1])
+	out = append(out, body...)
+	out = append(out, rest...)
+	return append(out, lines[end:]...)
+}
+
+// section returns the index of the header of the named section in lines and
+// the index of the line after its last line, or -1 if it is missing.
+func section(lines []string, name string) (start, end int) {
+	start = -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "[") || !strings.HasSuffix(trimmed, "]") {
+			continue
+		}
+		if start >= 0 {
+			return start, i
+		}
+		if trimmed[1:len(trimmed)-1] == name {
+			start = i
+		}
+	}
+	return start, len(lines)
+}
+
+// keyValue splits a Key=value line. Comments, blank lines and section
+// headers are not key lines.
+func keyValue(line string) (key, value string, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' || trimmed[0] == '[' {
+		return "", "", false
+	}
+	key, value, ok = strings.Cut(trimmed, "=")
+	return strings.TrimSpace(key), strings.TrimSpace(value), ok
+}
+
+// splitLines splits data into lines, without a final empty line.
+func splitLines(data []byte) []string {
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// writeLines replaces the content of the file at path with lines.
+func writeLines(path string, lines []string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), info.Mode().Perm())
+}
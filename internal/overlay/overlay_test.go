@@ -0,0 +1,194 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestApply(t *testing.T) {
+	base := t.TempDir()
+	writeFiles(t, base, map[string]string{
+		"app.container": `[Unit]
+Description=App
+
+[Container]
+Image=docker.io/library/nginx:1.25
+Environment=A=1
+Environment=B=2
+Label=tier=web
+PublishPort=8080:80
+# Published on all interfaces
+
+[Install]
+WantedBy=default.target
+`,
+		"db.container":    "[Container]\nImage=docker.io/library/postgres@sha256:abc\n",
+		"debug.container": "[Container]\nImage=busybox\n",
+	})
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		File: `images:
+  docker.io/library/postgres: docker.io/library/postgres:16
+patches:
+  - file: app.container
+    section: Container
+    set:
+      Image: registry.internal/nginx:1.25
+      PublishPort: 100.64.0.7:8080:80
+    add:
+      Environment: [TZ=Europe/Paris]
+    remove: [Label, Environment=B=2]
+  - file: app.container
+    section: Service
+    set:
+      Restart: always
+remove:
+  - debug.container
+`,
+		"app.container.d/10-host.conf": "[Container]\nMemory=512m\n",
+	})
+
+	o, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	changed, err := o.Apply(base)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	want := []string{"app.container", "app.container.d/10-host.conf", "db.container", "debug.container"}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("Changed: got %v, want %v", changed, want)
+	}
+
+	wantApp := `[Unit]
+Description=App
+
+[Container]
+Image=registry.internal/nginx:1.25
+Environment=A=1
+PublishPort=100.64.0.7:8080:80
+Environment=TZ=Europe/Paris
+# Published on all interfaces
+
+[Install]
+WantedBy=default.target
+
+[Service]
+Restart=always
+`
+	if got := readFile(t, filepath.Join(base, "app.container")); got != wantApp {
+		t.Errorf("app.container:\n%s\nwant:\n%s", got, wantApp)
+	}
+	if got := readFile(t, filepath.Join(base, "db.container")); got != "[Container]\nImage=docker.io/library/postgres:16\n" {
+		t.Errorf("db.container: got %q", got)
+	}
+	if got := readFile(t, filepath.Join(base, "app.container.d", "10-host.conf")); got != "[Container]\nMemory=512m\n" {
+		t.Errorf("Drop-in: got %q", got)
+	}
+	for _, name := range []string{"debug.container", File} {
+		if _, err := os.Stat(filepath.Join(base, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no file, got %v", name, err)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := map[string]struct {
+		files map[string]string
+		want  string
+	}{
+		"MissingFile": {
+			files: map[string]string{File: "patches:\n  - file: gone.container\n    section: Container\n    set: {Image: x}\n"},
+			want:  "not in the base",
+		},
+		"MissingRemove": {
+			files: map[string]string{File: "remove: [gone.container]\n"},
+			want:  "not in the base",
+		},
+		"Overwrite": {
+			files: map[string]string{"app.container": "[Container]\n"},
+			want:  "would overwrite",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			base := t.TempDir()
+			writeFiles(t, base, map[string]string{"app.container": "[Container]\nImage=nginx\n"})
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files)
+			o, err := Load(dir)
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if _, err := o.Apply(base); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Apply: got %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"NoFile":     "patches:\n  - section: Container\n    set: {Image: x}\n",
+		"NoSection":  "patches:\n  - file: a.container\n    set: {Image: x}\n",
+		"NoChange":   "patches:\n  - file: a.container\n    section: Container\n",
+		"SetAndAdd":  "patches:\n  - file: a.container\n    section: Container\n    set: {Label: x}\n    add: {Label: [y]}\n",
+		"OutsideDir": "remove: [../a.container]\n",
+		"Syntax":     "patches: [",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{File: data})
+			if _, err := Load(dir); err == nil {
+				t.Error("Load: expected error")
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	if o, err := Find("", "app"); o != nil || err != nil {
+		t.Errorf("Find without overlay: got %v, %v", o, err)
+	}
+	if _, err := Find(filepath.Join(home, "missing"), "app"); err == nil {
+		t.Error("Find of missing explicit dir: expected error")
+	}
+
+	dir := filepath.Join(home, ".config", "leger", "overlays", "app")
+	writeFiles(t, dir, map[string]string{"extra.volume": "[Volume]\n"})
+	o, err := Find("", "app")
+	if err != nil || o == nil || o.Dir != dir {
+		t.Errorf("Find default: got %v, %v", o, err)
+	}
+}
@@ -1,6 +1,7 @@
 package podman
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -22,7 +23,21 @@ func NewQuadletManager(scope string) *QuadletManager {
 	return &QuadletManager{scope: scope}
 }
 
-// Install installs quadlet files by copying them to the systemd directory
+// InstallDir returns the directory from which systemd generates units for
+// quadlets in the manager's scope.
+func (qm *QuadletManager) InstallDir() (string, error) {
+	if qm.scope != "user" {
+		return "/etc/containers/systemd", nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "containers", "systemd"), nil
+}
+
+// Install installs quadlet files, and their drop-ins, by copying them to the
+// systemd directory
 func (qm *QuadletManager) Install(quadletPath string) error {
 	// Verify path exists
 	fileInfo, err := os.Stat(quadletPath)
@@ -60,8 +75,8 @@ func (qm *QuadletManager) Install(quadletPath string) error {
 				return nil
 			}
 
-			// Only copy files with quadlet extensions
-			if !hasQuadletExtension(path) {
+			// Only copy quadlet files and their drop-ins
+			if !hasQuadletExtension(path) && !IsDropIn(path) {
 				return nil
 			}
 
@@ -221,6 +236,40 @@ func (qm *QuadletManager) Remove(name string) error {
 	return nil
 }
 
+// Uninstall removes the quadlet files and drop-ins that Install copied from
+// dir, including those in subdirectories, along with any directories that
+// are left empty. Other installed quadlets are not affected.
+func (qm *QuadletManager) Uninstall(dir string) error {
+	installDir, err := qm.InstallDir()
+	if err != nil {
+		return err
+	}
+	files, err := qm.DiscoverInstallFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return fmt.Errorf("failed to determine relative path: %w", err)
+		}
+		dest := filepath.Join(installDir, rel)
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to remove quadlet %s: %w", rel, err))
+			continue
+		}
+		// Remove the drop-in and subdirectories that are now empty.
+		for d := filepath.Dir(dest); d != installDir; d = filepath.Dir(d) {
+			if os.Remove(d) != nil {
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // Print prints a quadlet definition by reading the file
 func (qm *QuadletManager) Print(name string) (string, error) {
 	// Ensure proper extension if not provided
@@ -284,6 +333,33 @@ func (qm *QuadletManager) DiscoverQuadletFiles(dir string) ([]string, error) {
 	return quadletFiles, nil
 }
 
+// DiscoverInstallFiles discovers the files in a directory that Install
+// copies: quadlet files and their drop-ins
+func (qm *QuadletManager) DiscoverInstallFiles(dir string) ([]string, error) {
+	files, err := qm.DiscoverQuadletFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && IsDropIn(path) {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover drop-in files: %w", err)
+	}
+	return files, nil
+}
+
+// IsDropIn reports whether path is a drop-in for a quadlet, such as
+// app.container.d/10-host.conf, which systemd applies to the quadlet's unit
+func IsDropIn(path string) bool {
+	dir := filepath.Base(filepath.Dir(path))
+	return filepath.Ext(path) == ".conf" && strings.HasSuffix(dir, ".d") &&
+		hasQuadletExtension(strings.TrimSuffix(dir, ".d"))
+}
+
 // hasQuadletExtension checks if a file has a valid quadlet extension
 func hasQuadletExtension(path string) bool {
 	ext := filepath.Ext(path)
@@ -0,0 +1,104 @@
+package podman
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leger-labs/leger/internal/overlay"
+)
+
+func TestInstallDropIns(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	write := func(dir string, files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The overlay adds a drop-in to the base quadlet.
+	dir := t.TempDir()
+	write(dir, map[string]string{
+		"app.container": "[Container]\nImage=nginx\n",
+		"README.md":     "not installed\n",
+	})
+	ovDir := t.TempDir()
+	write(ovDir, map[string]string{
+		overlay.File:                   "patches: []\n",
+		"app.container.d/10-host.conf": "[Container]\nEnvironment=HOST=1\n",
+	})
+	ov, err := overlay.Load(ovDir)
+	if err != nil {
+		t.Fatalf("Load overlay: %v", err)
+	}
+	if _, err := ov.Apply(dir); err != nil {
+		t.Fatalf("Apply overlay: %v", err)
+	}
+
+	qm := NewQuadletManager("user")
+	if err := qm.Install(dir); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	installDir, err := qm.InstallDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"app.container":                true,
+		"app.container.d/10-host.conf": true,
+		"README.md":                    false,
+	} {
+		_, err := os.Stat(filepath.Join(installDir, name))
+		if got := err == nil; got != want {
+			t.Errorf("Installed %s: got %v, want %v", name, got, want)
+		}
+	}
+
+	files, err := qm.DiscoverInstallFiles(dir)
+	if err != nil {
+		t.Fatalf("DiscoverInstallFiles: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("DiscoverInstallFiles: got %q, want the quadlet and its drop-in", files)
+	}
+
+	// Uninstalling removes the quadlet and its drop-in, but not the quadlets
+	// of other deployments.
+	write(installDir, map[string]string{"other.container": "[Container]\nImage=redis\n"})
+	if err := qm.Uninstall(dir); err != nil {
+		t.Fatalf("Uninstall: %v", err)
+	}
+	for name, want := range map[string]bool{
+		"app.container":   false,
+		"app.container.d": false,
+		"other.container": true,
+	} {
+		_, err := os.Stat(filepath.Join(installDir, name))
+		if got := err == nil; got != want {
+			t.Errorf("After Uninstall, %s exists: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestIsDropIn(t *testing.T) {
+	for path, want := range map[string]bool{
+		"app.container.d/10-host.conf": true,
+		"sub/db.volume.d/size.conf":    true,
+		"app.container.d/notes.txt":    false,
+		"conf.d/10-host.conf":          false,
+		"10-host.conf":                 false,
+	} {
+		if got := IsDropIn(path); got != want {
+			t.Errorf("IsDropIn(%q): got %v, want %v", path, got, want)
+		}
+	}
+}
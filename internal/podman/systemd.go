@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -256,3 +257,16 @@ func QuadletNameToServiceName(quadletName string) string {
 	// Add .service extension
 	return name + ".service"
 }
+
+// GeneratedServiceName returns the name of the systemd service that quadlet
+// generates from the quadlet file at path. Pods, volumes, networks and images
+// get a suffix so that they do not collide with containers of the same name.
+func GeneratedServiceName(path string) string {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	switch ext {
+	case ".pod", ".volume", ".network", ".image":
+		return name + "-" + strings.TrimPrefix(ext, ".") + ".service"
+	}
+	return name + ".service"
+}
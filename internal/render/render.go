@@ -0,0 +1,306 @@
+// Package render renders quadlet templates for the host they are installed on.
+//
+// A template is any file whose name ends in .tmpl, such as app.container.tmpl.
+// It is executed with text/template and written without the suffix, so the
+// rendered quadlets are what get validated, diffed and installed. Templates
+// are given the deployment name and the merged values as .Deployment and
+// .Values, and helper functions for the host's names and Tailscale identity.
+// No helper reads secrets: those stay as Secret= lines resolved by Podman.
+package render
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/leger-labs/leger/internal/tailscale"
+	"github.com/leger-labs/leger/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Ext is the file name extension of templates.
+const Ext = ".tmpl"
+
+// noValue is what text/template prints for a missing value.
+const noValue = "<no value>"
+
+// ValuesDir is the directory of a source holding per-host values files,
+// named <hostname>.yaml.
+const ValuesDir = "values"
+
+// Options select values to render with beyond those in the source.
+type Options struct {
+	ValuesFiles []string // Values files, applied in order
+	Set         []string // key=value assignments, applied last; keys may be dotted paths
+}
+
+// Data is what templates are executed with.
+type Data struct {
+	Deployment string
+	Values     map[string]any
+}
+
+// identity returns the Tailscale identity of the host. Tests replace it.
+var identity = func(ctx context.Context) (*tailscale.Identity, error) {
+	return tailscale.NewClient().GetIdentity(ctx)
+}
+
+// hostname returns the name of the host. Tests replace it.
+var hostname = os.Hostname
+
+// HasTemplates reports whether dir contains any templates.
+func HasTemplates(dir string) (bool, error) {
+	found := false
+	err := walkTemplates(dir, func(string) error {
+		found = true
+		return fs.SkipAll
+	})
+	return found, err
+}
+
+// Load returns the data to render the templates in dir with for deployment.
+// Values are merged, later ones taking precedence, from the values section
+// of the source's manifest, the source's values file for this host, the
+// files in opts.ValuesFiles and the assignments in opts.Set.
+func Load(dir, deployment string, opts Options) (*Data, error) {
+	values := map[string]any{}
+
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		merge(values, manifest.Values)
+	}
+
+	if path, err := hostValuesFile(dir); err != nil {
+		return nil, err
+	} else if path != "" {
+		if err := mergeFile(values, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range opts.ValuesFiles {
+		if err := mergeFile(values, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kv := range opts.Set {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --set %q: expected key=value", kv)
+		}
+		if err := setPath(values, key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Data{Deployment: deployment, Values: values}, nil
+}
+
+// Dir renders the templates in dir in place: each is executed with data and
+// written without the .tmpl suffix, and then removed. It returns the names
+// of the rendered files, relative to dir.
+func Dir(ctx context.Context, dir string, data *Data) ([]string, error) {
+	funcs := helpers(ctx)
+	var rendered []string
+	err := walkTemplates(dir, func(path string) error {
+		target := strings.TrimSuffix(path, Ext)
+		rel, _ := filepath.Rel(dir, target)
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("template %s%s would overwrite %s", rel, Ext, rel)
+		}
+
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		// Missing values are not an error while executing, so that default
+		// and required see them; one that is printed is caught below.
+		tmpl, err := template.New(rel + Ext).Funcs(funcs).Parse(string(text))
+		if err != nil {
+			return fmt.Errorf("failed to parse template: %w", err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			return fmt.Errorf("failed to render template: %w", err)
+		}
+		if bytes.Contains(out.Bytes(), []byte(noValue)) {
+			return fmt.Errorf("failed to render template %s%s: it prints a missing value; set it, or use default or required", rel, Ext)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, out.Bytes(), info.Mode().Perm()); err != nil {
+			return err
+		}
+		rendered = append(rendered, rel)
+		return os.Remove(path)
+	})
+	return rendered, err
+}
+
+// walkTemplates calls fn with the path of each template in dir.
+func walkTemplates(dir string, fn func(path string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || (path != dir && d.Name() == ValuesDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), Ext) || d.Name() == Ext {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// helpers returns the functions available to templates.
+func helpers(ctx context.Context) template.FuncMap {
+	// The Tailscale identity is looked up once, and only if it is used.
+	tsIdentity := sync.OnceValues(func() (*tailscale.Identity, error) {
+		id, err := identity(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("tailscale identity: %w", err)
+		}
+		return id, nil
+	})
+	tsField := func(field func(*tailscale.Identity) string) func() (string, error) {
+		return func() (string, error) {
+			id, err := tsIdentity()
+			if err != nil {
+				return "", err
+			}
+			return field(id), nil
+		}
+	}
+
+	return template.FuncMap{
+		"hostname": hostname,
+		"shortHostname": func() (string, error) {
+			name, err := hostname()
+			short, _, _ := strings.Cut(name, ".")
+			return short, err
+		},
+		"tailscaleHostname": tsField(func(id *tailscale.Identity) string { return id.DeviceName }),
+		"tailscaleIP":       tsField(func(id *tailscale.Identity) string { return id.DeviceIP }),
+		"tailscaleTailnet":  tsField(func(id *tailscale.Identity) string { return id.Tailnet }),
+
+		"default": func(def, value any) any {
+			if value == nil || value == "" {
+				return def
+			}
+			return value
+		},
+		"required": func(name string, value any) (any, error) {
+			if value == nil || value == "" {
+				return nil, fmt.Errorf("value %s is required", name)
+			}
+			return value, nil
+		},
+	}
+}
+
+// loadManifest returns the manifest in dir, or nil if there is none.
+func loadManifest(dir string) (*types.Manifest, error) {
+	for _, name := range []string{"manifest.json", ".leger.yaml", ".leger.yml"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		m, err := types.LoadManifestFromFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", name, err)
+		}
+		return m, nil
+	}
+	return nil, nil
+}
+
+// hostValuesFile returns the values file in dir for this host, by full or
+// short hostname, or "" if there is none.
+func hostValuesFile(dir string) (string, error) {
+	name, err := hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	short, _, _ := strings.Cut(name, ".")
+	for _, n := range []string{name, short} {
+		for _, ext := range []string{".yaml", ".yml"} {
+			path := filepath.Join(dir, ValuesDir, n+ext)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// mergeFile merges the values in the YAML file at path into values.
+func mergeFile(values map[string]any, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read values: %w", err)
+	}
+	var v map[string]any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("failed to parse values %s: %w", path, err)
+	}
+	merge(values, v)
+	return nil
+}
+
+// merge merges src into dst. Nested maps are merged; other values replace
+// those in dst.
+func merge(dst, src map[string]any) {
+	for k, v := range src {
+		if sv, ok := v.(map[string]any); ok {
+			if dv, ok := dst[k].(map[string]any); ok {
+				merge(dv, sv)
+				continue
+			}
+			v = maps.Clone(sv)
+		}
+		dst[k] = v
+	}
+}
+
+// setPath sets the value at a dotted key path in values, creating maps as
+// needed. The value is always a string, so that tags such as 1.10 are kept
+// as written.
+func setPath(values map[string]any, key, value string) error {
+	parts := strings.Split(key, ".")
+	if slices.Contains(parts, "") {
+		return fmt.Errorf("invalid --set %s: empty key", key)
+	}
+	m := values
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := m[part].(map[string]any)
+		if !ok {
+			if _, exists := m[part]; exists {
+				return fmt.Errorf("invalid --set %s: %s is not a map", key, part)
+			}
+			next = map[string]any{}
+			m[part] = next
+		}
+		m = next
+	}
+	m[parts[len(parts)-1]] = value
+	return nil
+}
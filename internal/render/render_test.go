@@ -0,0 +1,170 @@
+package render
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/leger-labs/leger/internal/tailscale"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeHost replaces the host's name and Tailscale identity for a test.
+func fakeHost(t *testing.T, name string, id *tailscale.Identity) {
+	t.Helper()
+	oldHostname, oldIdentity := hostname, identity
+	t.Cleanup(func() { hostname, identity = oldHostname, oldIdentity })
+	hostname = func() (string, error) { return name, nil }
+	identity = func(context.Context) (*tailscale.Identity, error) {
+		if id == nil {
+			return nil, errors.New("not running")
+		}
+		return id, nil
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fakeHost(t, "web1.example.com", nil)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".leger.yaml": `name: app
+values:
+  port: 8080
+  image:
+    name: docker.io/library/nginx
+    tag: "1.25"
+  replicas: 1
+`,
+		"values/web1.yaml":  "port: 9090\nimage:\n  tag: \"1.26\"\n",
+		"values/other.yaml": "port: 1\n",
+	})
+	extra := filepath.Join(t.TempDir(), "extra.yaml")
+	writeFiles(t, filepath.Dir(extra), map[string]string{"extra.yaml": "replicas: 2\n"})
+
+	data, err := Load(dir, "app", Options{
+		ValuesFiles: []string{extra},
+		Set:         []string{"image.tag=1.27", "debug=true", "labels.team=web"},
+	})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	want := map[string]any{
+		"port":     9090,
+		"image":    map[string]any{"name": "docker.io/library/nginx", "tag": "1.27"},
+		"replicas": 2,
+		"debug":    "true",
+		"labels":   map[string]any{"team": "web"},
+	}
+	if data.Deployment != "app" || !reflect.DeepEqual(data.Values, want) {
+		t.Errorf("Load: got %s %v, want app %v", data.Deployment, data.Values, want)
+	}
+
+	for _, set := range []string{"novalue", "=x", "a..b=1", "port.x=1"} {
+		if _, err := Load(dir, "app", Options{Set: []string{set}}); err == nil {
+			t.Errorf("Load with --set %s: expected error", set)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	fakeHost(t, "web1.example.com", &tailscale.Identity{DeviceName: "web1", DeviceIP: "100.64.0.7", Tailnet: "example.ts.net"})
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.container.tmpl": `[Container]
+Image=docker.io/library/nginx:{{ .Values.tag }}
+PublishPort={{ tailscaleIP }}:{{ .Values.port | default 8080 }}:80
+Label=host={{ shortHostname }} deployment={{ .Deployment }}
+Secret=api-key,type=env,target=API_KEY
+`,
+		"app.volume":       "[Volume]\n",
+		"values/web1.yaml": "tag: \"{{ not rendered }}\"\n",
+	})
+
+	rendered, err := Dir(context.Background(), dir, &Data{Deployment: "app", Values: map[string]any{"tag": "1.25"}})
+	if err != nil {
+		t.Fatalf("Dir failed: %v", err)
+	}
+	if len(rendered) != 1 || rendered[0] != "app.container" {
+		t.Errorf("Rendered: got %v, want [app.container]", rendered)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "app.container"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[Container]
+Image=docker.io/library/nginx:1.25
+PublishPort=100.64.0.7:8080:80
+Label=host=web1 deployment=app
+Secret=api-key,type=env,target=API_KEY
+`
+	if string(got) != want {
+		t.Errorf("Rendered content:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.container.tmpl")); !os.IsNotExist(err) {
+		t.Errorf("Template was not removed: %v", err)
+	}
+	if ok, err := HasTemplates(dir); ok || err != nil {
+		t.Errorf("HasTemplates after Dir: got %v, %v", ok, err)
+	}
+}
+
+func TestDirErrors(t *testing.T) {
+	fakeHost(t, "web1", nil)
+
+	tests := map[string]struct {
+		files map[string]string
+		want  string
+	}{
+		"MissingValue": {
+			files: map[string]string{"a.container.tmpl": "{{ .Values.missing }}"},
+			want:  "missing",
+		},
+		"MissingNested": {
+			files: map[string]string{"a.container.tmpl": "{{ .Values.image.tag }}"},
+			want:  "missing value",
+		},
+		"Required": {
+			files: map[string]string{"a.container.tmpl": `{{ required "image" .Values.image }}`},
+			want:  "value image is required",
+		},
+		"RequiredEmpty": {
+			files: map[string]string{"a.container.tmpl": `{{ required "tag" .Values.tag }}`},
+			want:  "value tag is required",
+		},
+		"NoTailscale": {
+			files: map[string]string{"a.container.tmpl": "{{ tailscaleHostname }}"},
+			want:  "tailscale identity",
+		},
+		"Overwrite": {
+			files: map[string]string{"a.container.tmpl": "x", "a.container": "y"},
+			want:  "would overwrite",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tc.files)
+			_, err := Dir(context.Background(), dir, &Data{Values: map[string]any{"tag": ""}})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Dir: got %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
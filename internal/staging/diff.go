@@ -15,6 +15,12 @@ type DiffResult struct {
 	Added    []string
 	Removed  []string
 	Summary  DiffSummary
+
+	// Base and Overlay are set for deployments with an overlay. Base is
+	// the change to the base quadlets, and Overlay the difference the
+	// overlay makes to the new base.
+	Base    *DiffResult
+	Overlay *DiffResult
 }
 
 // FileDiff represents a diff for a single file
@@ -57,6 +63,36 @@ func (m *Manager) GenerateDiff(deploymentName string) (*DiffResult, error) {
 		return nil, fmt.Errorf("no staged updates for deployment %q", deploymentName)
 	}
 
+	result, err := diffDirs(activePath, stagingPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stagedBase := m.GetStagedBasePath(deploymentName)
+	if stagedBase == "" {
+		return result, nil
+	}
+	if _, err := os.Stat(stagedBase); os.IsNotExist(err) {
+		return result, nil
+	}
+	// Without a base of its own, the active deployment had no overlay.
+	activeBase := m.GetBasePath(deploymentName)
+	if _, err := os.Stat(activeBase); os.IsNotExist(err) {
+		activeBase = activePath
+	}
+	if result.Base, err = diffDirs(activeBase, stagedBase); err != nil {
+		return nil, fmt.Errorf("failed to diff base: %w", err)
+	}
+	if result.Overlay, err = diffDirs(stagedBase, stagingPath); err != nil {
+		return nil, fmt.Errorf("failed to diff overlay: %w", err)
+	}
+
+	return result, nil
+}
+
+// diffDirs compares the quadlets in activePath, which may not exist, with
+// those in stagingPath.
+func diffDirs(activePath, stagingPath string) (*DiffResult, error) {
 	result := &DiffResult{
 		Modified: []FileDiff{},
 		Added:    []string{},
@@ -143,6 +179,11 @@ func (m *Manager) GenerateDiff(deploymentName string) (*DiffResult, error) {
 	return result, nil
 }
 
+// HasChanges reports whether any file was modified, added or removed.
+func (d *DiffResult) HasChanges() bool {
+	return len(d.Modified) > 0 || len(d.Added) > 0 || len(d.Removed) > 0
+}
+
 // generateFileDiff generates a unified diff for a single file
 func generateFileDiff(oldPath, newPath, relativePath string) (*FileDiff, error) {
 	// First check if files are identical
@@ -244,8 +285,32 @@ func extractServiceNames(result *DiffResult) []string {
 	return services
 }
 
-// Display formats and prints the diff result to stdout
+// Display formats and prints the diff result to stdout. For deployments
+// with an overlay, the change to the base and the overlay's difference to
+// the new base are shown separately.
 func (d *DiffResult) Display() {
+	if d.Base != nil && d.Overlay != nil {
+		fmt.Println()
+		fmt.Println("##### Base changes (upstream) #####")
+		d.Base.displayFiles()
+		fmt.Println()
+		fmt.Println("##### Overlay result (host changes to the new base) #####")
+		d.Overlay.displayFiles()
+		fmt.Println()
+		fmt.Println("##### Total #####")
+		fmt.Println()
+		fmt.Printf("Files modified: %d\n", d.Summary.FilesModified)
+		fmt.Printf("Files added: %d\n", d.Summary.FilesAdded)
+		fmt.Printf("Files removed: %d\n", d.Summary.FilesRemoved)
+		fmt.Println()
+	} else {
+		d.displayFiles()
+	}
+	d.displaySummary()
+}
+
+// displayFiles prints the files changed and their diffs.
+func (d *DiffResult) displayFiles() {
 	fmt.Println()
 	fmt.Printf("Files modified: %d\n", d.Summary.FilesModified)
 	fmt.Printf("Files added: %d\n", d.Summary.FilesAdded)
@@ -286,8 +351,10 @@ func (d *DiffResult) Display() {
 		}
 		fmt.Println()
 	}
+}
 
-	// Show summary
+// displaySummary prints the services affected and any conflicts.
+func (d *DiffResult) displaySummary() {
 	if len(d.Summary.ServicesAffected) > 0 {
 		fmt.Println("=== Summary ===")
 		fmt.Printf("Services affected: %s\n", strings.Join(d.Summary.ServicesAffected, ", "))
@@ -6,6 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/leger-labs/leger/internal/overlay"
+	"github.com/leger-labs/leger/internal/render"
 )
 
 // Manager handles staging operations for quadlet updates
@@ -13,6 +17,25 @@ type Manager struct {
 	StagingDir string
 	ActiveDir  string
 	BackupDir  string
+
+	// BaseDir holds the base quadlets of deployments with an overlay, as
+	// they were before it was applied, so that diffs can tell changes to
+	// the base from the overlay's. If empty, bases are not kept.
+	BaseDir string
+
+	// SignaturePolicy, if set, is enforced on Git sources when staging.
+	SignaturePolicy *git.VerifyPolicy
+
+	// Credentials, if set, returns the credentials to fetch a Git source
+	// with, or nil to use the user's Git configuration.
+	Credentials func(repo *git.Repository) (*git.Credentials, error)
+
+	// Render selects values for rendering templates in sources, in addition
+	// to those in the source itself.
+	Render render.Options
+
+	// Overlay, if set, is applied to sources after rendering when staging.
+	Overlay *overlay.Overlay
 }
 
 // StagingMetadata contains information about staged updates
@@ -38,6 +61,7 @@ func NewManager() (*Manager, error) {
 		StagingDir: filepath.Join(baseDir, "staged"),
 		ActiveDir:  filepath.Join(baseDir, "active"),
 		BackupDir:  filepath.Join(baseDir, "backups"),
+		BaseDir:    filepath.Join(baseDir, "base"),
 	}
 
 	return m, nil
@@ -63,6 +87,11 @@ func (m *Manager) CleanStaging() error {
 	if err := os.RemoveAll(m.StagingDir); err != nil {
 		return fmt.Errorf("failed to clean staging directory: %w", err)
 	}
+	if m.BaseDir != "" {
+		if err := os.RemoveAll(filepath.Join(m.BaseDir, "staged")); err != nil {
+			return fmt.Errorf("failed to clean staging directory: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -176,6 +205,11 @@ func (m *Manager) DiscardStaged(deploymentName string) error {
 	if err := os.RemoveAll(stagingPath); err != nil {
 		return fmt.Errorf("failed to discard staged updates: %w", err)
 	}
+	if basePath := m.GetStagedBasePath(deploymentName); basePath != "" {
+		if err := os.RemoveAll(basePath); err != nil {
+			return fmt.Errorf("failed to discard staged updates: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -189,3 +223,23 @@ func (m *Manager) GetStagingPath(deploymentName string) string {
 func (m *Manager) GetActivePath(deploymentName string) string {
 	return filepath.Join(m.ActiveDir, deploymentName)
 }
+
+// GetBasePath returns the path to the base of a deployment's active
+// quadlets, or "" if bases are not kept. It exists only if the deployment
+// has an overlay.
+func (m *Manager) GetBasePath(deploymentName string) string {
+	if m.BaseDir == "" {
+		return ""
+	}
+	return filepath.Join(m.BaseDir, "active", deploymentName)
+}
+
+// GetStagedBasePath returns the path to the base of a deployment's staged
+// quadlets, or "" if bases are not kept. It exists only if the deployment
+// has an overlay.
+func (m *Manager) GetStagedBasePath(deploymentName string) string {
+	if m.BaseDir == "" {
+		return ""
+	}
+	return filepath.Join(m.BaseDir, "staged", deploymentName)
+}
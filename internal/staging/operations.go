@@ -2,6 +2,7 @@ package staging
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,8 +10,15 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/leger-labs/leger/internal/git"
+	"github.com/leger-labs/leger/internal/render"
 )
 
+// ErrRolledBack is reported by ApplyStaged when applying updates failed and
+// the previous deployment was restored from backup.
+var ErrRolledBack = errors.New("apply failed, rolled back successfully")
+
 // StageUpdate downloads quadlets from source and stages them for review
 func (m *Manager) StageUpdate(ctx context.Context, source string, deploymentName string) error {
 	// Create staging directory
@@ -19,16 +27,21 @@ func (m *Manager) StageUpdate(ctx context.Context, source string, deploymentName
 	}
 
 	// Download/copy quadlets to staging
-	// This will be integrated with existing download logic from deploy.go
-	// For now, we'll assume the source is a local path or has been pre-downloaded
-	// TODO: Integrate with git.Clone and legerrun.FetchManifest
-	_ = m.GetStagingPath(deploymentName) // Will be used when download integration is complete
+	// TODO: Integrate with legerrun.FetchManifest for leger.run sources
+	version := "latest"
+	if source != "" {
+		v, err := m.fetchSource(ctx, source, deploymentName)
+		if err != nil {
+			return err
+		}
+		version = v
+	}
 
 	// Create metadata
 	meta := &StagingMetadata{
 		DeploymentName: deploymentName,
 		SourceURL:      source,
-		StagedVersion:  "latest",  // TODO: Extract version from manifest
+		StagedVersion:  version,
 		CurrentVersion: "unknown", // TODO: Get from active deployment
 		StagedAt:       time.Now(),
 		Checksum:       "", // TODO: Calculate checksum
@@ -41,6 +54,91 @@ func (m *Manager) StageUpdate(ctx context.Context, source string, deploymentName
 	return nil
 }
 
+// fetchSource replaces the staged quadlets of the deployment with those from
+// source, a Git URL or local path, with any templates rendered and the
+// overlay applied, and returns the version staged: the commit checked out, if known. Git sources must
+// satisfy m.SignaturePolicy, and are fetched with m.Credentials.
+func (m *Manager) fetchSource(ctx context.Context, source, deploymentName string) (string, error) {
+	stagingPath := m.GetStagingPath(deploymentName)
+	dir := source
+	if git.IsGitURL(source) {
+		repo, err := git.ParseURL(source, "")
+		if err != nil {
+			return "", fmt.Errorf("invalid Git URL: %w", err)
+		}
+		var creds *git.Credentials
+		if m.Credentials != nil {
+			if creds, err = m.Credentials(repo); err != nil {
+				return "", err
+			}
+		}
+		co, err := git.Clone(repo, m.SignaturePolicy, creds)
+		if err != nil {
+			return "", err
+		}
+		defer co.Close()
+		dir = co.Dir
+	}
+
+	version := "local"
+	if commit, err := git.HeadCommit(dir); err == nil {
+		version = commit
+	}
+
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return "", fmt.Errorf("failed to clear staging directory: %w", err)
+	}
+	if err := copyDir(dir, stagingPath); err != nil {
+		return "", fmt.Errorf("failed to stage quadlets: %w", err)
+	}
+
+	if ok, err := render.HasTemplates(stagingPath); err != nil {
+		return "", err
+	} else if ok {
+		data, err := render.Load(stagingPath, deploymentName, m.Render)
+		if err != nil {
+			return "", err
+		}
+		rendered, err := render.Dir(ctx, stagingPath, data)
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("Rendered %d templates\n", len(rendered))
+	}
+
+	if err := m.applyOverlay(deploymentName); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// applyOverlay applies m.Overlay, if set, to the staged quadlets of the
+// deployment, keeping a copy of them as they were as its staged base.
+func (m *Manager) applyOverlay(deploymentName string) error {
+	stagingPath := m.GetStagingPath(deploymentName)
+	basePath := m.GetStagedBasePath(deploymentName)
+	if basePath != "" {
+		if err := os.RemoveAll(basePath); err != nil {
+			return fmt.Errorf("failed to clear staged base: %w", err)
+		}
+	}
+	if m.Overlay == nil {
+		return nil
+	}
+
+	if basePath != "" {
+		if err := copyDir(stagingPath, basePath); err != nil {
+			return fmt.Errorf("failed to save staged base: %w", err)
+		}
+	}
+	changed, err := m.Overlay.Apply(stagingPath)
+	if err != nil {
+		return fmt.Errorf("failed to apply overlay %s: %w", m.Overlay.Dir, err)
+	}
+	fmt.Printf("Applied overlay %s (%d files changed)\n", m.Overlay.Dir, len(changed))
+	return nil
+}
+
 // ApplyStaged applies staged updates to the active deployment
 func (m *Manager) ApplyStaged(ctx context.Context, deploymentName string) error {
 	stagingPath := m.GetStagingPath(deploymentName)
@@ -103,6 +201,11 @@ Or update directly:
 		return m.rollbackOnError(ctx, deploymentName, fmt.Errorf("failed to install quadlets: %w", err))
 	}
 
+	// Keep the base of the quadlets installed, if they have an overlay
+	if err := m.promoteBase(deploymentName); err != nil {
+		fmt.Printf("⚠️  Warning: failed to save base quadlets: %v\n", err)
+	}
+
 	// Start services
 	if len(services) > 0 {
 		fmt.Println("Starting services...")
@@ -186,6 +289,26 @@ func (m *Manager) createBackup(ctx context.Context, deploymentName string) error
 	return nil
 }
 
+// promoteBase replaces the base of the deployment's active quadlets with
+// the staged one, or removes it if there is none.
+func (m *Manager) promoteBase(deploymentName string) error {
+	basePath := m.GetBasePath(deploymentName)
+	if basePath == "" {
+		return nil
+	}
+	if err := os.RemoveAll(basePath); err != nil {
+		return err
+	}
+	stagedBase := m.GetStagedBasePath(deploymentName)
+	if _, err := os.Stat(stagedBase); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(basePath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(stagedBase, basePath)
+}
+
 func (m *Manager) getLatestBackupPath(deploymentName string) string {
 	backupBaseDir := filepath.Join(m.BackupDir, deploymentName)
 
@@ -266,7 +389,7 @@ Manual recovery required:
   3. Check logs: journalctl --user -u %s.service`, rollbackErr, originalErr, deploymentName)
 	}
 
-	return fmt.Errorf("apply failed, rolled back successfully: %w", originalErr)
+	return fmt.Errorf("%w: %w", ErrRolledBack, originalErr)
 }
 
 // copyDir recursively copies a directory
@@ -287,6 +410,11 @@ func copyDir(src, dst string) error {
 			return nil
 		}
 
+		// Skip Git metadata of cloned sources
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
 		targetPath := filepath.Join(dst, relPath)
 
 		if info.IsDir() {
@@ -0,0 +1,191 @@
+package staging
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leger-labs/leger/internal/overlay"
+	"github.com/leger-labs/leger/internal/render"
+)
+
+func TestStageUpdateLocal(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	m := &Manager{
+		StagingDir: filepath.Join(tmpDir, "staged"),
+		ActiveDir:  filepath.Join(tmpDir, "active"),
+		BackupDir:  filepath.Join(tmpDir, "backups"),
+	}
+
+	source := filepath.Join(tmpDir, "source")
+	for _, dir := range []string{source, filepath.Join(source, ".git")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(source, "app.container"), []byte("[Container]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, ".git", "HEAD"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file left from an earlier staging is replaced.
+	stale := filepath.Join(m.StagingDir, "app", "old.container")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.StageUpdate(context.Background(), source, "app"); err != nil {
+		t.Fatalf("StageUpdate() failed: %v", err)
+	}
+
+	stagingPath := m.GetStagingPath("app")
+	if _, err := os.Stat(filepath.Join(stagingPath, "app.container")); err != nil {
+		t.Errorf("Quadlet was not staged: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale file was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(stagingPath, ".git")); !os.IsNotExist(err) {
+		t.Errorf("Git metadata was staged: %v", err)
+	}
+
+	meta, err := m.LoadMetadata("app")
+	if err != nil {
+		t.Fatalf("LoadMetadata() failed: %v", err)
+	}
+	if meta.SourceURL != source || meta.StagedVersion == "" {
+		t.Errorf("Metadata: got %+v", meta)
+	}
+}
+
+func TestStageUpdateTemplates(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	m := &Manager{
+		StagingDir: filepath.Join(tmpDir, "staged"),
+		ActiveDir:  filepath.Join(tmpDir, "active"),
+		BackupDir:  filepath.Join(tmpDir, "backups"),
+		Render:     render.Options{Set: []string{"tag=1.26"}},
+	}
+
+	source := filepath.Join(tmpDir, "source")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		".leger.yaml":        "name: app\nvalues:\n  tag: \"1.25\"\n  port: 8080\n",
+		"app.container.tmpl": "[Container]\nImage=nginx:{{ .Values.tag }}\nPublishPort={{ .Values.port }}:80\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.StageUpdate(context.Background(), source, "app"); err != nil {
+		t.Fatalf("StageUpdate() failed: %v", err)
+	}
+
+	stagingPath := m.GetStagingPath("app")
+	data, err := os.ReadFile(filepath.Join(stagingPath, "app.container"))
+	if err != nil {
+		t.Fatalf("Template was not rendered: %v", err)
+	}
+	if want := "[Container]\nImage=nginx:1.26\nPublishPort=8080:80\n"; string(data) != want {
+		t.Errorf("Rendered quadlet: got %q, want %q", data, want)
+	}
+	if _, err := os.Stat(filepath.Join(stagingPath, "app.container.tmpl")); !os.IsNotExist(err) {
+		t.Errorf("Template was staged: %v", err)
+	}
+}
+
+func TestStageUpdateOverlay(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	m := &Manager{
+		StagingDir: filepath.Join(tmpDir, "staged"),
+		ActiveDir:  filepath.Join(tmpDir, "active"),
+		BackupDir:  filepath.Join(tmpDir, "backups"),
+		BaseDir:    filepath.Join(tmpDir, "base"),
+	}
+
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The active deployment has the overlay applied to nginx 1.25.
+	write(filepath.Join(m.GetBasePath("app"), "app.container"), "[Container]\nImage=nginx:1.25\n")
+	write(filepath.Join(m.GetActivePath("app"), "app.container"), "[Container]\nImage=nginx:1.25\nPublishPort=9090:80\n")
+
+	// Upstream moves to nginx 1.26.
+	source := filepath.Join(tmpDir, "source")
+	write(filepath.Join(source, "app.container"), "[Container]\nImage=nginx:1.26\n")
+
+	overlayDir := filepath.Join(tmpDir, "overlay")
+	write(filepath.Join(overlayDir, overlay.File), "patches:\n  - file: app.container\n    section: Container\n    set: {PublishPort: 9090:80}\n")
+	write(filepath.Join(overlayDir, "app.container.d", "host.conf"), "[Container]\nMemory=512m\n")
+	var err error
+	if m.Overlay, err = overlay.Load(overlayDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.StageUpdate(context.Background(), source, "app"); err != nil {
+		t.Fatalf("StageUpdate() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(m.GetStagingPath("app"), "app.container"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[Container]\nImage=nginx:1.26\nPublishPort=9090:80\n"; string(data) != want {
+		t.Errorf("Staged quadlet: got %q, want %q", data, want)
+	}
+	data, err = os.ReadFile(filepath.Join(m.GetStagedBasePath("app"), "app.container"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[Container]\nImage=nginx:1.26\n"; string(data) != want {
+		t.Errorf("Staged base: got %q, want %q", data, want)
+	}
+
+	diff, err := m.GenerateDiff("app")
+	if err != nil {
+		t.Fatalf("GenerateDiff() failed: %v", err)
+	}
+	if diff.Base == nil || diff.Overlay == nil {
+		t.Fatal("Expected base and overlay diffs")
+	}
+	if len(diff.Base.Modified) != 1 || len(diff.Base.Added) != 0 {
+		t.Errorf("Base diff: got %+v", diff.Base)
+	}
+	if len(diff.Overlay.Modified) != 1 || len(diff.Overlay.Added) != 1 || diff.Overlay.Added[0] != filepath.Join("app.container.d", "host.conf") {
+		t.Errorf("Overlay diff: got %+v", diff.Overlay)
+	}
+	if len(diff.Modified) != 1 || len(diff.Added) != 1 {
+		t.Errorf("Diff: got %+v", diff)
+	}
+
+	if err := m.promoteBase("app"); err != nil {
+		t.Fatalf("promoteBase() failed: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(m.GetBasePath("app"), "app.container"))
+	if err != nil || string(data) != "[Container]\nImage=nginx:1.26\n" {
+		t.Errorf("Active base: got %q, %v", data, err)
+	}
+	if _, err := os.Stat(m.GetStagedBasePath("app")); !os.IsNotExist(err) {
+		t.Errorf("Staged base was kept: %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+// Package state records the state of each deployment and a history of the
+// changes made to it, so that a host can report what is running and how it
+// got there.
+//
+// The state of all deployments is kept in a single JSON file, and the history
+// of each deployment in a separate file with one JSON event per line. History
+// outlives the deployment it describes, so that removals can be audited.
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/leger-labs/leger/internal/quadlet"
+	"github.com/leger-labs/leger/pkg/types"
+)
+
+// History actions.
+const (
+	ActionInstall  = "install"
+	ActionUpdate   = "update"
+	ActionApply    = "apply"
+	ActionRollback = "rollback"
+	ActionRestore  = "restore"
+	ActionRemove   = "remove"
+)
+
+const (
+	stateFileName  = "deployments.json"
+	historyDirName = "history"
+)
+
+// ErrNotFound is reported when there is no recorded state for a deployment.
+var ErrNotFound = errors.New("deployment not found")
+
+// Store persists deployment state and history under a directory.
+type Store struct {
+	Dir string
+}
+
+// NewStore creates a store in the default location, ~/.local/share/leger.
+func NewStore() (*Store, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return &Store{Dir: filepath.Join(homeDir, ".local", "share", "leger")}, nil
+}
+
+// List returns the state of all deployments, in order by name.
+func (s *Store) List() ([]types.DeploymentState, error) {
+	data, err := os.ReadFile(filepath.Join(s.Dir, stateFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read deployment state: %w", err)
+	}
+	var out []types.DeploymentState
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to parse deployment state: %w", err)
+	}
+	return out, nil
+}
+
+// Get returns the state of the named deployment, or an error wrapping
+// ErrNotFound if none is recorded.
+func (s *Store) Get(name string) (*types.DeploymentState, error) {
+	all, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		if all[i].Name == name {
+			return &all[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+}
+
+// Save records st as the state of the deployment st.Name, replacing any
+// previous state.
+func (s *Store) Save(st *types.DeploymentState) error {
+	if err := checkName(st.Name); err != nil {
+		return err
+	}
+	all, err := s.List()
+	if err != nil {
+		return err
+	}
+	all = slices.DeleteFunc(all, func(d types.DeploymentState) bool { return d.Name == st.Name })
+	all = append(all, *st)
+	slices.SortFunc(all, func(a, b types.DeploymentState) int { return strings.Compare(a.Name, b.Name) })
+	return s.write(all)
+}
+
+// Remove discards the state of the named deployment. Its history is kept.
+// It is not an error if no state is recorded.
+func (s *Store) Remove(name string) error {
+	all, err := s.List()
+	if err != nil {
+		return err
+	}
+	n := len(all)
+	all = slices.DeleteFunc(all, func(d types.DeploymentState) bool { return d.Name == name })
+	if len(all) == n {
+		return nil
+	}
+	return s.write(all)
+}
+
+func (s *Store) write(all []types.DeploymentState) error {
+	if all == nil {
+		all = []types.DeploymentState{}
+	}
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal deployment state: %w", err)
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	// Write a temporary file and rename it, so that readers never see a
+	// partially written state file.
+	path := filepath.Join(s.Dir, stateFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write deployment state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write deployment state: %w", err)
+	}
+	return nil
+}
+
+// Record appends an event to the history of the named deployment. If the
+// event has no timestamp, the current time is used.
+func (s *Store) Record(name string, event types.DeploymentHistory) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %w", err)
+	}
+
+	dir := filepath.Join(s.Dir, historyDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	f, err := os.OpenFile(s.historyPath(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return f.Close()
+}
+
+// History returns the history of the named deployment, oldest first.
+func (s *Store) History(name string) ([]types.DeploymentHistory, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.historyPath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open history: %w", err)
+	}
+	defer f.Close()
+
+	var out []types.DeploymentHistory
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var event types.DeploymentHistory
+		if err := json.Unmarshal(sc.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("failed to parse history: %w", err)
+		}
+		out = append(out, event)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return out, nil
+}
+
+func (s *Store) historyPath(name string) string {
+	return filepath.Join(s.Dir, historyDirName, name+".jsonl")
+}
+
+// checkName reports an error if name cannot be used as a deployment name.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid deployment name %q", name)
+	}
+	return nil
+}
+
+// Inspect fills in the services, volumes, and secrets of st from the quadlet
+// files installed in dir.
+func Inspect(st *types.DeploymentState, dir string) error {
+	// Volumes keep their creation time across updates.
+	created := make(map[string]time.Time)
+	for _, v := range st.Volumes {
+		created[v.Name] = v.CreatedAt
+	}
+	st.Services, st.Volumes, st.Secrets = nil, nil, nil
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".container", ".pod", ".kube", ".volume":
+		default:
+			return nil
+		}
+		qf, err := quadlet.ParseQuadletFile(path)
+		if err != nil {
+			return err
+		}
+		if qf.Type == "volume" {
+			name := strings.TrimSuffix(qf.Name, ".volume")
+			at, ok := created[name]
+			if !ok {
+				at = time.Now()
+			}
+			st.Volumes = append(st.Volumes, types.DeployedVolume{
+				Name:      name,
+				Driver:    qf.GetValue("Volume", "Driver"),
+				CreatedAt: at,
+			})
+			return nil
+		}
+		st.Services = append(st.Services, types.DeployedService{
+			Name:        strings.TrimSuffix(qf.Name, filepath.Ext(qf.Name)),
+			Type:        qf.Type,
+			QuadletPath: path,
+			ServiceName: qf.GetServiceName(),
+			Ports:       qf.GetPorts(),
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to inspect quadlets: %w", err)
+	}
+
+	pr, err := quadlet.ParseDirectory(dir)
+	if err != nil {
+		return fmt.Errorf("failed to parse quadlets: %w", err)
+	}
+	st.Secrets = pr.GetSecretNames()
+	slices.Sort(st.Secrets)
+	return nil
+}
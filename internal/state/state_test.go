@@ -0,0 +1,152 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/pkg/types"
+)
+
+func TestSaveGetRemove(t *testing.T) {
+	s := &Store{Dir: t.TempDir()}
+
+	// An empty store has no deployments.
+	if all, err := s.List(); err != nil || len(all) != 0 {
+		t.Fatalf("List on empty store: got %v, %v; want none", all, err)
+	}
+	if _, err := s.Get("web"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get missing: got %v, want ErrNotFound", err)
+	}
+
+	for _, name := range []string{"web", "db"} {
+		if err := s.Save(&types.DeploymentState{Name: name, Version: "v1"}); err != nil {
+			t.Fatalf("Save %s failed: %v", name, err)
+		}
+	}
+	if err := s.Save(&types.DeploymentState{Name: "web", Version: "v2"}); err != nil {
+		t.Fatalf("Save web failed: %v", err)
+	}
+
+	all, err := s.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(all) != 2 || all[0].Name != "db" || all[1].Name != "web" {
+		t.Fatalf("List: got %+v, want db and web in order", all)
+	}
+	if st, err := s.Get("web"); err != nil || st.Version != "v2" {
+		t.Errorf("Get web: got %+v, %v; want version v2", st, err)
+	}
+
+	if err := s.Remove("web"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := s.Remove("web"); err != nil {
+		t.Errorf("Remove of missing deployment failed: %v", err)
+	}
+	if _, err := s.Get("web"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Remove: got %v, want ErrNotFound", err)
+	}
+
+	for _, bad := range []string{"", ".", "..", "a/b", `a\b`} {
+		if err := s.Save(&types.DeploymentState{Name: bad}); err == nil {
+			t.Errorf("Save %q: expected error", bad)
+		}
+	}
+}
+
+func TestRecordHistory(t *testing.T) {
+	s := &Store{Dir: t.TempDir()}
+
+	if events, err := s.History("web"); err != nil || len(events) != 0 {
+		t.Fatalf("History with no events: got %v, %v; want none", events, err)
+	}
+
+	at := time.Date(2025, 10, 16, 12, 0, 0, 0, time.UTC)
+	events := []types.DeploymentHistory{
+		{Timestamp: at, Action: ActionInstall, Version: "abc", Success: true},
+		{Action: ActionUpdate, Version: "def", Message: "boom"},
+		{Action: ActionRemove, Success: true},
+	}
+	for _, ev := range events {
+		if err := s.Record("web", ev); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+
+	got, err := s.History("web")
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(got) != len(events) {
+		t.Fatalf("History: got %d events, want %d", len(got), len(events))
+	}
+	if !got[0].Timestamp.Equal(at) {
+		t.Errorf("Timestamp: got %v, want %v", got[0].Timestamp, at)
+	}
+	for i, ev := range got {
+		if ev.Timestamp.IsZero() {
+			t.Errorf("Event %d has no timestamp", i)
+		}
+		if ev.Action != events[i].Action || ev.Version != events[i].Version ||
+			ev.Success != events[i].Success || ev.Message != events[i].Message {
+			t.Errorf("Event %d: got %+v, want %+v", i, ev, events[i])
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"web.container": `[Container]
+Image=nginx:latest
+PublishPort=8080:80
+Secret=web-token,type=env,target=TOKEN
+Volume=web-data.volume:/data
+`,
+		"web-data.volume": `[Volume]
+Driver=local
+`,
+		"README.md": "not a quadlet\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := &types.DeploymentState{
+		Name:    "web",
+		Volumes: []types.DeployedVolume{{Name: "web-data", CreatedAt: created}},
+	}
+	if err := Inspect(st, dir); err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+
+	if len(st.Services) != 1 {
+		t.Fatalf("Services: got %+v, want one", st.Services)
+	}
+	svc := st.Services[0]
+	if svc.Name != "web" || svc.Type != "container" || svc.ServiceName != "web.service" {
+		t.Errorf("Service: got %+v", svc)
+	}
+	if !slices.Contains(svc.Ports, "8080:80") {
+		t.Errorf("Ports: got %v, want 8080:80", svc.Ports)
+	}
+
+	if len(st.Volumes) != 1 || st.Volumes[0].Name != "web-data" || st.Volumes[0].Driver != "local" {
+		t.Fatalf("Volumes: got %+v", st.Volumes)
+	}
+	if !st.Volumes[0].CreatedAt.Equal(created) {
+		t.Errorf("Volume CreatedAt: got %v, want %v", st.Volumes[0].CreatedAt, created)
+	}
+
+	if !slices.Equal(st.Secrets, []string{"web-token"}) {
+		t.Errorf("Secrets: got %v, want [web-token]", st.Secrets)
+	}
+}
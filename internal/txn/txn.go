@@ -0,0 +1,179 @@
+// Package txn runs operations made of several steps that each change the
+// host, so that a failure part way through can be undone.
+//
+// Each step is paired with a compensating action. As steps complete they are
+// written to a journal on disk, so that an operation which was interrupted or
+// deliberately left incomplete can be inspected afterwards. Rolling back runs
+// the compensating actions of the completed steps in reverse order.
+package txn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Journal statuses.
+const (
+	StatusRunning = "running"
+	StatusFailed  = "failed"
+)
+
+// A Step is one unit of work in a transaction.
+type Step struct {
+	// Name describes the step in the journal and in error messages.
+	Name string
+
+	// Do performs the step.
+	Do func(ctx context.Context) error
+
+	// Undo reverses the effects of Do. It is also called if Do fails, so it
+	// must cope with a step that only partly completed. It may be nil if the
+	// step has nothing to undo.
+	Undo func(ctx context.Context) error
+}
+
+// Journal is the on-disk record of a transaction.
+type Journal struct {
+	Name      string         `json:"name"`
+	Status    string         `json:"status"`
+	StartedAt time.Time      `json:"started_at"`
+	Steps     []JournalEntry `json:"steps"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// JournalEntry records a completed step.
+type JournalEntry struct {
+	Name        string    `json:"name"`
+	CompletedAt time.Time `json:"completed_at"`
+	Undone      bool      `json:"undone,omitempty"`
+	UndoError   string    `json:"undo_error,omitempty"`
+}
+
+// Transaction runs steps and keeps a journal of those that completed.
+type Transaction struct {
+	path    string
+	journal Journal
+	done    []Step
+}
+
+// Begin starts a transaction named name whose journal is written to path.
+func Begin(name, path string) (*Transaction, error) {
+	t := &Transaction{
+		path: path,
+		journal: Journal{
+			Name:      name,
+			Status:    StatusRunning,
+			StartedAt: time.Now(),
+			Steps:     []JournalEntry{},
+		},
+	}
+	if err := t.save(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// JournalPath returns the location of the journal.
+func (t *Transaction) JournalPath() string { return t.path }
+
+// Run performs step. If it succeeds, the step is added to the journal and
+// will be undone by Rollback. If it fails, its Undo is called at once to
+// clear away any partial effects, and the step is not recorded.
+func (t *Transaction) Run(ctx context.Context, step Step) error {
+	if err := step.Do(ctx); err != nil {
+		if step.Undo != nil {
+			if uerr := step.Undo(ctx); uerr != nil {
+				return errors.Join(err, fmt.Errorf("undo %s: %w", step.Name, uerr))
+			}
+		}
+		return err
+	}
+	t.done = append(t.done, step)
+	t.journal.Steps = append(t.journal.Steps, JournalEntry{
+		Name:        step.Name,
+		CompletedAt: time.Now(),
+	})
+	return t.save()
+}
+
+// Commit completes the transaction and discards its journal.
+func (t *Transaction) Commit() error {
+	t.done = nil
+	if err := os.Remove(t.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	return nil
+}
+
+// Abandon marks the transaction as failed with cause and leaves the completed
+// steps in place. The journal is kept for inspection.
+func (t *Transaction) Abandon(cause error) error {
+	t.journal.Status = StatusFailed
+	t.journal.Error = cause.Error()
+	return t.save()
+}
+
+// Rollback undoes the completed steps in reverse order, recording cause as
+// the reason. Every compensating action is attempted even if an earlier one
+// fails. If all succeed, the journal is discarded; otherwise it is kept and
+// the errors are reported.
+func (t *Transaction) Rollback(ctx context.Context, cause error) error {
+	t.journal.Error = cause.Error()
+
+	var errs []error
+	for i := len(t.done) - 1; i >= 0; i-- {
+		step := t.done[i]
+		entry := &t.journal.Steps[i]
+		if step.Undo != nil {
+			if err := step.Undo(ctx); err != nil {
+				entry.UndoError = err.Error()
+				errs = append(errs, fmt.Errorf("undo %s: %w", step.Name, err))
+				continue
+			}
+		}
+		entry.Undone = true
+	}
+	t.done = nil
+
+	if len(errs) == 0 {
+		return t.Commit()
+	}
+	t.journal.Status = StatusFailed
+	if err := t.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// save writes the journal to disk.
+func (t *Transaction) save() error {
+	data, err := json.MarshalIndent(t.journal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	if err := os.WriteFile(t.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+// Load reads the journal at path.
+func Load(path string) (*Journal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var j Journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("failed to parse journal: %w", err)
+	}
+	return &j, nil
+}
@@ -0,0 +1,153 @@
+package txn
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// recorder builds steps that log what they do.
+type recorder struct {
+	log []string
+}
+
+func (r *recorder) step(name string, fail, failUndo bool) Step {
+	return Step{
+		Name: name,
+		Do: func(context.Context) error {
+			r.log = append(r.log, "do "+name)
+			if fail {
+				return errors.New(name + " failed")
+			}
+			return nil
+		},
+		Undo: func(context.Context) error {
+			r.log = append(r.log, "undo "+name)
+			if failUndo {
+				return errors.New(name + " undo failed")
+			}
+			return nil
+		},
+	}
+}
+
+func TestCommit(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal", "web.json")
+
+	tx, err := Begin("install web", path)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	var r recorder
+	for _, name := range []string{"a", "b"} {
+		if err := tx.Run(ctx, r.step(name, false, false)); err != nil {
+			t.Fatalf("Run %s failed: %v", name, err)
+		}
+	}
+
+	j, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if j.Status != StatusRunning || len(j.Steps) != 2 || j.Steps[1].Name != "b" {
+		t.Errorf("Journal: got %+v, want two running steps", j)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Journal still exists after Commit: %v", err)
+	}
+	if want := []string{"do a", "do b"}; !slices.Equal(r.log, want) {
+		t.Errorf("Log: got %v, want %v", r.log, want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "web.json")
+
+	tx, err := Begin("install web", path)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	var r recorder
+	tx.Run(ctx, r.step("a", false, false))
+	tx.Run(ctx, r.step("b", false, false))
+	cause := tx.Run(ctx, r.step("c", true, false))
+	if cause == nil {
+		t.Fatal("Run c: expected error")
+	}
+	if err := tx.Rollback(ctx, cause); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	// The failed step cleans up after itself; the others are undone in
+	// reverse order.
+	want := []string{"do a", "do b", "do c", "undo c", "undo b", "undo a"}
+	if !slices.Equal(r.log, want) {
+		t.Errorf("Log: got %v, want %v", r.log, want)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Journal still exists after Rollback: %v", err)
+	}
+}
+
+func TestRollbackIncomplete(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "web.json")
+
+	tx, err := Begin("install web", path)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	var r recorder
+	tx.Run(ctx, r.step("a", false, false))
+	tx.Run(ctx, r.step("b", false, true))
+	if err := tx.Rollback(ctx, errors.New("boom")); err == nil {
+		t.Fatal("Rollback: expected error")
+	}
+	if want := []string{"do a", "do b", "undo b", "undo a"}; !slices.Equal(r.log, want) {
+		t.Errorf("Log: got %v, want %v", r.log, want)
+	}
+
+	j, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if j.Status != StatusFailed || j.Error != "boom" {
+		t.Errorf("Journal: got status %q error %q", j.Status, j.Error)
+	}
+	if !j.Steps[0].Undone || j.Steps[1].Undone || j.Steps[1].UndoError == "" {
+		t.Errorf("Journal steps: got %+v", j.Steps)
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web.json")
+
+	tx, err := Begin("install web", path)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	var r recorder
+	tx.Run(context.Background(), r.step("a", false, false))
+	if err := tx.Abandon(errors.New("boom")); err != nil {
+		t.Fatalf("Abandon failed: %v", err)
+	}
+	if want := []string{"do a"}; !slices.Equal(r.log, want) {
+		t.Errorf("Log: got %v, want %v", r.log, want)
+	}
+	j, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if j.Status != StatusFailed || len(j.Steps) != 1 || j.Steps[0].Undone {
+		t.Errorf("Journal: got %+v", j)
+	}
+}
@@ -0,0 +1,265 @@
+// Package watch decides when deployments are updated automatically.
+//
+// Each deployment has a policy: never update it, update it to new patch
+// releases only, or always update it. Updates may be restricted to
+// maintenance windows. The watcher that fetches sources and applies updates
+// is in the CLI; this package holds the rules it follows.
+package watch
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leger-labs/leger/internal/config"
+)
+
+// Policies.
+const (
+	PolicyNever     = "never"
+	PolicyPatchOnly = "patch-only"
+	PolicyAlways    = "always"
+)
+
+// Defaults used when the configuration leaves them unset.
+const (
+	DefaultInterval      = 5 * time.Minute
+	DefaultHealthTimeout = 2 * time.Minute
+)
+
+// Rule is how a deployment is updated.
+type Rule struct {
+	Policy  string
+	Windows []Window // Empty means at any time
+}
+
+// Rules are the rules of all deployments.
+type Rules struct {
+	Interval      time.Duration
+	HealthTimeout time.Duration
+
+	def         Rule
+	deployments map[string]Rule
+}
+
+// NewRules returns the rules in the watch section of the configuration.
+// Deployments not listed there follow its default policy, which is never.
+func NewRules(cfg *config.WatchConfig) (*Rules, error) {
+	r := &Rules{
+		Interval:      cfg.Interval,
+		HealthTimeout: cfg.HealthTimeout,
+		deployments:   make(map[string]Rule),
+	}
+	if r.Interval <= 0 {
+		r.Interval = DefaultInterval
+	}
+	if r.HealthTimeout <= 0 {
+		r.HealthTimeout = DefaultHealthTimeout
+	}
+
+	var err error
+	if r.def, err = newRule(cfg.WatchPolicy, Rule{Policy: PolicyNever}); err != nil {
+		return nil, fmt.Errorf("watch: %w", err)
+	}
+	for name, p := range cfg.Deployments {
+		if r.deployments[name], err = newRule(p, r.def); err != nil {
+			return nil, fmt.Errorf("watch: deployments.%s: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+// newRule returns the rule p configures, with unset fields taken from def.
+func newRule(p config.WatchPolicy, def Rule) (Rule, error) {
+	r := def
+	switch p.Policy {
+	case "":
+	case PolicyNever, PolicyPatchOnly, PolicyAlways:
+		r.Policy = p.Policy
+	default:
+		return Rule{}, fmt.Errorf("invalid policy %q (want %s, %s or %s)", p.Policy, PolicyNever, PolicyPatchOnly, PolicyAlways)
+	}
+	if p.Windows != nil {
+		r.Windows = nil
+		for _, s := range p.Windows {
+			w, err := ParseWindow(s)
+			if err != nil {
+				return Rule{}, err
+			}
+			r.Windows = append(r.Windows, w)
+		}
+	}
+	return r, nil
+}
+
+// For returns the rule of the named deployment.
+func (r *Rules) For(name string) Rule {
+	if rule, ok := r.deployments[name]; ok {
+		return rule
+	}
+	return r.def
+}
+
+// InWindow reports whether t is in one of the rule's maintenance windows,
+// or the rule has none.
+func (r Rule) InWindow(t time.Time) bool {
+	if len(r.Windows) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.Windows, func(w Window) bool { return w.Contains(t) })
+}
+
+// Window is a weekly maintenance window, in local time.
+type Window struct {
+	Days       [7]bool // Indexed by time.Weekday; the days the window starts on
+	Start, End int     // Minutes after midnight; End <= Start crosses midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWindow parses a window such as "02:00-04:00" (daily),
+// "Mon-Fri 22:00-02:00" or "Sat,Sun 00:00-06:00".
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	var days, hours string
+	switch len(fields) {
+	case 1:
+		days, hours = "mon-sun", fields[0]
+	case 2:
+		days, hours = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("invalid window %q: expected [days] HH:MM-HH:MM", s)
+	}
+
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok1 := weekdays[from]
+		last, ok2 := weekdays[to]
+		if !isRange {
+			last, ok2 = first, ok1
+		}
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("invalid window %q: unknown days %q", s, part)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(hours, "-")
+	var err error
+	if !ok {
+		return w, fmt.Errorf("invalid window %q: expected HH:MM-HH:MM", s)
+	}
+	if w.Start, err = parseClock(start); err != nil {
+		return w, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return w, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM, or 24:00, into minutes after midnight.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 ||
+		hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Contains reports whether t is in the window.
+func (w Window) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.End > w.Start {
+		return w.Days[day] && minute >= w.Start && minute < w.End
+	}
+	// The window crosses midnight: it is either in the part after the start
+	// today, or in the part before the end of a window that started
+	// yesterday.
+	yesterday := (day + 6) % 7
+	return (w.Days[day] && minute >= w.Start) || (w.Days[yesterday] && minute < w.End)
+}
+
+// version is a release version parsed from a tag such as v1.2.3.
+type version struct {
+	prefix              string
+	major, minor, patch int
+}
+
+// parseVersion parses a tag of the form [v]MAJOR.MINOR.PATCH. Pre-releases
+// and other tags are not versions.
+func parseVersion(tag string) (version, bool) {
+	var v version
+	rest := tag
+	if strings.HasPrefix(rest, "v") {
+		v.prefix, rest = "v", rest[1:]
+	}
+	parts := strings.Split(rest, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || p == "" || (len(p) > 1 && p[0] == '0') {
+			return v, false
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+func (v version) compare(o version) int {
+	if c := v.major - o.major; c != 0 {
+		return c
+	}
+	if c := v.minor - o.minor; c != 0 {
+		return c
+	}
+	return v.patch - o.patch
+}
+
+// IsVersion reports whether tag is a release version, such as v1.2.3.
+func IsVersion(tag string) bool {
+	_, ok := parseVersion(tag)
+	return ok
+}
+
+// NextTag returns the tag to update a source pinned to current to under
+// policy: the highest release version in tags above current, with the same
+// major and minor version for patch-only. It returns false if there is none,
+// or current is not a release version.
+func NextTag(current string, tags []string, policy string) (string, bool) {
+	cur, ok := parseVersion(current)
+	if !ok || policy == PolicyNever {
+		return "", false
+	}
+	best, bestTag := cur, ""
+	for _, tag := range tags {
+		v, ok := parseVersion(tag)
+		if !ok || v.prefix != cur.prefix || v.compare(best) <= 0 {
+			continue
+		}
+		if policy == PolicyPatchOnly && (v.major != cur.major || v.minor != cur.minor) {
+			continue
+		}
+		best, bestTag = v, tag
+	}
+	return bestTag, bestTag != ""
+}
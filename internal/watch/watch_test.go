@@ -0,0 +1,123 @@
+package watch
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/internal/config"
+)
+
+func TestNewRules(t *testing.T) {
+	r, err := NewRules(&config.WatchConfig{
+		WatchPolicy: config.WatchPolicy{Policy: PolicyPatchOnly, Windows: []string{"02:00-04:00"}},
+		Deployments: map[string]config.WatchPolicy{
+			"web":  {Policy: PolicyAlways},
+			"db":   {Windows: []string{}},
+			"jobs": {Policy: PolicyNever},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRules failed: %v", err)
+	}
+	if r.Interval != DefaultInterval || r.HealthTimeout != DefaultHealthTimeout {
+		t.Errorf("Defaults: got %v, %v", r.Interval, r.HealthTimeout)
+	}
+
+	tests := []struct {
+		name    string
+		policy  string
+		windows int
+	}{
+		{"web", PolicyAlways, 1},
+		{"db", PolicyPatchOnly, 0},
+		{"jobs", PolicyNever, 1},
+		{"other", PolicyPatchOnly, 1},
+	}
+	for _, tc := range tests {
+		if rule := r.For(tc.name); rule.Policy != tc.policy || len(rule.Windows) != tc.windows {
+			t.Errorf("For(%s): got %+v, want %s with %d windows", tc.name, rule, tc.policy, tc.windows)
+		}
+	}
+
+	if r, err := NewRules(&config.WatchConfig{}); err != nil || r.For("any").Policy != PolicyNever {
+		t.Errorf("Default policy: got %v, %v", r, err)
+	}
+	for _, cfg := range []*config.WatchConfig{
+		{WatchPolicy: config.WatchPolicy{Policy: "sometimes"}},
+		{Deployments: map[string]config.WatchPolicy{"web": {Windows: []string{"2am"}}}},
+	} {
+		if _, err := NewRules(cfg); err == nil {
+			t.Errorf("NewRules(%+v): expected error", cfg)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	// 2024-10-14 is a Monday.
+	at := func(day int, clock string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", fmt.Sprintf("2024-10-%02d %s", day, clock), time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"02:00-04:00", at(16, "02:00"), true},
+		{"02:00-04:00", at(16, "04:00"), false},
+		{"Mon-Fri 02:00-04:00", at(19, "03:00"), false}, // Saturday
+		{"Mon-Fri 02:00-04:00", at(18, "03:00"), true},
+		{"Sat,Sun 00:00-24:00", at(20, "23:59"), true},
+		{"Fri-Mon 12:00-13:00", at(14, "12:30"), true},
+		{"Fri-Mon 12:00-13:00", at(15, "12:30"), false},
+		// Crossing midnight: Friday 22:00 to Saturday 02:00.
+		{"Fri 22:00-02:00", at(18, "23:00"), true},
+		{"Fri 22:00-02:00", at(19, "01:00"), true},
+		{"Fri 22:00-02:00", at(19, "23:00"), false},
+		{"Fri 22:00-02:00", at(18, "01:00"), false},
+	}
+	for _, tc := range tests {
+		w, err := ParseWindow(tc.window)
+		if err != nil {
+			t.Fatalf("ParseWindow(%q) failed: %v", tc.window, err)
+		}
+		if got := w.Contains(tc.t); got != tc.want {
+			t.Errorf("%q contains %s: got %v, want %v", tc.window, tc.t.Format("Mon 15:04"), got, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "Mon", "Mon 02:00", "Funday 02:00-04:00", "25:00-26:00", "02:60-03:00", "Mon Tue 02:00-03:00"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("ParseWindow(%q): expected error", s)
+		}
+	}
+}
+
+func TestNextTag(t *testing.T) {
+	tags := []string{"v1.2.0", "v1.2.1", "v1.2.10", "v1.3.0", "v2.0.0", "v1.2.11-rc1", "1.2.12", "latest"}
+
+	tests := []struct {
+		current string
+		policy  string
+		want    string
+	}{
+		{"v1.2.0", PolicyPatchOnly, "v1.2.10"},
+		{"v1.2.0", PolicyAlways, "v2.0.0"},
+		{"v1.2.0", PolicyNever, ""},
+		{"v1.3.0", PolicyPatchOnly, ""},
+		{"v2.0.0", PolicyAlways, ""},
+		{"main", PolicyAlways, ""},
+		{"1.2.0", PolicyPatchOnly, "1.2.12"},
+	}
+	for _, tc := range tests {
+		got, ok := NextTag(tc.current, tags, tc.policy)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("NextTag(%s, %s): got %q, %v, want %q", tc.current, tc.policy, got, ok, tc.want)
+		}
+	}
+}
@@ -14,6 +14,18 @@ type DeploymentState struct {
 	Volumes     []DeployedVolume  `json:"volumes,omitempty"`
 	Secrets     []string          `json:"secrets,omitempty"`
 	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	// Options are what the deployment was installed with, so that updates
+	// render and overlay its quadlets the same way.
+	Options *DeploymentOptions `json:"options,omitempty"`
+}
+
+// DeploymentOptions are the options a deployment's quadlets are rendered and
+// overlaid with. Paths are absolute.
+type DeploymentOptions struct {
+	Values  []string `json:"values,omitempty"`  // values files, applied in order
+	Set     []string `json:"set,omitempty"`     // key=value assignments
+	Overlay string   `json:"overlay,omitempty"` // overlay directory, if not the default
 }
 
 // DeployedService represents a deployed service
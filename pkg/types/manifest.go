@@ -22,6 +22,10 @@ type Manifest struct {
 	Volumes     []VolumeDefinition  `json:"volumes,omitempty" yaml:"volumes,omitempty"`
 	Networks    []NetworkDefinition `json:"networks,omitempty" yaml:"networks,omitempty"`
 	Secrets     []SecretDefinition  `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+
+	// Values are the default values for rendering templates, which hosts
+	// may override. They must not hold secrets.
+	Values map[string]any `json:"values,omitempty" yaml:"values,omitempty"`
 }
 
 // ServiceDefinition defines a service in the manifest
@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// accessFlushInterval is how often the server saves the record of when each
+// secret version was last accessed.
+const accessFlushInterval = time.Minute
+
+func (s *Server) periodicFlushAccess(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(accessFlushInterval):
+		case <-ctx.Done():
+			return
+		}
+		if err := s.db.FlushAccess(); err != nil {
+			log.Printf("Failed to save access times: %v", err)
+		}
+	}
+}
+
+// FlushAccess saves the record of when each secret version was last accessed.
+// The server does this periodically while running; the caller should also call
+// FlushAccess when shutting down the server, so that recent accesses are not
+// lost.
+func (s *Server) FlushAccess() error { return s.db.FlushAccess() }
@@ -0,0 +1,364 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/audit"
+	"github.com/leger-labs/leger/ca"
+	"github.com/leger-labs/leger/db"
+	"github.com/leger-labs/leger/types/api"
+)
+
+// certCheckInterval is how often the server checks whether any certificate
+// secrets are due for renewal.
+const certCheckInterval = 5 * time.Minute
+
+// certIssuer is the principal recorded in audit logs for certificates issued
+// by the server itself.
+var certIssuer = audit.Principal{User: "legerd/ca"}
+
+// issuerCaller returns a caller for the server's certificate issuer, with
+// permission to put and activate the specified secrets.
+func issuerCaller(names ...string) db.Caller {
+	rule := acl.Rule{Action: []acl.Action{acl.ActionPut, acl.ActionActivate}}
+	for _, name := range names {
+		rule.Secret = append(rule.Secret, acl.Secret(name))
+	}
+	return db.Caller{Principal: certIssuer, Permissions: acl.Rules{rule}}
+}
+
+// periodicRenewCerts reissues certificate secrets that are due for renewal,
+// until ctx ends.
+func (s *Server) periodicRenewCerts(ctx context.Context) {
+	for {
+		if err := s.renewCerts(time.Now()); err != nil {
+			log.Printf("Renewing certificates: %v", err)
+		}
+		select {
+		case <-time.After(certCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// renewCerts reissues all the certificate secrets that are due for renewal
+// as of now.
+func (s *Server) renewCerts(now time.Time) error {
+	var errs []error
+	for _, cfgName := range s.db.NamesWithPrefix(db.CertConfigPrefix) {
+		name := strings.TrimPrefix(cfgName, db.CertConfigPrefix)
+		if _, err := s.issueCert(name, false, now); err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// issueCert issues a new certificate for the certificate secret called name,
+// stores it as a new active version of the secret, and records it in the
+// registry of its authority. Unless force is true, it does nothing if the
+// active version does not need renewal. It returns the version of the secret
+// holding the new certificate, or 0 if none was issued.
+func (s *Server) issueCert(name string, force bool, now time.Time) (api.SecretVersion, error) {
+	s.certMu.Lock()
+	defer s.certMu.Unlock()
+
+	cfgVal, err := s.db.Peek(db.CertConfigPrefix + name)
+	if err != nil {
+		return 0, fmt.Errorf("certificate config: %w", err)
+	}
+	cfg, err := ca.ParseCertConfig(cfgVal.Value)
+	if err != nil {
+		return 0, err
+	}
+	reg, err := s.registry(cfg.CA)
+	if err != nil {
+		return 0, err
+	}
+
+	if !force {
+		cur, err := s.db.Peek(name)
+		if err == nil && !ca.NeedsRenewal(cur.Value, cfg, now) {
+			// Reissue a revoked certificate even if it is otherwise fresh.
+			if c := reg.Find(name, cur.Version); c == nil || c.RevokedAt == nil {
+				return 0, nil
+			}
+		} else if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return 0, err
+		}
+	}
+
+	caVal, err := s.db.Peek(db.CAPrefix + cfg.CA)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, fmt.Errorf("unknown CA %q", cfg.CA)
+	} else if err != nil {
+		return 0, err
+	}
+	auth, err := ca.ParseAuthority(caVal.Value)
+	if err != nil {
+		return 0, fmt.Errorf("CA %q: %w", cfg.CA, err)
+	}
+	value, cert, err := auth.Issue(cfg, now)
+	if err != nil {
+		return 0, err
+	}
+
+	regName := db.CARegistryPrefix + cfg.CA
+	caller := issuerCaller(name)
+	ver, err := s.db.Put(caller, name, value)
+	if err != nil {
+		return 0, err
+	}
+	reg.Prune(now)
+	reg.Certs = append(reg.Certs, &ca.IssuedCert{
+		Serial:   ca.SerialString(cert.SerialNumber),
+		Secret:   name,
+		Version:  ver,
+		NotAfter: cert.NotAfter,
+	})
+	if err := s.putRegistry(regName, reg); err != nil {
+		return 0, err
+	}
+	if err := s.db.Activate(caller, name, ver); err != nil {
+		return 0, err
+	}
+	log.Printf("Issued certificate %s for %q (version %v), valid until %v",
+		ca.SerialString(cert.SerialNumber), name, ver, cert.NotAfter.Format(time.RFC3339))
+	return ver, nil
+}
+
+// registry returns the certificate registry for the named authority.
+func (s *Server) registry(caName string) (*ca.Registry, error) {
+	sv, err := s.db.Peek(db.CARegistryPrefix + caName)
+	if errors.Is(err, db.ErrNotFound) {
+		return new(ca.Registry), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ca.ParseRegistry(sv.Value)
+}
+
+// putRegistry stores reg as the new active version of the registry secret
+// called regName, and deletes the version it replaces.
+func (s *Server) putRegistry(regName string, reg *ca.Registry) error {
+	caller := db.Caller{Principal: certIssuer, Permissions: acl.Rules{{
+		Action: []acl.Action{acl.ActionPut, acl.ActionActivate, acl.ActionDelete},
+		Secret: []acl.Secret{acl.Secret(regName)},
+	}}}
+
+	var prev api.SecretVersion
+	if sv, err := s.db.Peek(regName); err == nil {
+		prev = sv.Version
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	ver, err := s.db.Put(caller, regName, reg.Encode())
+	if err != nil {
+		return fmt.Errorf("updating registry: %w", err)
+	}
+	if err := s.db.Activate(caller, regName, ver); err != nil {
+		return err
+	}
+	// Only the active version is ever read, and each version holds every
+	// certificate issued, so keep just that one.
+	if prev != 0 && prev != ver {
+		if err := s.db.DeleteVersion(caller, regName, prev); err != nil {
+			return fmt.Errorf("deleting old registry version: %w", err)
+		}
+	}
+	return nil
+}
+
+// certAuthority returns the name of the authority for the certificate secret
+// called name.
+func (s *Server) certAuthority(name string) (string, error) {
+	sv, err := s.db.Peek(db.CertConfigPrefix + name)
+	if err != nil {
+		return "", err
+	}
+	cfg, err := ca.ParseCertConfig(sv.Value)
+	if err != nil {
+		return "", err
+	}
+	return cfg.CA, nil
+}
+
+// authorizeCA verifies that caller may have certificates issued by the
+// authority called caName. Since a certificate config can name any DNS names
+// and addresses, the caller needs "info" access to the authority's secret
+// through a rule that names it explicitly; broad rules such as "*" do not
+// suffice.
+func (s *Server) authorizeCA(caller db.Caller, caName string) error {
+	return s.db.AuthorizeExplicit(caller, acl.ActionInfo, db.CAPrefix+caName, 0)
+}
+
+// authorizeCertConfig verifies that caller may store the certificate config
+// encoded in value, which requires access to the authority it names.
+func (s *Server) authorizeCertConfig(caller db.Caller, value []byte) error {
+	cfg, err := ca.ParseCertConfig(value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", db.ErrInvalidConfig, err)
+	}
+	return s.authorizeCA(caller, cfg.CA)
+}
+
+func (s *Server) issueCertAPI(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.IssueCertRequest, id db.Caller) (api.SecretVersion, error) {
+		// The caller needs the same access it would need to put and activate
+		// a new version of the secret by hand, and access to its authority.
+		if err := s.db.Authorize(id, acl.ActionPut, req.Name, 0); err != nil {
+			return 0, err
+		}
+		if err := s.db.Authorize(id, acl.ActionActivate, req.Name, 0); err != nil {
+			return 0, err
+		}
+		caName, err := s.certAuthority(req.Name)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.authorizeCA(id, caName); err != nil {
+			return 0, err
+		}
+		return s.issueCert(req.Name, true, time.Now())
+	})
+}
+
+func (s *Server) certStatus(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.CertStatusRequest, id db.Caller) (*api.CertStatus, error) {
+		now := time.Now()
+		if req.Serial != "" {
+			// Revocation status is public, like a CRL, so any caller may
+			// query it by serial number.
+			reg, err := s.registry(req.CA)
+			if err != nil {
+				return nil, err
+			}
+			st := reg.Status(strings.ToLower(req.Serial), now)
+			st.Secret, st.Version = "", 0 // not public
+			return st, nil
+		}
+		if err := s.db.Authorize(id, acl.ActionInfo, req.Name, req.Version); err != nil {
+			return nil, err
+		}
+		caName, err := s.certAuthority(req.Name)
+		if err != nil {
+			return nil, err
+		}
+		ver := req.Version
+		if ver == 0 {
+			sv, err := s.db.Peek(req.Name)
+			if err != nil {
+				return nil, err
+			}
+			ver = sv.Version
+		}
+		reg, err := s.registry(caName)
+		if err != nil {
+			return nil, err
+		}
+		c := reg.Find(req.Name, ver)
+		if c == nil {
+			return nil, db.ErrNotFound
+		}
+		return reg.Status(c.Serial, now), nil
+	})
+}
+
+func (s *Server) revokeCert(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.RevokeCertRequest, id db.Caller) (struct{}, error) {
+		if err := s.db.Authorize(id, acl.ActionDelete, req.Name, req.Version); err != nil {
+			return struct{}{}, err
+		}
+		caName, err := s.certAuthority(req.Name)
+		if err != nil {
+			return struct{}{}, err
+		}
+
+		now := time.Now().UTC()
+		s.certMu.Lock()
+		reg, err := s.registry(caName)
+		if err != nil {
+			s.certMu.Unlock()
+			return struct{}{}, err
+		}
+		c := reg.Find(req.Name, req.Version)
+		if c == nil {
+			s.certMu.Unlock()
+			return struct{}{}, db.ErrNotFound
+		}
+		if c.RevokedAt == nil {
+			c.RevokedAt = &now
+			regName := db.CARegistryPrefix + caName
+			if err := s.putRegistry(regName, reg); err != nil {
+				s.certMu.Unlock()
+				return struct{}{}, err
+			}
+		}
+		s.certMu.Unlock()
+
+		// If the revoked certificate is the active one, replace it now.
+		if _, err := s.issueCert(req.Name, false, now); err != nil {
+			log.Printf("Reissuing revoked certificate for %q: %v", req.Name, err)
+		}
+		return struct{}{}, nil
+	})
+}
+
+// serveCA serves the certificate and CRL of an authority, at /ca/<name>/cert
+// and /ca/<name>/crl respectively. These are public, since they are needed by
+// anyone who verifies certificates issued by the authority.
+func (s *Server) serveCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "invalid method", http.StatusBadRequest)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/ca/")
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	caName, what := rest[:i], rest[i+1:]
+	caVal, err := s.db.Peek(db.CAPrefix + caName)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	auth, err := ca.ParseAuthority(caVal.Value)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	switch what {
+	case "cert":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(auth.CertPEM())
+	case "crl":
+		reg, err := s.registry(caName)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		crl, err := auth.CRL(reg, time.Now())
+		if err != nil {
+			log.Printf("Generating CRL for %q: %v", caName, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(crl)
+	default:
+		http.NotFound(w, r)
+	}
+}
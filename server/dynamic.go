@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/db"
+	"github.com/leger-labs/leger/dynamic"
+	"github.com/leger-labs/leger/types/api"
+)
+
+// leasePath returns the path of the lease file for the database at dbPath.
+func leasePath(dbPath string) string { return dbPath + ".leases" }
+
+// dynamicConfig looks up the configuration of a dynamic secret, for use by a
+// dynamic.Manager.
+func (s *Server) dynamicConfig(name string) (*api.SecretValue, error) {
+	sv, err := s.db.DynamicConfig(name)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, api.ErrNotFound
+	}
+	return sv, err
+}
+
+// getDynamic issues a credential for a dynamic secret.
+func (s *Server) getDynamic(req api.GetRequest, id db.Caller) (*api.SecretValue, error) {
+	// As with GetConditional, only log an access if a new credential is
+	// issued, but log a refusal regardless. The refusal comes first, so that
+	// callers cannot tell which secrets are dynamic.
+	if !id.Permissions.Allow(acl.ActionGet, req.Name) {
+		return nil, s.db.Authorize(id, acl.ActionGet, req.Name, 0)
+	}
+	if req.Version != 0 && !req.UpdateIfChanged {
+		// Each version of a dynamic secret is a distinct credential, which is
+		// delivered only once.
+		return nil, db.ErrNotFound
+	}
+	ctx := id.Context
+	sv, err := s.dynamic.Issue(ctx, req.Name, id.Principal, req.Version, req.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Authorize(id, acl.ActionGet, req.Name, sv.Version); err != nil {
+		s.revokeIssued(ctx, req.Name, sv.Version)
+		return nil, err
+	}
+	return sv, nil
+}
+
+// revokeIssued revokes a credential that was issued but could not be
+// delivered to the caller.
+func (s *Server) revokeIssued(ctx context.Context, name string, serial api.SecretVersion) {
+	for _, l := range s.dynamic.Leases() {
+		if l.Secret == name && l.Serial == serial {
+			if err := s.dynamic.Revoke(ctx, l.ID); err != nil {
+				log.Printf("Failed to revoke undelivered lease %s: %v", l.ID, err)
+			}
+		}
+	}
+}
+
+func (s *Server) renewLease(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.RenewLeaseRequest, id db.Caller) (*api.LeaseInfo, error) {
+		lease, err := s.dynamic.Lookup(req.LeaseID)
+		if err != nil {
+			return nil, err
+		}
+		// Only the holder of a lease can renew it.
+		if !lease.HeldBy(id.Principal) {
+			id.Permissions = nil
+		}
+		if err := s.db.Authorize(id, acl.ActionGet, lease.Secret, lease.Serial); err != nil {
+			return nil, err
+		}
+		return s.dynamic.Renew(id.Context, req.LeaseID, req.TTL)
+	})
+}
+
+func (s *Server) revokeLease(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.RevokeLeaseRequest, id db.Caller) (struct{}, error) {
+		lease, err := s.dynamic.Lookup(req.LeaseID)
+		if err != nil {
+			return struct{}{}, err
+		}
+		// The holder of a lease can give it up; anyone else needs permission
+		// to delete the secret.
+		action := acl.ActionDelete
+		if lease.HeldBy(id.Principal) {
+			action = acl.ActionGet
+		}
+		if err := s.db.Authorize(id, action, lease.Secret, lease.Serial); err != nil {
+			return struct{}{}, err
+		}
+		return struct{}{}, s.dynamic.Revoke(id.Context, req.LeaseID)
+	})
+}
+
+// isBadRequest reports whether err is due to an invalid request, which
+// should be reported to the caller.
+func isBadRequest(err error) bool {
+	return errors.Is(err, db.ErrInvalidConfig) || errors.Is(err, dynamic.ErrNotRenewable)
+}
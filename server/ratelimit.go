@@ -0,0 +1,235 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/audit"
+)
+
+// RateLimit configures per-principal rate limits for API calls, and a
+// temporary lockout for principals that are repeatedly denied access.
+//
+// Rate limits are enforced separately for each combination of caller and API
+// method, using a token bucket. A caller that exceeds its limit, or that is
+// locked out, receives a 429 Too Many Requests response with a Retry-After
+// header indicating when it may try again.
+type RateLimit struct {
+	// Default is the limit applied to API methods that do not have an entry
+	// in Methods. If Default.Rate is zero, those methods are not limited.
+	Default Limit
+
+	// Methods optionally overrides the limit for individual API methods,
+	// keyed by request path (for example "/api/get").
+	Methods map[string]Limit
+
+	// LockoutThreshold is the number of access denials within LockoutWindow
+	// after which a principal is locked out of all API methods for
+	// LockoutDuration. If zero, principals are never locked out.
+	LockoutThreshold int
+
+	// LockoutWindow is the period over which access denials are counted.
+	// If zero, a default of 1 minute is used.
+	LockoutWindow time.Duration
+
+	// LockoutDuration is how long a lockout lasts once imposed.
+	// If zero, a default of 5 minutes is used.
+	LockoutDuration time.Duration
+}
+
+// Limit is a token bucket rate limit.
+type Limit struct {
+	// Rate is the sustained number of calls permitted per second.
+	// If zero, calls are not limited.
+	Rate float64
+
+	// Burst is the maximum number of calls permitted at once. If Burst is
+	// less than 1 and Rate is positive, a burst of 1 is used.
+	Burst int
+}
+
+func (r *RateLimit) limit(method string) Limit {
+	if lim, ok := r.Methods[method]; ok {
+		return lim
+	}
+	return r.Default
+}
+
+func (r *RateLimit) lockoutWindow() time.Duration {
+	if r.LockoutWindow <= 0 {
+		return time.Minute
+	}
+	return r.LockoutWindow
+}
+
+func (r *RateLimit) lockoutDuration() time.Duration {
+	if r.LockoutDuration <= 0 {
+		return 5 * time.Minute
+	}
+	return r.LockoutDuration
+}
+
+// idleBucketAge is the length of time after which state for a caller that has
+// not made any calls is discarded by the limiter.
+const idleBucketAge = 10 * time.Minute
+
+// limiter enforces a RateLimit configuration.
+type limiter struct {
+	cfg     RateLimit
+	timeNow func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket   // :: (principal, method) → bucket
+	callers   map[string]*callerState // :: principal → denial state
+	lastSweep time.Time
+}
+
+type bucketKey struct {
+	principal string
+	method    string
+}
+
+// bucket is the state of a single token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// callerState tracks recent access denials for a single principal.
+type callerState struct {
+	denials     []time.Time // within the lockout window, oldest first
+	lockedUntil time.Time
+	lastSeen    time.Time
+}
+
+func newLimiter(cfg RateLimit) *limiter {
+	return &limiter{
+		cfg:     cfg,
+		timeNow: time.Now,
+		buckets: make(map[bucketKey]*bucket),
+		callers: make(map[string]*callerState),
+	}
+}
+
+// principalKey returns the string used to identify p for rate limiting.
+func principalKey(p audit.Principal) string {
+	return p.Hostname + "|" + p.User
+}
+
+// allow reports whether p may call method now. If not, it returns a positive
+// duration after which the caller may retry, and reports whether the refusal
+// is due to a lockout rather than a rate limit.
+func (l *limiter) allow(p audit.Principal, method string) (retryAfter time.Duration, lockedOut bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.timeNow()
+	l.sweepLocked(now)
+	key := principalKey(p)
+
+	if cs := l.callers[key]; cs != nil {
+		cs.lastSeen = now
+		if now.Before(cs.lockedUntil) {
+			return cs.lockedUntil.Sub(now), true
+		}
+	}
+
+	lim := l.cfg.limit(method)
+	if lim.Rate <= 0 {
+		return 0, false
+	}
+	burst := float64(max(lim.Burst, 1))
+
+	bk := bucketKey{principal: key, method: method}
+	b := l.buckets[bk]
+	if b == nil {
+		b = &bucket{tokens: burst}
+		l.buckets[bk] = b
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*lim.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / lim.Rate
+		return time.Duration(math.Ceil(wait * float64(time.Second))), false
+	}
+	b.tokens--
+	return 0, false
+}
+
+// deny records an access denial for p, and reports whether that denial
+// caused p to be locked out.
+func (l *limiter) deny(p audit.Principal) bool {
+	if l.cfg.LockoutThreshold <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.timeNow()
+	key := principalKey(p)
+	cs := l.callers[key]
+	if cs == nil {
+		cs = new(callerState)
+		l.callers[key] = cs
+	}
+	cs.lastSeen = now
+
+	// Discard denials that have aged out of the window.
+	cutoff := now.Add(-l.cfg.lockoutWindow())
+	i := 0
+	for i < len(cs.denials) && !cs.denials[i].After(cutoff) {
+		i++
+	}
+	cs.denials = append(cs.denials[i:], now)
+
+	if len(cs.denials) < l.cfg.LockoutThreshold {
+		return false
+	}
+	cs.denials = nil
+	cs.lockedUntil = now.Add(l.cfg.lockoutDuration())
+	return true
+}
+
+// sweepLocked discards state for callers that have been idle for a while, so
+// that the limiter does not grow without bound. It does a full sweep at most
+// once per idleBucketAge. The caller must hold l.mu.
+func (l *limiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketAge {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > idleBucketAge {
+			delete(l.buckets, k)
+		}
+	}
+	for k, cs := range l.callers {
+		if now.Sub(cs.lastSeen) > idleBucketAge && now.After(cs.lockedUntil) {
+			delete(l.callers, k)
+		}
+	}
+}
+
+// methodAction returns the ACL action corresponding to the API method at the
+// given path, for use in audit log entries. It returns "" for unknown paths.
+func methodAction(path string) acl.Action {
+	switch path {
+	case "/api/get", "/api/lease/renew", "/api/lease/revoke":
+		return acl.ActionGet
+	case "/api/list", "/api/info", "/api/cert/status":
+		return acl.ActionInfo
+	case "/api/put", "/api/cert/issue":
+		return acl.ActionPut
+	case "/api/activate":
+		return acl.ActionActivate
+	case "/api/delete", "/api/delete-version", "/api/cert/revoke":
+		return acl.ActionDelete
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/audit"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := newLimiter(RateLimit{
+		Default: Limit{Rate: 1, Burst: 2},
+		Methods: map[string]Limit{
+			"/api/list": {}, // unlimited
+		},
+		LockoutThreshold: 3,
+		LockoutWindow:    time.Minute,
+		LockoutDuration:  5 * time.Minute,
+	})
+	l.timeNow = func() time.Time { return now }
+
+	alice := audit.Principal{Hostname: "alice.example.com"}
+	bob := audit.Principal{Hostname: "bob.example.com"}
+
+	mustAllow := func(p audit.Principal, method string) {
+		t.Helper()
+		if wait, locked := l.allow(p, method); wait != 0 {
+			t.Errorf("allow %q %q: got wait %v (locked=%v), want 0", p.Hostname, method, wait, locked)
+		}
+	}
+	mustRefuse := func(p audit.Principal, method string, wantLocked bool) {
+		t.Helper()
+		if wait, locked := l.allow(p, method); wait <= 0 || locked != wantLocked {
+			t.Errorf("allow %q %q: got wait %v (locked=%v), want wait > 0 (locked=%v)",
+				p.Hostname, method, wait, locked, wantLocked)
+		}
+	}
+
+	// The burst is available immediately, then the bucket is empty.
+	mustAllow(alice, "/api/get")
+	mustAllow(alice, "/api/get")
+	mustRefuse(alice, "/api/get", false)
+
+	// Other methods and other principals have their own buckets.
+	mustAllow(alice, "/api/info")
+	mustAllow(bob, "/api/get")
+	for range 10 {
+		mustAllow(alice, "/api/list")
+	}
+
+	// After a second, one more token is available.
+	now = now.Add(time.Second)
+	mustAllow(alice, "/api/get")
+	mustRefuse(alice, "/api/get", false)
+
+	// Denials outside the window do not count toward a lockout.
+	if l.deny(bob) || l.deny(bob) {
+		t.Error("deny: unexpected lockout before threshold")
+	}
+	now = now.Add(2 * time.Minute)
+	if l.deny(bob) || l.deny(bob) {
+		t.Error("deny: unexpected lockout after window expired")
+	}
+	if !l.deny(bob) {
+		t.Error("deny: want lockout at threshold")
+	}
+	mustRefuse(bob, "/api/list", true)
+	mustAllow(alice, "/api/list")
+
+	// The lockout expires after the configured duration.
+	now = now.Add(5*time.Minute + time.Second)
+	mustAllow(bob, "/api/list")
+}
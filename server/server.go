@@ -15,6 +15,10 @@ import (
 	"log"
 	"net/http"
 	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -24,8 +28,14 @@ import (
 	"github.com/leger-labs/leger/acl"
 	"github.com/leger-labs/leger/audit"
 	"github.com/leger-labs/leger/db"
+	"github.com/leger-labs/leger/dynamic"
+	"github.com/leger-labs/leger/telemetry"
 	"github.com/leger-labs/leger/types/api"
+	"github.com/leger-labs/leger/webhook"
 	"github.com/tink-crypto/tink-go/v2/tink"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/metrics"
 	"tailscale.com/tailcfg"
@@ -79,6 +89,16 @@ type Config struct {
 	// SDK. If BackupAssumeRole is empty, backups are written without
 	// assuming a role.
 	BackupAssumeRole string
+
+	// RateLimit, if non-nil, configures per-principal rate limits on API
+	// calls and a temporary lockout for principals that are repeatedly denied
+	// access. If nil, API calls are not rate limited.
+	RateLimit *RateLimit
+
+	// Webhooks configures the delivery of webhook events. The server sets
+	// its Subscriptions, and if DeadLetterPath is empty, stores dead letters
+	// alongside the database.
+	Webhooks webhook.Config
 }
 
 // Server is a secrets HTTP server.
@@ -88,6 +108,10 @@ type Server struct {
 	tmpl         *template.Template
 	backupClient *s3.Client
 	backupBucket string
+	limiter      *limiter // nil if rate limits are disabled
+	dynamic      *dynamic.Manager
+	webhooks     *webhook.Dispatcher
+	certMu       sync.Mutex // serializes certificate issuance
 
 	// Metrics
 	countCalls             *metrics.LabelMap // :: method name → count
@@ -95,6 +119,8 @@ type Server struct {
 	countCallForbidden     *metrics.LabelMap // :: method name → count
 	countCallNotFound      *metrics.LabelMap // :: method name → count
 	countCallInternalError *metrics.LabelMap // :: method name → count
+	countCallRateLimited   *metrics.LabelMap // :: method name → count
+	countLockouts          expvar.Int        // principals locked out
 }
 
 //go:embed templates
@@ -133,6 +159,10 @@ func New(ctx context.Context, cfg Config) (*Server, error) {
 		countCallForbidden:     &metrics.LabelMap{Label: "method"},
 		countCallNotFound:      &metrics.LabelMap{Label: "method"},
 		countCallInternalError: &metrics.LabelMap{Label: "method"},
+		countCallRateLimited:   &metrics.LabelMap{Label: "method"},
+	}
+	if cfg.RateLimit != nil {
+		ret.limiter = newLimiter(*cfg.RateLimit)
 	}
 
 	if cfg.BackupBucket != "" {
@@ -145,6 +175,25 @@ func New(ctx context.Context, cfg Config) (*Server, error) {
 		go ret.periodicBackup(ctx)
 	}
 
+	dm, err := dynamic.NewManager(leasePath(kdb.Path()), ret.dynamicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("loading dynamic secret leases: %w", err)
+	}
+	ret.dynamic = dm
+	go dm.Run(ctx)
+
+	whcfg := cfg.Webhooks
+	whcfg.Subscriptions = ret.webhookSubscriptions
+	if whcfg.DeadLetterPath == "" {
+		whcfg.DeadLetterPath = deadLetterPath(kdb.Path())
+	}
+	ret.webhooks = webhook.NewDispatcher(whcfg)
+	kdb.OnChange(ret.webhooks.Notify)
+	go ret.webhooks.Run(ctx)
+
+	go ret.periodicFlushAccess(ctx)
+	go ret.periodicRenewCerts(ctx)
+
 	cfg.Mux.HandleFunc("/", ret.htmlList)
 	cfg.Mux.Handle("/static/", http.FileServer(http.FS(staticFiles)))
 	cfg.Mux.HandleFunc("/api/list", ret.list)
@@ -154,6 +203,13 @@ func New(ctx context.Context, cfg Config) (*Server, error) {
 	cfg.Mux.HandleFunc("/api/activate", ret.activate)
 	cfg.Mux.HandleFunc("/api/delete", ret.deleteSecret)
 	cfg.Mux.HandleFunc("/api/delete-version", ret.deleteVersion)
+	cfg.Mux.HandleFunc("/api/lease/renew", ret.renewLease)
+	cfg.Mux.HandleFunc("/api/lease/revoke", ret.revokeLease)
+	cfg.Mux.HandleFunc("/api/cert/issue", ret.issueCertAPI)
+	cfg.Mux.HandleFunc("/api/cert/status", ret.certStatus)
+	cfg.Mux.HandleFunc("/api/cert/revoke", ret.revokeCert)
+	cfg.Mux.HandleFunc("/api/webhook/dead-letters", ret.webhookDeadLetters)
+	cfg.Mux.HandleFunc("/ca/", ret.serveCA)
 
 	return ret, nil
 }
@@ -180,6 +236,9 @@ func (s *Server) Metrics() expvar.Var {
 	m.Set("counter_api_bad_request", s.countCallBadRequest)
 	m.Set("counter_api_forbidden", s.countCallForbidden)
 	m.Set("counter_api_internal_error", s.countCallInternalError)
+	m.Set("counter_api_rate_limited", s.countCallRateLimited)
+	m.Set("counter_api_lockouts", &s.countLockouts)
+	m.Set("webhooks", s.webhooks.Metrics())
 	return m
 }
 
@@ -226,6 +285,9 @@ func (s *Server) list(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) get(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.GetRequest, id db.Caller) (*api.SecretValue, error) {
+		if s.dynamic.IsDynamic(req.Name) {
+			return s.getDynamic(req, id)
+		}
 		if req.Version != 0 {
 			if req.UpdateIfChanged {
 				// Case 1: Old version specified, update requested.
@@ -247,6 +309,16 @@ func (s *Server) info(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) put(w http.ResponseWriter, r *http.Request) {
 	serveJSON(s, w, r, func(req api.PutRequest, id db.Caller) (api.SecretVersion, error) {
+		if strings.HasPrefix(req.Name, db.WebhookPrefix) {
+			if err := s.authorizeWebhook(id, req.Value); err != nil {
+				return 0, err
+			}
+		}
+		if strings.HasPrefix(req.Name, db.CertConfigPrefix) {
+			if err := s.authorizeCertConfig(id, req.Value); err != nil {
+				return 0, err
+			}
+		}
 		return s.db.Put(id, req.Name, req.Value)
 	})
 }
@@ -318,6 +390,22 @@ func (s *Server) getIdentity(r *http.Request) (id db.Caller, err error) {
 	return id, nil
 }
 
+// recordDenial notes that id was denied access to apiMethod, and locks out
+// the caller if it has been denied too often.
+func (s *Server) recordDenial(id db.Caller, apiMethod string) {
+	if s.limiter == nil || !s.limiter.deny(id.Principal) {
+		return
+	}
+	s.countLockouts.Add(1)
+	dur := s.limiter.cfg.lockoutDuration()
+	log.Printf("Locking out %s (%s) for %v after repeated access denials",
+		id.Principal.Hostname, id.Principal.IP, dur)
+	reason := fmt.Sprintf("locked out for %v after %d access denials", dur, s.limiter.cfg.LockoutThreshold)
+	if err := s.db.LogRefused(id, methodAction(apiMethod), reason); err != nil {
+		log.Printf("Failed to audit lockout: %v", err)
+	}
+}
+
 // serveJSON calls fn to handle a JSON API request. fn is invoked with
 // the request body decoded into r, and from set to the Tailscale
 // identity of the caller. The response returned from fn is serialized
@@ -326,6 +414,22 @@ func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Requ
 	apiMethod := r.URL.Path
 	s.countCalls.Add(apiMethod, 1)
 
+	// Continue the caller's trace, if any. The span does not record the
+	// request, which may contain secret names and values.
+	ctx, span := telemetry.Tracer().Start(telemetry.Extract(r.Context(), r.Header), "legerd "+apiMethod,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.method", apiMethod)),
+	)
+	sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+	w = sw
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.code))
+		if sw.code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.code))
+		}
+		span.End()
+	}()
+
 	if r.Method != "POST" {
 		s.countCallBadRequest.Add(apiMethod, 1)
 		http.Error(w, "only POST requests allowed", http.StatusBadRequest)
@@ -355,6 +459,21 @@ func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Requ
 		http.Error(w, "unable to identify caller", http.StatusInternalServerError)
 		return
 	}
+	id.Context = ctx
+
+	if s.limiter != nil {
+		if wait, locked := s.limiter.allow(id.Principal, apiMethod); wait > 0 {
+			s.countCallRateLimited.Add(apiMethod, 1)
+			secs := int64((wait + time.Second - 1) / time.Second) // round up
+			w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+			msg := "too many requests"
+			if locked {
+				msg = "too many requests (locked out)"
+			}
+			http.Error(w, msg, http.StatusTooManyRequests)
+			return
+		}
+	}
 
 	var req REQ
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -366,12 +485,17 @@ func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Requ
 	resp, err := fn(req, id)
 	if errors.Is(err, db.ErrAccessDenied) {
 		s.countCallForbidden.Add(apiMethod, 1)
+		s.recordDenial(id, apiMethod)
 		http.Error(w, "access denied", http.StatusForbidden)
 		return
-	} else if errors.Is(err, db.ErrNotFound) {
+	} else if errors.Is(err, db.ErrNotFound) || errors.Is(err, api.ErrNotFound) {
 		s.countCallNotFound.Add(apiMethod, 1)
 		http.Error(w, "not found", http.StatusNotFound)
 		return
+	} else if isBadRequest(err) {
+		s.countCallBadRequest.Add(apiMethod, 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	} else if errors.Is(err, api.ErrValueNotChanged) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotModified)
@@ -393,3 +517,15 @@ func serveJSON[REQ any, RESP any](s *Server, w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(bs)
 }
+
+// statusWriter is an http.ResponseWriter that records the status code of the
+// response, for tracing.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -4,22 +4,33 @@
 package server_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/leger-labs/leger/acl"
 	"github.com/leger-labs/leger/audit"
+	"github.com/leger-labs/leger/ca"
 	"github.com/leger-labs/leger/client/setec"
 	"github.com/leger-labs/leger/db"
+	"github.com/leger-labs/leger/dynamic"
 	"github.com/leger-labs/leger/server"
 	"github.com/leger-labs/leger/setectest"
 	"github.com/leger-labs/leger/types/api"
+	"github.com/leger-labs/leger/webhook"
 	"github.com/tink-crypto/tink-go/v2/testutil"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tailcfg"
@@ -163,3 +174,466 @@ func TestServerStatus(t *testing.T) {
 		t.Errorf("DeleteVersion %v: unexpected error %v", ov2, err)
 	}
 }
+
+func TestServerLockout(t *testing.T) {
+	var auditBuf bytes.Buffer
+	d := setectest.NewDB(t, &setectest.DBOptions{AuditLog: audit.New(&auditBuf)})
+	d.MustPut(d.Superuser, "ok/test", "v1")
+	d.MustPut(d.Superuser, "no/test", "no")
+
+	rule, err := json.Marshal(acl.Rule{
+		Action: []acl.Action{acl.ActionGet},
+		Secret: []acl.Secret{"ok/*"},
+	})
+	if err != nil {
+		t.Fatalf("Create access grant: %v", err)
+	}
+	whois := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: "example.com"},
+		UserProfile: &tailcfg.UserProfile{
+			ID: 31337, LoginName: "elite@example.com", DisplayName: "Leet Q. Haxor",
+		},
+		CapMap: tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
+	}
+
+	mux := http.NewServeMux()
+	if _, err := server.New(context.Background(), server.Config{
+		DB: d.Actual,
+		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
+			return whois, nil
+		},
+		Mux: mux,
+		RateLimit: &server.RateLimit{
+			LockoutThreshold: 3,
+			LockoutDuration:  time.Hour,
+		},
+	}); err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	if _, err := cli.Get(ctx, "ok/test"); err != nil {
+		t.Fatalf("Get ok/test: unexpected error: %v", err)
+	}
+
+	// Each denial is reported as such until the threshold is reached.
+	for i := range 3 {
+		if _, err := cli.Get(ctx, "no/test"); !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("Get no/test %d: got %v, want %v", i+1, err, api.ErrAccessDenied)
+		}
+	}
+
+	// Now the caller is locked out, even for secrets it may access. The
+	// lockout is longer than the client is willing to wait, so it does not
+	// retry.
+	if _, err := cli.Get(ctx, "ok/test"); !errors.Is(err, api.ErrRateLimited) {
+		t.Errorf("Get ok/test: got %v, want %v", err, api.ErrRateLimited)
+	}
+
+	// The lockout should be recorded in the audit log.
+	var found bool
+	dec := json.NewDecoder(&auditBuf)
+	for {
+		var e audit.Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Decode audit entry: %v", err)
+		}
+		if e.Reason != "" && !e.Authorized && e.Principal.User == "elite@example.com" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("No audit entry found for lockout")
+	}
+}
+
+func TestServerDynamic(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+	var denied atomic.Bool // if set, callers have no access
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		WhoIs: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			who, err := setectest.AllAccess(ctx, addr)
+			if denied.Load() {
+				who.CapMap = nil
+			}
+			return who, err
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	// Invalid configurations are rejected.
+	if _, err := cli.Put(ctx, db.DynamicConfigPrefix+"token", []byte(`{"backend":"nonesuch"}`)); err == nil {
+		t.Error("Put invalid config: got nil error")
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	cfg, err := json.Marshal(dynamic.Config{
+		Backend: "hmac",
+		TTL:     dynamic.Duration(time.Hour),
+		HMAC:    &dynamic.HMACConfig{Key: key},
+	})
+	if err != nil {
+		t.Fatalf("Marshal config: %v", err)
+	}
+	if _, err := cli.Put(ctx, db.DynamicConfigPrefix+"token", cfg); err != nil {
+		t.Fatalf("Put config: unexpected error: %v", err)
+	}
+
+	sv, err := cli.Get(ctx, "token")
+	if err != nil {
+		t.Fatalf("Get token: unexpected error: %v", err)
+	}
+	var dv api.DynamicValue
+	if err := json.Unmarshal(sv.Value, &dv); err != nil {
+		t.Fatalf("Decode dynamic value: %v", err)
+	}
+	if _, err := dynamic.VerifyToken(key, dv.Data["token"], "", time.Now()); err != nil {
+		t.Errorf("VerifyToken: unexpected error: %v", err)
+	}
+
+	// The lease is still fresh, so polling does not issue a new credential.
+	if _, err := cli.GetIfChanged(ctx, "token", sv.Version); !errors.Is(err, api.ErrValueNotChanged) {
+		t.Errorf("GetIfChanged: got %v, want %v", err, api.ErrValueNotChanged)
+	}
+	// Issued credentials cannot be fetched again.
+	if _, err := cli.GetVersion(ctx, "token", sv.Version); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("GetVersion: got %v, want %v", err, api.ErrNotFound)
+	}
+	// Callers without access are refused before learning that the secret
+	// is dynamic.
+	denied.Store(true)
+	if _, err := cli.GetVersion(ctx, "token", sv.Version); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("GetVersion without access: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	denied.Store(false)
+
+	// HMAC tokens cannot be renewed.
+	if _, err := cli.RenewLease(ctx, dv.LeaseID, 0); err == nil {
+		t.Error("RenewLease: got nil error")
+	}
+
+	if err := cli.RevokeLease(ctx, dv.LeaseID); err != nil {
+		t.Errorf("RevokeLease: unexpected error: %v", err)
+	}
+	if err := cli.RevokeLease(ctx, dv.LeaseID); !errors.Is(err, api.ErrNotFound) {
+		t.Errorf("RevokeLease again: got %v, want %v", err, api.ErrNotFound)
+	}
+}
+
+func TestServerCerts(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+
+	// Callers have full access, and may use the "test" CA unless noCA is set.
+	caRule, err := json.Marshal(acl.Rule{
+		Action: []acl.Action{acl.ActionInfo},
+		Secret: []acl.Secret{acl.Secret(db.CAPrefix + "test")},
+	})
+	if err != nil {
+		t.Fatalf("Create access grant: %v", err)
+	}
+	var noCA atomic.Bool
+	ss := setectest.NewServer(t, d, &setectest.ServerOptions{
+		WhoIs: func(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+			who, err := setectest.AllAccess(ctx, addr)
+			if !noCA.Load() {
+				who.CapMap = tailcfg.PeerCapMap{
+					server.ACLCap: append(who.CapMap[server.ACLCap], tailcfg.RawMessage(caRule)),
+				}
+			}
+			return who, err
+		},
+	})
+	hs := httptest.NewServer(ss.Mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	caPEM, err := ca.NewAuthority("Test CA", 24*time.Hour, ca.ECDSAP256)
+	if err != nil {
+		t.Fatalf("NewAuthority: %v", err)
+	}
+	if _, err := cli.Put(ctx, db.CAPrefix+"test", caPEM); err != nil {
+		t.Fatalf("Put CA: %v", err)
+	}
+	if _, err := cli.Put(ctx, db.CAPrefix+"bogus", []byte("not a CA")); err == nil {
+		t.Error("Put invalid CA: got nil error")
+	}
+	if _, err := cli.Put(ctx, db.CertConfigPrefix+"web/tls", []byte(`{"ca":"test","dnsNames":["web.example.com"]}`)); err != nil {
+		t.Fatalf("Put cert config: %v", err)
+	}
+
+	// Without access to the CA, full access to secrets does not allow
+	// defining or issuing certificates.
+	noCA.Store(true)
+	if _, err := cli.Put(ctx, db.CertConfigPrefix+"api/tls", []byte(`{"ca":"test","dnsNames":["evil.example.com"]}`)); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("Put cert config without CA access: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	if _, err := cli.IssueCert(ctx, "web/tls"); !errors.Is(err, api.ErrAccessDenied) {
+		t.Errorf("IssueCert without CA access: got %v, want %v", err, api.ErrAccessDenied)
+	}
+	noCA.Store(false)
+
+	v1, err := cli.IssueCert(ctx, "web/tls")
+	if err != nil {
+		t.Fatalf("IssueCert: %v", err)
+	}
+	sv, err := cli.Get(ctx, "web/tls")
+	if err != nil {
+		t.Fatalf("Get web/tls: %v", err)
+	} else if sv.Version != v1 {
+		t.Errorf("Get web/tls: got version %v, want %v", sv.Version, v1)
+	}
+	if _, err := tls.X509KeyPair(sv.Value, sv.Value); err != nil {
+		t.Errorf("X509KeyPair: %v", err)
+	}
+
+	st, err := cli.CertStatus(ctx, api.CertStatusRequest{Name: "web/tls"})
+	if err != nil {
+		t.Fatalf("CertStatus: %v", err)
+	} else if st.Status != api.CertGood || st.Version != v1 {
+		t.Errorf("CertStatus: got %+v, want good at version %v", st, v1)
+	}
+
+	// Revoking the active certificate causes a replacement to be issued.
+	if err := cli.RevokeCert(ctx, "web/tls", v1); err != nil {
+		t.Fatalf("RevokeCert: %v", err)
+	}
+	if sv, err := cli.Get(ctx, "web/tls"); err != nil {
+		t.Fatalf("Get web/tls: %v", err)
+	} else if sv.Version == v1 {
+		t.Errorf("Get web/tls after revoke: still version %v", v1)
+	}
+	byName, err := cli.CertStatus(ctx, api.CertStatusRequest{Name: "web/tls", Version: v1})
+	if err != nil {
+		t.Fatalf("CertStatus: %v", err)
+	} else if byName.Status != api.CertRevoked {
+		t.Errorf("CertStatus after revoke: got %q, want %q", byName.Status, api.CertRevoked)
+	}
+	bySerial, err := cli.CertStatus(ctx, api.CertStatusRequest{CA: "test", Serial: st.Serial})
+	if err != nil {
+		t.Fatalf("CertStatus by serial: %v", err)
+	} else if bySerial.Status != api.CertRevoked || bySerial.Secret != "" {
+		t.Errorf("CertStatus by serial: got %+v, want revoked without secret name", bySerial)
+	}
+
+	// The registry keeps only its active version.
+	if si, err := cli.Info(ctx, db.CARegistryPrefix+"test"); err != nil {
+		t.Fatalf("Info registry: %v", err)
+	} else if len(si.Versions) != 1 || si.Versions[0] != si.ActiveVersion {
+		t.Errorf("Registry versions: got %v, want only active version %v", si.Versions, si.ActiveVersion)
+	}
+
+	// The CRL lists the revoked certificate.
+	rsp, err := hs.Client().Get(hs.URL + "/ca/test/crl")
+	if err != nil {
+		t.Fatalf("Get CRL: %v", err)
+	}
+	defer rsp.Body.Close()
+	der, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatalf("Read CRL: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("Parse CRL: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || ca.SerialString(crl.RevokedCertificateEntries[0].SerialNumber) != st.Serial {
+		t.Errorf("CRL entries: got %+v, want serial %s", crl.RevokedCertificateEntries, st.Serial)
+	}
+}
+
+func TestServerWebhooks(t *testing.T) {
+	d := setectest.NewDB(t, nil)
+
+	const key = "0123456789abcdef0123456789abcdef"
+	events := make(chan webhook.Event, 10)
+	var mu sync.Mutex
+	var bodies bytes.Buffer
+	handler := webhook.Handler([]byte(key), func(_ context.Context, ev webhook.Event) error {
+		events <- ev
+		return nil
+	})
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies.Write(body)
+		mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	}))
+	defer recv.Close()
+
+	// Subscriptions may not name loopback hosts, so receivers are given names
+	// that the dispatcher's client maps to their listeners.
+	var hostsMu sync.Mutex
+	hosts := map[string]string{"app.hooks.test:80": recv.Listener.Addr().String()}
+	hookClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			hostsMu.Lock()
+			target, ok := hosts[addr]
+			hostsMu.Unlock()
+			if !ok {
+				return nil, fmt.Errorf("unknown host %q", addr)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, target)
+		},
+	}}
+	const recvURL = "http://app.hooks.test/hook"
+
+	// The caller may manage subscriptions and see the secrets under app/, but
+	// not those under ops/.
+	rule, err := json.Marshal(acl.Rule{
+		Action: []acl.Action{acl.ActionGet, acl.ActionInfo, acl.ActionPut, acl.ActionActivate, acl.ActionDelete},
+		Secret: []acl.Secret{"app/*", acl.Secret(db.WebhookPrefix + "*")},
+	})
+	if err != nil {
+		t.Fatalf("Create access grant: %v", err)
+	}
+	whois := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "example.com"},
+		UserProfile: &tailcfg.UserProfile{ID: 1, LoginName: "admin@example.com"},
+		CapMap:      tailcfg.PeerCapMap{server.ACLCap: []tailcfg.RawMessage{tailcfg.RawMessage(rule)}},
+	}
+	mux := http.NewServeMux()
+	if _, err := server.New(context.Background(), server.Config{
+		DB: d.Actual,
+		WhoIs: func(context.Context, string) (*apitype.WhoIsResponse, error) {
+			return whois, nil
+		},
+		Mux:      mux,
+		Webhooks: webhook.Config{Client: hookClient, MaxAttempts: 2, Backoff: time.Millisecond},
+	}); err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	putSub := func(name, url string, secrets ...string) error {
+		cfg, err := json.Marshal(map[string]any{"url": url, "secrets": secrets, "key": key})
+		if err != nil {
+			t.Fatalf("Encode subscription: %v", err)
+		}
+		_, err = cli.Put(ctx, db.WebhookPrefix+name, cfg)
+		return err
+	}
+
+	// Subscribing to secrets the caller cannot see is not allowed.
+	for _, pat := range []string{"ops/*", "*"} {
+		if err := putSub("bad", recvURL, pat); !errors.Is(err, api.ErrAccessDenied) {
+			t.Errorf("Subscribe to %q: got %v, want %v", pat, err, api.ErrAccessDenied)
+		}
+	}
+	for _, url := range []string{"not a url", recv.URL} {
+		if err := putSub("bad", url, "app/*"); err == nil {
+			t.Errorf("Subscribe with URL %q: got nil, want error", url)
+		}
+	}
+	if err := putSub("app", recvURL, "app/*"); err != nil {
+		t.Fatalf("Subscribe: unexpected error: %v", err)
+	}
+
+	wantEvent := func(action, secret string, version api.SecretVersion) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Action != action || ev.Secret != secret || ev.Version != version {
+				t.Errorf("Event: got %s %q version %v, want %s %q version %v",
+					ev.Action, ev.Secret, ev.Version, action, secret, version)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for %s event for %q", action, secret)
+		}
+	}
+
+	if _, err := cli.Put(ctx, "app/token", []byte("sekrit-1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	wantEvent(webhook.ActionPut, "app/token", 1)
+	wantEvent(webhook.ActionActivate, "app/token", 1)
+	if _, err := cli.Put(ctx, "app/token", []byte("sekrit-1")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	v2, err := cli.Put(ctx, "app/token", []byte("sekrit-2"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	wantEvent(webhook.ActionPut, "app/token", v2)
+	if err := cli.Activate(ctx, "app/token", v2); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	wantEvent(webhook.ActionActivate, "app/token", v2)
+	if err := cli.Delete(ctx, "app/token"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	wantEvent(webhook.ActionDelete, "app/token", 0)
+
+	// Changes to secrets outside the subscription are not reported.
+	d.MustPut(d.Superuser, "ops/key", "sekrit-3")
+	select {
+	case ev := <-events:
+		t.Errorf("Unexpected event: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	if bytes.Contains(bodies.Bytes(), []byte("sekrit")) {
+		t.Errorf("Event bodies contain secret values: %s", bodies.String())
+	}
+	mu.Unlock()
+
+	t.Run("DeadLetters", func(t *testing.T) {
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusBadGateway)
+		}))
+		defer down.Close()
+		hostsMu.Lock()
+		hosts["down.hooks.test:80"] = down.Listener.Addr().String()
+		hostsMu.Unlock()
+		const downURL = "http://down.hooks.test/hook"
+		if err := putSub("down", downURL, "app/other"); err != nil {
+			t.Fatalf("Subscribe: unexpected error: %v", err)
+		}
+		if _, err := cli.Put(ctx, "app/other", []byte("x")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		wantEvent(webhook.ActionPut, "app/other", 1) // delivered to "app"
+		wantEvent(webhook.ActionActivate, "app/other", 1)
+
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			dls, err := cli.WebhookDeadLetters(ctx, "down")
+			if err != nil {
+				t.Fatalf("WebhookDeadLetters: unexpected error: %v", err)
+			}
+			if len(dls) == 2 {
+				for _, dl := range dls {
+					if dl.Secret != "app/other" || dl.Attempts != 2 || dl.URL != downURL {
+						t.Errorf("Dead letter: got %+v", dl)
+					}
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for dead letters, have %d", len(dls))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if dls, err := cli.WebhookDeadLetters(ctx, "app"); err != nil || len(dls) != 0 {
+			t.Errorf("WebhookDeadLetters(app): got (%v, %v), want none", dls, err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/db"
+	"github.com/leger-labs/leger/types/api"
+	"github.com/leger-labs/leger/webhook"
+)
+
+// deadLetterPath returns the path of the webhook dead-letter log for the
+// database at dbPath.
+func deadLetterPath(dbPath string) string { return dbPath + ".dead-letters" }
+
+// webhookSubscriptions returns the current webhook subscriptions, for use by
+// a webhook.Dispatcher.
+func (s *Server) webhookSubscriptions() ([]*webhook.Subscription, error) {
+	var subs []*webhook.Subscription
+	for _, cfgName := range s.db.NamesWithPrefix(db.WebhookPrefix) {
+		sv, err := s.db.Peek(cfgName)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := webhook.ParseSubscription(sv.Value)
+		if err != nil {
+			// Subscriptions are validated when they are stored, so this
+			// should not happen; skip it rather than blocking the others.
+			log.Printf("Webhook %q: %v", cfgName, err)
+			continue
+		}
+		sub.Name = strings.TrimPrefix(cfgName, db.WebhookPrefix)
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// authorizeWebhook verifies that caller may subscribe to the secrets named in
+// the subscription encoded in value. Because events report the names and
+// versions of changed secrets, the caller must have "info" access to every
+// name that each pattern of the subscription could match.
+func (s *Server) authorizeWebhook(caller db.Caller, value []byte) error {
+	sub, err := webhook.ParseSubscription(value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", db.ErrInvalidConfig, err)
+	}
+	for _, pat := range sub.Secrets {
+		// A rule whose pattern matches the subscription pattern taken
+		// literally covers every name the subscription pattern matches.
+		if err := s.db.Authorize(caller, acl.ActionInfo, string(pat), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) webhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	serveJSON(s, w, r, func(req api.WebhookDeadLettersRequest, id db.Caller) ([]*api.WebhookDeadLetter, error) {
+		if req.Name != "" {
+			if err := s.db.Authorize(id, acl.ActionInfo, db.WebhookPrefix+req.Name, 0); err != nil {
+				return nil, err
+			}
+		}
+		all, err := s.webhooks.DeadLetters()
+		if err != nil {
+			return nil, err
+		}
+
+		// As with List, report only what the caller can see, without logging
+		// each subscription separately.
+		out := []*api.WebhookDeadLetter{}
+		for _, dl := range all {
+			if req.Name != "" && dl.Subscription != req.Name {
+				continue
+			}
+			if id.Permissions.Allow(acl.ActionInfo, db.WebhookPrefix+dl.Subscription) {
+				out = append(out, dl)
+			}
+		}
+		return out, nil
+	})
+}
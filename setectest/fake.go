@@ -0,0 +1,277 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setectest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/server"
+	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// DefaultPrincipal is the name of the principal that calls a [Fake] through
+// its URL. Unless its rules are changed, it has full access to all secrets.
+const DefaultPrincipal = "user@example.com"
+
+// Fake is a scriptable in-process setec server for tests of programs that
+// use the setec API. Each principal defined on a Fake is served at its own
+// URL, so clients act as that principal simply by using its URL.
+//
+// In addition to serving the API from a real database, a Fake can inject
+// errors and latency into calls by method, rotate secrets on demand or on a
+// schedule, and records every API call for later assertions.
+//
+// The methods of a Fake are safe for concurrent use.
+type Fake struct {
+	faults
+
+	t *testing.T
+
+	DB     *DB     // the database served by the fake
+	Server *Server // the underlying test server
+	URL    string  // the base URL for DefaultPrincipal
+
+	mu         sync.Mutex
+	principals map[string]*principal // :: name → principal
+	calls      []Call
+}
+
+// A Call records an API call received by a [Fake].
+type Call struct {
+	Principal string    // the name of the calling principal
+	Method    string    // the API method name, e.g. "get"
+	Secret    string    // the secret name in the request, if any
+	Status    int       // the HTTP status of the response
+	Injected  bool      // whether the response was an injected fault
+	Time      time.Time // when the call was received
+}
+
+type principal struct {
+	name  string
+	rules []tailcfg.RawMessage
+	hs    *httptest.Server
+}
+
+// principalKey is the context key for the name of the calling principal.
+type principalKey struct{}
+
+// NewFake constructs a new Fake serving the contents of db for the duration
+// of the test and subtests governed by t. If db == nil, a new empty database
+// is created.
+func NewFake(t *testing.T, db *DB) *Fake {
+	t.Helper()
+	if db == nil {
+		db = NewDB(t, nil)
+	}
+	f := &Fake{
+		t:          t,
+		DB:         db,
+		principals: make(map[string]*principal),
+	}
+	f.Server = NewServer(t, db, &ServerOptions{WhoIs: f.whoIs})
+	f.URL = f.AddPrincipal(DefaultPrincipal, allAccessRule)
+	return f
+}
+
+// allAccessRule grants full access to all secrets.
+var allAccessRule = acl.Rule{
+	Action: []acl.Action{
+		acl.ActionGet, acl.ActionInfo, acl.ActionPut, acl.ActionActivate, acl.ActionDelete,
+	},
+	Secret: []acl.Secret{"*"},
+}
+
+// AddPrincipal defines a principal with the given access rules, and returns
+// the base URL at which the principal calls the fake. A name beginning with
+// "tag:" denotes a tagged node; any other name is a user login name.
+//
+// If the principal already exists, its rules are replaced as if by SetRules,
+// and its existing URL is returned.
+func (f *Fake) AddPrincipal(name string, rules ...acl.Rule) string {
+	f.t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.principals[name]
+	if !ok {
+		p = &principal{name: name}
+		p.hs = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.serveHTTP(p.name, w, r)
+		}))
+		f.t.Cleanup(p.hs.Close)
+		f.principals[name] = p
+	}
+	p.rules = f.encodeRules(rules)
+	return p.hs.URL
+}
+
+// SetRules replaces the access rules of the named principal, which must
+// already exist. Calls in progress are not affected.
+func (f *Fake) SetRules(name string, rules ...acl.Rule) {
+	f.t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.principals[name]
+	if !ok {
+		f.t.Fatalf("SetRules: unknown principal %q", name)
+	}
+	p.rules = f.encodeRules(rules)
+}
+
+func (f *Fake) encodeRules(rules []acl.Rule) []tailcfg.RawMessage {
+	out := make([]tailcfg.RawMessage, len(rules))
+	for i, r := range rules {
+		bits, err := json.Marshal(r)
+		if err != nil {
+			f.t.Fatalf("Encoding rule: %v", err)
+		}
+		out[i] = tailcfg.RawMessage(bits)
+	}
+	return out
+}
+
+// Rotate adds value as a new version of the named secret, creating it if
+// necessary, and makes it the active version.
+func (f *Fake) Rotate(name, value string) api.SecretVersion {
+	f.t.Helper()
+	v := f.DB.MustPut(f.DB.Superuser, name, value)
+	f.DB.MustActivate(f.DB.Superuser, name, v)
+	return v
+}
+
+// RotateEvery rotates the named secret once per interval until stopped, or
+// until the test ends. The nth rotation (starting from 1) sets the value
+// returned by value(n). The returned stop function ends the rotations and
+// waits for any rotation in progress to complete.
+func (f *Fake) RotateEvery(name string, interval time.Duration, value func(n int) string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for n := 1; ; n++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+			v, err := f.DB.Actual.Put(f.DB.Superuser, name, []byte(value(n)))
+			if err == nil {
+				err = f.DB.Actual.Activate(f.DB.Superuser, name, v)
+			}
+			if err != nil {
+				f.t.Errorf("Rotating %q: %v", name, err)
+				return
+			}
+		}
+	}()
+	stop = sync.OnceFunc(func() { cancel(); <-done })
+	f.t.Cleanup(stop)
+	return stop
+}
+
+// Calls returns the API calls received by the fake, in order.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallsTo returns the calls received by the fake for the named API method.
+func (f *Fake) CallsTo(method string) []Call {
+	var out []Call
+	for _, c := range f.Calls() {
+		if c.Method == method {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// ResetCalls discards the record of calls received by the fake.
+func (f *Fake) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+// whoIs implements the WhoIs function for the server, reporting the identity
+// and capabilities of the principal whose URL received the request.
+func (f *Fake) whoIs(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+	name, _ := ctx.Value(principalKey{}).(string)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.principals[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown principal %q", name)
+	}
+	rsp := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "fake.example.com"},
+		UserProfile: &tailcfg.UserProfile{ID: 666, LoginName: name, DisplayName: name},
+		CapMap:      tailcfg.PeerCapMap{server.ACLCap: p.rules},
+	}
+	if strings.HasPrefix(name, "tag:") {
+		rsp.Node.Tags = []string{name}
+		rsp.UserProfile = &tailcfg.UserProfile{}
+	}
+	return rsp, nil
+}
+
+func (f *Fake) serveHTTP(name string, w http.ResponseWriter, r *http.Request) {
+	call := Call{
+		Principal: name,
+		Method:    apiMethod(r),
+		Time:      time.Now(),
+	}
+	if r.Body != nil {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct{ Name string }
+		if json.Unmarshal(body, &req) == nil {
+			call.Secret = req.Name
+		}
+	}
+
+	fail, status := f.inject(r)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		call.Status, call.Injected = sw.status, fail
+		f.mu.Lock()
+		f.calls = append(f.calls, call)
+		f.mu.Unlock()
+	}()
+	if fail {
+		if status == 0 {
+			sw.status = 0
+		}
+		serveFault(sw, status)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), principalKey{}, name))
+	f.Server.Mux.ServeHTTP(sw, r)
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
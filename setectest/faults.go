@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package setectest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// faults injects errors and latency into API calls by method. Its methods
+// are promoted to the servers that embed it, a [FaultServer] and a [Fake].
+type faults struct {
+	mu sync.Mutex
+	m  map[string]*fault // :: method name or "*" → fault
+}
+
+type fault struct {
+	fail    int // fail this many calls; negative means all calls
+	status  int // status for failed calls; 0 means drop the connection
+	latency time.Duration
+}
+
+// FailMethod causes the next n calls to the named API method (for example
+// "get" or "put"; "*" for any method) to fail. If n < 0, all calls fail until
+// the fault is cleared. If status is 0, the server closes the connection
+// without responding, as if it had crashed; otherwise it responds with the
+// given HTTP status.
+func (fs *faults) FailMethod(method string, n, status int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	ft := fs.faultLocked(method)
+	ft.fail, ft.status = n, status
+}
+
+// SetLatency delays each call to the named API method ("*" for any method)
+// by d before it is handled. A latency of 0 removes the delay.
+func (fs *faults) SetLatency(method string, d time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faultLocked(method).latency = d
+}
+
+// ClearFaults removes all injected errors and latency.
+func (fs *faults) ClearFaults() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	clear(fs.m)
+}
+
+func (fs *faults) faultLocked(method string) *fault {
+	if fs.m == nil {
+		fs.m = make(map[string]*fault)
+	}
+	ft, ok := fs.m[method]
+	if !ok {
+		ft = new(fault)
+		fs.m[method] = ft
+	}
+	return ft
+}
+
+// take returns the faults to inject into a call to method, and consumes one
+// of its pending failures, if any.
+func (fs *faults) take(method string) (latency time.Duration, fail bool, status int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, key := range []string{method, "*"} {
+		ft, ok := fs.m[key]
+		if !ok {
+			continue
+		}
+		latency = max(latency, ft.latency)
+		if !fail && ft.fail != 0 {
+			if ft.fail > 0 {
+				ft.fail--
+			}
+			fail, status = true, ft.status
+		}
+	}
+	return latency, fail, status
+}
+
+// inject applies the faults for the API method called by r: it waits out any
+// latency, and reports whether the call should fail, and with what status.
+func (fs *faults) inject(r *http.Request) (fail bool, status int) {
+	latency, fail, status := fs.take(apiMethod(r))
+	if latency > 0 {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(latency):
+		}
+	}
+	return fail, status
+}
+
+// serveFault fails a call with status, or drops the connection if status is 0.
+func serveFault(w http.ResponseWriter, status int) {
+	if status == 0 {
+		panic(http.ErrAbortHandler) // drop the connection
+	}
+	http.Error(w, "injected fault", status)
+}
+
+// apiMethod returns the name of the API method called by r, e.g. "get".
+func apiMethod(r *http.Request) string { return strings.TrimPrefix(r.URL.Path, "/api/") }
+
+// FaultServer is a test HTTP server that forwards requests to a handler, such
+// as the Mux of a Server, and can be told to fail requests, to exercise the
+// retry and failover paths of clients. Besides FailNext and SetDown, it
+// injects faults by API method as a [Fake] does.
+type FaultServer struct {
+	*httptest.Server // the running server; use its URL and Client
+	faults
+
+	handler http.Handler
+
+	mu       sync.Mutex
+	requests int // requests received, including failures
+	failures int // requests failed
+}
+
+// NewFaultServer starts a FaultServer that forwards requests to h. The server
+// is closed when the test governed by t ends.
+func NewFaultServer(t *testing.T, h http.Handler) *FaultServer {
+	t.Helper()
+	fs := &FaultServer{handler: h}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.serveHTTP))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+// FailNext causes the next n requests to fail. If status is 0, the server
+// closes the connection without responding, as if it had crashed; otherwise
+// it responds with the given HTTP status.
+func (fs *FaultServer) FailNext(n, status int) { fs.FailMethod("*", n, status) }
+
+// SetDown sets whether the server fails all requests, by closing the
+// connection without responding, as if it were not running.
+func (fs *FaultServer) SetDown(down bool) {
+	if down {
+		fs.FailMethod("*", -1, 0)
+	} else {
+		fs.FailMethod("*", 0, 0)
+	}
+}
+
+// Requests reports the number of requests received by the server, and how
+// many of them were failed.
+func (fs *FaultServer) Requests() (total, failed int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.requests, fs.failures
+}
+
+func (fs *FaultServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fail, status := fs.inject(r)
+	fs.mu.Lock()
+	fs.requests++
+	if fail {
+		fs.failures++
+	}
+	fs.mu.Unlock()
+
+	if fail {
+		serveFault(w, status)
+		return
+	}
+	fs.handler.ServeHTTP(w, r)
+}
@@ -16,6 +16,20 @@
 //
 //	// Hook up the Server to the httptest package.
 //	hs := httptest.NewServer(ss.Mux)
+//
+// For tests that need more control, a [Fake] serves a database at a separate
+// URL for each principal, with its own access rules, and can inject errors and
+// latency, rotate secrets, and record calls:
+//
+//	f := setectest.NewFake(t, nil)
+//	f.Rotate("app/token", "value")
+//	url := f.AddPrincipal("tag:app", acl.Rule{
+//	  Action: []acl.Action{acl.ActionGet},
+//	  Secret: []acl.Secret{"app/*"},
+//	})
+//	f.FailMethod("get", 2, http.StatusServiceUnavailable)
+//
+//	cli := setec.Client{Server: url}
 package setectest
 
 import (
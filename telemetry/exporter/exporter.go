@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package exporter configures the export of OpenTelemetry traces for the
+// leger and legerd programs.
+package exporter
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/leger-labs/leger/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Exporter names recognized by Setup.
+const (
+	None   = "none"   // do not export traces
+	OTLP   = "otlp"   // export via OTLP over HTTP
+	Stdout = "stdout" // write traces as JSON, for debugging and tests
+)
+
+// Config configures trace export.
+type Config struct {
+	// Exporter is the name of the exporter to use: "otlp", "stdout", or
+	// "none". If empty, traces are not exported.
+	Exporter string
+
+	// Endpoint is the URL of the OTLP/HTTP collector, for example
+	// "https://otel.example.ts.net:4318". If empty, the standard
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variables are used, or
+	// "http://localhost:4318" if those are not set.
+	Endpoint string
+
+	// Writer is where the stdout exporter writes. If nil, os.Stdout is used.
+	Writer io.Writer
+
+	// ServiceName is the name of the program reported with its spans.
+	ServiceName string
+
+	// RecordSecretNames enables recording the names of secrets in spans.
+	// Secret values are never recorded.
+	RecordSecretNames bool
+}
+
+// ConfigFromEnv returns a Config for the named service, populated from the
+// standard OpenTelemetry environment variables:
+//
+//   - OTEL_TRACES_EXPORTER selects the exporter ("otlp", "console" or
+//     "stdout", or "none").
+//   - OTEL_EXPORTER_OTLP_ENDPOINT and related variables configure OTLP
+//     export; they are read by the exporter itself.
+//   - OTEL_SERVICE_NAME, if set, overrides the service name.
+//
+// In addition, LEGER_TRACE_SECRET_NAMES=true enables recording secret names.
+func ConfigFromEnv(serviceName string) Config {
+	exp := os.Getenv("OTEL_TRACES_EXPORTER")
+	if exp == "console" {
+		exp = Stdout
+	}
+	record, _ := strconv.ParseBool(os.Getenv("LEGER_TRACE_SECRET_NAMES"))
+	return Config{
+		Exporter:          exp,
+		ServiceName:       cmp.Or(os.Getenv("OTEL_SERVICE_NAME"), serviceName),
+		RecordSecretNames: record,
+	}
+}
+
+// Setup installs a global tracer provider that exports spans as described by
+// cfg, and the W3C trace context propagator. The caller must call the
+// returned function before exiting, to flush any buffered spans.
+//
+// If cfg does not select an exporter, Setup installs nothing, and returns a
+// shutdown function that does nothing.
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	telemetry.SetRecordSecretNames(cfg.RecordSecretNames)
+
+	var exp sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "", None:
+		return func(context.Context) error { return nil }, nil
+	case OTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	case Stdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(cmp.Or[io.Writer](cfg.Writer, os.Stdout)))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cmp.Or(cfg.ServiceName, "leger")),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	return tp.Shutdown, nil
+}
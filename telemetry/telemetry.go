@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package telemetry provides the OpenTelemetry tracing helpers shared by the
+// setec client, the server, and the database.
+//
+// Spans are reported to the global OpenTelemetry tracer provider, which does
+// nothing unless the program installs one, for example with
+// [github.com/leger-labs/leger/telemetry/exporter.Setup]. Library packages
+// only depend on the OpenTelemetry API.
+//
+// Secret values are never recorded in spans. Secret names are only recorded
+// if enabled with [SetRecordSecretNames], since the names of secrets may
+// themselves reveal sensitive information.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/leger-labs/leger/types/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the tracer used by this module.
+const instrumentationName = "github.com/leger-labs/leger"
+
+// SecretNameKey is the attribute key for secret names, when they are
+// recorded.
+const SecretNameKey = attribute.Key("leger.secret.name")
+
+// Tracer returns the tracer for spans reported by this module.
+func Tracer() trace.Tracer { return otel.Tracer(instrumentationName) }
+
+var recordNames atomic.Bool
+
+// SetRecordSecretNames sets whether spans record the names of secrets. By
+// default they do not.
+func SetRecordSecretNames(record bool) { recordNames.Store(record) }
+
+// SecretName returns the attributes to record for an operation on the named
+// secret: the name, if recording names is enabled, and otherwise nothing.
+func SecretName(name string) []attribute.KeyValue {
+	if !recordNames.Load() || name == "" {
+		return nil
+	}
+	return []attribute.KeyValue{SecretNameKey.String(name)}
+}
+
+// propagator carries W3C trace context over the HTTP API. It is used even if
+// the program has not installed a global propagator, so that the client and
+// server traces are always connected.
+var propagator = propagation.TraceContext{}
+
+// Inject adds the W3C trace context of ctx to the headers of an outbound
+// request.
+func Inject(ctx context.Context, h http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// Extract returns a copy of ctx carrying the W3C trace context from the
+// headers of an inbound request, if any.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// End records err, if it is not nil, as the status of span, and ends span.
+// A report that a secret has not changed is not an error.
+//
+// Since error messages often mention secret names, the text of err is only
+// recorded if recording names is enabled. Otherwise, only the text of the
+// common API errors it wraps, if any, is recorded.
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, api.ErrValueNotChanged) {
+		msg := "error"
+		if recordNames.Load() {
+			msg = err.Error()
+		} else {
+			for _, known := range knownErrors {
+				if errors.Is(err, known) {
+					msg = known.Error()
+					break
+				}
+			}
+		}
+		span.SetStatus(codes.Error, msg)
+	}
+	span.End()
+}
+
+// knownErrors are errors whose text can be recorded without revealing
+// secret names.
+var knownErrors = []error{
+	api.ErrNotFound,
+	api.ErrAccessDenied,
+	api.ErrRateLimited,
+	context.Canceled,
+	context.DeadlineExceeded,
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package telemetry_test
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/leger-labs/leger/client/setec"
+	"github.com/leger-labs/leger/setectest"
+	"github.com/leger-labs/leger/telemetry"
+	"github.com/leger-labs/leger/telemetry/exporter"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	defer tp.Shutdown(context.Background())
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(old)
+
+	d := setectest.NewDB(t, nil)
+	d.MustPut(d.Superuser, "alpha", "hunter2")
+	ts := setectest.NewServer(t, d, nil)
+	hs := httptest.NewServer(ts.Mux)
+	defer hs.Close()
+	cli := setec.Client{Server: hs.URL, DoHTTP: hs.Client().Do}
+
+	// getSpans fetches the secret and returns the spans it reported, by name.
+	getSpans := func() map[string]sdktrace.ReadOnlySpan {
+		t.Helper()
+		n := len(rec.Ended())
+		if _, err := cli.Get(context.Background(), "alpha"); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		spans := make(map[string]sdktrace.ReadOnlySpan)
+		for _, s := range rec.Ended()[n:] {
+			spans[s.Name()] = s
+		}
+		return spans
+	}
+	hasName := func(s sdktrace.ReadOnlySpan) bool {
+		for _, kv := range s.Attributes() {
+			if kv.Key == telemetry.SecretNameKey {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("Propagation", func(t *testing.T) {
+		spans := getSpans()
+		cs, ss, ds := spans["setec.Client /api/get"], spans["legerd /api/get"], spans["db.Get"]
+		if cs == nil || ss == nil || ds == nil {
+			t.Fatalf("Missing spans: got %v", spans)
+		}
+		if cs.SpanKind() != trace.SpanKindClient || ss.SpanKind() != trace.SpanKindServer {
+			t.Errorf("Span kinds: got %v, %v", cs.SpanKind(), ss.SpanKind())
+		}
+		tid := cs.SpanContext().TraceID()
+		if ss.SpanContext().TraceID() != tid || ds.SpanContext().TraceID() != tid {
+			t.Errorf("Spans are not in the same trace")
+		}
+		if ss.Parent().SpanID() != cs.SpanContext().SpanID() {
+			t.Errorf("Server span parent: got %v, want %v", ss.Parent().SpanID(), cs.SpanContext().SpanID())
+		}
+		if ds.Parent().SpanID() != ss.SpanContext().SpanID() {
+			t.Errorf("Database span parent: got %v, want %v", ds.Parent().SpanID(), ss.SpanContext().SpanID())
+		}
+		if hasName(ds) {
+			t.Errorf("Database span records secret name by default")
+		}
+	})
+
+	t.Run("SecretNames", func(t *testing.T) {
+		telemetry.SetRecordSecretNames(true)
+		defer telemetry.SetRecordSecretNames(false)
+
+		if ds := getSpans()["db.Get"]; ds == nil {
+			t.Fatal("Missing database span")
+		} else if !hasName(ds) {
+			t.Errorf("Database span does not record secret name")
+		}
+	})
+}
+
+func TestSetup(t *testing.T) {
+	old := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(old)
+	defer telemetry.SetRecordSecretNames(false)
+
+	ctx := context.Background()
+	if _, err := exporter.Setup(ctx, exporter.Config{Exporter: "bogus"}); err == nil {
+		t.Error("Setup with unknown exporter: got nil, want error")
+	}
+
+	var buf bytes.Buffer
+	shutdown, err := exporter.Setup(ctx, exporter.Config{
+		Exporter:    exporter.Stdout,
+		Writer:      &buf,
+		ServiceName: "test",
+	})
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	_, span := telemetry.Tracer().Start(ctx, "test-span")
+	span.End()
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if got := buf.String(); !strings.Contains(got, `"test-span"`) {
+		t.Errorf("Exported spans do not include test-span:\n%s", got)
+	}
+}
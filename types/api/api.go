@@ -8,6 +8,7 @@ package api
 import (
 	"errors"
 	"strconv"
+	"time"
 )
 
 var (
@@ -22,6 +23,13 @@ var (
 	// ErrAccessDenied is a sentinel error reported by requests when access to
 	// perform the requested operation is denied.
 	ErrAccessDenied = errors.New("access denied")
+
+	// ErrRateLimited is a sentinel error reported by requests when the caller
+	// has made too many requests, or has been temporarily locked out after
+	// repeated access denials. The server reports this as HTTP status 429 Too
+	// Many Requests, with a Retry-After header giving the number of seconds
+	// the caller should wait before trying again.
+	ErrRateLimited = errors.New("rate limited")
 )
 
 // SecretVersion is the version of a secret.
@@ -58,6 +66,33 @@ type SecretInfo struct {
 	Name          string
 	Versions      []SecretVersion
 	ActiveVersion SecretVersion
+
+	// LastAccess reports, for each version of the secret that has been
+	// fetched since the server began tracking accesses, when and by whom it
+	// was most recently fetched. Versions that have not been fetched are
+	// omitted.
+	LastAccess map[SecretVersion]*AccessInfo `json:",omitempty"`
+
+	// AccessSince is when the server began tracking accesses. A version
+	// without an entry in LastAccess may have been fetched before then.
+	AccessSince time.Time `json:",omitzero"`
+}
+
+// AccessInfo describes the most recent access to a secret version.
+type AccessInfo struct {
+	// Time is when the version was most recently fetched.
+	Time time.Time
+
+	// Hostname is the Tailscale FQDN of the node that fetched the version.
+	Hostname string
+
+	// User is the login name of the user that fetched the version, or empty
+	// if it was fetched by a tagged node.
+	User string `json:",omitempty"`
+
+	// Tags are the tags of the node that fetched the version, or nil if it
+	// was fetched by a user.
+	Tags []string `json:",omitempty"`
 }
 
 // ListRequest is a request to list secrets.
@@ -80,6 +115,12 @@ type GetRequest struct {
 	// If Version == SecretVersionDefault, this flag is ignored and the latest
 	// active version is returned unconditionally.
 	UpdateIfChanged bool
+
+	// RequestID, if non-empty, identifies the call. A client that retries a
+	// get sends the same RequestID with each attempt, so that a credential
+	// issued for a dynamic secret by an attempt whose response was lost is
+	// revoked rather than left until its lease expires.
+	RequestID string `json:",omitempty"`
 }
 
 // InfoRequest is a request for secret metadata.
@@ -119,3 +160,144 @@ type DeleteVersionRequest struct {
 	// active version cannot be deleted.
 	Version SecretVersion
 }
+
+// DynamicValue is the value of a dynamic secret. Rather than storing a fixed
+// value, the server issues a fresh credential for a dynamic secret each time
+// a caller fetches it, valid for the duration of a lease. When a dynamic
+// secret is fetched, the Value of the resulting SecretValue is a JSON encoded
+// DynamicValue, and its Version identifies the lease.
+type DynamicValue struct {
+	// LeaseID identifies the lease under which the credential was issued.
+	LeaseID string
+
+	// Expires is when the lease expires. After this time the server revokes
+	// the credential, unless the lease is renewed.
+	Expires time.Time
+
+	// Data are the fields of the credential. Their names depend on the kind
+	// of dynamic secret, for example "username" and "password".
+	Data map[string]string
+}
+
+// LeaseInfo is information about a lease on a dynamic secret.
+type LeaseInfo struct {
+	// ID is the unique identifier of the lease.
+	ID string
+
+	// Secret is the name of the dynamic secret the lease belongs to.
+	Secret string
+
+	// Expires is when the lease expires.
+	Expires time.Time
+}
+
+// RenewLeaseRequest is a request to extend a lease on a dynamic secret.
+type RenewLeaseRequest struct {
+	// LeaseID is the ID of the lease to renew.
+	LeaseID string
+
+	// TTL is the requested lifetime of the lease, from the time of the
+	// request. If zero, the default TTL of the secret is used. The server may
+	// shorten the TTL to respect the maximum lifetime of the lease.
+	TTL time.Duration
+}
+
+// RevokeLeaseRequest is a request to revoke a lease on a dynamic secret
+// before it expires.
+type RevokeLeaseRequest struct {
+	// LeaseID is the ID of the lease to revoke.
+	LeaseID string
+}
+
+// IssueCertRequest is a request to issue a new certificate for a certificate
+// secret immediately, rather than waiting for the server to renew it.
+type IssueCertRequest struct {
+	// Name is the name of the certificate secret.
+	Name string
+}
+
+// CertStatusRequest is a request for the revocation status of a certificate.
+// The certificate is identified either by CA and Serial, or by Name and
+// Version.
+type CertStatusRequest struct {
+	// CA is the name of the issuing authority, and Serial is the serial
+	// number of the certificate in hexadecimal.
+	CA     string `json:",omitempty"`
+	Serial string `json:",omitempty"`
+
+	// Name and Version identify a version of a certificate secret.
+	// If Version is zero, the active version is used.
+	Name    string        `json:",omitempty"`
+	Version SecretVersion `json:",omitempty"`
+}
+
+// RevokeCertRequest is a request to revoke the certificate stored in a
+// version of a certificate secret. If the revoked version is active, the
+// server issues a replacement.
+type RevokeCertRequest struct {
+	// Name is the name of the certificate secret.
+	Name string
+
+	// Version is the version of the secret holding the certificate.
+	Version SecretVersion
+}
+
+// Revocation status values reported in a CertStatus.
+const (
+	CertGood    = "good"
+	CertRevoked = "revoked"
+	CertExpired = "expired"
+	CertUnknown = "unknown"
+)
+
+// CertStatus is the revocation status of a certificate issued by the server.
+type CertStatus struct {
+	// Serial is the serial number of the certificate, in hexadecimal.
+	Serial string
+
+	// Status is one of "good", "revoked", "expired", or "unknown" if the
+	// server has no record of the certificate.
+	Status string
+
+	// Secret and Version identify the certificate secret version that holds
+	// the certificate.
+	Secret  string        `json:",omitempty"`
+	Version SecretVersion `json:",omitempty"`
+
+	// NotAfter is when the certificate expires.
+	NotAfter time.Time `json:",omitzero"`
+
+	// RevokedAt is when the certificate was revoked, if it was.
+	RevokedAt *time.Time `json:",omitempty"`
+}
+
+// WebhookDeadLettersRequest is a request for the record of webhook events that
+// could not be delivered.
+type WebhookDeadLettersRequest struct {
+	// Name, if non-empty, selects the dead letters of a single subscription.
+	Name string `json:",omitempty"`
+}
+
+// WebhookDeadLetter is a record of a webhook event that could not be
+// delivered to a subscriber.
+type WebhookDeadLetter struct {
+	// Subscription is the name of the subscription, and URL is where the
+	// event was to be delivered.
+	Subscription string
+	URL          string
+
+	// EventID identifies the event, Action is what changed, and Secret and
+	// Version identify the secret version that changed.
+	EventID string
+	Action  string
+	Secret  string
+	Version SecretVersion `json:",omitempty"`
+
+	// Attempts is the number of delivery attempts made, and Error describes
+	// the failure of the last one.
+	Attempts int
+	Error    string
+
+	// Time is when delivery was abandoned.
+	Time time.Time
+}
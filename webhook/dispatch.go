@@ -0,0 +1,404 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/leger-labs/leger/types/api"
+	"tailscale.com/metrics"
+)
+
+// Config is the configuration for a Dispatcher.
+type Config struct {
+	// Subscriptions reports the current subscriptions. It is called once for
+	// each event, so changes to subscriptions take effect immediately.
+	Subscriptions func() ([]*Subscription, error)
+
+	// DeadLetterPath, if non-empty, is the path of a file to which records of
+	// deliveries that fail permanently are appended, one JSON encoded
+	// api.WebhookDeadLetter per line. If empty, the most recent 1000 are kept
+	// in memory only.
+	DeadLetterPath string
+
+	// Client is the HTTP client used to deliver events. If nil, a client
+	// with a 10 second timeout that refuses to connect to loopback and
+	// link-local addresses is used.
+	Client *http.Client
+
+	// MaxAttempts is the number of times delivery of an event is attempted
+	// before it is recorded as a dead letter. If zero, 6 is used.
+	MaxAttempts int
+
+	// Backoff is the time to wait after the first failed attempt. The wait
+	// doubles after each further failure, up to 5 minutes. If zero, 1 second
+	// is used.
+	Backoff time.Duration
+}
+
+func (c *Config) client() *http.Client {
+	if c.Client == nil {
+		return defaultClient
+	}
+	return c.Client
+}
+
+// defaultClient is the client used if Config.Client is nil. It checks the
+// address of each connection, since a subscription URL may name a host that
+// resolves to a loopback or link-local address.
+var defaultClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				ap, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if !allowedAddr(ap.Addr()) {
+					return fmt.Errorf("webhook address %v is not allowed", ap.Addr())
+				}
+				return nil
+			},
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+func (c *Config) maxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return 6
+	}
+	return c.MaxAttempts
+}
+
+func (c *Config) backoff() time.Duration {
+	if c.Backoff <= 0 {
+		return time.Second
+	}
+	return c.Backoff
+}
+
+// maxBackoff is the longest wait between delivery attempts.
+const maxBackoff = 5 * time.Minute
+
+// queueSize is the number of events that can be waiting for dispatch.
+const queueSize = 1024
+
+// maxDeadLetters is the number of dead letters kept in memory if there is no
+// dead-letter file. Older ones are discarded.
+const maxDeadLetters = 1000
+
+// A Dispatcher delivers events to the subscriptions that match them.
+// Events are queued by Notify, and delivered while Run is active.
+type Dispatcher struct {
+	cfg    Config
+	events chan Event
+
+	mu   sync.Mutex               // protects dead and writes to the dead-letter file
+	dead []*api.WebhookDeadLetter // used if cfg.DeadLetterPath == ""
+
+	// Metrics
+	countDelivered expvar.Int
+	countRetried   expvar.Int
+	countFailed    expvar.Int
+	countDropped   expvar.Int
+}
+
+// NewDispatcher constructs a Dispatcher with the given configuration.
+// The caller must call Run to deliver events.
+func NewDispatcher(cfg Config) *Dispatcher {
+	return &Dispatcher{cfg: cfg, events: make(chan Event, queueSize)}
+}
+
+// Metrics returns a collection of metrics for d. The caller is responsible
+// for publishing the result to the metrics exporter.
+func (d *Dispatcher) Metrics() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("counter_webhook_delivered", &d.countDelivered)
+	m.Set("counter_webhook_retried", &d.countRetried)
+	m.Set("counter_webhook_failed", &d.countFailed)
+	m.Set("counter_webhook_dropped", &d.countDropped)
+	return m
+}
+
+// Notify queues ev for delivery to the subscriptions that match it. If ev has
+// no ID or time, they are filled in. Notify does not block; if too many
+// events are already waiting, ev is dropped.
+func (d *Dispatcher) Notify(ev Event) {
+	if ev.ID == "" {
+		ev.ID = newEventID()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	select {
+	case d.events <- ev:
+	default:
+		d.countDropped.Add(1)
+		log.Printf("Webhook queue full, dropped %s event %s for %q", ev.Action, ev.ID, ev.Secret)
+	}
+}
+
+// Run delivers queued events until ctx ends. Events and deliveries that are
+// still queued, being retried or waiting when ctx ends are recorded as dead
+// letters.
+//
+// Each subscription has a worker that delivers its events one at a time, in
+// the order they were queued, so a subscriber sees changes in order and a
+// slow or failing subscriber holds up only its own events. The worker of a
+// deleted subscription is idle until Run returns.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	workers := make(map[string]chan delivery) // by subscription name
+	for {
+		select {
+		case <-ctx.Done():
+			d.drain()
+			return
+		case ev := <-d.events:
+			for _, sub := range d.matching(ev) {
+				q, ok := workers[sub.Name]
+				if !ok {
+					q = make(chan delivery, subQueueSize)
+					workers[sub.Name] = q
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						d.work(ctx, q)
+					}()
+				}
+				select {
+				case q <- delivery{sub: sub, ev: ev}:
+				default:
+					d.fail(sub, ev, 0, errors.New("too many events waiting for delivery"))
+				}
+			}
+		}
+	}
+}
+
+// drain records the events still queued for dispatch as dead letters for the
+// subscriptions they match.
+func (d *Dispatcher) drain() {
+	for {
+		select {
+		case ev := <-d.events:
+			for _, sub := range d.matching(ev) {
+				d.fail(sub, ev, 0, errors.New("dispatcher stopped"))
+			}
+		default:
+			return
+		}
+	}
+}
+
+// matching returns the current subscriptions that match ev.
+func (d *Dispatcher) matching(ev Event) []*Subscription {
+	subs, err := d.cfg.Subscriptions()
+	if err != nil {
+		log.Printf("Loading webhook subscriptions: %v", err)
+		return nil
+	}
+	var out []*Subscription
+	for _, sub := range subs {
+		if sub.Matches(ev.Secret) {
+			out = append(out, sub)
+		}
+	}
+	return out
+}
+
+// subQueueSize is the number of events that can be waiting for delivery to
+// one subscription.
+const subQueueSize = 256
+
+// A delivery is an event waiting to be delivered to a subscription.
+type delivery struct {
+	sub *Subscription
+	ev  Event
+}
+
+// work delivers the events in q in order until ctx ends, and then records
+// those still waiting as dead letters.
+func (d *Dispatcher) work(ctx context.Context, q <-chan delivery) {
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case dv := <-q:
+					d.fail(dv.sub, dv.ev, 0, errors.New("dispatcher stopped"))
+				default:
+					return
+				}
+			}
+		case dv := <-q:
+			d.deliver(ctx, dv.sub, dv.ev)
+		}
+	}
+}
+
+// deliver delivers ev to sub, retrying until it succeeds, fails permanently,
+// or ctx ends.
+func (d *Dispatcher) deliver(ctx context.Context, sub *Subscription, ev Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		panic(err) // cannot happen: an Event is always encodable
+	}
+
+	wait := d.cfg.backoff()
+	var attempts int
+	for {
+		attempts++
+		retry, err := d.post(ctx, sub, ev.ID, body)
+		if err == nil {
+			d.countDelivered.Add(1)
+			return
+		}
+		if !retry || attempts >= d.cfg.maxAttempts() {
+			d.fail(sub, ev, attempts, err)
+			return
+		}
+		d.countRetried.Add(1)
+		select {
+		case <-time.After(wait):
+			wait = min(2*wait, maxBackoff)
+		case <-ctx.Done():
+			d.fail(sub, ev, attempts, fmt.Errorf("%w (dispatcher stopped)", err))
+			return
+		}
+	}
+}
+
+// post makes one attempt to deliver an event with the given body to sub.
+// It reports whether a failed attempt is worth retrying.
+func (d *Dispatcher) post(ctx context.Context, sub *Subscription, id string, body []byte) (retry bool, _ error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, id)
+	req.Header.Set(HeaderSignature, Sign([]byte(sub.Key), time.Now(), body))
+	rsp, err := d.cfg.client().Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(rsp.Body, 1<<16))
+	rsp.Body.Close()
+	switch c := rsp.StatusCode; {
+	case c >= 200 && c < 300:
+		return false, nil
+	case c == http.StatusRequestTimeout, c == http.StatusTooManyRequests, c >= 500:
+		return true, fmt.Errorf("delivery failed: %s", rsp.Status)
+	default:
+		// Other client errors will not be fixed by trying again.
+		return false, fmt.Errorf("delivery rejected: %s", rsp.Status)
+	}
+}
+
+// fail records that ev could not be delivered to sub.
+func (d *Dispatcher) fail(sub *Subscription, ev Event, attempts int, err error) {
+	d.countFailed.Add(1)
+	log.Printf("Webhook %q: giving up on %s event %s for %q after %d attempts: %v",
+		sub.Name, ev.Action, ev.ID, ev.Secret, attempts, err)
+	dl := &api.WebhookDeadLetter{
+		Subscription: sub.Name,
+		URL:          sub.URL,
+		EventID:      ev.ID,
+		Action:       ev.Action,
+		Secret:       ev.Secret,
+		Version:      ev.Version,
+		Attempts:     attempts,
+		Error:        err.Error(),
+		Time:         time.Now().UTC(),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cfg.DeadLetterPath == "" {
+		if len(d.dead) >= maxDeadLetters {
+			d.dead = slices.Delete(d.dead, 0, len(d.dead)-maxDeadLetters+1)
+		}
+		d.dead = append(d.dead, dl)
+		return
+	}
+	if err := appendDeadLetter(d.cfg.DeadLetterPath, dl); err != nil {
+		log.Printf("Writing webhook dead letter: %v", err)
+	}
+}
+
+func appendDeadLetter(path string, dl *api.WebhookDeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, werr := f.Write(append(line, '\n'))
+	return errors.Join(werr, f.Close())
+}
+
+// DeadLetters returns the record of events that could not be delivered, in
+// the order they were abandoned.
+func (d *Dispatcher) DeadLetters() ([]*api.WebhookDeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cfg.DeadLetterPath == "" {
+		return append([]*api.WebhookDeadLetter(nil), d.dead...), nil
+	}
+	f, err := os.Open(d.cfg.DeadLetterPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []*api.WebhookDeadLetter
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var dl api.WebhookDeadLetter
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			return nil, fmt.Errorf("reading dead letters: %w", err)
+		}
+		out = append(out, &dl)
+	}
+	return out, sc.Err()
+}
+
+// newEventID returns a random event ID.
+func newEventID() string {
+	var buf [12]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,253 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package webhook delivers notifications of changes to secrets to
+// subscribers over HTTP.
+//
+// A [Subscription], stored in the secrets database, names a URL, the secrets
+// the subscriber is interested in, and a key shared with the subscriber. When
+// a matching secret is changed, a [Dispatcher] POSTs an [Event] describing the
+// change to the URL, signed with the key. Failed deliveries are retried with
+// backoff, and recorded in a dead-letter log if they never succeed.
+//
+// Events never contain secret values. A subscriber that wants the new value
+// fetches it from the server as usual, so learning of a change does not
+// bypass the server's access control. Subscribers check the signature of an
+// event with [Verify], or serve events with a [Handler].
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/types/api"
+)
+
+// Actions reported in an Event.
+const (
+	ActionPut           = "put"            // a new version was stored
+	ActionActivate      = "activate"       // a version was made active
+	ActionDeleteVersion = "delete-version" // a version was deleted
+	ActionDelete        = "delete"         // the secret was deleted
+)
+
+// Headers set on each delivery.
+const (
+	// HeaderSignature carries the signature of the request body, in the form
+	// "t=<unix-seconds>,v1=<hex-hmac-sha256>"; see [Sign].
+	HeaderSignature = "X-Leger-Signature"
+
+	// HeaderEvent carries the ID of the event being delivered. Retries of a
+	// delivery have the same ID, so subscribers can discard duplicates.
+	HeaderEvent = "X-Leger-Event"
+)
+
+// minKeyLen is the shortest permitted subscription key, in bytes.
+const minKeyLen = 16
+
+// Subscription is a subscription to changes of secrets. It is stored as JSON:
+//
+//	{
+//	  "url": "https://host.example.ts.net/hooks/leger",
+//	  "secrets": ["prod/app/*"],
+//	  "key": "4b1d0c2f9e8a7b6c5d4e3f2a1b0c9d8e"
+//	}
+type Subscription struct {
+	// Name is the name of the subscription. It is not stored in the
+	// configuration, but set from the name of the secret that holds it.
+	Name string `json:"-"`
+
+	// URL is the http or https URL to which events are posted. It must not
+	// name a loopback or link-local host.
+	URL string `json:"url"`
+
+	// Secrets are the name patterns of the secrets whose changes are
+	// reported, which may contain "*" wildcards as in an ACL.
+	Secrets []acl.Secret `json:"secrets"`
+
+	// Key is the key used to sign events, which the subscriber uses to check
+	// them. It must be at least 16 bytes long.
+	Key string `json:"key"`
+}
+
+// ParseSubscription parses and validates a JSON encoded Subscription.
+func ParseSubscription(data []byte) (*Subscription, error) {
+	var sub Subscription
+	if err := json.Unmarshal(data, &sub); err != nil {
+		return nil, fmt.Errorf("invalid webhook subscription: %w", err)
+	}
+	if err := sub.check(); err != nil {
+		return nil, fmt.Errorf("invalid webhook subscription: %w", err)
+	}
+	return &sub, nil
+}
+
+func (s *Subscription) check() error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url %q must be http or https", s.URL)
+	} else if u.Host == "" {
+		return fmt.Errorf("url %q has no host", s.URL)
+	} else if !allowedHost(u.Hostname()) {
+		return fmt.Errorf("url %q must not name a loopback or link-local host", s.URL)
+	}
+	if len(s.Secrets) == 0 {
+		return errors.New("no secrets specified")
+	}
+	for _, pat := range s.Secrets {
+		if pat == "" {
+			return errors.New("empty secret pattern")
+		}
+	}
+	if len(s.Key) < minKeyLen {
+		return fmt.Errorf("key must be at least %d bytes", minKeyLen)
+	}
+	return nil
+}
+
+// allowedHost reports whether events may be posted to host. Loopback and
+// link-local hosts are refused, so that subscribers cannot reach services on
+// the server's own host or a cloud metadata endpoint. Names that resolve to
+// such addresses are refused when the default client dials them.
+func allowedHost(host string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip, err := netip.ParseAddr(host)
+	return err != nil || allowedAddr(ip)
+}
+
+// allowedAddr reports whether events may be posted to ip.
+func allowedAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// Matches reports whether changes to the secret called name are reported to
+// the subscriber.
+func (s *Subscription) Matches(name string) bool {
+	for _, pat := range s.Secrets {
+		if pat.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a notification that a secret has changed.
+type Event struct {
+	// ID uniquely identifies the event.
+	ID string `json:"id"`
+
+	// Time is when the change was made.
+	Time time.Time `json:"time"`
+
+	// Action is what changed: one of "put", "activate", "delete-version",
+	// or "delete".
+	Action string `json:"action"`
+
+	// Secret is the name of the secret that changed.
+	Secret string `json:"secret"`
+
+	// Version is the version of the secret that was stored, activated, or
+	// deleted. It is zero when the whole secret is deleted.
+	Version api.SecretVersion `json:"version,omitempty"`
+}
+
+// Sign returns the value of the HeaderSignature header for a request with the
+// given body, signed with key at time t.
+func Sign(key []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(key, ts, body))
+}
+
+func mac(key []byte, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, ts)
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// ErrBadSignature is reported by Verify when a signature is missing, invalid,
+// or too old.
+var ErrBadSignature = errors.New("invalid webhook signature")
+
+// Verify checks that sig, the value of a HeaderSignature header, is a valid
+// signature of body with key made within tolerance of now. Checking the time
+// prevents old deliveries from being replayed.
+func Verify(key []byte, sig string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts, v1 string
+	for _, part := range strings.Split(sig, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			v1 = v
+		}
+	}
+	want, err := hex.DecodeString(v1)
+	if ts == "" || err != nil || !hmac.Equal(want, mac(key, ts, body)) {
+		return ErrBadSignature
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if d := now.Sub(time.Unix(secs, 0)); d > tolerance || d < -tolerance {
+		return fmt.Errorf("%w: signed at %v", ErrBadSignature, time.Unix(secs, 0).UTC())
+	}
+	return nil
+}
+
+// DefaultTolerance is the age of signatures accepted by a Handler.
+const DefaultTolerance = 5 * time.Minute
+
+// Handler returns an http.Handler that receives events signed with key and
+// passes them to fn. If fn reports an error, the handler responds with an
+// error status so that the server retries the delivery later.
+func Handler(key []byte, fn func(context.Context, Event) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err != nil {
+			http.Error(w, "reading request", http.StatusBadRequest)
+			return
+		}
+		if err := Verify(key, r.Header.Get(HeaderSignature), body, time.Now(), DefaultTolerance); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(w, "invalid event", http.StatusBadRequest)
+			return
+		}
+		if err := fn(r.Context(), ev); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,302 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package webhook_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leger-labs/leger/acl"
+	"github.com/leger-labs/leger/types/api"
+	"github.com/leger-labs/leger/webhook"
+)
+
+const testKey = "0123456789abcdef0123456789abcdef"
+
+func TestParseSubscription(t *testing.T) {
+	sub, err := webhook.ParseSubscription([]byte(`{"url":"https://example.com/hook","secrets":["app/*","db/password"],"key":"` + testKey + `"}`))
+	if err != nil {
+		t.Fatalf("ParseSubscription: unexpected error: %v", err)
+	}
+	for name, want := range map[string]bool{
+		"app/token":   true,
+		"app/":        true,
+		"db/password": true,
+		"db/user":     false,
+		"other":       false,
+	} {
+		if got := sub.Matches(name); got != want {
+			t.Errorf("Matches(%q): got %v, want %v", name, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"url":"ftp://example.com","secrets":["x"],"key":"` + testKey + `"}`,
+		`{"url":"https:///path","secrets":["x"],"key":"` + testKey + `"}`,
+		`{"url":"https://example.com","secrets":[],"key":"` + testKey + `"}`,
+		`{"url":"https://example.com","secrets":[""],"key":"` + testKey + `"}`,
+		`{"url":"https://example.com","secrets":["x"],"key":"short"}`,
+		`{"url":"http://127.0.0.1:8080/hook","secrets":["x"],"key":"` + testKey + `"}`,
+		`{"url":"http://localhost/hook","secrets":["x"],"key":"` + testKey + `"}`,
+		`{"url":"http://[::1]/hook","secrets":["x"],"key":"` + testKey + `"}`,
+		`{"url":"http://[::ffff:127.0.0.1]/hook","secrets":["x"],"key":"` + testKey + `"}`,
+		`{"url":"http://169.254.169.254/latest","secrets":["x"],"key":"` + testKey + `"}`,
+		`{"url":"http://0.0.0.0/hook","secrets":["x"],"key":"` + testKey + `"}`,
+		`not json`,
+	} {
+		if sub, err := webhook.ParseSubscription([]byte(bad)); err == nil {
+			t.Errorf("ParseSubscription(%s): got %+v, want error", bad, sub)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key := []byte(testKey)
+	body := []byte(`{"id":"x","action":"put","secret":"app/token","version":2}`)
+	now := time.Now()
+	sig := webhook.Sign(key, now, body)
+
+	if err := webhook.Verify(key, sig, body, now, time.Minute); err != nil {
+		t.Errorf("Verify: unexpected error: %v", err)
+	}
+	tests := []struct {
+		name string
+		key  string
+		sig  string
+		body string
+		now  time.Time
+	}{
+		{"WrongKey", "fedcba9876543210fedcba9876543210", sig, string(body), now},
+		{"Tampered", testKey, sig, strings.Replace(string(body), "2", "3", 1), now},
+		{"Stale", testKey, sig, string(body), now.Add(time.Hour)},
+		{"Missing", testKey, "", string(body), now},
+		{"Garbled", testKey, "t=x,v1=zz", string(body), now},
+	}
+	for _, tc := range tests {
+		err := webhook.Verify([]byte(tc.key), tc.sig, []byte(tc.body), tc.now, time.Minute)
+		if !errors.Is(err, webhook.ErrBadSignature) {
+			t.Errorf("Verify %s: got %v, want %v", tc.name, err, webhook.ErrBadSignature)
+		}
+	}
+}
+
+// subscribe returns a Subscriptions function reporting a single subscription
+// to all secrets at url.
+func subscribe(url string) func() ([]*webhook.Subscription, error) {
+	return func() ([]*webhook.Subscription, error) {
+		return []*webhook.Subscription{{
+			Name: "test", URL: url, Secrets: []acl.Secret{"*"}, Key: testKey,
+		}}, nil
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	// The receiver fails the first two deliveries, then accepts events.
+	var calls atomic.Int32
+	got := make(chan webhook.Event, 1)
+	hs := httptest.NewServer(webhook.Handler([]byte(testKey), func(_ context.Context, ev webhook.Event) error {
+		if calls.Add(1) <= 2 {
+			return errors.New("not yet")
+		}
+		got <- ev
+		return nil
+	}))
+	defer hs.Close()
+
+	d := webhook.NewDispatcher(webhook.Config{
+		Subscriptions: subscribe(hs.URL),
+		Client:        hs.Client(),
+		Backoff:       time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Notify(webhook.Event{Action: webhook.ActionPut, Secret: "app/token", Version: 3})
+	select {
+	case ev := <-got:
+		if ev.ID == "" || ev.Time.IsZero() {
+			t.Errorf("Event is missing ID or time: %+v", ev)
+		}
+		if ev.Action != webhook.ActionPut || ev.Secret != "app/token" || ev.Version != 3 {
+			t.Errorf("Event: got %+v, want put of app/token version 3", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for delivery")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("Delivery attempts: got %d, want 3", n)
+	}
+}
+
+func TestDispatcherOrder(t *testing.T) {
+	// The receiver fails the first delivery, so later events would overtake
+	// its retry if they were not delivered in order.
+	var calls atomic.Int32
+	got := make(chan api.SecretVersion, 3)
+	hs := httptest.NewServer(webhook.Handler([]byte(testKey), func(_ context.Context, ev webhook.Event) error {
+		if calls.Add(1) == 1 {
+			return errors.New("not yet")
+		}
+		got <- ev.Version
+		return nil
+	}))
+	defer hs.Close()
+
+	d := webhook.NewDispatcher(webhook.Config{
+		Subscriptions: subscribe(hs.URL),
+		Client:        hs.Client(),
+		Backoff:       10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	for v := range api.SecretVersion(3) {
+		d.Notify(webhook.Event{Action: webhook.ActionPut, Secret: "app/token", Version: v + 1})
+	}
+	for want := api.SecretVersion(1); want <= 3; want++ {
+		select {
+		case v := <-got:
+			if v != want {
+				t.Errorf("Delivered version: got %v, want %v", v, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for version %v", want)
+		}
+	}
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	var calls atomic.Int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if strings.Contains(r.Header.Get(webhook.HeaderEvent), "gone") {
+			http.Error(w, "no such hook", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer hs.Close()
+
+	d := webhook.NewDispatcher(webhook.Config{
+		Subscriptions:  subscribe(hs.URL),
+		Client:         hs.Client(),
+		DeadLetterPath: filepath.Join(t.TempDir(), "dead"),
+		MaxAttempts:    3,
+		Backoff:        time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	// A server error is retried until the attempts are exhausted; a client
+	// error is not retried.
+	d.Notify(webhook.Event{ID: "retry", Action: webhook.ActionActivate, Secret: "app/token", Version: 2})
+	d.Notify(webhook.Event{ID: "gone", Action: webhook.ActionDelete, Secret: "app/token"})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		dls, err := d.DeadLetters()
+		if err != nil {
+			t.Fatalf("DeadLetters: unexpected error: %v", err)
+		}
+		if len(dls) == 2 {
+			attempts := map[string]int{}
+			for _, dl := range dls {
+				if dl.Subscription != "test" || dl.URL != hs.URL || dl.Error == "" {
+					t.Errorf("Dead letter: got %+v", dl)
+				}
+				attempts[dl.EventID] = dl.Attempts
+			}
+			if attempts["retry"] != 3 || attempts["gone"] != 1 {
+				t.Errorf("Attempts: got %v, want retry:3 gone:1", attempts)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for dead letters, have %d", len(dls))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("Delivery attempts: got %d, want 4", n)
+	}
+}
+
+func TestDispatcherStopped(t *testing.T) {
+	d := webhook.NewDispatcher(webhook.Config{
+		Subscriptions: subscribe("http://hooks.test/hook"),
+	})
+
+	// Events still queued when the dispatcher stops are dead letters. Without
+	// a dead-letter file, only the most recent 1000 are kept.
+	for v := range api.SecretVersion(1024) {
+		d.Notify(webhook.Event{Action: webhook.ActionPut, Secret: "app/token", Version: v + 1})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx)
+
+	dls, err := d.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters: unexpected error: %v", err)
+	}
+	if len(dls) != 1000 {
+		t.Errorf("Dead letters: got %d, want 1000", len(dls))
+	}
+	for _, dl := range dls {
+		if !strings.Contains(dl.Error, "stopped") {
+			t.Errorf("Dead letter: got %+v, want a stopped dispatcher", dl)
+			break
+		}
+	}
+}
+
+func TestDispatcherLoopback(t *testing.T) {
+	// Without a client of its own, the dispatcher refuses to connect to a
+	// loopback address, even if the subscription got past validation.
+	var calls atomic.Int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer hs.Close()
+
+	d := webhook.NewDispatcher(webhook.Config{
+		Subscriptions: subscribe(hs.URL),
+		MaxAttempts:   1,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx)
+
+	d.Notify(webhook.Event{Action: webhook.ActionPut, Secret: "app/token", Version: 1})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		dls, err := d.DeadLetters()
+		if err != nil {
+			t.Fatalf("DeadLetters: unexpected error: %v", err)
+		}
+		if len(dls) == 1 {
+			if !strings.Contains(dls[0].Error, "not allowed") {
+				t.Errorf("Dead letter error: got %q, want not allowed", dls[0].Error)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for dead letter, have %d", len(dls))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("Delivery attempts reached the server: got %d, want 0", n)
+	}
+}